@@ -0,0 +1,256 @@
+package main
+
+// The block engine (-engine block) translates straight-line runs of guest
+// code into blocks of decoded instructions and runs a whole block per
+// step, dispatching each instruction through its handler without going
+// back to the fetch/decode/interrupt loop in between.
+//
+// A block starts at a physical address and ends after the first
+// instruction that may change control flow or machine state the engine
+// depends on (branches, jumps, system and CSR instructions, fences), at
+// the end of its page, or after blockMax instructions. Blocks remember the
+// blocks that ran after them so that a loop can go from block to block
+// without translating PC again.
+//
+// Results are the same as with the interpreter:
+//   - A block stops early as soon as an instruction does not fall through
+//     to the next one, which is how a trap in the middle of a block shows
+//     up. The next step starts from the trap handler.
+//   - Interrupts are checked before each block, and a block never runs
+//     past the instruction at which the timer would fire. A store to a
+//     device also ends the block since it may raise an interrupt.
+//   - mtime (on hart 0) and the cycle counter advance by one per
+//     instruction. Other devices tick once per block.
+//   - A write to a word covered by a block drops every block on that page,
+//     and fence.i drops them all, so self-modifying code is seen by the
+//     next block lookup. A block that drops itself stops after the store.
+const (
+	blockMax        = 64
+	blockPageShift  = 12
+	blockPageWords  = 1 << (blockPageShift - 2)
+	blockLinksCount = 2
+)
+
+// blockLink is a cached successor of a block. It is only followed when
+// the hart is at the same PC, privilege level and translation as when it
+// was recorded.
+type blockLink struct {
+	pc    uint32
+	priv  uint32
+	gen   uint32
+	block *Block
+}
+
+type Block struct {
+	paddr uint32
+	ops   []Ops
+	valid bool
+	links [blockLinksCount]blockLink
+	next  int
+}
+
+type blockPage struct {
+	code   [blockPageWords]bool
+	blocks []*Block
+}
+
+type BlockCache struct {
+	blocks     map[uint32]*Block
+	pages      map[uint32]*blockPage
+	last       *blockPage
+	lastPN     uint32
+	Translated uint64
+	Chained    uint64
+}
+
+func NewBlockCache() *BlockCache {
+	return &BlockCache{
+		blocks: make(map[uint32]*Block),
+		pages:  make(map[uint32]*blockPage),
+		lastPN: 0xffffffff,
+	}
+}
+
+func (p *BlockCache) page(paddr uint32) *blockPage {
+	pn := paddr >> blockPageShift
+	if pn == p.lastPN {
+		return p.last
+	}
+	t, ok := p.pages[pn]
+	if !ok {
+		return nil
+	}
+	p.last = t
+	p.lastPN = pn
+	return t
+}
+
+// Insert adds a translated block and marks the words it covers.
+func (p *BlockCache) Insert(b *Block) {
+	t := p.page(b.paddr)
+	if t == nil {
+		t = &blockPage{}
+		p.pages[b.paddr>>blockPageShift] = t
+	}
+	idx := (b.paddr >> 2) & (blockPageWords - 1)
+	for i := range b.ops {
+		t.code[idx+uint32(i)] = true
+	}
+	t.blocks = append(t.blocks, b)
+	p.blocks[b.paddr] = b
+	p.Translated++
+}
+
+// Invalidate drops every block on the page of paddr if one of them covers
+// the word containing paddr.
+func (p *BlockCache) Invalidate(paddr uint32) {
+	t := p.page(paddr)
+	if (t == nil) || !t.code[(paddr>>2)&(blockPageWords-1)] {
+		return
+	}
+	for _, b := range t.blocks {
+		b.valid = false
+		delete(p.blocks, b.paddr)
+	}
+	delete(p.pages, paddr>>blockPageShift)
+	p.last = nil
+	p.lastPN = 0xffffffff
+}
+
+// Holds reports whether a block covers part of the page of paddr.
+func (p *BlockCache) Holds(paddr uint32) bool {
+	return p.page(paddr) != nil
+}
+
+// Flush drops every block.
+func (p *BlockCache) Flush() {
+	for _, b := range p.blocks {
+		b.valid = false
+	}
+	p.blocks = make(map[uint32]*Block)
+	p.pages = make(map[uint32]*blockPage)
+	p.last = nil
+	p.lastPN = 0xffffffff
+}
+
+// endsBlock reports whether a block must stop after ops.
+func endsBlock(ops *Ops) bool {
+	switch ops.Name {
+	case "beq", "bne", "blt", "bge", "bltu", "bgeu", "jal", "jalr",
+		"ecall", "ebreak", "mret", "sret", "wfi", "fence_i", "sfence_vma",
+		"csrrw", "csrrs", "csrrc", "csrrwi", "csrrsi", "csrrci",
+		"illegal_instruction":
+		return true
+	}
+	return false
+}
+
+// translate decodes the block starting at paddr. It returns nil if paddr
+// is not in memory, in which case the interpreter runs the instruction.
+func (cpu *CPU) translate(paddr uint32) *Block {
+	if cpu.bus.page(paddr) == nil {
+		return nil
+	}
+	b := &Block{paddr: paddr, valid: true}
+	end := (paddr | (1<<blockPageShift - 1)) + 1
+	for a := paddr; (a != end) && (len(b.ops) < blockMax); a += 4 {
+		b.ops = append(b.ops, cpu.Decode(cpu.bus.ReadWord(a)))
+		if endsBlock(&b.ops[len(b.ops)-1]) {
+			break
+		}
+	}
+	cpu.bus.MarkCode(paddr)
+	cpu.bus.blocks.Insert(b)
+	return b
+}
+
+// block returns the block at PC, following a link from the previous block
+// when possible. If the fetch faults the trap is taken and ok is false; if
+// PC is not in memory block is nil and ok is true.
+func (cpu *CPU) block() (*Block, bool) {
+	c := cpu.bus.blocks
+	prev := cpu.lastBlock
+	if (prev != nil) && prev.valid {
+		for i := range prev.links {
+			l := &prev.links[i]
+			if (l.block != nil) && (l.pc == cpu.PC) && (l.priv == cpu.Priv) &&
+				(l.gen == cpu.tlbGen) && l.block.valid {
+				c.Chained++
+				return l.block, true
+			}
+		}
+	}
+
+	paddr, ok := cpu.fetchAddr()
+	if !ok {
+		return nil, false
+	}
+	b := c.blocks[paddr]
+	if b == nil {
+		b = cpu.translate(paddr)
+		if b == nil {
+			return nil, true
+		}
+	}
+	if (prev != nil) && prev.valid {
+		prev.links[prev.next] = blockLink{cpu.PC, cpu.Priv, cpu.tlbGen, b}
+		prev.next = (prev.next + 1) % blockLinksCount
+	}
+	return b, true
+}
+
+// StepBlock runs at most n instructions from PC as one block and returns
+// the number of steps used.
+func (cpu *CPU) StepBlock(n int) int {
+	if !cpu.Tick() {
+		cpu.lastBlock = nil
+		return 1
+	}
+	b, ok := cpu.block()
+	if !ok {
+		cpu.lastBlock = nil
+		return 1
+	}
+	if b == nil {
+		cpu.lastBlock = nil
+		if ops, ok := cpu.Next(); ok {
+			cpu.Execute(ops)
+		}
+		return 1
+	}
+
+	limit := len(b.ops)
+	if n < limit {
+		limit = n
+	}
+	clint := cpu.bus.clint
+	timer := cpu.hart == 0
+	if cmp := clint.mtimecmp[cpu.hart]; clint.mtime < cmp {
+		if d := cmp - clint.mtime; d < uint64(limit) {
+			limit = int(d)
+		}
+	}
+
+	i := 0
+	for i < limit {
+		if i > 0 {
+			if timer {
+				clint.Tick()
+			}
+			cpu.Cycle++
+		}
+		ops := &b.ops[i]
+		pc := cpu.PC
+		ops.Exec(cpu, ops)
+		cpu.countInstret()
+		i++
+		// A store to the block's own code drops it; the rest of the
+		// block is stale and must be translated again.
+		if (cpu.PC != pc+4) || cpu.bus.ioWritten || cpu.Halted || !b.valid {
+			break
+		}
+	}
+	cpu.bus.ioWritten = false
+	cpu.lastBlock = b
+	return i
+}
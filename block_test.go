@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+// TestBlockSelfModify runs code that patches the instruction right after
+// the store, inside the block being run. Both engines must execute the
+// new instruction.
+func TestBlockSelfModify(t *testing.T) {
+	patched := encI(0x13, 0, 10, 0, 42) // li a0, 42
+	prog := []uint32{
+		encU(0x37, 5, 0x80000000),                   // lui t0, 0x80000
+		encU(0x37, 6, patched+0x800),                // lui t1, %hi(patched)
+		encI(0x13, 0, 6, 6, int32(patched<<20)>>20), // addi t1, t1, %lo(patched)
+		encS(2, 5, 6, 16),                           // sw t1, 16(t0)
+		encI(0x13, 0, 10, 0, 1),                     // li a0, 1, replaced by li a0, 42
+		encJ(0, 0),                                  // j .
+	}
+	for _, blocks := range []bool{false, true} {
+		p := newTestCPU(t)
+		for i, inst := range prog {
+			p.bus.WriteWord(p.PC+uint32(4*i), inst)
+		}
+		runHart(p, 2*len(prog), blocks)
+		if p.PC != 0x80000014 {
+			t.Errorf("blocks %v: PC %08x", blocks, p.PC)
+		}
+		if p.Regs[10] != 42 {
+			t.Errorf("blocks %v: a0 = %v, want 42", blocks, p.Regs[10])
+		}
+	}
+}
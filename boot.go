@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+// Boot layout used with -bios/-kernel/-initrd, following the OpenSBI
+// fw_dynamic convention on a 32-bit machine: the firmware runs at the
+// start of RAM, the kernel image 4MiB above it, and the initrd, the boot
+// information and the device tree are placed at the top of RAM.
+const (
+	kernelOffset = 0x00400000
+	bootReserve  = 0x00100000 // reserved below the end of RAM for the device tree
+	bootInfoSize = 0x40       // fw_dynamic_info below the device tree
+)
+
+const (
+	FW_DYNAMIC_INFO_MAGIC   = 0x4942534f // "OSBI"
+	FW_DYNAMIC_INFO_VERSION = 2
+	FW_DYNAMIC_INFO_MODE_S  = 1
+)
+
+// extent is the memory taken by an image loaded at boot.
+type extent struct {
+	name string
+	base uint32
+	top  uint32
+}
+
+// loaded records that the image name takes size bytes at base.
+func (p *CPU) loaded(name string, base uint32, size uint32) {
+	if size > 0 {
+		p.images = append(p.images, extent{name, base, base + size - 1})
+	}
+}
+
+// place records that name takes size bytes at base, where the simulator
+// itself puts it, and fails if an image loaded earlier is there.
+func (p *CPU) place(name string, base uint32, size uint32) error {
+	top := base + size - 1
+	for _, e := range p.images {
+		if (base <= e.top) && (e.base <= top) {
+			return fmt.Errorf("%v at 0x%08x-0x%08x overlaps %v at 0x%08x-0x%08x",
+				name, base, top, e.name, e.base, e.top)
+		}
+	}
+	p.loaded(name, base, size)
+	return nil
+}
+
+// LoadBytes copies b to memory at addr.
+func (p *CPU) LoadBytes(b []byte, addr uint32) {
+	for i, c := range b {
+		p.bus.WriteByte(addr+uint32(i), c)
+	}
+}
+
+// LoadInitrd places the initial ramdisk in filename page aligned just
+// below the area reserved for the device tree and returns its bounds.
+func (p *CPU) LoadInitrd(filename string) (uint32, uint32, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	start := (p.bus.ramTop + 1 - bootReserve - uint32(len(b))) &^ 0xfff
+	if err := p.place("initrd "+filename, start, uint32(len(b))); err != nil {
+		return 0, 0, err
+	}
+	p.LoadBytes(b, start)
+	return start, start + uint32(len(b)), nil
+}
+
+// LoadBootInfo stores the fw_dynamic_info structure that tells OpenSBI
+// where to jump next just below the device tree at dtb and passes its
+// address in a2 of every hart.
+func (p *CPU) LoadBootInfo(dtb uint32, next uint32) {
+	addr := dtb - bootInfoSize
+	info := []uint32{
+		FW_DYNAMIC_INFO_MAGIC,
+		FW_DYNAMIC_INFO_VERSION,
+		next,
+		FW_DYNAMIC_INFO_MODE_S,
+		0, // options
+		0, // boot_hart
+	}
+	for i, t := range info {
+		p.bus.WriteWord(addr+uint32(4*i), t)
+	}
+	for _, h := range p.bus.harts {
+		h.RegWrite(12, addr)
+	}
+}
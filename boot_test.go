@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadDeviceTree(t *testing.T) {
+	p := newTestCPU(t)
+	dtb := p.DeviceTree("").DTB()
+	addr, err := p.LoadDeviceTree(dtb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (addr&0xfff != 0) || (addr+uint32(len(dtb))-1 > p.bus.ramTop) || (p.Regs[11] != addr) {
+		t.Errorf("device tree at %08x, a1 = %08x", addr, p.Regs[11])
+	}
+	if got := p.bus.ReadWord(addr); got != 0xedfe0dd0 {
+		t.Errorf("magic = %08x", got)
+	}
+}
+
+func TestLoadDeviceTreeOverlap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "top.bin")
+	if err := ioutil.WriteFile(filename, make([]byte, 0x1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestCPU(t)
+	if err := p.LoadFile(filename, p.bus.ramTop+1-0x1000); err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.LoadDeviceTree(p.DeviceTree("").DTB())
+	if (err == nil) || !strings.Contains(err.Error(), "overlaps "+filename) {
+		t.Errorf("LoadDeviceTree over an image: %v", err)
+	}
+}
@@ -1,104 +1,617 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"unsafe"
 )
 
+// Device is a memory mapped peripheral. Addresses are relative to the
+// base address the device is mapped at.
+type Device interface {
+	ReadByte(addr uint32) uint8
+	ReadHalf(addr uint32) uint16
+	ReadWord(addr uint32) uint32
+	WriteByte(addr uint32, data uint8)
+	WriteHalf(addr uint32, data uint16)
+	WriteWord(addr uint32, data uint32)
+}
+
+// Serial is a UART usable as the console.
+type Serial interface {
+	Device
+	Attach(out io.Writer, in <-chan uint8)
+	Tick()
+	Flush()
+	Pending() bool
+	Interactive() bool
+}
+
+// Interrupter is a device with an interrupt line.
+type Interrupter interface {
+	Pending() bool
+}
+
+type irqLine struct {
+	irq uint32
+	dev Interrupter
+}
+
+type mapping struct {
+	base uint32
+	top  uint32
+	dev  Device
+}
+
+// RAM is reached through a two level page table that maps every 4KiB page
+// backed entirely by a Mem to its host bytes, so that loads and stores to
+// memory skip the device list. Only MMIO goes through the Device
+// handlers.
+const (
+	pageShift = 12
+	pageSize  = 1 << pageShift
+	pageMask  = pageSize - 1
+)
+
+type pageEntry struct {
+	mem  unsafe.Pointer // *[pageSize]byte, nil if the page is not mapped
+	attr uint8
+	code bool // the caches hold instructions from this page
+}
+
+// bytes returns the host bytes of the page, or nil. With -parallel a hart
+// may map a page while the others look at its entry, so mem is loaded
+// atomically and attr is only valid once mem is set.
+func (e *pageEntry) bytes() []byte {
+	pg := (*[pageSize]byte)(atomic.LoadPointer(&e.mem))
+	if pg == nil {
+		return nil
+	}
+	return pg[:]
+}
+
+type pageDir [1024]pageEntry
+
 type Bus struct {
-	mem  *Mem
-	uart *UART
+	machine *Machine
+	ramBase uint32
+	ramTop  uint32
+	pages   [1024]*pageDir
+	icache  *ICache
+	blocks  *BlockCache
+	mem     *Mem
+	uart    Serial   // the console UART
+	uarts   []Serial // all UARTs, the console first
+	clint   *CLINT
+	plic    *PLIC
+	drives  []*VirtioBlk
+	harts   []*CPU
+	devs    []mapping
+	irqs    []irqLine
+
+	// ioWritten is set by a write to anything but memory.
+	ioWritten bool
+
+	// parallel is set while the harts run on goroutines of their own,
+	// see parallel.go. io guards the devices then, grow the mapping of
+	// memory pages on their first use and resv the lr/sc reservations.
+	parallel bool
+	io       sync.Mutex
+	grow     sync.Mutex
+	resv     resTable
+
+	// rec logs or replays the inputs from the host, see replay.go.
+	rec *Recorder
+
+	// watch, if set, is called before a hart stores the size bytes of
+	// data at vaddr, which is paddr in memory, and before a device does
+	// with h nil and vaddr the same as paddr.
+	watch func(h *CPU, vaddr uint32, paddr uint32, size uint32, data uint32)
+
+	// dirty, if set, collects the addresses of the memory pages written
+	// to, for the debugger's checkpoints.
+	dirty map[uint32]bool
 }
 
 const (
-	uartBase = 0x20000000
-	uartTop  = 0x20000fff
-	ramBase = 0x80000000
-	ramTop  = 0x800fffff
+	virtioIrq = 1
+	uartIrq   = 10
+)
+
+const (
+	clintBase      = 0x02000000
+	clintTop       = 0x0200ffff
+	plicBase       = 0x0c000000
+	plicTop        = 0x0fffffff
+	ns16550Base    = 0x10000000
+	ns16550Top     = 0x100000ff
+	virtioBase     = 0x10001000
+	virtioSize     = 0x00001000
+	virtioMax      = 8
+	uartBase       = 0x20000000
+	uartTop        = 0x20000fff
+	ramBaseDefault = 0x80000000
 )
 
 var _ = fmt.Println
 
-func NewBus() *Bus {
-	mem := NewMem()
-	uart := NewUART()
-	return &Bus{mem, uart}
+// NewBus builds the memory map of the machine m, which must have been
+// validated.
+func NewBus(m *Machine) (*Bus, error) {
+	mem := NewMem(m.RAM.Size, memRWX)
+	clint := NewCLINT(int(m.Harts))
+	plic := NewPLIC(int(m.Harts))
+	bus := &Bus{machine: m, ramBase: m.RAM.Base, ramTop: m.RAM.Base + m.RAM.Size - 1, icache: NewICache(), blocks: NewBlockCache(), mem: mem, clint: clint, plic: plic}
+	bus.Map(m.CLINT.Base, m.CLINT.Base+m.CLINT.Size-1, clint)
+	bus.Map(m.PLIC.Base, m.PLIC.Base+m.PLIC.Size-1, plic)
+
+	for _, d := range append([]DevConfig{m.UART}, m.Serials...) {
+		var u Serial
+		switch d.Model {
+		case "ns16550":
+			u = NewNS16550()
+		case "sifive":
+			u = NewUART()
+		default:
+			return nil, fmt.Errorf("unknown UART model %v", d.Model)
+		}
+		bus.Map(d.Base, d.Base+d.Size-1, u)
+		bus.Connect(d.IRQ, u)
+		bus.uarts = append(bus.uarts, u)
+	}
+	bus.uart = bus.uarts[0]
+	if err := bus.MapFree("RAM", bus.ramBase, bus.ramTop, mem); err != nil {
+		return nil, err
+	}
+	for _, r := range m.Regions {
+		if err := bus.MapFree(r.Name, r.Base, r.Base+r.Size-1, NewMem(r.Size, r.Attr)); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range m.Drives {
+		if err := bus.addDrive(d); err != nil {
+			bus.Close()
+			return nil, err
+		}
+	}
+	return bus, nil
+}
+
+// MapFree maps dev at [base, top] unless that overlaps an existing
+// mapping. name is used in the error.
+func (p *Bus) MapFree(name string, base uint32, top uint32, dev Device) error {
+	for _, m := range p.devs {
+		if (base <= m.top) && (m.base <= top) {
+			return fmt.Errorf("%v at 0x%08x-0x%08x overlaps 0x%08x-0x%08x", name, base, top, m.base, m.top)
+		}
+	}
+	p.Map(base, top, dev)
+	return nil
+}
+
+// addDrive attaches a virtio block device backed by the disk image of d.
+func (p *Bus) addDrive(d DriveConfig) error {
+	blk, err := NewVirtioBlk(p, d)
+	if err != nil {
+		return err
+	}
+	p.drives = append(p.drives, blk)
+	if err := p.MapFree(d.Path, d.Base, d.Base+d.Size-1, blk); err != nil {
+		return err
+	}
+	p.Connect(d.IRQ, blk)
+	return nil
+}
+
+// Connect wires the interrupt line of dev to PLIC source irq.
+func (p *Bus) Connect(irq uint32, dev Interrupter) {
+	p.irqs = append(p.irqs, irqLine{irq, dev})
+}
+
+func (p *Bus) Close() {
+	for _, d := range p.drives {
+		d.Close()
+	}
+}
+
+// Map places dev at [base, top].
+func (p *Bus) Map(base uint32, top uint32, dev Device) {
+	p.devs = append(p.devs, mapping{base, top, dev})
+	p.remap(base, top)
+}
+
+// Overlay places dev at [base, top] in front of the existing mappings.
+func (p *Bus) Overlay(base uint32, top uint32, dev Device) {
+	p.devs = append([]mapping{{base, top, dev}}, p.devs...)
+	p.remap(base, top)
+}
+
+// remap updates the page table entries of the pages in [base, top].
+func (p *Bus) remap(base uint32, top uint32) {
+	for pn := uint64(base) >> pageShift; pn <= uint64(top)>>pageShift; pn++ {
+		p.mapPage(uint32(pn << pageShift))
+	}
+}
+
+// mapPage points the page table entry of the page at addr at the host
+// bytes of the Mem mapped there. Pages only partly covered by a Mem and
+// pages not written yet go through the device list.
+func (p *Bus) mapPage(addr uint32) {
+	addr &^= pageMask
+	e := p.entry(addr)
+	atomic.StorePointer(&e.mem, nil)
+	e.attr = 0
+	for _, m := range p.devs {
+		if (m.top < addr) || (addr+pageMask < m.base) {
+			continue
+		}
+		if mem, ok := m.dev.(*Mem); ok && (m.base <= addr) && (addr+pageMask <= m.top) {
+			if pg := mem.Page(addr-m.base, false); pg != nil {
+				e.attr = mem.attr
+				atomic.StorePointer(&e.mem, unsafe.Pointer(&pg[0]))
+			}
+		}
+		return
+	}
+}
+
+// entry returns the page table entry of addr, allocating it if needed.
+func (p *Bus) entry(addr uint32) *pageEntry {
+	d := p.pages[addr>>22]
+	if d == nil {
+		d = &pageDir{}
+		p.pages[addr>>22] = d
+	}
+	return &d[(addr>>pageShift)&0x3ff]
+}
+
+// page returns the host bytes of the memory page containing addr, or nil
+// if it is not plain memory. It does not check the access rights.
+func (p *Bus) page(addr uint32) []byte {
+	d := p.pages[addr>>22]
+	if d == nil {
+		return nil
+	}
+	if pg := d[(addr>>pageShift)&0x3ff].bytes(); pg != nil {
+		return pg
+	}
+	if p.parallel {
+		return p.populate(addr)
+	}
+	return nil
+}
+
+// access returns the host bytes of the memory page containing addr if the
+// hart may access it with access, or nil.
+func (p *Bus) access(addr uint32, access int) []byte {
+	d := p.pages[addr>>22]
+	if d == nil {
+		return nil
+	}
+	e := &d[(addr>>pageShift)&0x3ff]
+	pg := e.bytes()
+	if (pg == nil) && p.parallel {
+		pg = p.populate(addr)
+	}
+	if (pg == nil) || (e.attr&(1<<uint(access)) == 0) {
+		return nil
+	}
+	return pg
+}
+
+// MarkCode records that instructions from the page of addr are cached so
+// that writes to it invalidate them.
+func (p *Bus) MarkCode(addr uint32) {
+	p.entry(addr).code = true
+}
+
+// Tick advances the devices by one step.
+func (p *Bus) Tick() {
+	p.clint.Tick()
+	if p.rec != nil {
+		p.rec.before()
+		p.uart.Tick()
+		p.rec.after()
+	} else {
+		p.uart.Tick()
+	}
+	for _, u := range p.uarts[1:] {
+		u.Tick()
+	}
+	for _, l := range p.irqs {
+		p.plic.SetLevel(l.irq, l.dev.Pending())
+	}
+}
+
+// ExternalPending reports whether the PLIC interrupts context ctx, 2*h
+// for hart h M-mode and 2*h+1 for hart h S-mode.
+func (p *Bus) ExternalPending(ctx int) bool {
+	return p.plic.Pending(ctx)
+}
+
+// interactive reports whether input from the host may still arrive at
+// one of the UARTs.
+func (p *Bus) interactive() bool {
+	for _, u := range p.uarts {
+		if u.Interactive() {
+			return true
+		}
+	}
+	return false
+}
+
+// flushSerial sends the output still queued in the UARTs.
+func (p *Bus) flushSerial() {
+	for _, u := range p.uarts {
+		u.Flush()
+	}
+}
+
+// idle reports whether every hart is waiting in wfi. With -parallel the
+// other harts run on their own and the machine is never idle.
+func (p *Bus) idle() bool {
+	if p.parallel {
+		return false
+	}
+	for _, h := range p.harts {
+		if !h.Wfi {
+			return false
+		}
+	}
+	return true
+}
+
+// snoop drops the LR reservations of the harts other than self that
+// cover the word at addr, which self is about to store to. With -parallel
+// sc.w checks the word itself instead.
+func (p *Bus) snoop(addr uint32, self *CPU) {
+	if p.parallel {
+		return
+	}
+	for _, h := range p.harts {
+		if (h != self) && h.resOk && (h.resAddr == addr&^3) {
+			h.resOk = false
+		}
+	}
+}
+
+// Allowed reports whether a device responds at addr and lets the hart
+// access it with access, one of accessFetch, accessLoad and accessStore.
+func (p *Bus) Allowed(addr uint32, access int) bool {
+	if p.page(addr) != nil {
+		return p.access(addr, access) != nil
+	}
+	dev, _ := p.lookup(addr)
+	if mem, ok := dev.(*Mem); ok {
+		return mem.Allows(access)
+	}
+	return dev != nil
+}
+
+// Mapped reports whether a device responds at addr.
+func (p *Bus) Mapped(addr uint32) bool {
+	if p.page(addr) != nil {
+		return true
+	}
+	dev, _ := p.lookup(addr)
+	return dev != nil
+}
+
+// InMemory reports whether the size bytes at addr are all memory, RAM or
+// regions, not devices or holes.
+func (p *Bus) InMemory(addr uint32, size uint32) bool {
+	end := uint64(addr) + uint64(size)
+	for a := uint64(addr); a < end; {
+		dev, off := p.lookup(uint32(a))
+		m, ok := dev.(*Mem)
+		if !ok || (a > 0xffffffff) {
+			return false
+		}
+		a += uint64(m.size) - uint64(off)
+	}
+	return true
 }
 
 // Memory Map
-// - Reserved : 0x00000000 - 0x1fffffff
-// - UART     : 0x20000000 - 0x20000fff
+// - Reserved : 0x00000000 - 0x01ffffff
+// - CLINT    : 0x02000000 - 0x0200ffff
+// - Reserved : 0x02010000 - 0x0bffffff
+// - PLIC     : 0x0c000000 - 0x0fffffff
+// - NS16550A : 0x10000000 - 0x100000ff (-uart ns16550, irq 10)
+// - Reserved : 0x10000100 - 0x10000fff
+// - Virtio   : 0x10001000 - 0x10008fff (-drive, irq 1-8)
+// - Reserved : 0x10009000 - 0x1fffffff
+// - UART     : 0x20000000 - 0x20000fff (-uart sifive, irq 10)
 // - Reserved : 0x20001000 - 0x7fffffff
-// - Program  : 0x80000000 - 0x800fffff
-// - Reserved : 0x80100000 - 0xffffffff
+// - RAM      : 0x80000000 - (-ram-base and -m, 128MiB by default)
+// - Regions added with -region anywhere that is free
+
+func (p *Bus) lookup(addr uint32) (Device, uint32) {
+	for _, m := range p.devs {
+		if (m.base <= addr) && (addr <= m.top) {
+			return m.dev, addr - m.base
+		}
+	}
+	return nil, 0
+}
+
+// invalidate drops cached code at addr before it is overwritten, and
+// marks its page dirty if that is tracked.
+func (p *Bus) invalidate(addr uint32) {
+	if p.dirty != nil {
+		p.dirty[addr&^pageMask] = true
+	}
+	d := p.pages[addr>>22]
+	if d == nil {
+		return
+	}
+	e := &d[(addr>>pageShift)&0x3ff]
+	if !e.code {
+		return
+	}
+	if p.icache != nil {
+		p.icache.Invalidate(addr)
+	}
+	if p.blocks != nil {
+		p.blocks.Invalidate(addr)
+	}
+	// Once no code from the page is cached, stores to it stop coming
+	// here. With -parallel the harts' own caches do not use the flag.
+	if !p.parallel {
+		e.code = ((p.icache != nil) && p.icache.Holds(addr)) || ((p.blocks != nil) && p.blocks.Holds(addr))
+	}
+}
+
+// clearCode forgets which pages hold cached code, once the caches have
+// been flushed.
+func (p *Bus) clearCode() {
+	for _, d := range p.pages {
+		if d == nil {
+			continue
+		}
+		for i := range d {
+			d[i].code = false
+		}
+	}
+}
+
+// dmaWrite stores the low size bytes of data at addr for a device.
+func (p *Bus) dmaWrite(addr uint32, size uint32, data uint32) {
+	if p.watch != nil {
+		p.watch(nil, addr, addr, size, data)
+	}
+	switch size {
+	case 1:
+		p.WriteByte(addr, uint8(data))
+	case 2:
+		p.WriteHalf(addr, uint16(data))
+	default:
+		p.WriteWord(addr, data)
+	}
+}
 
 func (p *Bus) WriteByte(addr uint32, data uint8) {
-	if (ramBase <= addr) && (addr <= ramTop) {
-		t := addr - ramBase
-		p.mem.WriteByte(t, data)
-	} else if (uartBase <= addr) && (addr <= uartTop) {
-		t := addr - uartBase
-		p.uart.WriteByte(t, data)
+	p.invalidate(addr)
+	if pg := p.page(addr); pg != nil {
+		if p.parallel {
+			p.writeShared(pg, addr, 1, uint32(data))
+			return
+		}
+		pg[addr&pageMask] = data
+		return
+	}
+	if dev, t := p.lookup(addr); dev != nil {
+		p.lock()
+		dev.WriteByte(t, data)
+		if _, ok := dev.(*Mem); ok {
+			p.mapPage(addr)
+		} else {
+			p.ioWritten = true
+		}
+		p.unlock()
 	}
 }
 
 func (p *Bus) WriteHalf(addr uint32, data uint16) {
-	if (ramBase <= addr) && (addr <= ramTop) {
-		t := addr - ramBase
-		p.mem.WriteHalf(t, data)
-	} else if (uartBase <= addr) && (addr <= uartTop) {
-		t := addr - uartBase
-		p.uart.WriteHalf(t, data)
+	p.invalidate(addr)
+	if pg := p.page(addr); pg != nil {
+		if p.parallel {
+			p.writeShared(pg, addr, 2, uint32(data))
+			return
+		}
+		binary.LittleEndian.PutUint16(pg[addr&0xffe:], data)
+		return
+	}
+	if dev, t := p.lookup(addr); dev != nil {
+		p.lock()
+		dev.WriteHalf(t, data)
+		if _, ok := dev.(*Mem); ok {
+			p.mapPage(addr)
+		} else {
+			p.ioWritten = true
+		}
+		p.unlock()
 	}
 }
 
 func (p *Bus) WriteWord(addr uint32, data uint32) {
-	if (ramBase <= addr) && (addr <= ramTop) {
-		t := addr - ramBase
-		p.mem.WriteWord(t, data)
-	} else if (uartBase <= addr) && (addr <= uartTop) {
-		t := addr - uartBase
-		p.uart.WriteWord(t, data)
+	p.invalidate(addr)
+	if pg := p.page(addr); pg != nil {
+		if p.parallel {
+			p.writeShared(pg, addr, 4, data)
+			return
+		}
+		binary.LittleEndian.PutUint32(pg[addr&0xffc:], data)
+		return
+	}
+	if dev, t := p.lookup(addr); dev != nil {
+		p.lock()
+		dev.WriteWord(t, data)
+		if _, ok := dev.(*Mem); ok {
+			p.mapPage(addr)
+		} else {
+			p.ioWritten = true
+		}
+		p.unlock()
 	}
 }
 
 func (p *Bus) ReadByte(addr uint32) uint8 {
+	if pg := p.page(addr); pg != nil {
+		if p.parallel {
+			return uint8(loadShared(pg, addr&pageMask, 1))
+		}
+		return pg[addr&pageMask]
+	}
+
 	var ret uint8 = 0
 
-	if (ramBase <= addr) && (addr <= ramTop) {
-		t := addr - ramBase
-		ret = p.mem.ReadByte(t)
-	} else if (uartBase <= addr) && (addr <= uartTop) {
-		t := addr - uartBase
-		ret = p.uart.ReadByte(t)
+	if dev, t := p.lookup(addr); dev != nil {
+		p.lock()
+		ret = dev.ReadByte(t)
+		p.unlock()
 	}
-	
+
 	return ret
 }
 
 func (p *Bus) ReadHalf(addr uint32) uint16 {
+	if pg := p.page(addr); pg != nil {
+		if p.parallel {
+			return uint16(loadShared(pg, addr&0xffe, 2))
+		}
+		return binary.LittleEndian.Uint16(pg[addr&0xffe:])
+	}
+
 	var ret uint16 = 0
-	
-	if (ramBase <= addr) && (addr <= ramTop) {
-		t := addr - ramBase
-		ret = p.mem.ReadHalf(t)
-	} else if (uartBase <= addr) && (addr <= uartTop) {
-		t := addr - uartBase
-		ret = p.uart.ReadHalf(t)
-	}
-	
+
+	if dev, t := p.lookup(addr); dev != nil {
+		p.lock()
+		ret = dev.ReadHalf(t)
+		p.unlock()
+	}
+
 	return ret
 }
 
 func (p *Bus) ReadWord(addr uint32) uint32 {
+	if pg := p.page(addr); pg != nil {
+		if p.parallel {
+			return loadShared(pg, addr&0xffc, 4)
+		}
+		return binary.LittleEndian.Uint32(pg[addr&0xffc:])
+	}
+
 	var ret uint32 = 0
-	
-	if (ramBase <= addr) && (addr <= ramTop) {
-		t := addr - ramBase
-		ret = p.mem.ReadWord(t)
-	} else if (uartBase <= addr) && (addr <= uartTop) {
-		t := addr - uartBase
-		ret = p.uart.ReadWord(t)
-	}
-	
+
+	if dev, t := p.lookup(addr); dev != nil {
+		p.lock()
+		ret = dev.ReadWord(t)
+		p.unlock()
+	}
+
 	return ret
 }
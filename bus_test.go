@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBusRAM(t *testing.T) {
+	p := newTestCPU(t)
+	bus := p.bus
+	base := bus.ramBase
+	bus.WriteWord(base+0x1000, 0x44332211)
+	bus.WriteHalf(base+0x1004, 0x6655)
+	bus.WriteByte(base+0x1006, 0x77)
+	tests := []struct {
+		addr uint32
+		size int
+		want uint32
+	}{
+		{0x1000, 4, 0x44332211},
+		{0x1004, 4, 0x00776655},
+		{0x1001, 1, 0x22},
+		{0x1002, 2, 0x4433},
+		{0x1006, 2, 0x0077},
+		{0x2000, 4, 0},
+	}
+	for _, tt := range tests {
+		var got uint32
+		switch tt.size {
+		case 1:
+			got = uint32(bus.ReadByte(base + tt.addr))
+		case 2:
+			got = uint32(bus.ReadHalf(base + tt.addr))
+		default:
+			got = bus.ReadWord(base + tt.addr)
+		}
+		if got != tt.want {
+			t.Errorf("%v bytes at %08x = %x, want %x", tt.size, base+tt.addr, got, tt.want)
+		}
+	}
+	top := bus.ramTop &^ 3
+	bus.WriteWord(top, 0xcafef00d)
+	if got := bus.ReadWord(top); got != 0xcafef00d {
+		t.Errorf("last word of RAM = %08x", got)
+	}
+}
+
+func TestBusDevices(t *testing.T) {
+	p := newTestCPU(t)
+	bus := p.bus
+	var out bytes.Buffer
+	bus.uart.Attach(&out, nil)
+	uart := p.bus.machine.UART.Base
+	bus.WriteWord(uart+uartTxctrl, uartTxen)
+	bus.WriteByte(uart+uartTxdata, 'o')
+	bus.WriteWord(uart+uartTxdata, 'k')
+	bus.Tick()
+	bus.Tick()
+	if out.String() != "ok" {
+		t.Errorf("UART output %q, want \"ok\"", out.String())
+	}
+	if got := bus.ReadWord(uart + uartTxctrl); got != uartTxen {
+		t.Errorf("txctrl = %08x", got)
+	}
+	if got := bus.ReadByte(uart + uartRxdata + 3); got != 0x80 {
+		t.Errorf("rxdata byte 3 = %02x, want the empty flag", got)
+	}
+}
+
+func TestBusUnmapped(t *testing.T) {
+	p := newTestCPU(t)
+	bus := p.bus
+	const addr = 0x40000000
+	if bus.Mapped(addr) || bus.Allowed(addr, accessLoad) {
+		t.Fatalf("%08x is mapped", addr)
+	}
+	bus.WriteWord(addr, 0xffffffff)
+	if (bus.ReadWord(addr) != 0) || (bus.ReadHalf(addr) != 0) || (bus.ReadByte(addr) != 0) {
+		t.Errorf("unmapped memory does not read as zero")
+	}
+	if !bus.Allowed(bus.ramBase, accessStore) || !bus.Mapped(bus.ramTop) || bus.Mapped(bus.ramTop+1) {
+		t.Errorf("RAM bounds are wrong")
+	}
+}
+
+func TestBusUARTModel(t *testing.T) {
+	m := DefaultMachine()
+	m.UART.Model = "pl011"
+	if _, err := NewBus(m); err == nil {
+		t.Errorf("NewBus accepted an unknown UART model")
+	}
+}
+
+func TestBusCodeFlag(t *testing.T) {
+	p := newTestCPU(t)
+	bus := p.bus
+	pc := p.PC
+	code := func() bool { return bus.entry(pc).code }
+	bus.WriteWord(pc, encI(0x13, 0, 10, 0, 1)) // li a0, 1
+	bus.WriteWord(pc+4, 0x0000100f)            // fence.i
+
+	p.Next()
+	if !code() {
+		t.Fatalf("page not marked after caching an instruction")
+	}
+	// A store next to the cached word leaves it cached.
+	bus.WriteWord(pc+8, 0)
+	if !code() {
+		t.Errorf("page unmarked while the cache holds code")
+	}
+	// Overwriting the only cached instruction leaves nothing cached.
+	bus.WriteWord(pc, encI(0x13, 0, 10, 0, 2))
+	if code() {
+		t.Errorf("page still marked after its code was overwritten")
+	}
+
+	ops, _ := p.Next()
+	p.Execute(ops)
+	ops, _ = p.Next()
+	p.Execute(ops)
+	if code() {
+		t.Errorf("page still marked after fence.i")
+	}
+}
+
+// devicePath hides a Mem from the page table, so that every access takes
+// the device list as before there was a page table.
+type devicePath struct {
+	Device
+}
+
+// BenchmarkMemory runs a loop of word, half and byte copies, one
+// instruction per operation, with RAM reached through the page table and
+// through the device list.
+func BenchmarkMemory(b *testing.B) {
+	prog := []uint32{
+		encU(0x37, 8, 0x80010000),  // lui s0, 0x80010
+		encU(0x37, 9, 0x80020000),  // lui s1, 0x80020
+		encR(0x33, 0, 0, 6, 8, 5),  // add t1, s0, t0
+		encR(0x33, 0, 0, 7, 9, 5),  // add t2, s1, t0
+		encI(0x03, 2, 10, 6, 0),    // lw a0, 0(t1)
+		encS(2, 7, 10, 0),          // sw a0, 0(t2)
+		encI(0x03, 1, 11, 6, 4),    // lh a1, 4(t1)
+		encS(1, 7, 11, 4),          // sh a1, 4(t2)
+		encI(0x03, 0, 12, 6, 6),    // lb a2, 6(t1)
+		encS(0, 7, 12, 6),          // sb a2, 6(t2)
+		encI(0x13, 0, 5, 5, 8),     // addi t0, t0, 8
+		encI(0x13, 7, 5, 5, 0x7f8), // andi t0, t0, 0x7f8
+		encJ(0, -40),               // j loop
+	}
+	for _, pages := range []bool{true, false} {
+		name := "pages"
+		if !pages {
+			name = "devices"
+		}
+		b.Run(name, func(b *testing.B) {
+			p := newTestCPU(b)
+			bus := p.bus
+			// The code stays in RAM, where it is cached either way; the
+			// copies go to memory of their own.
+			var data Device = NewMem(0x20000, memRWX)
+			if !pages {
+				data = devicePath{data}
+			}
+			bus.Overlay(0x80010000, 0x8002ffff, data)
+			for i, inst := range prog {
+				bus.WriteWord(p.PC+uint32(4*i), inst)
+			}
+			b.ResetTimer()
+			runHart(p, b.N, false)
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+// Memory Map:
+// 0x0000: msip     machine software interrupt pending, 4 bytes per hart
+// 0x4000: mtimecmp machine timer compare register (64bit), 8 bytes per hart
+// 0xbff8: mtime    machine timer register (64bit), shared by all harts
+
+// mtime advances once per instruction; the frequency reported to
+// software assumes a 10 MIPS hart.
+const timebaseFreq = 10000000
+
+const (
+	clintMsip     = 0x0000
+	clintMtimecmp = 0x4000
+	clintMtime    = 0xbff8
+)
+
+type CLINT struct {
+	msip     []uint32
+	mtimecmp []uint64
+	mtime    uint64
+}
+
+func NewCLINT(harts int) *CLINT {
+	mtimecmp := make([]uint64, harts)
+	for i := range mtimecmp {
+		mtimecmp[i] = 0xffffffffffffffff
+	}
+	return &CLINT{make([]uint32, harts), mtimecmp, 0}
+}
+
+// Tick advances mtime by one. The timer runs in virtual time, one tick
+// per simulated instruction of hart 0.
+func (p *CLINT) Tick() {
+	p.mtime++
+}
+
+// Skip fast-forwards mtime to the next mtimecmp so that idle harts
+// waiting only for the timer wake up without simulating the idle period.
+func (p *CLINT) Skip() {
+	next := uint64(0xffffffffffffffff)
+	for _, t := range p.mtimecmp {
+		if (t > p.mtime) && (t < next) {
+			next = t
+		}
+	}
+	if next != 0xffffffffffffffff {
+		p.mtime = next
+	}
+}
+
+func (p *CLINT) TimerPending(hart int) bool {
+	return p.mtime >= p.mtimecmp[hart]
+}
+
+func (p *CLINT) SoftwarePending(hart int) bool {
+	return p.msip[hart]&0x01 != 0
+}
+
+func (p *CLINT) ReadByte(addr uint32) uint8 {
+	sel := addr & 0x00000003
+	t := p.ReadWord(addr & 0xfffffffc)
+	return uint8((t >> (sel * 8)) & 0xff)
+}
+
+func (p *CLINT) ReadHalf(addr uint32) uint16 {
+	sel := addr & 0x00000002
+	t := p.ReadWord(addr & 0xfffffffc)
+	return uint16((t >> (sel * 8)) & 0xffff)
+}
+
+func (p *CLINT) ReadWord(addr uint32) uint32 {
+	addr &= 0xfffffffc
+	if h := int((addr - clintMsip) / 4); (addr < clintMtimecmp) && (h < len(p.msip)) {
+		return p.msip[h]
+	}
+	if h := int((addr - clintMtimecmp) / 8); (addr >= clintMtimecmp) && (h < len(p.mtimecmp)) {
+		if addr&4 != 0 {
+			return uint32(p.mtimecmp[h] >> 32)
+		}
+		return uint32(p.mtimecmp[h])
+	}
+	switch addr {
+	case clintMtime:
+		return uint32(p.mtime)
+	case clintMtime + 4:
+		return uint32(p.mtime >> 32)
+	default:
+		return 0
+	}
+}
+
+func (p *CLINT) WriteByte(addr uint32, data uint8) {
+	sel := addr & 0x00000003
+	maskAddr := addr & 0xfffffffc
+	t := p.ReadWord(maskAddr)
+	t = (t &^ (0xff << (sel * 8))) | (uint32(data) << (sel * 8))
+	p.WriteWord(maskAddr, t)
+}
+
+func (p *CLINT) WriteHalf(addr uint32, data uint16) {
+	sel := addr & 0x00000002
+	maskAddr := addr & 0xfffffffc
+	t := p.ReadWord(maskAddr)
+	t = (t &^ (0xffff << (sel * 8))) | (uint32(data) << (sel * 8))
+	p.WriteWord(maskAddr, t)
+}
+
+func (p *CLINT) WriteWord(addr uint32, data uint32) {
+	addr &= 0xfffffffc
+	if h := int((addr - clintMsip) / 4); (addr < clintMtimecmp) && (h < len(p.msip)) {
+		p.msip[h] = data & 0x01
+		return
+	}
+	if h := int((addr - clintMtimecmp) / 8); (addr >= clintMtimecmp) && (h < len(p.mtimecmp)) {
+		if addr&4 != 0 {
+			p.mtimecmp[h] = (p.mtimecmp[h] & 0x00000000ffffffff) | (uint64(data) << 32)
+		} else {
+			p.mtimecmp[h] = (p.mtimecmp[h] & 0xffffffff00000000) | uint64(data)
+		}
+		return
+	}
+	switch addr {
+	case clintMtime:
+		p.mtime = (p.mtime & 0xffffffff00000000) | uint64(data)
+	case clintMtime + 4:
+		p.mtime = (p.mtime & 0x00000000ffffffff) | (uint64(data) << 32)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func TestCLINTRegisters(t *testing.T) {
+	c := NewCLINT(2)
+	if c.TimerPending(0) || c.TimerPending(1) {
+		t.Errorf("timer pending after reset")
+	}
+	c.WriteWord(clintMtimecmp+8, 0x100)
+	c.WriteWord(clintMtimecmp+12, 0)
+	c.WriteByte(clintMtimecmp+9, 0x02)
+	if got := c.ReadWord(clintMtimecmp + 8); got != 0x200 {
+		t.Errorf("mtimecmp[1] = %x, want 200", got)
+	}
+	c.WriteHalf(clintMtime+2, 0x1)
+	if got := c.ReadWord(clintMtime); got != 0x10000 {
+		t.Errorf("mtime = %x, want 10000", got)
+	}
+	if !c.TimerPending(1) || c.TimerPending(0) {
+		t.Errorf("timer pending: hart 0 %v, hart 1 %v", c.TimerPending(0), c.TimerPending(1))
+	}
+	c.WriteWord(clintMsip+4, 0xffffffff)
+	if (c.ReadWord(clintMsip+4) != 1) || !c.SoftwarePending(1) || c.SoftwarePending(0) {
+		t.Errorf("msip[1] = %x", c.ReadWord(clintMsip+4))
+	}
+}
+
+func TestCLINTSkip(t *testing.T) {
+	c := NewCLINT(2)
+	c.WriteWord(clintMtimecmp, 500)
+	c.WriteWord(clintMtimecmp+4, 0)
+	c.WriteWord(clintMtimecmp+8, 300)
+	c.WriteWord(clintMtimecmp+12, 0)
+	c.Skip()
+	if c.mtime != 300 {
+		t.Errorf("mtime = %v, want 300", c.mtime)
+	}
+	c.Skip()
+	if c.mtime != 500 {
+		t.Errorf("mtime = %v, want 500", c.mtime)
+	}
+	c.Skip()
+	if c.mtime != 500 {
+		t.Errorf("mtime = %v with no timer left, want 500", c.mtime)
+	}
+}
+
+func TestWfiTimer(t *testing.T) {
+	p := newTestCPU(t)
+	clint := p.bus.clint
+	clint.WriteWord(clintMtimecmp, 100000)
+	clint.WriteWord(clintMtimecmp+4, 0)
+	p.CSRs[CSR_ADDR_MTVEC] = 0x80000100
+	p.CSRs[CSR_ADDR_MIE] = MIP_MTIP
+	p.CSRs[CSR_ADDR_MSTATUS] = MSTATUS_MIE
+	exec(p, 0x10500073)
+	if !p.Wfi || (p.PC != 0x80000004) {
+		t.Fatalf("wfi: wfi %v, pc %08x", p.Wfi, p.PC)
+	}
+	if p.Tick() {
+		t.Errorf("hart ran on while waiting for the timer")
+	}
+	if clint.mtime != 100000 {
+		t.Errorf("mtime = %v, want the idle period skipped to 100000", clint.mtime)
+	}
+	if !p.Tick() || p.Wfi {
+		t.Fatalf("timer did not wake the hart")
+	}
+	if (p.PC != 0x80000100) || (p.CSRs[CSR_ADDR_MCAUSE] != 0x80000007) || (p.CSRs[CSR_ADDR_MEPC] != 0x80000004) {
+		t.Errorf("pc = %08x, mcause = %08x, mepc = %08x", p.PC, p.CSRs[CSR_ADDR_MCAUSE], p.CSRs[CSR_ADDR_MEPC])
+	}
+}
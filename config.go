@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The machine description is written in a subset of TOML: comments,
+// key = value pairs, [table] and [[array of tables]] headers, and values
+// that are strings, integers (decimal, 0x, 0o or 0b, with optional
+// underscores), booleans or single line arrays of those. Every value
+// remembers its line so that errors can point at it.
+
+type configValue struct {
+	v    interface{} // string, int64, bool or []interface{}
+	line int
+}
+
+type configTable struct {
+	name string
+	line int
+	keys map[string]*configValue
+	used map[string]bool
+}
+
+type configFile struct {
+	name   string
+	root   *configTable
+	tables map[string]*configTable
+	arrays map[string][]*configTable
+	order  []*configTable
+}
+
+func newConfigTable(name string, line int) *configTable {
+	return &configTable{name: name, line: line, keys: map[string]*configValue{}, used: map[string]bool{}}
+}
+
+// errorf formats an error pointing at line of the file.
+func (p *configFile) errorf(line int, format string, a ...interface{}) error {
+	return fmt.Errorf("%v:%v: %v", p.name, line, fmt.Sprintf(format, a...))
+}
+
+// readConfig parses the file filename.
+func readConfig(filename string) (*configFile, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(filename, b)
+}
+
+func parseConfig(name string, b []byte) (*configFile, error) {
+	f := &configFile{
+		name:   name,
+		root:   newConfigTable("", 1),
+		tables: map[string]*configTable{},
+		arrays: map[string][]*configTable{},
+	}
+	f.order = append(f.order, f.root)
+	cur := f.root
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "[["):
+			if !strings.HasSuffix(line, "]]") {
+				return nil, f.errorf(n, "missing ]] in table header")
+			}
+			name := strings.TrimSpace(line[2 : len(line)-2])
+			if !isConfigKey(name) {
+				return nil, f.errorf(n, "bad table name %q", name)
+			}
+			if _, ok := f.tables[name]; ok {
+				return nil, f.errorf(n, "%v is already a table", name)
+			}
+			cur = newConfigTable(name, n)
+			f.arrays[name] = append(f.arrays[name], cur)
+			f.order = append(f.order, cur)
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") {
+				return nil, f.errorf(n, "missing ] in table header")
+			}
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if !isConfigKey(name) {
+				return nil, f.errorf(n, "bad table name %q", name)
+			}
+			if t, ok := f.tables[name]; ok {
+				return nil, f.errorf(n, "table %v is already defined on line %v", name, t.line)
+			}
+			if _, ok := f.arrays[name]; ok {
+				return nil, f.errorf(n, "%v is already an array of tables", name)
+			}
+			cur = newConfigTable(name, n)
+			f.tables[name] = cur
+			f.order = append(f.order, cur)
+		default:
+			i := strings.IndexByte(line, '=')
+			if i < 0 {
+				return nil, f.errorf(n, "expected key = value")
+			}
+			key := strings.TrimSpace(line[:i])
+			if !isConfigKey(key) {
+				return nil, f.errorf(n, "bad key %q", key)
+			}
+			if v, ok := cur.keys[key]; ok {
+				return nil, f.errorf(n, "%v is already set on line %v", key, v.line)
+			}
+			v, err := parseConfigValue(strings.TrimSpace(line[i+1:]))
+			if err != nil {
+				return nil, f.errorf(n, "%v: %v", key, err)
+			}
+			cur.keys[key] = &configValue{v, n}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// stripComment removes a # comment that is not inside a string.
+func stripComment(s string) string {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case '#':
+			if !quoted {
+				return s[:i]
+			}
+		}
+	}
+	return s
+}
+
+func isConfigKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func parseConfigValue(s string) (interface{}, error) {
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("missing value")
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	case s[0] == '"':
+		t, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad string %v", s)
+		}
+		return t, nil
+	case s[0] == '[':
+		if s[len(s)-1] != ']' {
+			return nil, fmt.Errorf("missing ] in array")
+		}
+		var a []interface{}
+		for _, e := range splitConfigArray(s[1 : len(s)-1]) {
+			e = strings.TrimSpace(e)
+			if e == "" {
+				continue // trailing comma
+			}
+			v, err := parseConfigValue(e)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := v.([]interface{}); ok {
+				return nil, fmt.Errorf("nested arrays are not supported")
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	}
+	n, err := strconv.ParseInt(strings.Replace(s, "_", "", -1), 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad value %v", s)
+	}
+	return n, nil
+}
+
+// splitConfigArray splits the elements of an array at commas outside of
+// strings.
+func splitConfigArray(s string) []string {
+	var a []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				a = append(a, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(a, s[start:])
+}
+
+// Accessors. Each one marks the key as used, returns whether it is set
+// and reports a type mismatch at the line of the value.
+
+func (p *configFile) str(t *configTable, key string, dst *string) (bool, error) {
+	v, ok := t.keys[key]
+	if !ok {
+		return false, nil
+	}
+	t.used[key] = true
+	s, ok := v.v.(string)
+	if !ok {
+		return false, p.errorf(v.line, "%v must be a string", key)
+	}
+	*dst = s
+	return true, nil
+}
+
+// path reads a file name. Relative names are taken relative to the
+// directory of the configuration file.
+func (p *configFile) path(t *configTable, key string, dst *string) (bool, error) {
+	set, err := p.str(t, key, dst)
+	if set {
+		*dst = p.join(*dst)
+	}
+	return set, err
+}
+
+func (p *configFile) join(name string) string {
+	if (name == "") || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(p.name), name)
+}
+
+func (p *configFile) boolean(t *configTable, key string, dst *bool) (bool, error) {
+	v, ok := t.keys[key]
+	if !ok {
+		return false, nil
+	}
+	t.used[key] = true
+	b, ok := v.v.(bool)
+	if !ok {
+		return false, p.errorf(v.line, "%v must be true or false", key)
+	}
+	*dst = b
+	return true, nil
+}
+
+// u32 reads an integer that fits in 32 bits. Strings with a K, M or G
+// suffix are accepted as sizes.
+func (p *configFile) u32(t *configTable, key string, dst *uint32) (bool, error) {
+	v, ok := t.keys[key]
+	if !ok {
+		return false, nil
+	}
+	t.used[key] = true
+	var n uint64
+	switch x := v.v.(type) {
+	case int64:
+		if x < 0 {
+			return false, p.errorf(v.line, "%v must not be negative", key)
+		}
+		n = uint64(x)
+	case string:
+		var err error
+		if n, err = parseSize(x); err != nil {
+			return false, p.errorf(v.line, "%v: bad size %q", key, x)
+		}
+	default:
+		return false, p.errorf(v.line, "%v must be an integer", key)
+	}
+	if n > 0xffffffff {
+		return false, p.errorf(v.line, "%v is out of range", key)
+	}
+	*dst = uint32(n)
+	return true, nil
+}
+
+func (p *configFile) strs(t *configTable, key string, dst *[]string) (bool, error) {
+	v, ok := t.keys[key]
+	if !ok {
+		return false, nil
+	}
+	t.used[key] = true
+	a, ok := v.v.([]interface{})
+	if !ok {
+		return false, p.errorf(v.line, "%v must be an array of strings", key)
+	}
+	var r []string
+	for _, e := range a {
+		s, ok := e.(string)
+		if !ok {
+			return false, p.errorf(v.line, "%v must be an array of strings", key)
+		}
+		r = append(r, s)
+	}
+	*dst = r
+	return true, nil
+}
+
+// lineOf returns the line of key in t, or of t itself if key is not set.
+func (p *configTable) lineOf(key string) int {
+	if v, ok := p.keys[key]; ok {
+		return v.line
+	}
+	return p.line
+}
+
+// unused reports the first key or table that nothing has read.
+func (p *configFile) unused(known map[string]bool) error {
+	for _, t := range p.order {
+		if (t != p.root) && !known[t.name] {
+			return p.errorf(t.line, "unknown table %v", t.name)
+		}
+		var first *configValue
+		var name string
+		for k, v := range t.keys {
+			if !t.used[k] && ((first == nil) || (v.line < first.line)) {
+				first, name = v, k
+			}
+		}
+		if first != nil {
+			return p.errorf(first.line, "unknown key %v", name)
+		}
+	}
+	return nil
+}
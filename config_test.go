@@ -0,0 +1,152 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	f, err := parseConfig("t.toml", []byte(`
+# a comment
+top = 1_000   # trailing comment
+[a]
+s = "x # not a comment"
+hex = 0x10
+oct = 0o17
+bin = 0b101
+neg = -3
+yes = true
+list = ["a,b", "c", ]
+mixed = [1, "two", false]
+
+[[b]]
+n = 1
+[[b]]
+n = 2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := f.root.keys["top"]; (v == nil) || (v.v != int64(1000)) || (v.line != 3) {
+		t.Errorf("top = %+v", v)
+	}
+	want := map[string]interface{}{
+		"s":     "x # not a comment",
+		"hex":   int64(16),
+		"oct":   int64(15),
+		"bin":   int64(5),
+		"neg":   int64(-3),
+		"yes":   true,
+		"list":  []interface{}{"a,b", "c"},
+		"mixed": []interface{}{int64(1), "two", false},
+	}
+	a := f.tables["a"]
+	if a == nil {
+		t.Fatal("no table a")
+	}
+	for k, w := range want {
+		if v := a.keys[k]; (v == nil) || !reflect.DeepEqual(v.v, w) {
+			t.Errorf("%v = %#v, want %#v", k, v, w)
+		}
+	}
+	if b := f.arrays["b"]; (len(b) != 2) || (b[1].keys["n"].v != int64(2)) || (b[1].line != 16) {
+		t.Errorf("array b: %+v", b)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"x", "t.toml:1: expected key = value"},
+		{"\n[a\n", "t.toml:2: missing ] in table header"},
+		{"[[a]\n", "t.toml:1: missing ]] in table header"},
+		{"[a b]\n", "t.toml:1: bad table name"},
+		{"a b = 1\n", "t.toml:1: bad key"},
+		{"a = 1\na = 2\n", "t.toml:2: a is already set on line 1"},
+		{"[a]\n[a]\n", "t.toml:2: table a is already defined on line 1"},
+		{"[[a]]\n[a]\n", "t.toml:2: a is already an array of tables"},
+		{"[a]\n[[a]]\n", "t.toml:2: a is already a table"},
+		{"a =\n", "t.toml:1: a: missing value"},
+		{"a = \"x\n", "t.toml:1: a: bad string"},
+		{"a = [1, 2\n", "t.toml:1: a: missing ] in array"},
+		{"a = [[1]]\n", "t.toml:1: a: nested arrays are not supported"},
+		{"a = 12abc\n", "t.toml:1: a: bad value 12abc"},
+	}
+	for _, tt := range tests {
+		_, err := parseConfig("t.toml", []byte(tt.text))
+		if (err == nil) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: error %v, want %v", tt.text, err, tt.want)
+		}
+	}
+}
+
+func TestConfigAccessors(t *testing.T) {
+	f, err := parseConfig("/etc/m.toml", []byte(`
+n = 5
+size = "64K"
+big = 0x100000000
+neg = -1
+s = "abc"
+file = "img.bin"
+abs = "/boot/img.bin"
+b = true
+l = ["x", "y"]
+bad = [1]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := f.root
+	var n uint32
+	if _, err := f.u32(r, "n", &n); (err != nil) || (n != 5) {
+		t.Errorf("n = %v, %v", n, err)
+	}
+	if _, err := f.u32(r, "size", &n); (err != nil) || (n != 64<<10) {
+		t.Errorf("size = %v, %v", n, err)
+	}
+	if set, err := f.u32(r, "missing", &n); set || (err != nil) {
+		t.Errorf("missing key: set %v, %v", set, err)
+	}
+	var s string
+	if _, err := f.path(r, "file", &s); (err != nil) || (s != "/etc/img.bin") {
+		t.Errorf("file = %v, %v", s, err)
+	}
+	if _, err := f.path(r, "abs", &s); (err != nil) || (s != "/boot/img.bin") {
+		t.Errorf("abs = %v, %v", s, err)
+	}
+	var b bool
+	if _, err := f.boolean(r, "b", &b); (err != nil) || !b {
+		t.Errorf("b = %v, %v", b, err)
+	}
+	var l []string
+	if _, err := f.strs(r, "l", &l); (err != nil) || !reflect.DeepEqual(l, []string{"x", "y"}) {
+		t.Errorf("l = %v, %v", l, err)
+	}
+
+	errs := []struct {
+		get  func() error
+		want string
+	}{
+		{func() error { _, err := f.u32(r, "big", &n); return err }, "/etc/m.toml:4: big is out of range"},
+		{func() error { _, err := f.u32(r, "neg", &n); return err }, "/etc/m.toml:5: neg must not be negative"},
+		{func() error { _, err := f.u32(r, "s", &n); return err }, "/etc/m.toml:6: s: bad size \"abc\""},
+		{func() error { _, err := f.u32(r, "b", &n); return err }, "/etc/m.toml:9: b must be an integer"},
+		{func() error { _, err := f.str(r, "n", &s); return err }, "/etc/m.toml:2: n must be a string"},
+		{func() error { _, err := f.boolean(r, "s", &b); return err }, "/etc/m.toml:6: s must be true or false"},
+		{func() error { _, err := f.strs(r, "bad", &l); return err }, "/etc/m.toml:11: bad must be an array of strings"},
+	}
+	for _, e := range errs {
+		if err := e.get(); (err == nil) || (err.Error() != e.want) {
+			t.Errorf("error %v, want %v", err, e.want)
+		}
+	}
+
+	// Everything has been read except the key nobody asked for.
+	r.keys["extra"] = &configValue{int64(1), 12}
+	if err := f.unused(nil); (err == nil) || (err.Error() != "/etc/m.toml:12: unknown key extra") {
+		t.Errorf("unused: %v", err)
+	}
+}
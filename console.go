@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Console connects a UART to the host. Output written to it is decorated
+// with an optional per-line prefix and timestamp before it reaches the
+// sink.
+type Console struct {
+	out     io.Writer
+	in      io.Reader
+	prefix  string
+	stamp   bool
+	start   time.Time
+	bol     bool
+	closers []func()
+}
+
+// OpenConsole opens the console described by spec. Input comes from in
+// if it is not nil, otherwise from the sink if it has any:
+//
+//	stdio            stdout and stdin (raw mode if stdin is a terminal)
+//	stdout           write to stdout, no input
+//	file:PATH        write to PATH, no input
+//	pty              a new pseudo terminal, its name is printed on stderr
+//	tcp:HOST:PORT    wait for one TCP client and talk to it
+//	unix:PATH        wait for one client on a Unix domain socket
+//	none             discard output, no input
+func OpenConsole(spec string, in io.Reader) (*Console, error) {
+	p := &Console{start: time.Now(), bol: true}
+
+	kind := spec
+	arg := ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind = spec[:i]
+		arg = spec[i+1:]
+	}
+
+	switch kind {
+	case "stdio":
+		p.out = os.Stdout
+		if in != nil {
+			break
+		}
+		p.in = os.Stdin
+		if restore, ok := MakeRaw(os.Stdin.Fd()); ok {
+			p.closers = append(p.closers, restore)
+		}
+	case "stdout":
+		p.out = os.Stdout
+	case "file":
+		f, err := os.Create(arg)
+		if err != nil {
+			return nil, err
+		}
+		p.out = f
+		p.closers = append(p.closers, func() { f.Close() })
+	case "pty":
+		master, slave, err := OpenPty()
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "console on %v\n", slave.Name())
+		p.out = master
+		p.in = master
+		p.closers = append(p.closers, func() { master.Close(); slave.Close() })
+	case "tcp", "unix":
+		conn, err := acceptOne(kind, arg)
+		if err != nil {
+			return nil, err
+		}
+		p.out = conn
+		p.in = conn
+		p.closers = append(p.closers, func() { conn.Close() })
+	case "none":
+		p.out = ioutil.Discard
+	default:
+		return nil, fmt.Errorf("unknown console %q", spec)
+	}
+	if in != nil {
+		p.in = in
+	}
+	return p, nil
+}
+
+// acceptOne waits for one client on a tcp or unix socket.
+func acceptOne(network string, addr string) (net.Conn, error) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "waiting for connection on %v:%v\n", network, addr)
+	conn, err := ln.Accept()
+	ln.Close()
+	return conn, err
+}
+
+// SetPrefix sets a string printed at the start of every output line.
+func (p *Console) SetPrefix(prefix string) {
+	p.prefix = prefix
+}
+
+// SetTimestamp enables a host time stamp at the start of every line.
+func (p *Console) SetTimestamp(on bool) {
+	p.stamp = on
+}
+
+func (p *Console) Input() io.Reader {
+	return p.in
+}
+
+// Feed returns a channel that delivers the bytes read from r one at a time
+// and is closed when r fails or reaches EOF. It is nil if r is nil.
+func Feed(r io.Reader) <-chan uint8 {
+	if r == nil {
+		return nil
+	}
+	c := make(chan uint8, 256)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := r.Read(buf); err != nil {
+				close(c)
+				return
+			}
+			c <- buf[0]
+		}
+	}()
+	return c
+}
+
+func (p *Console) Write(b []byte) (int, error) {
+	if p.prefix == "" && !p.stamp {
+		return p.out.Write(b)
+	}
+
+	var buf []byte
+	for _, c := range b {
+		if p.bol {
+			if p.stamp {
+				d := time.Since(p.start)
+				buf = append(buf, fmt.Sprintf("[%5d.%06d] ", d/time.Second, (d%time.Second)/time.Microsecond)...)
+			}
+			buf = append(buf, p.prefix...)
+			p.bol = false
+		}
+		buf = append(buf, c)
+		if c == '\n' {
+			p.bol = true
+		}
+	}
+	if _, err := p.out.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *Console) Close() {
+	for i := len(p.closers) - 1; i >= 0; i-- {
+		p.closers[i]()
+	}
+	p.closers = nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConsoleFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "out.txt")
+	c, err := OpenConsole("file:"+filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Input() != nil {
+		t.Errorf("file console has input")
+	}
+	c.SetPrefix("[1] ")
+	c.Write([]byte("one\ntw"))
+	c.Write([]byte("o\n"))
+	c.Close()
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "[1] one\n[1] two\n" {
+		t.Errorf("wrote %q", b)
+	}
+}
+
+func TestConsoleInput(t *testing.T) {
+	in := strings.NewReader("abc")
+	// stdio leaves the terminal alone when the input comes from elsewhere.
+	c, err := OpenConsole("stdio", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (c.Input() != in) || (len(c.closers) != 0) {
+		t.Errorf("stdio console with input: input %v, %v closers", c.Input(), len(c.closers))
+	}
+	c.Close()
+	if _, err := OpenConsole("serial0", nil); err == nil {
+		t.Errorf("OpenConsole accepted an unknown sink")
+	}
+}
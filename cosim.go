@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// With -cosim the simulator runs in lockstep with a reference, typically
+// an RTL core, that reports the instructions it retires. After each
+// instruction the two are compared and the run stops at the first
+// difference in PC, instruction, register written, memory written or
+// trap. The reference is read from a file, or from a client of a tcp or
+// unix socket, as
+//
+//	spike   a Spike commit log (--log-commits)
+//	rvfi    RVFI execution packets (88 bytes each, see RVFI)
+//
+// Records before the first one at the simulator's start PC are skipped,
+// so a Spike log may include its boot ROM. Spike does not log
+// instructions that trap; when its log has no exception lines such
+// instructions of the simulator are passed over. Interrupts depend on
+// timing and are not synchronised, only the harts' instructions are.
+const cosimContext = 8
+
+// commitSource yields the records of the reference and the text they were
+// read from.
+type commitSource interface {
+	Next() (RVFI, string, error)
+}
+
+type spikeSource struct {
+	s    *bufio.Scanner
+	line int
+}
+
+func (p *spikeSource) Next() (RVFI, string, error) {
+	for p.s.Scan() {
+		p.line++
+		l := p.s.Text()
+		r, ok, err := parseSpike(l)
+		if err != nil {
+			return r, l, fmt.Errorf("line %v: %v", p.line, err)
+		}
+		if ok {
+			return r, l, nil
+		}
+	}
+	if err := p.s.Err(); err != nil {
+		return RVFI{}, "", err
+	}
+	return RVFI{}, "", io.EOF
+}
+
+func parseHex(s string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+}
+
+// parseSpike parses a line of a Spike commit log. ok is false for lines
+// that do not describe an instruction or an exception.
+//
+//	core   0: 3 0x80000010 (0x0062a023) mem 0x80001000 0x00000001
+//	core   0: exception trap_illegal_instruction, epc 0x80000014
+func parseSpike(l string) (r RVFI, ok bool, err error) {
+	f := strings.Fields(l)
+	if (len(f) < 4) || (f[0] != "core") {
+		return r, false, nil
+	}
+	f = f[2:]
+	if f[0] == "exception" {
+		if strings.Contains(f[1], "interrupt") {
+			return r, false, nil
+		}
+		for i := 1; i+1 < len(f); i++ {
+			if f[i] == "epc" {
+				r.PCRData, err = parseHex(f[i+1])
+				r.Trap = 1
+				return r, err == nil, err
+			}
+		}
+		return r, false, fmt.Errorf("exception without epc")
+	}
+	if (len(f) < 3) || (len(f[0]) != 1) || (f[0][0] < '0') || (f[0][0] > '3') {
+		// Instruction trace lines and the like.
+		return r, false, nil
+	}
+	if r.PCRData, err = parseHex(f[1]); err != nil {
+		return r, false, fmt.Errorf("bad pc %v", f[1])
+	}
+	if r.Insn, err = parseHex(strings.Trim(f[2], "()")); err != nil {
+		return r, false, fmt.Errorf("bad instruction %v", f[2])
+	}
+	for i := 3; i < len(f); {
+		switch {
+		case f[i] == "mem":
+			if i+1 >= len(f) {
+				return r, false, fmt.Errorf("mem without address")
+			}
+			addr, err := parseHex(f[i+1])
+			if err != nil {
+				return r, false, fmt.Errorf("bad address %v", f[i+1])
+			}
+			i += 2
+			if (i < len(f)) && strings.HasPrefix(f[i], "0x") {
+				// A store, the width of the data gives its size.
+				if r.MemWData, err = parseHex(f[i]); err != nil {
+					return r, false, fmt.Errorf("bad data %v", f[i])
+				}
+				r.MemAddr = addr
+				r.MemWMask = uint8(1<<uint((len(f[i])-2)/2)) - 1
+				i++
+			}
+		case (len(f[i]) > 1) && (f[i][0] == 'x') && (i+1 < len(f)):
+			n, err := strconv.ParseUint(f[i][1:], 10, 8)
+			if err != nil {
+				return r, false, fmt.Errorf("bad register %v", f[i])
+			}
+			t, err := parseHex(f[i+1])
+			if err != nil {
+				return r, false, fmt.Errorf("bad value %v", f[i+1])
+			}
+			if (n != 0) && (r.RDAddr == 0) {
+				r.RDAddr = uint8(n)
+				r.RDWData = t & 0xffffffff
+			}
+			i += 2
+		default:
+			// CSR and floating point writes.
+			i += 2
+		}
+	}
+	return r, true, nil
+}
+
+type rvfiSource struct {
+	r io.Reader
+}
+
+func (p *rvfiSource) Next() (RVFI, string, error) {
+	r, err := ReadRVFI(p.r)
+	if err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("truncated packet")
+	}
+	return r, r.String(), err
+}
+
+// OpenCosim opens the reference spec, a file name, tcp:HOST:PORT or
+// unix:PATH, in format.
+func OpenCosim(spec string, format string) (commitSource, io.Closer, error) {
+	if (format != "spike") && (format != "rvfi") {
+		return nil, nil, fmt.Errorf("unknown reference format %v", format)
+	}
+	var f io.ReadCloser
+	var err error
+	if i := strings.Index(spec, ":"); (i >= 0) && ((spec[:i] == "tcp") || (spec[:i] == "unix")) {
+		f, err = acceptOne(spec[:i], spec[i+1:])
+	} else {
+		f, err = os.Open(spec)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if format == "rvfi" {
+		return &rvfiSource{bufio.NewReader(f)}, f, nil
+	}
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	return &spikeSource{s: s}, f, nil
+}
+
+// cosimDiff returns the fields in which the simulator's record a differs
+// from the reference's b.
+func cosimDiff(a *RVFI, b *RVFI, spike bool) []string {
+	var d []string
+	if a.PCRData != b.PCRData {
+		d = append(d, "pc")
+	}
+	if a.Trap != b.Trap {
+		d = append(d, "trap")
+	}
+	if (a.Trap != 0) || (b.Trap != 0) {
+		// Spike does not log the instruction of an exception.
+		return d
+	}
+	if a.Insn != b.Insn {
+		d = append(d, "instruction")
+	}
+	if (a.RDAddr != b.RDAddr) || (a.RDWData != b.RDWData) {
+		d = append(d, "rd")
+	}
+	if (a.MemWMask != b.MemWMask) || ((a.MemWMask != 0) && ((a.MemAddr != b.MemAddr) || (a.MemWData != b.MemWData))) {
+		d = append(d, "memory write")
+	}
+	if !spike && (a.PCWData != b.PCWData) {
+		d = append(d, "next pc")
+	}
+	return d
+}
+
+// Cosim runs sim in lockstep with src until the reference ends, the two
+// differ or sim has run steps steps (0 for no limit), and returns the exit
+// status.
+func Cosim(sim *CPU, src commitSource, format string, steps int) int {
+	spike := format == "spike"
+	var context []string
+	show := func(r *RVFI) string {
+		s := r.String()
+		if (r.Trap == 0) && (r.Insn != 0) {
+			ops := sim.Decode(uint32(r.Insn))
+			s = fmt.Sprintf("%-66v %v", s, disasms[ops.Name](&ops, uint32(r.PCRData)))
+		}
+		return s
+	}
+
+	ref, text, err := src.Next()
+	for (err == nil) && (ref.PCRData != uint64(sim.PC)) {
+		ref, text, err = src.Next()
+	}
+	if err == io.EOF {
+		fmt.Fprintf(os.Stderr, "cosim: the reference never reaches pc %08x\n", sim.PC)
+		return 1
+	}
+	n := 0
+	used := 0
+	for ; err == nil; ref, text, err = src.Next() {
+		if sim.Halted {
+			fmt.Fprintf(os.Stderr, "cosim: the simulator halted after %v instructions, the reference goes on with\n  %v\n", n, text)
+			return 1
+		}
+		if (steps != 0) && (used >= steps) {
+			fmt.Fprintf(os.Stderr, "cosim: %v instructions match, stopped after %v steps\n", n, used)
+			return 0
+		}
+		var r RVFI
+		ok := false
+		start := used
+		for !ok {
+			// Steps in wfi, and traps Spike does not log, retire
+			// nothing.
+			if (steps != 0) && (used >= steps) {
+				fmt.Fprintf(os.Stderr, "cosim: the simulator retired nothing in its last %v steps, the reference goes on with\n  %v\n", used-start, text)
+				sim.Dump(os.Stderr)
+				return 1
+			}
+			r, ok = sim.StepRVFI()
+			used++
+			if ok && spike && (r.Trap != 0) && (ref.Trap == 0) {
+				ok = false
+			}
+		}
+		d := cosimDiff(&r, &ref, spike)
+		if len(d) > 0 {
+			fmt.Fprintf(os.Stderr, "cosim: mismatch at instruction %v in %v\n", n, strings.Join(d, ", "))
+			for _, c := range context {
+				fmt.Fprintf(os.Stderr, "  %v\n", c)
+			}
+			fmt.Fprintf(os.Stderr, "simulator: %v\n", show(&r))
+			fmt.Fprintf(os.Stderr, "reference: %v\n", text)
+			sim.Dump(os.Stderr)
+			return 1
+		}
+		if len(context) == cosimContext {
+			context = context[1:]
+		}
+		context = append(context, show(&r))
+		n++
+	}
+	if err != io.EOF {
+		fmt.Fprintf(os.Stderr, "cosim: reference: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "cosim: %v instructions match\n", n)
+	if sim.Halted {
+		return sim.Exit
+	}
+	return 0
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseSpike(t *testing.T) {
+	tests := []struct {
+		line string
+		ok   bool
+		err  bool
+		want RVFI
+	}{
+		{"core   0: 3 0x80000000 (0x800012b7) x5  0x80001000", true, false,
+			RVFI{PCRData: 0x80000000, Insn: 0x800012b7, RDAddr: 5, RDWData: 0x80001000}},
+		{"core   0: 3 0x80000008 (0x0062a023) mem 0x80001000 0x00000005", true, false,
+			RVFI{PCRData: 0x80000008, Insn: 0x0062a023, MemAddr: 0x80001000, MemWData: 5, MemWMask: 0xf}},
+		{"core   0: 3 0x80000010 (0x00629023) mem 0x80001000 0x0005", true, false,
+			RVFI{PCRData: 0x80000010, Insn: 0x00629023, MemAddr: 0x80001000, MemWData: 5, MemWMask: 0x3}},
+		// A load logs its address only.
+		{"core   0: 3 0x8000000c (0x0002a383) x7  0x00000005 mem 0x80001000", true, false,
+			RVFI{PCRData: 0x8000000c, Insn: 0x0002a383, RDAddr: 7, RDWData: 5}},
+		// CSR writes are passed over, x0 is never written.
+		{"core   0: 3 0x80000014 (0x30529073) c773_mtvec 0x80000100 x0  0x00000000", true, false,
+			RVFI{PCRData: 0x80000014, Insn: 0x30529073}},
+		{"core   0: exception trap_illegal_instruction, epc 0x80000018", true, false,
+			RVFI{PCRData: 0x80000018, Trap: 1}},
+		{"core   0: exception interrupt #7, epc 0x80000018", false, false, RVFI{}},
+		{"core   0: 0x80000000 (0x800012b7) lui     t0, 0x80001", false, false, RVFI{}},
+		{"bbl loader", false, false, RVFI{}},
+		{"", false, false, RVFI{}},
+		{"core   0: exception trap_illegal_instruction", false, true, RVFI{}},
+		{"core   0: 3 0x8000000g (0x800012b7)", false, true, RVFI{}},
+		{"core   0: 3 0x80000000 (0x800012bz)", false, true, RVFI{}},
+		{"core   0: 3 0x80000000 (0x0062a023) mem", false, true, RVFI{}},
+		{"core   0: 3 0x80000000 (0x800012b7) x5  0x8000100z", false, true, RVFI{}},
+	}
+	for _, tt := range tests {
+		r, ok, err := parseSpike(tt.line)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: error %v", tt.line, err)
+			continue
+		}
+		if ok != tt.ok {
+			t.Errorf("%q: ok %v, want %v", tt.line, ok, tt.ok)
+		}
+		if ok && (r != tt.want) {
+			t.Errorf("%q: %+v, want %+v", tt.line, r, tt.want)
+		}
+	}
+}
+
+// cosimProg stores 5 and loads it back.
+var cosimProg = []uint32{
+	encU(0x37, 5, 0x80001000), // lui t0, 0x80001
+	encI(0x13, 0, 6, 0, 5),    // li t1, 5
+	encS(2, 5, 6, 0),          // sw t1, 0(t0)
+	encI(0x03, 2, 7, 5, 0),    // lw t2, 0(t0)
+}
+
+// cosimLog is the Spike commit log of cosimProg, after two boot ROM
+// instructions.
+var cosimLog = []string{
+	"core   0: 3 0x00001000 (0x00000297) x5  0x00001000",
+	"core   0: 3 0x00001004 (0x02028593) x11 0x00001020",
+	"core   0: 3 0x80000000 (0x800012b7) x5  0x80001000",
+	"core   0: 3 0x80000004 (0x00500313) x6  0x00000005",
+	"core   0: 3 0x80000008 (0x0062a023) mem 0x80001000 0x00000005",
+	"core   0: 3 0x8000000c (0x0002a383) x7  0x00000005 mem 0x80001000",
+}
+
+func TestCosim(t *testing.T) {
+	null, err := os.Create(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	stderr := os.Stderr
+	os.Stderr = null
+	defer func() { os.Stderr = stderr }()
+
+	edit := func(i int, old string, new string) string {
+		l := append([]string(nil), cosimLog...)
+		l[i] = strings.Replace(l[i], old, new, 1)
+		return strings.Join(l, "\n")
+	}
+	tests := []struct {
+		name  string
+		log   string
+		steps int
+		want  int
+	}{
+		{"match", strings.Join(cosimLog, "\n"), 0, 0},
+		// The mismatch is after the last step.
+		{"steps", edit(5, "0x8000000c", "0x80000010"), 3, 0},
+		{"register", edit(3, "x6  0x00000005", "x6  0x00000006"), 0, 1},
+		{"rd", edit(3, "x6 ", "x7 "), 0, 1},
+		{"store data", edit(4, "0x80001000 0x00000005", "0x80001000 0x00000004"), 0, 1},
+		{"store size", edit(4, "0x80001000 0x00000005", "0x80001000 0x0005"), 0, 1},
+		{"instruction", edit(5, "0x0002a383", "0x0002a303"), 0, 1},
+		{"pc", edit(5, "0x8000000c", "0x80000010"), 0, 1},
+		{"trap", edit(5, "3 0x8000000c (0x0002a383) x7  0x00000005 mem 0x80001000",
+			"exception trap_load_access_fault, epc 0x8000000c"), 0, 1},
+		{"no start", strings.Join(cosimLog[:2], "\n"), 0, 1},
+		{"bad line", edit(4, "mem 0x80001000 0x00000005", "mem"), 0, 1},
+	}
+	for _, tt := range tests {
+		p := newTestCPU(t)
+		loadProgram([]*CPU{p}, cosimProg)
+		src := &spikeSource{s: bufio.NewScanner(strings.NewReader(tt.log))}
+		if got := Cosim(p, src, "spike", tt.steps); got != tt.want {
+			t.Errorf("%v: status %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
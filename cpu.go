@@ -1,40 +1,130 @@
 package main
 
 import (
-	"fmt"
 	"encoding/binary"
+	"fmt"
 	"os"
 )
 
 const (
-	CSR_ADDR_MVENDORID       = 0xF11
-	CSR_ADDR_MARCHID         = 0xF12
-	CSR_ADDR_MIMPID          = 0xF13
-	CSR_ADDR_MHARTID         = 0xF14
-	CSR_ADDR_MSTATUS         = 0x300
-	CSR_ADDR_MISA            = 0x301
-	CSR_ADDR_MEDELEG         = 0x302
-	CSR_ADDR_MIDELEG         = 0x303
-	CSR_ADDR_MIE             = 0x304
-	CSR_ADDR_MTVEC           = 0x305
-	CSR_ADDR_MCOUNTEREN      = 0x306
-	CSR_ADDR_MEPC            = 0x341
-	CSR_ADDR_MCAUSE          = 0x342
-	CSR_ADDR_MTVAL           = 0x343
-	CSR_ADDR_MIP             = 0x344
-	EXCEPT_CODE_ILLEGAL_INST = 0x00000002
-	EXCEPT_CODE_BREAKPOINT   = 0x00000003
-	EXCEPT_CODE_ECALL_FROM_M = 0x0000000b
+	CSR_ADDR_SSTATUS               = 0x100
+	CSR_ADDR_SIE                   = 0x104
+	CSR_ADDR_STVEC                 = 0x105
+	CSR_ADDR_SCOUNTEREN            = 0x106
+	CSR_ADDR_SSCRATCH              = 0x140
+	CSR_ADDR_SEPC                  = 0x141
+	CSR_ADDR_SCAUSE                = 0x142
+	CSR_ADDR_STVAL                 = 0x143
+	CSR_ADDR_SIP                   = 0x144
+	CSR_ADDR_SATP                  = 0x180
+	CSR_ADDR_MVENDORID             = 0xF11
+	CSR_ADDR_MARCHID               = 0xF12
+	CSR_ADDR_MIMPID                = 0xF13
+	CSR_ADDR_MHARTID               = 0xF14
+	CSR_ADDR_MSTATUS               = 0x300
+	CSR_ADDR_MISA                  = 0x301
+	CSR_ADDR_MEDELEG               = 0x302
+	CSR_ADDR_MIDELEG               = 0x303
+	CSR_ADDR_MIE                   = 0x304
+	CSR_ADDR_MTVEC                 = 0x305
+	CSR_ADDR_MCOUNTEREN            = 0x306
+	CSR_ADDR_MSTATUSH              = 0x310
+	CSR_ADDR_MCOUNTINHIBIT         = 0x320
+	CSR_ADDR_MHPMEVENT3            = 0x323
+	CSR_ADDR_MHPMEVENT31           = 0x33F
+	CSR_ADDR_MSCRATCH              = 0x340
+	CSR_ADDR_MEPC                  = 0x341
+	CSR_ADDR_MCAUSE                = 0x342
+	CSR_ADDR_MTVAL                 = 0x343
+	CSR_ADDR_MIP                   = 0x344
+	CSR_ADDR_PMPCFG0               = 0x3A0
+	CSR_ADDR_PMPCFG3               = 0x3A3
+	CSR_ADDR_PMPADDR0              = 0x3B0
+	CSR_ADDR_PMPADDR15             = 0x3BF
+	CSR_ADDR_MCYCLE                = 0xB00
+	CSR_ADDR_MINSTRET              = 0xB02
+	CSR_ADDR_MHPMCOUNTER31         = 0xB1F
+	CSR_ADDR_MCYCLEH               = 0xB80
+	CSR_ADDR_MINSTRETH             = 0xB82
+	CSR_ADDR_MHPMCOUNTER31H        = 0xB9F
+	CSR_ADDR_CYCLE                 = 0xC00
+	CSR_ADDR_TIME                  = 0xC01
+	CSR_ADDR_INSTRET               = 0xC02
+	CSR_ADDR_HPMCOUNTER31          = 0xC1F
+	CSR_ADDR_CYCLEH                = 0xC80
+	CSR_ADDR_TIMEH                 = 0xC81
+	CSR_ADDR_INSTRETH              = 0xC82
+	CSR_ADDR_HPMCOUNTER31H         = 0xC9F
+	EXCEPT_CODE_INST_MISALIGNED    = 0x00000000
+	EXCEPT_CODE_INST_ACCESS_FAULT  = 0x00000001
+	EXCEPT_CODE_ILLEGAL_INST       = 0x00000002
+	EXCEPT_CODE_BREAKPOINT         = 0x00000003
+	EXCEPT_CODE_LOAD_MISALIGNED    = 0x00000004
+	EXCEPT_CODE_LOAD_ACCESS_FAULT  = 0x00000005
+	EXCEPT_CODE_STORE_MISALIGNED   = 0x00000006
+	EXCEPT_CODE_STORE_ACCESS_FAULT = 0x00000007
+	EXCEPT_CODE_ECALL_FROM_U       = 0x00000008
+	EXCEPT_CODE_ECALL_FROM_S       = 0x00000009
+	EXCEPT_CODE_ECALL_FROM_M       = 0x0000000b
+	EXCEPT_CODE_INST_PAGE_FAULT    = 0x0000000c
+	EXCEPT_CODE_LOAD_PAGE_FAULT    = 0x0000000d
+	EXCEPT_CODE_STORE_PAGE_FAULT   = 0x0000000f
+	INTR_CODE_S_SOFTWARE           = 0x80000001
+	INTR_CODE_M_SOFTWARE           = 0x80000003
+	INTR_CODE_S_TIMER              = 0x80000005
+	INTR_CODE_M_TIMER              = 0x80000007
+	INTR_CODE_S_EXTERNAL           = 0x80000009
+	INTR_CODE_M_EXTERNAL           = 0x8000000b
+)
+
+const (
+	PRIV_U = 0
+	PRIV_S = 1
+	PRIV_M = 3
 )
 
 const (
-	resetVec = 0x80000000
+	MISA_MXL_32  = 0x40000000
+	MISA_A       = 0x00000001
+	MISA_I       = 0x00000100
+	MISA_M       = 0x00001000
+	MISA_S       = 0x00040000
+	MISA_U       = 0x00100000
+	MSTATUS_SIE  = 0x00000002
+	MSTATUS_MIE  = 0x00000008
+	MSTATUS_SPIE = 0x00000020
+	MSTATUS_MPIE = 0x00000080
+	MSTATUS_SPP  = 0x00000100
+	MSTATUS_MPP  = 0x00001800
+	MSTATUS_MPRV = 0x00020000
+	MSTATUS_SUM  = 0x00040000
+	MSTATUS_MXR  = 0x00080000
+	MSTATUS_TVM  = 0x00100000
+	MSTATUS_TW   = 0x00200000
+	MSTATUS_TSR  = 0x00400000
+	MIP_SSIP     = 0x00000002
+	MIP_MSIP     = 0x00000008
+	MIP_STIP     = 0x00000020
+	MIP_MTIP     = 0x00000080
+	MIP_SEIP     = 0x00000200
+	MIP_MEIP     = 0x00000800
 )
 
+// Interrupts in decreasing priority.
+var interruptOrder = [...]uint32{
+	INTR_CODE_M_EXTERNAL,
+	INTR_CODE_M_SOFTWARE,
+	INTR_CODE_M_TIMER,
+	INTR_CODE_S_EXTERNAL,
+	INTR_CODE_S_SOFTWARE,
+	INTR_CODE_S_TIMER,
+}
+
 const (
 	EI_CLASS  = 4
 	EI_DATA   = 5
 	EI_NIDENT = 16
+	PT_LOAD   = 1
 )
 
 type FileHeader struct {
@@ -67,6 +157,8 @@ type ProgramHeader struct {
 
 type Ops struct {
 	Name   string
+	Exec   func(cpu *CPU, ops *Ops)
+	Inst   uint32
 	Imm    uint32
 	Rs1    uint32
 	Rs2    uint32
@@ -78,10 +170,35 @@ type Ops struct {
 }
 
 type CPU struct {
-	PC   uint32
-	Regs []uint32
-	CSRs []uint32
-	bus *Bus
+	hart      int
+	PC        uint32
+	Regs      []uint32
+	CSRs      []uint32
+	Priv      uint32
+	Wfi       bool
+	Halted    bool
+	Exit      int
+	Cycle     uint64
+	Instret   uint64
+	instretW  bool // the instruction being executed wrote minstret
+	seip      bool
+	resAddr   uint32
+	resVer    uint32 // version of the reservation slot with -parallel
+	resOk     bool
+	tlb       map[uint32]tlbEntry
+	tlbGen    uint32
+	proxy     *Proxy
+	semihost  *Semihost
+	icache    *ICache
+	lastBlock *Block
+	bus       *Bus
+
+	// traps counts the traps taken, so that a step can tell whether it
+	// trapped.
+	traps uint64
+
+	// images lists the memory taken by the images loaded at boot.
+	images []extent
 }
 
 var _ = fmt.Println
@@ -93,28 +210,40 @@ func sext(imm uint32, bitwidth uint32) int32 {
 	return signed >> shift
 }
 
-func NewCPU() *CPU {
-	bus := NewBus()
+// NewCPU adds the next hart to bus. Hart IDs are assigned in order from 0.
+func NewCPU(bus *Bus) *CPU {
 	regs := make([]uint32, 32)
 	csrs := make([]uint32, 4096)
-	return &CPU{0, regs, csrs, bus}
+	csrs[CSR_ADDR_MISA] = bus.machine.Misa()
+	tlb := make(map[uint32]tlbEntry)
+	hart := len(bus.harts)
+	csrs[CSR_ADDR_MHARTID] = uint32(hart)
+	cpu := &CPU{hart: hart, Regs: regs, CSRs: csrs, Priv: PRIV_M, tlb: tlb, icache: bus.icache, bus: bus}
+	bus.harts = append(bus.harts, cpu)
+	return cpu
 }
 
-func (p *CPU) LoadElf(filename string) {
+// LoadElf loads the PT_LOAD segments of an ELF32 file at their physical
+// addresses and sets PC to the entry point.
+func (p *CPU) LoadElf(filename string) error {
 	t := make([]byte, 1)
-	file, _ := os.Open(filename)
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
 	var ident [16]uint8
 	if _, err := file.ReadAt(ident[0:], 0); err != nil {
-		return
+		return err
 	}
 	if ident[0] != '\x7f' || ident[1] != 'E' || ident[2] != 'L' || ident[3] != 'F' {
-		return
+		return fmt.Errorf("%v: not an ELF file", filename)
 	}
 
 	eiClass := ident[EI_CLASS]
 	if eiClass != 1 { /* not LFCLASS32 */
-		return
+		return fmt.Errorf("%v: not a 32-bit ELF file", filename)
 	}
 
 	eiData := ident[EI_DATA]
@@ -126,13 +255,13 @@ func (p *CPU) LoadElf(filename string) {
 	case 2: /* big-endian */
 		byteOrder = binary.BigEndian
 	default:
-		return
+		return fmt.Errorf("%v: unknown byte order", filename)
 	}
 
 	fileHdr := new(FileHeader)
 	file.Seek(0, os.SEEK_SET)
 	if err := binary.Read(file, byteOrder, fileHdr); err != nil {
-		return
+		return err
 	}
 
 	progHdr := new(ProgramHeader)
@@ -140,281 +269,852 @@ func (p *CPU) LoadElf(filename string) {
 	for i := 0; i < int(fileHdr.Phnum); i++ {
 		file.Seek(int64(fileHdr.Phoff+uint32(phOff)), os.SEEK_SET)
 		if err := binary.Read(file, byteOrder, progHdr); err != nil {
-			return
+			return err
 		}
 		phOff += 32
-		pVaddr := uint32(progHdr.Vaddr)
+		if progHdr.Type != PT_LOAD {
+			continue
+		}
+		pAddr := uint32(progHdr.Paddr)
+		if err := p.checkLoad(filename, pAddr, progHdr.Memsz); err != nil {
+			return err
+		}
+		p.loaded(filename, pAddr, uint32(progHdr.Memsz))
 		file.Seek(int64(progHdr.Off), os.SEEK_SET)
 		for j := 0; j < int(progHdr.Memsz); j++ {
-			file.Read(t)
-			p.bus.WriteByte(pVaddr, uint8(t[0]))
-			pVaddr++
+			t[0] = 0
+			if j < int(progHdr.Filesz) {
+				file.Read(t)
+			}
+			p.bus.WriteByte(pAddr, uint8(t[0]))
+			pAddr++
 		}
 	}
 	p.PC = uint32(fileHdr.Entry)
+	return nil
+}
+
+// Halt stops the simulation with the given exit status.
+func (p *CPU) Halt(code int) {
+	p.Halted = true
+	p.Exit = code
 }
 
 func (p *CPU) Reset() {
-	p.PC = resetVec
+	p.PC = p.bus.ramBase
+	if p.bus.machine.HasReset {
+		p.PC = p.bus.machine.Reset
+	}
+	p.Priv = PRIV_M
 }
 
 var instructions = map[string]func(cpu *CPU, ops *Ops){
-	"lui": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, ops.Imm)
-		cpu.PC = cpu.PC + 4
-	},
-	"auipc": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, cpu.PC+ops.Imm)
-		cpu.PC = cpu.PC + 4
-	},
-	"jal": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, cpu.PC+4)
-		cpu.PC = cpu.PC + ops.Imm
-	},
-	"jalr": func(cpu *CPU, ops *Ops) {
-		t := cpu.PC + 4
-		cpu.PC = (cpu.Regs[ops.Rs1] + ops.Imm) & 0xfffffffe
+	"lui":                 execLui,
+	"auipc":               execAuipc,
+	"jal":                 execJal,
+	"jalr":                execJalr,
+	"beq":                 execBeq,
+	"bne":                 execBne,
+	"blt":                 execBlt,
+	"bge":                 execBge,
+	"bltu":                execBltu,
+	"bgeu":                execBgeu,
+	"lb":                  execLb,
+	"lh":                  execLh,
+	"lw":                  execLw,
+	"lbu":                 execLbu,
+	"lhu":                 execLhu,
+	"sb":                  execSb,
+	"sh":                  execSh,
+	"sw":                  execSw,
+	"addi":                execAddi,
+	"slti":                execSlti,
+	"sltiu":               execSltiu,
+	"xori":                execXori,
+	"ori":                 execOri,
+	"andi":                execAndi,
+	"slli":                execSlli,
+	"srli":                execSrli,
+	"srai":                execSrai,
+	"add":                 execAdd,
+	"sub":                 execSub,
+	"sll":                 execSll,
+	"slt":                 execSlt,
+	"sltu":                execSltu,
+	"xor":                 execXor,
+	"srl":                 execSrl,
+	"sra":                 execSra,
+	"or":                  execOr,
+	"and":                 execAnd,
+	"mul":                 execMul,
+	"mulh":                execMulh,
+	"mulhsu":              execMulhsu,
+	"mulhu":               execMulhu,
+	"div":                 execDiv,
+	"divu":                execDivu,
+	"rem":                 execRem,
+	"remu":                execRemu,
+	"lr_w":                execLrW,
+	"sc_w":                execScW,
+	"amoswap_w":           execAmoswapW,
+	"amoadd_w":            execAmoaddW,
+	"amoxor_w":            execAmoxorW,
+	"amoand_w":            execAmoandW,
+	"amoor_w":             execAmoorW,
+	"amomin_w":            execAmominW,
+	"amomax_w":            execAmomaxW,
+	"amominu_w":           execAmominuW,
+	"amomaxu_w":           execAmomaxuW,
+	"fence":               execFence,
+	"fence_i":             execFenceI,
+	"ecall":               execEcall,
+	"ebreak":              execEbreak,
+	"mret":                execMret,
+	"sret":                execSret,
+	"wfi":                 execWfi,
+	"sfence_vma":          execSfenceVma,
+	"csrrw":               execCsrrw,
+	"csrrs":               execCsrrs,
+	"csrrc":               execCsrrc,
+	"csrrwi":              execCsrrwi,
+	"csrrsi":              execCsrrsi,
+	"csrrci":              execCsrrci,
+	"illegal_instruction": execIllegalInstruction,
+}
+
+func execLui(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, ops.Imm)
+	cpu.PC = cpu.PC + 4
+}
+
+func execAuipc(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, cpu.PC+ops.Imm)
+	cpu.PC = cpu.PC + 4
+}
+
+func execJal(cpu *CPU, ops *Ops) {
+	t := cpu.PC + 4
+	if cpu.jump(cpu.PC + ops.Imm) {
 		cpu.RegWrite(ops.Rd, t)
-	},
-	"beq": func(cpu *CPU, ops *Ops) {
-		if cpu.Regs[ops.Rs1] == cpu.Regs[ops.Rs2] {
-			cpu.PC = cpu.PC + ops.Imm
-		} else {
-			cpu.PC = cpu.PC + 4
-		}
-	},
-	"bne": func(cpu *CPU, ops *Ops) {
-		if cpu.Regs[ops.Rs1] != cpu.Regs[ops.Rs2] {
-			cpu.PC = cpu.PC + ops.Imm
-		} else {
-			cpu.PC = cpu.PC + 4
-		}
-	},
-	"blt": func(cpu *CPU, ops *Ops) {
-		if int32(cpu.Regs[ops.Rs1]) < int32(cpu.Regs[ops.Rs2]) {
-			cpu.PC = cpu.PC + ops.Imm
-		} else {
-			cpu.PC = cpu.PC + 4
-		}
-	},
-	"bge": func(cpu *CPU, ops *Ops) {
-		if int32(cpu.Regs[ops.Rs1]) >= int32(cpu.Regs[ops.Rs2]) {
-			cpu.PC = cpu.PC + ops.Imm
-		} else {
-			cpu.PC = cpu.PC + 4
-		}
-	},
-	"bltu": func(cpu *CPU, ops *Ops) {
-		if cpu.Regs[ops.Rs1] < cpu.Regs[ops.Rs2] {
-			cpu.PC = cpu.PC + ops.Imm
-		} else {
-			cpu.PC = cpu.PC + 4
-		}
-	},
-	"bgeu": func(cpu *CPU, ops *Ops) {
-		if cpu.Regs[ops.Rs1] >= cpu.Regs[ops.Rs2] {
-			cpu.PC = cpu.PC + ops.Imm
-		} else {
-			cpu.PC = cpu.PC + 4
-		}
-	},
-	"lb": func(cpu *CPU, ops *Ops) {
-		t := cpu.bus.ReadByte(cpu.Regs[ops.Rs1] + ops.Imm)
-		cpu.RegWrite(ops.Rd, uint32(sext(uint32(t), 8)))
-		cpu.PC = cpu.PC + 4
-	},
-	"lh": func(cpu *CPU, ops *Ops) {
-		t := cpu.bus.ReadHalf(cpu.Regs[ops.Rs1] + ops.Imm)
-		cpu.RegWrite(ops.Rd, uint32(sext(uint32(t), 16)))
+	}
+}
+
+func execJalr(cpu *CPU, ops *Ops) {
+	t := cpu.PC + 4
+	if cpu.jump((cpu.Regs[ops.Rs1] + ops.Imm) & 0xfffffffe) {
+		cpu.RegWrite(ops.Rd, t)
+	}
+}
+
+func execBeq(cpu *CPU, ops *Ops) {
+	if cpu.Regs[ops.Rs1] == cpu.Regs[ops.Rs2] {
+		cpu.jump(cpu.PC + ops.Imm)
+	} else {
 		cpu.PC = cpu.PC + 4
-	},
-	"lw": func(cpu *CPU, ops *Ops) {
-		t := cpu.bus.ReadWord(cpu.Regs[ops.Rs1]+ops.Imm) & 0xffffffff
-		cpu.RegWrite(ops.Rd, uint32(sext(t, 32)))
+	}
+}
+
+func execBne(cpu *CPU, ops *Ops) {
+	if cpu.Regs[ops.Rs1] != cpu.Regs[ops.Rs2] {
+		cpu.jump(cpu.PC + ops.Imm)
+	} else {
 		cpu.PC = cpu.PC + 4
-	},
-	"lbu": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, uint32(cpu.bus.ReadByte(cpu.Regs[ops.Rs1]+ops.Imm)))
+	}
+}
+
+func execBlt(cpu *CPU, ops *Ops) {
+	if int32(cpu.Regs[ops.Rs1]) < int32(cpu.Regs[ops.Rs2]) {
+		cpu.jump(cpu.PC + ops.Imm)
+	} else {
 		cpu.PC = cpu.PC + 4
-	},
-	"lhu": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, uint32(cpu.bus.ReadHalf(cpu.Regs[ops.Rs1]+ops.Imm)))
+	}
+}
+
+func execBge(cpu *CPU, ops *Ops) {
+	if int32(cpu.Regs[ops.Rs1]) >= int32(cpu.Regs[ops.Rs2]) {
+		cpu.jump(cpu.PC + ops.Imm)
+	} else {
 		cpu.PC = cpu.PC + 4
-	},
-	"sb": func(cpu *CPU, ops *Ops) {
-		cpu.bus.WriteByte(cpu.Regs[ops.Rs1]+ops.Imm, uint8(cpu.Regs[ops.Rs2]&0xff))
+	}
+}
+
+func execBltu(cpu *CPU, ops *Ops) {
+	if cpu.Regs[ops.Rs1] < cpu.Regs[ops.Rs2] {
+		cpu.jump(cpu.PC + ops.Imm)
+	} else {
 		cpu.PC = cpu.PC + 4
-	},
-	"sh": func(cpu *CPU, ops *Ops) {
-		cpu.bus.WriteHalf(cpu.Regs[ops.Rs1]+ops.Imm, uint16(cpu.Regs[ops.Rs2]&0xffff))
+	}
+}
+
+func execBgeu(cpu *CPU, ops *Ops) {
+	if cpu.Regs[ops.Rs1] >= cpu.Regs[ops.Rs2] {
+		cpu.jump(cpu.PC + ops.Imm)
+	} else {
 		cpu.PC = cpu.PC + 4
-	},
-	"sw": func(cpu *CPU, ops *Ops) {
-		cpu.bus.WriteWord(cpu.Regs[ops.Rs1]+ops.Imm, cpu.Regs[ops.Rs2]&0xffffffff)
+	}
+}
+
+func execLb(cpu *CPU, ops *Ops) {
+	t, ok := cpu.Load(cpu.Regs[ops.Rs1]+ops.Imm, 1)
+	if !ok {
+		return
+	}
+	cpu.RegWrite(ops.Rd, uint32(sext(t, 8)))
+	cpu.PC = cpu.PC + 4
+}
+
+func execLh(cpu *CPU, ops *Ops) {
+	t, ok := cpu.Load(cpu.Regs[ops.Rs1]+ops.Imm, 2)
+	if !ok {
+		return
+	}
+	cpu.RegWrite(ops.Rd, uint32(sext(t, 16)))
+	cpu.PC = cpu.PC + 4
+}
+
+func execLw(cpu *CPU, ops *Ops) {
+	t, ok := cpu.Load(cpu.Regs[ops.Rs1]+ops.Imm, 4)
+	if !ok {
+		return
+	}
+	cpu.RegWrite(ops.Rd, t)
+	cpu.PC = cpu.PC + 4
+}
+
+func execLbu(cpu *CPU, ops *Ops) {
+	t, ok := cpu.Load(cpu.Regs[ops.Rs1]+ops.Imm, 1)
+	if !ok {
+		return
+	}
+	cpu.RegWrite(ops.Rd, t)
+	cpu.PC = cpu.PC + 4
+}
+
+func execLhu(cpu *CPU, ops *Ops) {
+	t, ok := cpu.Load(cpu.Regs[ops.Rs1]+ops.Imm, 2)
+	if !ok {
+		return
+	}
+	cpu.RegWrite(ops.Rd, t)
+	cpu.PC = cpu.PC + 4
+}
+
+func execSb(cpu *CPU, ops *Ops) {
+	if !cpu.Store(cpu.Regs[ops.Rs1]+ops.Imm, 1, cpu.Regs[ops.Rs2]) {
+		return
+	}
+	cpu.PC = cpu.PC + 4
+}
+
+func execSh(cpu *CPU, ops *Ops) {
+	if !cpu.Store(cpu.Regs[ops.Rs1]+ops.Imm, 2, cpu.Regs[ops.Rs2]) {
+		return
+	}
+	cpu.PC = cpu.PC + 4
+}
+
+func execSw(cpu *CPU, ops *Ops) {
+	if !cpu.Store(cpu.Regs[ops.Rs1]+ops.Imm, 4, cpu.Regs[ops.Rs2]) {
+		return
+	}
+	cpu.PC = cpu.PC + 4
+}
+
+func execAddi(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]+ops.Imm)
+	cpu.PC = cpu.PC + 4
+}
+
+func execSlti(cpu *CPU, ops *Ops) {
+	if int32(cpu.Regs[ops.Rs1]) < int32(ops.Imm) {
+		cpu.RegWrite(ops.Rd, 1)
+	} else {
+		cpu.RegWrite(ops.Rd, 0)
+	}
+	cpu.PC = cpu.PC + 4
+}
+
+func execSltiu(cpu *CPU, ops *Ops) {
+	if cpu.Regs[ops.Rs1] < ops.Imm {
+		cpu.RegWrite(ops.Rd, 1)
+	} else {
+		cpu.RegWrite(ops.Rd, 0)
+	}
+	cpu.PC = cpu.PC + 4
+}
+
+func execXori(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]^ops.Imm)
+	cpu.PC = cpu.PC + 4
+}
+
+func execOri(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]|ops.Imm)
+	cpu.PC = cpu.PC + 4
+}
+
+func execAndi(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]&ops.Imm)
+	cpu.PC = cpu.PC + 4
+}
+
+func execSlli(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]<<ops.Shamt)
+	cpu.PC = cpu.PC + 4
+}
+
+func execSrli(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]>>ops.Shamt)
+	cpu.PC = cpu.PC + 4
+}
+
+func execSrai(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, uint32(int32(cpu.Regs[ops.Rs1])>>ops.Shamt))
+	cpu.PC = cpu.PC + 4
+}
+
+func execAdd(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]+cpu.Regs[ops.Rs2])
+	cpu.PC = cpu.PC + 4
+}
+
+func execSub(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]-cpu.Regs[ops.Rs2])
+	cpu.PC = cpu.PC + 4
+}
+
+func execSll(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]<<(cpu.Regs[ops.Rs2]&0x1f))
+	cpu.PC = cpu.PC + 4
+}
+
+func execSlt(cpu *CPU, ops *Ops) {
+	if int32(cpu.Regs[ops.Rs1]) < int32(cpu.Regs[ops.Rs2]) {
+		cpu.RegWrite(ops.Rd, 1)
+	} else {
+		cpu.RegWrite(ops.Rd, 0)
+	}
+	cpu.PC = cpu.PC + 4
+}
+
+func execSltu(cpu *CPU, ops *Ops) {
+	if cpu.Regs[ops.Rs1] < cpu.Regs[ops.Rs2] {
+		cpu.RegWrite(ops.Rd, 1)
+	} else {
+		cpu.RegWrite(ops.Rd, 0)
+	}
+	cpu.PC = cpu.PC + 4
+}
+
+func execXor(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]^cpu.Regs[ops.Rs2])
+	cpu.PC = cpu.PC + 4
+}
+
+func execSrl(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]>>(cpu.Regs[ops.Rs2]&0x1f))
+	cpu.PC = cpu.PC + 4
+}
+
+func execSra(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, uint32(int32(cpu.Regs[ops.Rs1])>>(cpu.Regs[ops.Rs2]&0x1f)))
+	cpu.PC = cpu.PC + 4
+}
+
+func execOr(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]|cpu.Regs[ops.Rs2])
+	cpu.PC = cpu.PC + 4
+}
+
+func execAnd(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]&cpu.Regs[ops.Rs2])
+	cpu.PC = cpu.PC + 4
+}
+
+func execMul(cpu *CPU, ops *Ops) {
+	cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]*cpu.Regs[ops.Rs2])
+	cpu.PC = cpu.PC + 4
+}
+
+func execMulh(cpu *CPU, ops *Ops) {
+	t := int64(int32(cpu.Regs[ops.Rs1])) * int64(int32(cpu.Regs[ops.Rs2]))
+	cpu.RegWrite(ops.Rd, uint32(t>>32))
+	cpu.PC = cpu.PC + 4
+}
+
+func execMulhsu(cpu *CPU, ops *Ops) {
+	t := int64(int32(cpu.Regs[ops.Rs1])) * int64(cpu.Regs[ops.Rs2])
+	cpu.RegWrite(ops.Rd, uint32(t>>32))
+	cpu.PC = cpu.PC + 4
+}
+
+func execMulhu(cpu *CPU, ops *Ops) {
+	t := uint64(cpu.Regs[ops.Rs1]) * uint64(cpu.Regs[ops.Rs2])
+	cpu.RegWrite(ops.Rd, uint32(t>>32))
+	cpu.PC = cpu.PC + 4
+}
+
+func execDiv(cpu *CPU, ops *Ops) {
+	a := int32(cpu.Regs[ops.Rs1])
+	b := int32(cpu.Regs[ops.Rs2])
+	switch {
+	case b == 0:
+		cpu.RegWrite(ops.Rd, 0xffffffff)
+	case (a == -0x80000000) && (b == -1):
+		cpu.RegWrite(ops.Rd, uint32(a))
+	default:
+		cpu.RegWrite(ops.Rd, uint32(a/b))
+	}
+	cpu.PC = cpu.PC + 4
+}
+
+func execDivu(cpu *CPU, ops *Ops) {
+	if cpu.Regs[ops.Rs2] == 0 {
+		cpu.RegWrite(ops.Rd, 0xffffffff)
+	} else {
+		cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]/cpu.Regs[ops.Rs2])
+	}
+	cpu.PC = cpu.PC + 4
+}
+
+func execRem(cpu *CPU, ops *Ops) {
+	a := int32(cpu.Regs[ops.Rs1])
+	b := int32(cpu.Regs[ops.Rs2])
+	switch {
+	case b == 0:
+		cpu.RegWrite(ops.Rd, uint32(a))
+	case (a == -0x80000000) && (b == -1):
+		cpu.RegWrite(ops.Rd, 0)
+	default:
+		cpu.RegWrite(ops.Rd, uint32(a%b))
+	}
+	cpu.PC = cpu.PC + 4
+}
+
+func execRemu(cpu *CPU, ops *Ops) {
+	if cpu.Regs[ops.Rs2] == 0 {
+		cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1])
+	} else {
+		cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]%cpu.Regs[ops.Rs2])
+	}
+	cpu.PC = cpu.PC + 4
+}
+
+func execLrW(cpu *CPU, ops *Ops) {
+	addr := cpu.Regs[ops.Rs1]
+	if addr&0x3 != 0 {
+		cpu.Trap(EXCEPT_CODE_LOAD_MISALIGNED, addr)
+		return
+	}
+	paddr, cause, ok := cpu.Translate(addr, accessLoad)
+	if !ok {
+		cpu.Trap(cause, addr)
+		return
+	}
+	t, ok := cpu.loadReserved(addr, paddr)
+	if !ok {
+		return
+	}
+	cpu.resAddr = paddr
+	cpu.resOk = true
+	cpu.RegWrite(ops.Rd, t)
+	cpu.PC = cpu.PC + 4
+}
+
+func execScW(cpu *CPU, ops *Ops) {
+	addr := cpu.Regs[ops.Rs1]
+	if addr&0x3 != 0 {
+		cpu.Trap(EXCEPT_CODE_STORE_MISALIGNED, addr)
+		return
+	}
+	paddr, cause, ok := cpu.Translate(addr, accessStore)
+	if !ok {
+		cpu.Trap(cause, addr)
+		return
+	}
+	stored := false
+	if cpu.resOk && (cpu.resAddr == paddr) {
+		if stored, ok = cpu.storeConditional(addr, paddr, cpu.Regs[ops.Rs2]); !ok {
+			return
+		}
+	}
+	if stored {
+		cpu.RegWrite(ops.Rd, 0)
+	} else {
+		cpu.RegWrite(ops.Rd, 1)
+	}
+	cpu.resOk = false
+	cpu.PC = cpu.PC + 4
+}
+
+func execAmoswapW(cpu *CPU, ops *Ops) {
+	cpu.amo(ops, func(a, b uint32) uint32 { return b })
+}
+
+func execAmoaddW(cpu *CPU, ops *Ops) {
+	cpu.amo(ops, func(a, b uint32) uint32 { return a + b })
+}
+
+func execAmoxorW(cpu *CPU, ops *Ops) {
+	cpu.amo(ops, func(a, b uint32) uint32 { return a ^ b })
+}
+
+func execAmoandW(cpu *CPU, ops *Ops) {
+	cpu.amo(ops, func(a, b uint32) uint32 { return a & b })
+}
+
+func execAmoorW(cpu *CPU, ops *Ops) {
+	cpu.amo(ops, func(a, b uint32) uint32 { return a | b })
+}
+
+func execAmominW(cpu *CPU, ops *Ops) {
+	cpu.amo(ops, func(a, b uint32) uint32 {
+		if int32(a) < int32(b) {
+			return a
+		}
+		return b
+	})
+}
+
+func execAmomaxW(cpu *CPU, ops *Ops) {
+	cpu.amo(ops, func(a, b uint32) uint32 {
+		if int32(a) > int32(b) {
+			return a
+		}
+		return b
+	})
+}
+
+func execAmominuW(cpu *CPU, ops *Ops) {
+	cpu.amo(ops, func(a, b uint32) uint32 {
+		if a < b {
+			return a
+		}
+		return b
+	})
+}
+
+func execAmomaxuW(cpu *CPU, ops *Ops) {
+	cpu.amo(ops, func(a, b uint32) uint32 {
+		if a > b {
+			return a
+		}
+		return b
+	})
+}
+
+func execFence(cpu *CPU, ops *Ops) {
+	// Memory accesses take effect in program order, and with
+	// -parallel they are sequentially consistent.
+	cpu.PC = cpu.PC + 4
+}
+
+func execFenceI(cpu *CPU, ops *Ops) {
+	if cpu.icache != nil {
+		cpu.icache.Flush()
+	}
+	if cpu.bus.blocks != nil {
+		cpu.bus.blocks.Flush()
+	}
+	if !cpu.bus.parallel {
+		cpu.bus.clearCode()
+	}
+	cpu.PC = cpu.PC + 4
+}
+
+func execEcall(cpu *CPU, ops *Ops) {
+	if (cpu.proxy != nil) && (cpu.Priv == PRIV_U) {
+		cpu.proxy.Syscall(cpu)
 		cpu.PC = cpu.PC + 4
-	},
-	"addi": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]+ops.Imm)
+		return
+	}
+	switch cpu.Priv {
+	case PRIV_U:
+		cpu.Trap(EXCEPT_CODE_ECALL_FROM_U, 0)
+	case PRIV_S:
+		cpu.Trap(EXCEPT_CODE_ECALL_FROM_S, 0)
+	default:
+		cpu.Trap(EXCEPT_CODE_ECALL_FROM_M, 0)
+	}
+}
+
+func execEbreak(cpu *CPU, ops *Ops) {
+	if (cpu.semihost != nil) && cpu.semihost.Detect(cpu) {
+		cpu.semihost.Call(cpu)
 		cpu.PC = cpu.PC + 4
-	},
-	"slti": func(cpu *CPU, ops *Ops) {
-		if int32(cpu.Regs[ops.Rs1]) < int32(ops.Imm) {
-			cpu.RegWrite(ops.Rd, 1)
+		return
+	}
+	cpu.Trap(EXCEPT_CODE_BREAKPOINT, cpu.PC)
+}
+
+func execMret(cpu *CPU, ops *Ops) {
+	if cpu.Priv < PRIV_M {
+		cpu.Trap(EXCEPT_CODE_ILLEGAL_INST, ops.Inst)
+		return
+	}
+	var t uint32
+	cpu.CSRRead(CSR_ADDR_MSTATUS, &t)
+	cpu.Priv = (t & MSTATUS_MPP) >> 11
+	if t&MSTATUS_MPIE != 0 {
+		t = t | MSTATUS_MIE
+	} else {
+		t = t &^ MSTATUS_MIE
+	}
+	t = t | MSTATUS_MPIE
+	t = t &^ MSTATUS_MPP
+	if cpu.Priv != PRIV_M {
+		t = t &^ MSTATUS_MPRV
+	}
+	cpu.CSRWrite(CSR_ADDR_MSTATUS, &t)
+	cpu.CSRRead(CSR_ADDR_MEPC, &t)
+	cpu.PC = t
+}
+
+func execSret(cpu *CPU, ops *Ops) {
+	var t uint32
+	cpu.CSRRead(CSR_ADDR_MSTATUS, &t)
+	if (cpu.Priv < PRIV_S) || ((cpu.Priv == PRIV_S) && (t&MSTATUS_TSR != 0)) {
+		cpu.Trap(EXCEPT_CODE_ILLEGAL_INST, ops.Inst)
+		return
+	}
+	if t&MSTATUS_SPP != 0 {
+		cpu.Priv = PRIV_S
+	} else {
+		cpu.Priv = PRIV_U
+	}
+	if t&MSTATUS_SPIE != 0 {
+		t = t | MSTATUS_SIE
+	} else {
+		t = t &^ MSTATUS_SIE
+	}
+	t = t | MSTATUS_SPIE
+	t = t &^ MSTATUS_SPP
+	t = t &^ MSTATUS_MPRV
+	cpu.CSRWrite(CSR_ADDR_MSTATUS, &t)
+	cpu.CSRRead(CSR_ADDR_SEPC, &t)
+	cpu.PC = t
+}
+
+func execWfi(cpu *CPU, ops *Ops) {
+	if (cpu.Priv == PRIV_U) || ((cpu.Priv == PRIV_S) && (cpu.CSRs[CSR_ADDR_MSTATUS]&MSTATUS_TW != 0)) {
+		cpu.Trap(EXCEPT_CODE_ILLEGAL_INST, ops.Inst)
+		return
+	}
+	cpu.Wfi = true
+	cpu.PC = cpu.PC + 4
+}
+
+func execSfenceVma(cpu *CPU, ops *Ops) {
+	if (cpu.Priv == PRIV_U) || ((cpu.Priv == PRIV_S) && (cpu.CSRs[CSR_ADDR_MSTATUS]&MSTATUS_TVM != 0)) {
+		cpu.Trap(EXCEPT_CODE_ILLEGAL_INST, ops.Inst)
+		return
+	}
+	cpu.FlushTLB()
+	cpu.PC = cpu.PC + 4
+}
+
+func execCsrrw(cpu *CPU, ops *Ops) {
+	cpu.csr(ops, ops.Rd != 0, true, func(t uint32) uint32 { return cpu.Regs[ops.Rs1] })
+}
+
+func execCsrrs(cpu *CPU, ops *Ops) {
+	cpu.csr(ops, true, ops.Rs1 != 0, func(t uint32) uint32 { return t | cpu.Regs[ops.Rs1] })
+}
+
+func execCsrrc(cpu *CPU, ops *Ops) {
+	cpu.csr(ops, true, ops.Rs1 != 0, func(t uint32) uint32 { return t & (^cpu.Regs[ops.Rs1]) })
+}
+
+func execCsrrwi(cpu *CPU, ops *Ops) {
+	cpu.csr(ops, ops.Rd != 0, true, func(t uint32) uint32 { return ops.Rs1 /* zimm[4:0] */ })
+}
+
+func execCsrrsi(cpu *CPU, ops *Ops) {
+	cpu.csr(ops, true, ops.Rs1 != 0, func(t uint32) uint32 { return t | ops.Rs1 /* zimm[4:0] */ })
+}
+
+func execCsrrci(cpu *CPU, ops *Ops) {
+	cpu.csr(ops, true, ops.Rs1 != 0, func(t uint32) uint32 { return t & (^ops.Rs1) /* zimm[4:0] */ })
+}
+
+func execIllegalInstruction(cpu *CPU, ops *Ops) {
+	cpu.Trap(EXCEPT_CODE_ILLEGAL_INST, ops.Inst)
+}
+
+// csr carries out a Zicsr instruction. The old value is only read if read
+// is set and the new value from op is only written if write is set, so
+// that side effects and access checks follow the specification.
+func (p *CPU) csr(ops *Ops, read bool, write bool, op func(t uint32) uint32) {
+	if !p.CSRAllowed(ops.Csr, write) {
+		p.Trap(EXCEPT_CODE_ILLEGAL_INST, ops.Inst)
+		return
+	}
+	var t uint32 = 0
+	if read || write {
+		t = p.CSRLoad(ops.Csr)
+	}
+	if write {
+		p.CSRStore(ops.Csr, op(t))
+	}
+	p.RegWrite(ops.Rd, t)
+	p.PC = p.PC + 4
+}
+
+func (p *CPU) amo(ops *Ops, op func(a, b uint32) uint32) {
+	b := p.Regs[ops.Rs2]
+	t, ok := p.Atomic(p.Regs[ops.Rs1], func(a uint32) uint32 { return op(a, b) })
+	if !ok {
+		return
+	}
+	p.RegWrite(ops.Rd, t)
+	p.PC = p.PC + 4
+}
+
+// Trap enters the trap handler. Exceptions and interrupts taken in S or
+// U-mode go to S-mode if delegated by medeleg/mideleg. Interrupt causes
+// are dispatched through the vector table when the trap vector is in
+// vectored mode.
+func (p *CPU) Trap(cause uint32, tval uint32) {
+	p.traps++
+	var t uint32
+	var jumpAddr uint32
+	interrupt := cause&0x80000000 != 0
+	deleg := p.CSRs[CSR_ADDR_MEDELEG]
+	if interrupt {
+		deleg = p.CSRs[CSR_ADDR_MIDELEG]
+	}
+
+	if (p.Priv <= PRIV_S) && (deleg&(1<<(cause&0x1f)) != 0) {
+		p.CSRWrite(CSR_ADDR_SEPC, &p.PC)
+		p.CSRWrite(CSR_ADDR_SCAUSE, &cause)
+		p.CSRWrite(CSR_ADDR_STVAL, &tval)
+
+		p.CSRRead(CSR_ADDR_MSTATUS, &t)
+		if t&MSTATUS_SIE != 0 {
+			t = t | MSTATUS_SPIE
 		} else {
-			cpu.RegWrite(ops.Rd, 0)
+			t = t &^ MSTATUS_SPIE
 		}
-		cpu.PC = cpu.PC + 4
-	},
-	"sltiu": func(cpu *CPU, ops *Ops) {
-		if cpu.Regs[ops.Rs1] < ops.Imm {
-			cpu.RegWrite(ops.Rd, 1)
+		if p.Priv == PRIV_S {
+			t = t | MSTATUS_SPP
 		} else {
-			cpu.RegWrite(ops.Rd, 0)
+			t = t &^ MSTATUS_SPP
 		}
-		cpu.PC = cpu.PC + 4
-	},
-	"xori": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]^ops.Imm)
-		cpu.PC = cpu.PC + 4
-	},
-	"ori": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]|ops.Imm)
-		cpu.PC = cpu.PC + 4
-	},
-	"andi": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]&ops.Imm)
-		cpu.PC = cpu.PC + 4
-	},
-	"slli": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]<<ops.Shamt)
-		cpu.PC = cpu.PC + 4
-	},
-	"srli": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]>>ops.Shamt)
-		cpu.PC = cpu.PC + 4
-	},
-	"srai": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, uint32(int32(cpu.Regs[ops.Rs1])>>ops.Shamt))
-		cpu.PC = cpu.PC + 4
-	},
-	"add": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]+cpu.Regs[ops.Rs2])
-		cpu.PC = cpu.PC + 4
-	},
-	"sub": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]-cpu.Regs[ops.Rs2])
-		cpu.PC = cpu.PC + 4
-	},
-	"sll": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]<<(cpu.Regs[ops.Rs2]&0x1f))
-		cpu.PC = cpu.PC + 4
-	},
-	"slt": func(cpu *CPU, ops *Ops) {
-		if int32(cpu.Regs[ops.Rs1]) < int32(cpu.Regs[ops.Rs2]) {
-			cpu.RegWrite(ops.Rd, 1)
+		t = t &^ MSTATUS_SIE
+		p.CSRWrite(CSR_ADDR_MSTATUS, &t)
+
+		p.Priv = PRIV_S
+		p.CSRRead(CSR_ADDR_STVEC, &jumpAddr)
+	} else {
+		p.CSRWrite(CSR_ADDR_MEPC, &p.PC)
+		p.CSRWrite(CSR_ADDR_MCAUSE, &cause)
+		p.CSRWrite(CSR_ADDR_MTVAL, &tval)
+
+		p.CSRRead(CSR_ADDR_MSTATUS, &t)
+		if t&MSTATUS_MIE != 0 {
+			t = t | MSTATUS_MPIE
 		} else {
-			cpu.RegWrite(ops.Rd, 0)
+			t = t &^ MSTATUS_MPIE
 		}
-		cpu.PC = cpu.PC + 4
-	},
-	"sltu": func(cpu *CPU, ops *Ops) {
-		if cpu.Regs[ops.Rs1] < cpu.Regs[ops.Rs2] {
-			cpu.RegWrite(ops.Rd, 1)
-		} else {
-			cpu.RegWrite(ops.Rd, 0)
+		t = (t &^ MSTATUS_MPP) | (p.Priv << 11)
+		t = t &^ MSTATUS_MIE
+		p.CSRWrite(CSR_ADDR_MSTATUS, &t)
+
+		p.Priv = PRIV_M
+		p.CSRRead(CSR_ADDR_MTVEC, &jumpAddr)
+	}
+
+	if (jumpAddr&0x3 == 1) && interrupt {
+		jumpAddr = (jumpAddr &^ 0x3) + 4*(cause&0x7fffffff)
+	} else {
+		jumpAddr = jumpAddr &^ 0x3
+	}
+	p.PC = jumpAddr
+}
+
+// sample updates the interrupt pending bits driven by the CLINT and the
+// PLIC.
+func (p *CPU) sample() {
+	clint := p.bus.clint
+	mip := p.CSRs[CSR_ADDR_MIP] &^ (MIP_MSIP | MIP_MTIP | MIP_MEIP | MIP_SEIP)
+	if p.bus.ExternalPending(2 * p.hart) {
+		mip |= MIP_MEIP
+	}
+	if p.seip || p.bus.ExternalPending(2*p.hart+1) {
+		mip |= MIP_SEIP
+	}
+	if clint.SoftwarePending(p.hart) {
+		mip |= MIP_MSIP
+	}
+	if clint.TimerPending(p.hart) {
+		mip |= MIP_MTIP
+	}
+	p.CSRs[CSR_ADDR_MIP] = mip
+}
+
+// Tick advances the timer by one step and takes a pending interrupt if
+// it is enabled. It returns false while the hart is stalled in wfi. Hart 0
+// keeps time for the machine; the other harts only sample it.
+func (p *CPU) Tick() bool {
+	if !p.bus.parallel {
+		if p.hart == 0 {
+			p.bus.Tick()
 		}
-		cpu.PC = cpu.PC + 4
-	},
-	"xor": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]^cpu.Regs[ops.Rs2])
-		cpu.PC = cpu.PC + 4
-	},
-	"srl": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]>>(cpu.Regs[ops.Rs2]&0x1f))
-		cpu.PC = cpu.PC + 4
-	},
-	"sra": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, uint32(int32(cpu.Regs[ops.Rs1])>>(cpu.Regs[ops.Rs2]&0x1f)))
-		cpu.PC = cpu.PC + 4
-	},
-	"or": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]|cpu.Regs[ops.Rs2])
-		cpu.PC = cpu.PC + 4
-	},
-	"and": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, cpu.Regs[ops.Rs1]&cpu.Regs[ops.Rs2])
-		cpu.PC = cpu.PC + 4
-	},
-	"fence": func(cpu *CPU, ops *Ops) {
-		cpu.PC = cpu.PC + 4
-	},
-	"fence_i": func(cpu *CPU, ops *Ops) {
-		cpu.PC = cpu.PC + 4
-	},
-	"ecall": func(cpu *CPU, ops *Ops) {
-		cpu.CSRWrite(CSR_ADDR_MEPC, &cpu.PC)
-		var t uint32 = EXCEPT_CODE_ECALL_FROM_M
-		cpu.CSRWrite(CSR_ADDR_MCAUSE, &t)
-		var jumpAddr uint32
-		cpu.CSRRead(CSR_ADDR_MTVEC, &jumpAddr)
-		cpu.PC = jumpAddr
-	},
-	"ebreak": func(cpu *CPU, ops *Ops) {
-		cpu.CSRWrite(CSR_ADDR_MEPC, &cpu.PC)
-		var t uint32 = EXCEPT_CODE_BREAKPOINT
-		cpu.CSRWrite(CSR_ADDR_MCAUSE, &t)
-		var jumpAddr uint32
-		cpu.CSRRead(CSR_ADDR_MTVEC, &jumpAddr)
-		cpu.PC = jumpAddr
-	},
-	"mret": func(cpu *CPU, ops *Ops) {
-		var t uint32
-		cpu.CSRRead(CSR_ADDR_MEPC, &t)
-		cpu.PC = t
-	},
-	"csrrw": func(cpu *CPU, ops *Ops) {
-		t := cpu.CSRs[ops.Csr]
-		cpu.CSRs[ops.Csr] = cpu.Regs[ops.Rs1]
-		cpu.RegWrite(ops.Rd, t)
-		cpu.PC = cpu.PC + 4
-	},
-	"csrrs": func(cpu *CPU, ops *Ops) {
-		t := cpu.CSRs[ops.Csr]
-		cpu.CSRs[ops.Csr] = t | cpu.Regs[ops.Rs1]
-		cpu.RegWrite(ops.Rd, t)
-		cpu.PC = cpu.PC + 4
-	},
-	"csrrc": func(cpu *CPU, ops *Ops) {
-		t := cpu.CSRs[ops.Csr]
-		cpu.CSRs[ops.Csr] = t & (^cpu.Regs[ops.Rs1])
-		cpu.RegWrite(ops.Rd, t)
-		cpu.PC = cpu.PC + 4
-	},
-	"csrrwi": func(cpu *CPU, ops *Ops) {
-		cpu.RegWrite(ops.Rd, cpu.CSRs[ops.Csr])
-		cpu.CSRs[ops.Csr] = ops.Rs1 /* zimm[4:0] */
-		cpu.PC = cpu.PC + 4
-	},
-	"csrrsi": func(cpu *CPU, ops *Ops) {
-		t := cpu.CSRs[ops.Csr]
-		cpu.CSRs[ops.Csr] = t | ops.Rs1 /* zimm[4:0] */
-		cpu.RegWrite(ops.Rd, t)
-		cpu.PC = cpu.PC + 4
-	},
-	"csrrci": func(cpu *CPU, ops *Ops) {
-		t := cpu.CSRs[ops.Csr]
-		cpu.CSRs[ops.Csr] = t & (^ops.Rs1) /* zimm[4:0] */
-		cpu.RegWrite(ops.Rd, t)
-		cpu.PC = cpu.PC + 4
-	},
-	"illegal_instruction": func(cpu *CPU, ops *Ops) {
-		cpu.CSRWrite(CSR_ADDR_MEPC, &cpu.PC)
-		var t uint32 = EXCEPT_CODE_ILLEGAL_INST
-		cpu.CSRWrite(CSR_ADDR_MCAUSE, &t)
-		var jumpAddr uint32
-		cpu.CSRRead(CSR_ADDR_MTVEC, &jumpAddr)
-		cpu.PC = jumpAddr
-	},
+		p.sample()
+	}
+	p.Cycle++
+	mip := p.CSRs[CSR_ADDR_MIP]
+	mie := p.CSRs[CSR_ADDR_MIE]
+	pending := mip & mie
+	if p.Wfi {
+		if pending == 0 {
+			// If nothing but the timer can wake us up, skip the idle
+			// period instead of spinning through it. Devices fed from
+			// the host may interrupt at any time, and a hart that is
+			// still running may send an IPI.
+			if (mie&MIP_MTIP != 0) && p.bus.idle() {
+				external := mie&(MIP_MEIP|MIP_SEIP) != 0 && p.bus.interactive()
+				if !external {
+					p.bus.clint.Skip()
+				}
+			}
+			return false
+		}
+		p.Wfi = false
+	}
+	if pending == 0 {
+		return true
+	}
+
+	mstatus := p.CSRs[CSR_ADDR_MSTATUS]
+	mideleg := p.CSRs[CSR_ADDR_MIDELEG]
+	mEnabled := (p.Priv < PRIV_M) || (mstatus&MSTATUS_MIE != 0)
+	sEnabled := (p.Priv < PRIV_S) || ((p.Priv == PRIV_S) && (mstatus&MSTATUS_SIE != 0))
+	var enabled uint32 = 0
+	if mEnabled {
+		enabled |= pending &^ mideleg
+	}
+	if sEnabled {
+		enabled |= pending & mideleg
+	}
+	for _, cause := range interruptOrder {
+		if enabled&(1<<(cause&0x1f)) != 0 {
+			p.Trap(cause, 0)
+			break
+		}
+	}
+	return true
+}
+
+// jump moves PC to a jump or taken branch target, raising an instruction
+// address misaligned exception at the jump if target is not aligned.
+func (p *CPU) jump(target uint32) bool {
+	if target&3 != 0 {
+		p.Trap(EXCEPT_CODE_INST_MISALIGNED, target)
+		return false
+	}
+	p.PC = target
+	return true
 }
 
 func (p *CPU) RegWrite(addr uint32, data uint32) {
@@ -423,10 +1123,62 @@ func (p *CPU) RegWrite(addr uint32, data uint32) {
 	}
 }
 
-func (cpu *CPU) Fetch() uint32 {
-	t := cpu.bus.ReadWord(cpu.PC)
+// Fetch reads the instruction at PC. If the fetch faults the trap is
+// taken and false is returned.
+func (cpu *CPU) Fetch() (uint32, bool) {
+	paddr, ok := cpu.fetchAddr()
+	if !ok {
+		return 0, false
+	}
+	if !cpu.bus.Allowed(paddr, accessFetch) {
+		cpu.Trap(EXCEPT_CODE_INST_ACCESS_FAULT, cpu.PC)
+		return 0, false
+	}
+	t := cpu.bus.ReadWord(paddr)
 	// cpu.PC = cpu.PC + 4
-	return t
+	return t, true
+}
+
+// fetchAddr translates PC for an instruction fetch.
+func (cpu *CPU) fetchAddr() (uint32, bool) {
+	if cpu.PC&0x3 != 0 {
+		cpu.Trap(EXCEPT_CODE_INST_MISALIGNED, cpu.PC)
+		return 0, false
+	}
+	paddr, cause, ok := cpu.Translate(cpu.PC, accessFetch)
+	if !ok {
+		cpu.Trap(cause, cpu.PC)
+		return 0, false
+	}
+	return paddr, true
+}
+
+// Next returns the decoded instruction at PC, taking it from the decoded
+// instruction cache if it has run before. Only code in memory is cached. If
+// the fetch faults the trap is taken and false is returned.
+func (cpu *CPU) Next() (*Ops, bool) {
+	paddr, ok := cpu.fetchAddr()
+	if !ok {
+		return nil, false
+	}
+	c := cpu.icache
+	if c != nil {
+		if ops := c.Lookup(paddr); ops != nil {
+			return ops, true
+		}
+	}
+	if !cpu.bus.Allowed(paddr, accessFetch) {
+		cpu.Trap(EXCEPT_CODE_INST_ACCESS_FAULT, cpu.PC)
+		return nil, false
+	}
+	ops := cpu.Decode(cpu.bus.ReadWord(paddr))
+	if (c != nil) && (cpu.bus.page(paddr) != nil) {
+		if !cpu.bus.parallel {
+			cpu.bus.MarkCode(paddr)
+		}
+		return c.Insert(paddr, ops), true
+	}
+	return &ops, true
 }
 
 func (cpu *CPU) Decode(inst uint32) Ops {
@@ -434,13 +1186,14 @@ func (cpu *CPU) Decode(inst uint32) Ops {
 	opcode := inst & 0x7f
 	var ops Ops
 
-	ops.Name = "illegal_instruction"
+	ops.Name, ops.Exec = "illegal_instruction", execIllegalInstruction
+	ops.Inst = inst
 	ops.Rd = (inst >> 7) & 0x1f
 	ops.Funct3 = (inst >> 12) & 0x7
 	ops.Rs1 = (inst >> 15) & 0x1f
 	ops.Rs2 = (inst >> 20) & 0x1f
-	ops.Funct7 = (inst >> 25) & 0x3f
-	ops.Shamt = (inst >> 20) & 0x3f
+	ops.Funct7 = (inst >> 25) & 0x7f
+	ops.Shamt = (inst >> 20) & 0x1f
 	ops.Csr = (inst >> 20) & 0xfff
 
 	iimm := (inst >> 20) & 0xfff
@@ -469,85 +1222,89 @@ func (cpu *CPU) Decode(inst uint32) Ops {
 
 	switch opcode {
 	case 0x37:
-		ops.Name = "lui"
+		ops.Name, ops.Exec = "lui", execLui
 		ops.Imm = uimm
 	case 0x17:
-		ops.Name = "auipc"
+		ops.Name, ops.Exec = "auipc", execAuipc
 		ops.Imm = uimm
 	case 0x6f:
-		ops.Name = "jal"
+		ops.Name, ops.Exec = "jal", execJal
 		ops.Imm = jimm
 	case 0x67:
-		ops.Name = "jalr"
+		if ops.Funct3 == 0 {
+			ops.Name, ops.Exec = "jalr", execJalr
+		}
 		ops.Imm = iimm
 	case 0x63:
 		switch ops.Funct3 {
 		case 0:
-			ops.Name = "beq"
+			ops.Name, ops.Exec = "beq", execBeq
 		case 1:
-			ops.Name = "bne"
+			ops.Name, ops.Exec = "bne", execBne
 		case 4:
-			ops.Name = "blt"
+			ops.Name, ops.Exec = "blt", execBlt
 		case 5:
-			ops.Name = "bge"
+			ops.Name, ops.Exec = "bge", execBge
 		case 6:
-			ops.Name = "bltu"
+			ops.Name, ops.Exec = "bltu", execBltu
 		case 7:
-			ops.Name = "bgeu"
+			ops.Name, ops.Exec = "bgeu", execBgeu
 		}
 		ops.Imm = bimm
 	case 0x03:
 		switch ops.Funct3 {
 		case 0:
-			ops.Name = "lb"
+			ops.Name, ops.Exec = "lb", execLb
 		case 1:
-			ops.Name = "lh"
+			ops.Name, ops.Exec = "lh", execLh
 		case 2:
-			ops.Name = "lw"
+			ops.Name, ops.Exec = "lw", execLw
 		case 4:
-			ops.Name = "lbu"
+			ops.Name, ops.Exec = "lbu", execLbu
 		case 5:
-			ops.Name = "lhu"
+			ops.Name, ops.Exec = "lhu", execLhu
 		default:
-			ops.Name = "illegal_instruction"
+			ops.Name, ops.Exec = "illegal_instruction", execIllegalInstruction
 		}
 		ops.Imm = iimm
 	case 0x23:
 		switch ops.Funct3 {
 		case 0:
-			ops.Name = "sb"
+			ops.Name, ops.Exec = "sb", execSb
 		case 1:
-			ops.Name = "sh"
+			ops.Name, ops.Exec = "sh", execSh
 		case 2:
-			ops.Name = "sw"
+			ops.Name, ops.Exec = "sw", execSw
 		default:
-			ops.Name = "illegal_instruction"
+			ops.Name, ops.Exec = "illegal_instruction", execIllegalInstruction
 		}
 		ops.Imm = simm
 	case 0x13:
 		switch ops.Funct3 {
 		case 0:
-			ops.Name = "addi"
+			ops.Name, ops.Exec = "addi", execAddi
 		case 1:
-			ops.Name = "slli"
+			if ops.Funct7 == 0 {
+				ops.Name, ops.Exec = "slli", execSlli
+			}
 		case 2:
-			ops.Name = "slti"
+			ops.Name, ops.Exec = "slti", execSlti
 		case 3:
-			ops.Name = "sltiu"
+			ops.Name, ops.Exec = "sltiu", execSltiu
 		case 4:
-			ops.Name = "xori"
+			ops.Name, ops.Exec = "xori", execXori
 		case 5:
 			if ops.Funct7 == 0 {
-				ops.Name = "srli"
-			} else {
-				ops.Name = "srai"
+				ops.Name, ops.Exec = "srli", execSrli
+			} else if ops.Funct7 == 0x20 {
+				ops.Name, ops.Exec = "srai", execSrai
 			}
 		case 6:
-			ops.Name = "ori"
+			ops.Name, ops.Exec = "ori", execOri
 		case 7:
-			ops.Name = "andi"
+			ops.Name, ops.Exec = "andi", execAndi
 		default:
-			ops.Name = "illegal_instruction"
+			ops.Name, ops.Exec = "illegal_instruction", execIllegalInstruction
 		}
 		if (ops.Funct3 == 1) || (ops.Funct3 == 5) { // slli, srli, srai
 			ops.Imm = ops.Shamt
@@ -555,75 +1312,120 @@ func (cpu *CPU) Decode(inst uint32) Ops {
 			ops.Imm = iimm
 		}
 	case 0x33:
+		if ops.Funct7 == 0x01 {
+			if cpu.CSRs[CSR_ADDR_MISA]&MISA_M == 0 {
+				break
+			}
+			ops.Name = [...]string{"mul", "mulh", "mulhsu", "mulhu", "div", "divu", "rem", "remu"}[ops.Funct3]
+			ops.Exec = [...]func(cpu *CPU, ops *Ops){execMul, execMulh, execMulhsu, execMulhu, execDiv, execDivu, execRem, execRemu}[ops.Funct3]
+			break
+		}
+		// Only sub and sra have funct7 0x20.
+		if (ops.Funct7 != 0) && ((ops.Funct7 != 0x20) || ((ops.Funct3 != 0) && (ops.Funct3 != 5))) {
+			break
+		}
 		switch ops.Funct3 {
 		case 0:
 			if ops.Funct7 == 0 {
-				ops.Name = "add"
+				ops.Name, ops.Exec = "add", execAdd
 			} else {
-				ops.Name = "sub"
+				ops.Name, ops.Exec = "sub", execSub
 			}
 		case 1:
-			ops.Name = "sll"
+			ops.Name, ops.Exec = "sll", execSll
 		case 2:
-			ops.Name = "slt"
+			ops.Name, ops.Exec = "slt", execSlt
 		case 3:
-			ops.Name = "sltu"
+			ops.Name, ops.Exec = "sltu", execSltu
 		case 4:
-			ops.Name = "xor"
+			ops.Name, ops.Exec = "xor", execXor
 		case 5:
 			if ops.Funct7 == 0 {
-				ops.Name = "srl"
+				ops.Name, ops.Exec = "srl", execSrl
 			} else {
-				ops.Name = "sra"
+				ops.Name, ops.Exec = "sra", execSra
 			}
 		case 6:
-			ops.Name = "or"
+			ops.Name, ops.Exec = "or", execOr
 		case 7:
-			ops.Name = "and"
+			ops.Name, ops.Exec = "and", execAnd
 		default:
-			ops.Name = "illegal_instruction"
+			ops.Name, ops.Exec = "illegal_instruction", execIllegalInstruction
 		}
 		ops.Imm = bimm
+	case 0x2f:
+		if (ops.Funct3 != 2) || (cpu.CSRs[CSR_ADDR_MISA]&MISA_A == 0) {
+			break
+		}
+		switch ops.Funct7 >> 2 {
+		case 0x00:
+			ops.Name, ops.Exec = "amoadd_w", execAmoaddW
+		case 0x01:
+			ops.Name, ops.Exec = "amoswap_w", execAmoswapW
+		case 0x02:
+			if ops.Rs2 == 0 {
+				ops.Name, ops.Exec = "lr_w", execLrW
+			}
+		case 0x03:
+			ops.Name, ops.Exec = "sc_w", execScW
+		case 0x04:
+			ops.Name, ops.Exec = "amoxor_w", execAmoxorW
+		case 0x08:
+			ops.Name, ops.Exec = "amoor_w", execAmoorW
+		case 0x0c:
+			ops.Name, ops.Exec = "amoand_w", execAmoandW
+		case 0x10:
+			ops.Name, ops.Exec = "amomin_w", execAmominW
+		case 0x14:
+			ops.Name, ops.Exec = "amomax_w", execAmomaxW
+		case 0x18:
+			ops.Name, ops.Exec = "amominu_w", execAmominuW
+		case 0x1c:
+			ops.Name, ops.Exec = "amomaxu_w", execAmomaxuW
+		}
 	case 0x0f: //
 		switch ops.Funct3 {
 		case 0:
-			ops.Name = "fence"
+			ops.Name, ops.Exec = "fence", execFence
 		case 1:
-			ops.Name = "fence_i"
+			ops.Name, ops.Exec = "fence_i", execFenceI
 		default:
-			ops.Name = "illegal_instruction"
+			ops.Name, ops.Exec = "illegal_instruction", execIllegalInstruction
 		}
 		ops.Imm = iimm
 	case 0x73: // I
 		switch ops.Funct3 {
 		case 0:
-			if ops.Csr == 0x000 {
-				ops.Name = "ecall"
-			} else if ops.Csr == 0x001 {
-				ops.Name = "ebreak"
-				// } else if ops.Csr == 0x002 {
-				// 	ops.Name = "uret"
-				// } else if ops.Csr == 0x102 {
-				// 	ops.Name = "sret"
-			} else if ops.Csr == 0x302 {
-				ops.Name = "mret"
+			// The other fields of these must be zero.
+			if inst == 0x00000073 {
+				ops.Name, ops.Exec = "ecall", execEcall
+			} else if inst == 0x00100073 {
+				ops.Name, ops.Exec = "ebreak", execEbreak
+			} else if inst == 0x10200073 {
+				ops.Name, ops.Exec = "sret", execSret
+			} else if inst&0xfe007fff == 0x12000073 {
+				ops.Name, ops.Exec = "sfence_vma", execSfenceVma
+			} else if inst == 0x30200073 {
+				ops.Name, ops.Exec = "mret", execMret
+			} else if inst == 0x10500073 {
+				ops.Name, ops.Exec = "wfi", execWfi
 			} else {
-				ops.Name = "illegal_instruction"
+				ops.Name, ops.Exec = "illegal_instruction", execIllegalInstruction
 			}
 		case 1:
-			ops.Name = "csrrw"
+			ops.Name, ops.Exec = "csrrw", execCsrrw
 		case 2:
-			ops.Name = "csrrs"
+			ops.Name, ops.Exec = "csrrs", execCsrrs
 		case 3:
-			ops.Name = "csrrc"
+			ops.Name, ops.Exec = "csrrc", execCsrrc
 		case 5:
-			ops.Name = "csrrwi"
+			ops.Name, ops.Exec = "csrrwi", execCsrrwi
 		case 6:
-			ops.Name = "csrrsi"
+			ops.Name, ops.Exec = "csrrsi", execCsrrsi
 		case 7:
-			ops.Name = "csrrci"
+			ops.Name, ops.Exec = "csrrci", execCsrrci
 		default:
-			ops.Name = "illegal_instruction"
+			ops.Name, ops.Exec = "illegal_instruction", execIllegalInstruction
 		}
 		ops.Imm = iimm
 	default:
@@ -641,5 +1443,17 @@ func (p *CPU) CSRWrite(addr uint16, data *uint32) {
 }
 
 func (p *CPU) Execute(ops *Ops) {
-	instructions[ops.Name](p, ops)
+	ops.Exec(p, ops)
+	p.countInstret()
+}
+
+// countInstret counts an executed instruction in minstret, unless the
+// instruction wrote minstret itself: the written value is what the next
+// instruction reads.
+func (p *CPU) countInstret() {
+	if p.instretW {
+		p.instretW = false
+		return
+	}
+	p.Instret++
 }
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// Instruction encoders for the base formats.
+
+func encR(op uint32, f3 uint32, f7 uint32, rd uint32, rs1 uint32, rs2 uint32) uint32 {
+	return f7<<25 | rs2<<20 | rs1<<15 | f3<<12 | rd<<7 | op
+}
+
+func encI(op uint32, f3 uint32, rd uint32, rs1 uint32, imm int32) uint32 {
+	return uint32(imm)<<20 | rs1<<15 | f3<<12 | rd<<7 | op
+}
+
+func encS(f3 uint32, rs1 uint32, rs2 uint32, imm int32) uint32 {
+	i := uint32(imm)
+	return (i>>5&0x7f)<<25 | rs2<<20 | rs1<<15 | f3<<12 | (i&0x1f)<<7 | 0x23
+}
+
+func encB(f3 uint32, rs1 uint32, rs2 uint32, imm int32) uint32 {
+	i := uint32(imm)
+	return (i>>12&1)<<31 | (i>>5&0x3f)<<25 | rs2<<20 | rs1<<15 | f3<<12 | (i>>1&0xf)<<8 | (i>>11&1)<<7 | 0x63
+}
+
+func encU(op uint32, rd uint32, imm uint32) uint32 {
+	return imm&0xfffff000 | rd<<7 | op
+}
+
+func encJ(rd uint32, imm int32) uint32 {
+	i := uint32(imm)
+	return (i>>20&1)<<31 | (i>>1&0x3ff)<<21 | (i>>11&1)<<20 | (i>>12&0xff)<<12 | rd<<7 | 0x6f
+}
+
+func newTestCPU(t testing.TB) *CPU {
+	bus, err := NewBus(DefaultMachine())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus.uart.Attach(ioutil.Discard, nil)
+	p := NewCPU(bus)
+	p.Reset()
+	return p
+}
+
+// newTestHarts returns n harts sharing a bus, all reset.
+func newTestHarts(t testing.TB, n int) []*CPU {
+	m := DefaultMachine()
+	m.Harts = uint32(n)
+	bus, err := NewBus(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus.uart.Attach(ioutil.Discard, nil)
+	for i := 0; i < n; i++ {
+		NewCPU(bus).Reset()
+	}
+	return bus.harts
+}
+
+// exec runs inst at the PC of p.
+func exec(p *CPU, inst uint32) {
+	ops := p.Decode(inst)
+	p.Execute(&ops)
+}
+
+// decodeTable lists the legal combinations of opcode, funct3 and funct7
+// with rd, rs1 and rs2 zero. A funct3 or funct7 of -1 matches any value.
+var decodeTable = []struct {
+	op   uint32
+	f3   int
+	f7   int
+	name string
+}{
+	{0x37, -1, -1, "lui"},
+	{0x17, -1, -1, "auipc"},
+	{0x6f, -1, -1, "jal"},
+	{0x67, 0, -1, "jalr"},
+	{0x63, 0, -1, "beq"},
+	{0x63, 1, -1, "bne"},
+	{0x63, 4, -1, "blt"},
+	{0x63, 5, -1, "bge"},
+	{0x63, 6, -1, "bltu"},
+	{0x63, 7, -1, "bgeu"},
+	{0x03, 0, -1, "lb"},
+	{0x03, 1, -1, "lh"},
+	{0x03, 2, -1, "lw"},
+	{0x03, 4, -1, "lbu"},
+	{0x03, 5, -1, "lhu"},
+	{0x23, 0, -1, "sb"},
+	{0x23, 1, -1, "sh"},
+	{0x23, 2, -1, "sw"},
+	{0x13, 0, -1, "addi"},
+	{0x13, 1, 0x00, "slli"},
+	{0x13, 2, -1, "slti"},
+	{0x13, 3, -1, "sltiu"},
+	{0x13, 4, -1, "xori"},
+	{0x13, 5, 0x00, "srli"},
+	{0x13, 5, 0x20, "srai"},
+	{0x13, 6, -1, "ori"},
+	{0x13, 7, -1, "andi"},
+	{0x33, 0, 0x00, "add"},
+	{0x33, 0, 0x20, "sub"},
+	{0x33, 1, 0x00, "sll"},
+	{0x33, 2, 0x00, "slt"},
+	{0x33, 3, 0x00, "sltu"},
+	{0x33, 4, 0x00, "xor"},
+	{0x33, 5, 0x00, "srl"},
+	{0x33, 5, 0x20, "sra"},
+	{0x33, 6, 0x00, "or"},
+	{0x33, 7, 0x00, "and"},
+	{0x33, 0, 0x01, "mul"},
+	{0x33, 1, 0x01, "mulh"},
+	{0x33, 2, 0x01, "mulhsu"},
+	{0x33, 3, 0x01, "mulhu"},
+	{0x33, 4, 0x01, "div"},
+	{0x33, 5, 0x01, "divu"},
+	{0x33, 6, 0x01, "rem"},
+	{0x33, 7, 0x01, "remu"},
+	{0x0f, 0, -1, "fence"},
+	{0x0f, 1, -1, "fence_i"},
+	{0x73, 0, 0x00, "ecall"},
+	{0x73, 0, 0x09, "sfence_vma"},
+	{0x73, 1, -1, "csrrw"},
+	{0x73, 2, -1, "csrrs"},
+	{0x73, 3, -1, "csrrc"},
+	{0x73, 5, -1, "csrrwi"},
+	{0x73, 6, -1, "csrrsi"},
+	{0x73, 7, -1, "csrrci"},
+}
+
+// amoTable maps funct7 >> 2 of the A extension, funct3 2, to the
+// instruction; aq and rl may have any value.
+var amoTable = map[uint32]string{
+	0x00: "amoadd_w",
+	0x01: "amoswap_w",
+	0x02: "lr_w",
+	0x03: "sc_w",
+	0x04: "amoxor_w",
+	0x08: "amoor_w",
+	0x0c: "amoand_w",
+	0x10: "amomin_w",
+	0x14: "amomax_w",
+	0x18: "amominu_w",
+	0x1c: "amomaxu_w",
+}
+
+func decodeWant(op uint32, f3 uint32, f7 uint32) string {
+	if op == 0x2f {
+		if name, ok := amoTable[f7>>2]; ok && (f3 == 2) {
+			return name
+		}
+		return "illegal_instruction"
+	}
+	for _, e := range decodeTable {
+		if (e.op == op) && ((e.f3 < 0) || (uint32(e.f3) == f3)) && ((e.f7 < 0) || (uint32(e.f7) == f7)) {
+			return e.name
+		}
+	}
+	return "illegal_instruction"
+}
+
+func TestDecodeAll(t *testing.T) {
+	p := newTestCPU(t)
+	for op := uint32(0); op < 0x80; op++ {
+		for f3 := uint32(0); f3 < 8; f3++ {
+			for f7 := uint32(0); f7 < 0x80; f7++ {
+				inst := encR(op, f3, f7, 0, 0, 0)
+				ops := p.Decode(inst)
+				if want := decodeWant(op, f3, f7); ops.Name != want {
+					t.Errorf("%08x (opcode %02x funct3 %v funct7 %02x): got %v, want %v", inst, op, f3, f7, ops.Name, want)
+				}
+				// Decode picks the function itself; it must be the one
+				// the name stands for.
+				if reflect.ValueOf(ops.Exec).Pointer() != reflect.ValueOf(instructions[ops.Name]).Pointer() {
+					t.Errorf("%08x: %v executes the wrong function", inst, ops.Name)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeSystem(t *testing.T) {
+	p := newTestCPU(t)
+	tests := []struct {
+		inst uint32
+		name string
+	}{
+		{0x00000073, "ecall"},
+		{0x00100073, "ebreak"},
+		{0x10200073, "sret"},
+		{0x30200073, "mret"},
+		{0x10500073, "wfi"},
+		{0x12000073, "sfence_vma"},
+		{0x12b50073, "sfence_vma"},
+		{0x00200073, "illegal_instruction"}, // uret
+		{0x000000f3, "illegal_instruction"}, // ecall with rd
+		{0x00108073, "illegal_instruction"}, // ebreak with rs1
+		{0x30200173, "illegal_instruction"}, // mret with rd
+		{0x105000f3, "illegal_instruction"}, // wfi with rd
+		{0x120000f3, "illegal_instruction"}, // sfence.vma with rd
+		{0x7b200073, "illegal_instruction"}, // dret
+		{0x30405073, "csrrwi"},
+		{0x0000c073, "illegal_instruction"}, // funct3 4
+		{0x1000202f, "lr_w"},
+		{0x1030202f, "illegal_instruction"}, // lr.w with rs2
+		{0x0000302f, "illegal_instruction"}, // amoadd.d
+	}
+	for _, tt := range tests {
+		if ops := p.Decode(tt.inst); ops.Name != tt.name {
+			t.Errorf("%08x: got %v, want %v", tt.inst, ops.Name, tt.name)
+		}
+	}
+}
+
+func TestDecodeExtensions(t *testing.T) {
+	p := newTestCPU(t)
+	p.CSRs[CSR_ADDR_MISA] &^= MISA_M | MISA_A
+	for _, inst := range []uint32{encR(0x33, 0, 1, 1, 2, 3), encR(0x33, 4, 1, 1, 2, 3), encR(0x2f, 2, 0, 1, 2, 3)} {
+		if ops := p.Decode(inst); ops.Name != "illegal_instruction" {
+			t.Errorf("%08x without M and A: got %v", inst, ops.Name)
+		}
+	}
+}
+
+func TestDecodeFields(t *testing.T) {
+	p := newTestCPU(t)
+	ops := p.Decode(encR(0x33, 7, 0, 5, 17, 31))
+	if (ops.Rd != 5) || (ops.Rs1 != 17) || (ops.Rs2 != 31) || (ops.Funct3 != 7) || (ops.Funct7 != 0) {
+		t.Errorf("and x5,x17,x31: got rd %v rs1 %v rs2 %v funct3 %v funct7 %v", ops.Rd, ops.Rs1, ops.Rs2, ops.Funct3, ops.Funct7)
+	}
+	ops = p.Decode(encI(0x73, 1, 10, 11, 0x305))
+	if (ops.Name != "csrrw") || (ops.Csr != 0x305) || (ops.Rd != 10) || (ops.Rs1 != 11) {
+		t.Errorf("csrrw a0,mtvec,a1: got %v csr %x rd %v rs1 %v", ops.Name, ops.Csr, ops.Rd, ops.Rs1)
+	}
+	ops = p.Decode(encR(0x13, 5, 0x20, 1, 2, 31))
+	if (ops.Name != "srai") || (ops.Shamt != 31) || (ops.Imm != 31) {
+		t.Errorf("srai x1,x2,31: got %v shamt %v imm %v", ops.Name, ops.Shamt, ops.Imm)
+	}
+}
+
+func TestDecodeImmediates(t *testing.T) {
+	p := newTestCPU(t)
+	for _, imm := range []int32{0, 1, -1, 5, 0x7ff, -0x800, 0x555, -0x556, 0x400, -2} {
+		if ops := p.Decode(encI(0x13, 0, 1, 2, imm)); ops.Imm != uint32(imm) {
+			t.Errorf("addi %v: got imm %x", imm, ops.Imm)
+		}
+		if ops := p.Decode(encI(0x03, 2, 1, 2, imm)); ops.Imm != uint32(imm) {
+			t.Errorf("lw %v: got imm %x", imm, ops.Imm)
+		}
+		if ops := p.Decode(encI(0x67, 0, 1, 2, imm)); ops.Imm != uint32(imm) {
+			t.Errorf("jalr %v: got imm %x", imm, ops.Imm)
+		}
+		if ops := p.Decode(encS(2, 1, 2, imm)); ops.Imm != uint32(imm) {
+			t.Errorf("sw %v: got imm %x", imm, ops.Imm)
+		}
+	}
+	for _, imm := range []int32{0, 2, -2, 0x7fe, 0x800, 0xffe, -0x1000, 0xaaa, -0x556, 0x554} {
+		if ops := p.Decode(encB(0, 1, 2, imm)); ops.Imm != uint32(imm) {
+			t.Errorf("beq %v: got imm %x", imm, ops.Imm)
+		}
+	}
+	for _, imm := range []int32{0, 2, -2, 0x7fe, 0x800, 0xffffe, -0x100000, 0x55554, -0xaaaaa, 0x1000} {
+		if ops := p.Decode(encJ(1, imm)); ops.Imm != uint32(imm) {
+			t.Errorf("jal %v: got imm %x", imm, ops.Imm)
+		}
+	}
+	for _, imm := range []uint32{0, 0x1000, 0xfffff000, 0x80000000, 0x12345000} {
+		if ops := p.Decode(encU(0x37, 1, imm)); ops.Imm != imm {
+			t.Errorf("lui %x: got imm %x", imm, ops.Imm)
+		}
+		if ops := p.Decode(encU(0x17, 1, imm)); ops.Imm != imm {
+			t.Errorf("auipc %x: got imm %x", imm, ops.Imm)
+		}
+	}
+}
+
+// executeTests run inst at 0x80000000 with x1 and x2 set to rs1 and rs2
+// and x3 to 0xdeadbeef. rd is the value of x3 afterwards and next the
+// offset of the next PC, 4 if zero.
+var executeTests = []struct {
+	name string
+	inst uint32
+	rs1  uint32
+	rs2  uint32
+	rd   uint32
+	next int32
+}{
+	{"lui", encU(0x37, 3, 0x12345000), 0, 0, 0x12345000, 0},
+	{"auipc", encU(0x17, 3, 0x1000), 0, 0, 0x80001000, 0},
+	{"jal", encJ(3, 16), 0, 0, 0x80000004, 16},
+	{"jal back", encJ(3, -8), 0, 0, 0x80000004, -8},
+	{"jalr", encI(0x67, 0, 3, 1, 5), 0x80000100, 0, 0x80000004, 0x104},
+	{"beq taken", encB(0, 1, 2, 8), 5, 5, 0xdeadbeef, 8},
+	{"beq", encB(0, 1, 2, 8), 5, 6, 0xdeadbeef, 0},
+	{"bne taken", encB(1, 1, 2, -4), 5, 6, 0xdeadbeef, -4},
+	{"bne", encB(1, 1, 2, -4), 5, 5, 0xdeadbeef, 0},
+	{"blt taken", encB(4, 1, 2, 8), 0xffffffff, 1, 0xdeadbeef, 8},
+	{"blt", encB(4, 1, 2, 8), 1, 1, 0xdeadbeef, 0},
+	{"bge taken", encB(5, 1, 2, 8), 1, 0xffffffff, 0xdeadbeef, 8},
+	{"bge equal", encB(5, 1, 2, 8), 7, 7, 0xdeadbeef, 8},
+	{"bge", encB(5, 1, 2, 8), 0xffffffff, 1, 0xdeadbeef, 0},
+	{"bltu taken", encB(6, 1, 2, 8), 1, 0xffffffff, 0xdeadbeef, 8},
+	{"bltu", encB(6, 1, 2, 8), 0xffffffff, 1, 0xdeadbeef, 0},
+	{"bgeu taken", encB(7, 1, 2, 8), 0xffffffff, 1, 0xdeadbeef, 8},
+	{"bgeu", encB(7, 1, 2, 8), 1, 0xffffffff, 0xdeadbeef, 0},
+	{"lb", encI(0x03, 0, 3, 1, 0), 0x80001000, 0, 0xffffffff, 0},
+	{"lb 3", encI(0x03, 0, 3, 1, 3), 0x80001000, 0, 0xffffff80, 0},
+	{"lh", encI(0x03, 1, 3, 1, 0), 0x80001000, 0, 0xfffff0ff, 0},
+	{"lh 2", encI(0x03, 1, 3, 1, 2), 0x80001000, 0, 0xffff8081, 0},
+	{"lw", encI(0x03, 2, 3, 1, 0), 0x80001000, 0, 0x8081f0ff, 0},
+	{"lw negative", encI(0x03, 2, 3, 1, -4), 0x80001004, 0, 0x8081f0ff, 0},
+	{"lbu", encI(0x03, 4, 3, 1, 0), 0x80001000, 0, 0x000000ff, 0},
+	{"lhu", encI(0x03, 5, 3, 1, 2), 0x80001000, 0, 0x00008081, 0},
+	{"addi", encI(0x13, 0, 3, 1, -1), 0, 0, 0xffffffff, 0},
+	{"addi wrap", encI(0x13, 0, 3, 1, 1), 0xffffffff, 0, 0, 0},
+	{"slti", encI(0x13, 2, 3, 1, -1), 0xfffffffe, 0, 1, 0},
+	{"slti false", encI(0x13, 2, 3, 1, -1), 0, 0, 0, 0},
+	{"sltiu", encI(0x13, 3, 3, 1, -1), 1, 0, 1, 0},
+	{"sltiu false", encI(0x13, 3, 3, 1, 1), 1, 0, 0, 0},
+	{"xori", encI(0x13, 4, 3, 1, -1), 0xff, 0, 0xffffff00, 0},
+	{"ori", encI(0x13, 6, 3, 1, 0x0f), 0xf0, 0, 0xff, 0},
+	{"andi", encI(0x13, 7, 3, 1, 0x0f0), 0xfff, 0, 0xf0, 0},
+	{"slli", encR(0x13, 1, 0, 3, 1, 31), 1, 0, 0x80000000, 0},
+	{"srli", encR(0x13, 5, 0, 3, 1, 31), 0x80000000, 0, 1, 0},
+	{"srai", encR(0x13, 5, 0x20, 3, 1, 31), 0x80000000, 0, 0xffffffff, 0},
+	{"srai 4", encR(0x13, 5, 0x20, 3, 1, 4), 0x80000000, 0, 0xf8000000, 0},
+	{"add", encR(0x33, 0, 0, 3, 1, 2), 0xffffffff, 1, 0, 0},
+	{"sub", encR(0x33, 0, 0x20, 3, 1, 2), 0, 1, 0xffffffff, 0},
+	{"sll", encR(0x33, 1, 0, 3, 1, 2), 1, 33, 2, 0},
+	{"slt", encR(0x33, 2, 0, 3, 1, 2), 0xffffffff, 1, 1, 0},
+	{"sltu", encR(0x33, 3, 0, 3, 1, 2), 0xffffffff, 1, 0, 0},
+	{"xor", encR(0x33, 4, 0, 3, 1, 2), 0xff00ff00, 0x0ff00ff0, 0xf0f0f0f0, 0},
+	{"srl", encR(0x33, 5, 0, 3, 1, 2), 0x80000000, 31, 1, 0},
+	{"sra", encR(0x33, 5, 0x20, 3, 1, 2), 0x80000000, 31, 0xffffffff, 0},
+	{"sra masked", encR(0x33, 5, 0x20, 3, 1, 2), 0x80000000, 36, 0xf8000000, 0},
+	{"or", encR(0x33, 6, 0, 3, 1, 2), 0xff00ff00, 0x0ff00ff0, 0xfff0fff0, 0},
+	{"and", encR(0x33, 7, 0, 3, 1, 2), 0xff00ff00, 0x0ff00ff0, 0x0f000f00, 0},
+	{"mul", encR(0x33, 0, 1, 3, 1, 2), 0x10001, 0x10000, 0x00010000, 0},
+	{"mul negative", encR(0x33, 0, 1, 3, 1, 2), 0xfffffffd, 7, 0xffffffeb, 0},
+	{"mulh", encR(0x33, 1, 1, 3, 1, 2), 0x80000000, 0x80000000, 0x40000000, 0},
+	{"mulh mixed", encR(0x33, 1, 1, 3, 1, 2), 0xffffffff, 1, 0xffffffff, 0},
+	{"mulhsu", encR(0x33, 2, 1, 3, 1, 2), 0xffffffff, 0xffffffff, 0xffffffff, 0},
+	{"mulhsu positive", encR(0x33, 2, 1, 3, 1, 2), 2, 0x80000000, 1, 0},
+	{"mulhu", encR(0x33, 3, 1, 3, 1, 2), 0xffffffff, 0xffffffff, 0xfffffffe, 0},
+	{"div", encR(0x33, 4, 1, 3, 1, 2), 0xfffffff9, 2, 0xfffffffd, 0},
+	{"div by zero", encR(0x33, 4, 1, 3, 1, 2), 7, 0, 0xffffffff, 0},
+	{"div overflow", encR(0x33, 4, 1, 3, 1, 2), 0x80000000, 0xffffffff, 0x80000000, 0},
+	{"divu", encR(0x33, 5, 1, 3, 1, 2), 0xfffffff9, 2, 0x7ffffffc, 0},
+	{"divu by zero", encR(0x33, 5, 1, 3, 1, 2), 7, 0, 0xffffffff, 0},
+	{"rem", encR(0x33, 6, 1, 3, 1, 2), 0xfffffff9, 2, 0xffffffff, 0},
+	{"rem by zero", encR(0x33, 6, 1, 3, 1, 2), 7, 0, 7, 0},
+	{"rem overflow", encR(0x33, 6, 1, 3, 1, 2), 0x80000000, 0xffffffff, 0, 0},
+	{"remu", encR(0x33, 7, 1, 3, 1, 2), 0xfffffff9, 2, 1, 0},
+	{"remu by zero", encR(0x33, 7, 1, 3, 1, 2), 7, 0, 7, 0},
+	{"fence", encI(0x0f, 0, 0, 0, 0x0ff), 0, 0, 0xdeadbeef, 0},
+	{"fence.i", encI(0x0f, 1, 0, 0, 0), 0, 0, 0xdeadbeef, 0},
+}
+
+func TestExecute(t *testing.T) {
+	for _, tt := range executeTests {
+		p := newTestCPU(t)
+		p.bus.WriteWord(0x80001000, 0x8081f0ff)
+		p.Regs[1], p.Regs[2], p.Regs[3] = tt.rs1, tt.rs2, 0xdeadbeef
+		pc := p.PC
+		exec(p, tt.inst)
+		next := tt.next
+		if next == 0 {
+			next = 4
+		}
+		if p.Regs[3] != tt.rd {
+			t.Errorf("%v: x3 = %08x, want %08x", tt.name, p.Regs[3], tt.rd)
+		}
+		if p.PC != pc+uint32(next) {
+			t.Errorf("%v: pc = %08x, want %08x", tt.name, p.PC, pc+uint32(next))
+		}
+		if p.Instret != 1 {
+			t.Errorf("%v: instret = %v, want 1", tt.name, p.Instret)
+		}
+	}
+}
+
+func TestExecuteZero(t *testing.T) {
+	p := newTestCPU(t)
+	exec(p, encI(0x13, 0, 0, 0, 5))
+	exec(p, encU(0x37, 0, 0x1000))
+	exec(p, encJ(0, 8))
+	if p.Regs[0] != 0 {
+		t.Errorf("x0 = %08x", p.Regs[0])
+	}
+}
+
+func TestExecuteStore(t *testing.T) {
+	tests := []struct {
+		name string
+		inst uint32
+		want uint32
+	}{
+		{"sb", encS(0, 1, 2, 0), 0x111111dd},
+		{"sb 3", encS(0, 1, 2, 3), 0xdd111111},
+		{"sh", encS(1, 1, 2, 0), 0x1111ccdd},
+		{"sh 2", encS(1, 1, 2, 2), 0xccdd1111},
+		{"sw", encS(2, 1, 2, 0), 0xaabbccdd},
+		{"sw negative", encS(2, 1, 2, -4), 0x11111111},
+	}
+	for _, tt := range tests {
+		p := newTestCPU(t)
+		p.bus.WriteWord(0x80001000, 0x11111111)
+		p.Regs[1], p.Regs[2] = 0x80001000, 0xaabbccdd
+		exec(p, tt.inst)
+		if got := p.bus.ReadWord(0x80001000); got != tt.want {
+			t.Errorf("%v: memory = %08x, want %08x", tt.name, got, tt.want)
+		}
+		if p.PC != 0x80000004 {
+			t.Errorf("%v: pc = %08x", tt.name, p.PC)
+		}
+	}
+}
+
+func TestExecuteAtomic(t *testing.T) {
+	tests := []struct {
+		funct5 uint32
+		mem    uint32
+		rs2    uint32
+		want   uint32
+	}{
+		{0x00, 5, 3, 8},
+		{0x01, 5, 3, 3},
+		{0x04, 0xff00, 0x0ff0, 0xf0f0},
+		{0x08, 0xff00, 0x0ff0, 0xfff0},
+		{0x0c, 0xff00, 0x0ff0, 0x0f00},
+		{0x10, 0xffffffff, 1, 0xffffffff},
+		{0x14, 0xffffffff, 1, 1},
+		{0x18, 0xffffffff, 1, 1},
+		{0x1c, 0xffffffff, 1, 0xffffffff},
+	}
+	for _, tt := range tests {
+		p := newTestCPU(t)
+		p.bus.WriteWord(0x80001000, tt.mem)
+		p.Regs[1], p.Regs[2] = 0x80001000, tt.rs2
+		exec(p, encR(0x2f, 2, tt.funct5<<2, 3, 1, 2))
+		name := amoTable[tt.funct5]
+		if p.Regs[3] != tt.mem {
+			t.Errorf("%v: x3 = %08x, want %08x", name, p.Regs[3], tt.mem)
+		}
+		if got := p.bus.ReadWord(0x80001000); got != tt.want {
+			t.Errorf("%v: memory = %08x, want %08x", name, got, tt.want)
+		}
+	}
+
+	p := newTestCPU(t)
+	p.bus.WriteWord(0x80001000, 42)
+	p.Regs[1], p.Regs[2] = 0x80001000, 7
+	lr := encR(0x2f, 2, 0x02<<2, 3, 1, 0)
+	sc := encR(0x2f, 2, 0x03<<2, 4, 1, 2)
+	exec(p, lr)
+	exec(p, sc)
+	if (p.Regs[3] != 42) || (p.Regs[4] != 0) || (p.bus.ReadWord(0x80001000) != 7) {
+		t.Errorf("lr/sc: x3 = %v, x4 = %v, memory = %v", p.Regs[3], p.Regs[4], p.bus.ReadWord(0x80001000))
+	}
+	exec(p, sc)
+	if p.Regs[4] != 1 {
+		t.Errorf("sc without reservation: x4 = %v, want 1", p.Regs[4])
+	}
+}
+
+// A store by another hart to the reserved word breaks the reservation; a
+// store elsewhere does not.
+func TestHartsReservation(t *testing.T) {
+	lr := encR(0x2f, 2, 0x02<<2, 3, 1, 0)
+	sc := encR(0x2f, 2, 0x03<<2, 4, 1, 2)
+	for _, tt := range []struct {
+		addr uint32
+		want uint32
+	}{
+		{0x80001000, 1},
+		{0x80001002, 1},
+		{0x80001004, 0},
+	} {
+		h := newTestHarts(t, 2)
+		h[0].Regs[1], h[0].Regs[2] = 0x80001000, 7
+		exec(h[0], lr)
+		h[1].Regs[1], h[1].Regs[2] = tt.addr, 0
+		exec(h[1], encS(1, 1, 2, 0)) // sh x2, 0(x1)
+		exec(h[0], sc)
+		if h[0].Regs[4] != tt.want {
+			t.Errorf("store to %08x: sc.w returned %v, want %v", tt.addr, h[0].Regs[4], tt.want)
+		}
+	}
+}
+
+// Harts take turns of quantum steps on the shared bus.
+func TestHartsRoundRobin(t *testing.T) {
+	prog := []uint32{
+		encU(0x37, 11, 0x80001000),   // lui a1, 0x80001
+		encI(0x13, 0, 12, 0, 1),      // li a2, 1
+		encI(0x13, 0, 9, 0, 100),     // li s1, 100
+		encR(0x2f, 2, 0, 0, 11, 12),  // amoadd.w x0, a2, (a1)
+		encI(0x13, 0, 9, 9, -1),      // addi s1, s1, -1
+		encB(1, 9, 0, -8),            // bnez s1, 1b
+		encI(0x73, 2, 10, 0, 0xf14),  // csrr a0, mhartid
+		encI(0x13, 1, 10, 10, 2),     // slli a0, a0, 2
+		encR(0x33, 0, 0, 10, 10, 11), // add a0, a0, a1
+		encS(2, 10, 12, 4),           // sw a2, 4(a0)
+		encJ(0, 0),                   // j .
+	}
+	h := newTestHarts(t, 2)
+	for i, inst := range prog {
+		h[0].bus.WriteWord(h[0].PC+uint32(4*i), inst)
+	}
+	for i := 0; i < 100; i++ {
+		for _, p := range h {
+			runHart(p, 10, false)
+		}
+		if i == 0 && (h[0].Instret != 10 || h[1].Instret != 10) {
+			t.Errorf("after one round instret %v and %v, want 10 each", h[0].Instret, h[1].Instret)
+		}
+	}
+	bus := h[0].bus
+	if n := bus.ReadWord(0x80001000); n != 200 {
+		t.Errorf("counter %v, want 200", n)
+	}
+	for i := range h {
+		if bus.ReadWord(0x80001004+uint32(4*i)) != 1 {
+			t.Errorf("hart %v did not finish", i)
+		}
+	}
+}
+
+func TestExecuteCSR(t *testing.T) {
+	tests := []struct {
+		name string
+		inst uint32
+		want uint32
+	}{
+		{"csrrw", encI(0x73, 1, 3, 1, CSR_ADDR_MSCRATCH), 0x0000ffe0},
+		{"csrrs", encI(0x73, 2, 3, 1, CSR_ADDR_MSCRATCH), 0x0ff0fff0},
+		{"csrrc", encI(0x73, 3, 3, 1, CSR_ADDR_MSCRATCH), 0x0ff00010},
+		{"csrrwi", encI(0x73, 5, 3, 0x15, CSR_ADDR_MSCRATCH), 0x00000015},
+		{"csrrsi", encI(0x73, 6, 3, 0x15, CSR_ADDR_MSCRATCH), 0x0ff0ff15},
+		{"csrrci", encI(0x73, 7, 3, 0x15, CSR_ADDR_MSCRATCH), 0x0ff0ff00},
+	}
+	for _, tt := range tests {
+		p := newTestCPU(t)
+		p.CSRs[CSR_ADDR_MSCRATCH] = 0x0ff0ff10
+		p.Regs[1] = 0x0000ffe0
+		exec(p, tt.inst)
+		if p.Regs[3] != 0x0ff0ff10 {
+			t.Errorf("%v: x3 = %08x, want the old value", tt.name, p.Regs[3])
+		}
+		if got := p.CSRs[CSR_ADDR_MSCRATCH]; got != tt.want {
+			t.Errorf("%v: mscratch = %08x, want %08x", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A write to minstret is what the next instruction reads, the write is
+// not counted on top of it.
+func TestExecuteCounters(t *testing.T) {
+	p := newTestCPU(t)
+	p.Regs[1] = 100
+	exec(p, encI(0x73, 1, 0, 1, CSR_ADDR_MINSTRET))
+	exec(p, encI(0x73, 2, 3, 0, CSR_ADDR_MINSTRET))
+	if p.Regs[3] != 100 {
+		t.Errorf("minstret = %v after writing 100", p.Regs[3])
+	}
+	exec(p, encI(0x73, 1, 0, 1, CSR_ADDR_MINSTRETH))
+	if p.Instret != 100<<32|101 {
+		t.Errorf("instret = %x after writing minstreth", p.Instret)
+	}
+	exec(p, encI(0x13, 0, 0, 0, 0))
+	if p.Instret != 100<<32|102 {
+		t.Errorf("instret = %x, want it to count on", p.Instret)
+	}
+
+	p.Regs[1] = 0x5
+	exec(p, encI(0x73, 1, 0, 1, CSR_ADDR_MCOUNTINHIBIT))
+	exec(p, encI(0x73, 2, 3, 0, CSR_ADDR_MCOUNTINHIBIT))
+	if p.Regs[3] != 0 {
+		t.Errorf("mcountinhibit = %v, want read-only zero", p.Regs[3])
+	}
+}
+
+func TestExecuteTrap(t *testing.T) {
+	tests := []struct {
+		name  string
+		inst  uint32
+		cause uint32
+		tval  uint32
+	}{
+		{"illegal", 0x00000000, EXCEPT_CODE_ILLEGAL_INST, 0},
+		{"illegal sra", encR(0x33, 5, 0x10, 3, 1, 2), EXCEPT_CODE_ILLEGAL_INST, encR(0x33, 5, 0x10, 3, 1, 2)},
+		{"ecall", 0x00000073, EXCEPT_CODE_ECALL_FROM_M, 0},
+		{"ebreak", 0x00100073, EXCEPT_CODE_BREAKPOINT, 0x80000000},
+		{"unknown csr", encI(0x73, 2, 3, 0, 0x7ff), EXCEPT_CODE_ILLEGAL_INST, encI(0x73, 2, 3, 0, 0x7ff)},
+		{"misaligned jal", encJ(3, 6), EXCEPT_CODE_INST_MISALIGNED, 0x80000006},
+		{"misaligned branch", encB(0, 0, 0, 2), EXCEPT_CODE_INST_MISALIGNED, 0x80000002},
+	}
+	for _, tt := range tests {
+		p := newTestCPU(t)
+		p.CSRs[CSR_ADDR_MTVEC] = 0x80000100
+		p.Regs[3] = 0xdeadbeef
+		exec(p, tt.inst)
+		if (p.PC != 0x80000100) || (p.CSRs[CSR_ADDR_MEPC] != 0x80000000) {
+			t.Errorf("%v: pc = %08x, mepc = %08x", tt.name, p.PC, p.CSRs[CSR_ADDR_MEPC])
+		}
+		if (p.CSRs[CSR_ADDR_MCAUSE] != tt.cause) || (p.CSRs[CSR_ADDR_MTVAL] != tt.tval) {
+			t.Errorf("%v: mcause = %v, mtval = %08x, want %v, %08x", tt.name,
+				p.CSRs[CSR_ADDR_MCAUSE], p.CSRs[CSR_ADDR_MTVAL], tt.cause, tt.tval)
+		}
+		if p.Regs[3] != 0xdeadbeef {
+			t.Errorf("%v: x3 = %08x", tt.name, p.Regs[3])
+		}
+	}
+}
+
+func TestExecuteMret(t *testing.T) {
+	p := newTestCPU(t)
+	p.CSRs[CSR_ADDR_MEPC] = 0x80000200
+	p.CSRs[CSR_ADDR_MSTATUS] = MSTATUS_MPIE
+	exec(p, 0x30200073)
+	if (p.PC != 0x80000200) || (p.Priv != PRIV_U) {
+		t.Errorf("mret: pc = %08x, priv = %v", p.PC, p.Priv)
+	}
+	if p.CSRs[CSR_ADDR_MSTATUS]&MSTATUS_MIE == 0 {
+		t.Errorf("mret: mstatus.MIE not restored")
+	}
+	exec(p, 0x30200073)
+	if p.CSRs[CSR_ADDR_MCAUSE] != EXCEPT_CODE_ILLEGAL_INST {
+		t.Errorf("mret in U-mode: mcause = %v", p.CSRs[CSR_ADDR_MCAUSE])
+	}
+}
+
+// benchProgram is the loop of sample/bench.s, a mix of ALU, load/store
+// and branch instructions, running forever.
+var benchProgram = []uint32{
+	encU(0x37, 8, 0x80010000), // lui s0, 0x80010
+	encU(0x37, 9, 0x7ffff000), // lui s1, 0x7ffff
+	encI(0x13, 0, 10, 0, 0),   // li a0, 0
+	encI(0x13, 0, 11, 0, 1),   // li a1, 1
+	encR(0x33, 0, 0, 12, 10, 11),
+	encI(0x13, 0, 10, 11, 0),
+	encI(0x13, 0, 11, 12, 0),
+	encI(0x13, 7, 5, 9, 0xfc),
+	encR(0x33, 0, 0, 5, 5, 8),
+	encS(2, 5, 12, 0),
+	encI(0x03, 2, 6, 5, 0),
+	encR(0x33, 4, 0, 13, 13, 6),
+	encI(0x13, 1, 7, 13, 3),
+	encI(0x13, 5, 28, 13, 5),
+	encR(0x33, 6, 0, 13, 7, 28),
+	encI(0x13, 0, 9, 9, -1),
+	encB(1, 9, 0, -48), // bnez s1, loop
+	encJ(0, -52),       // j loop
+}
+
+// BenchmarkStep measures one instruction per operation the way the
+// simulator runs them; 1000 divided by ns/op is the MIPS figure that
+// make bench prints.
+func BenchmarkStep(b *testing.B) {
+	for _, e := range []struct {
+		name   string
+		icache bool
+		blocks bool
+	}{
+		{"nocache", false, false},
+		{"icache", true, false},
+		{"block", true, true},
+	} {
+		b.Run(e.name, func(b *testing.B) {
+			p := newTestCPU(b)
+			if !e.icache {
+				p.bus.icache = nil
+				p.icache = nil
+			}
+			for i, inst := range benchProgram {
+				p.bus.WriteWord(p.PC+uint32(4*i), inst)
+			}
+			b.ResetTimer()
+			runHart(p, b.N, e.blocks)
+			if p.Instret < uint64(b.N) {
+				b.Fatalf("retired %v of %v instructions", p.Instret, b.N)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+// Writable bits of the CSRs that are not plain read/write registers.
+const (
+	mstatusMask = MSTATUS_SIE | MSTATUS_MIE | MSTATUS_SPIE | MSTATUS_MPIE | MSTATUS_SPP |
+		MSTATUS_MPP | MSTATUS_MPRV | MSTATUS_SUM | MSTATUS_MXR | MSTATUS_TVM | MSTATUS_TW | MSTATUS_TSR
+	sstatusMask = MSTATUS_SIE | MSTATUS_SPIE | MSTATUS_SPP | MSTATUS_SUM | MSTATUS_MXR
+	medelegMask = 0x0000b3ff
+	midelegMask = MIP_SSIP | MIP_STIP | MIP_SEIP
+	mieMask     = MIP_SSIP | MIP_MSIP | MIP_STIP | MIP_MTIP | MIP_SEIP | MIP_MEIP
+	mipMask     = MIP_SSIP | MIP_STIP | MIP_SEIP
+	satpMask    = 0x803fffff // no ASID bits
+)
+
+// csrExists reports whether addr is implemented.
+func csrExists(addr uint32) bool {
+	switch {
+	case addr == CSR_ADDR_SSTATUS, addr == CSR_ADDR_SIE, addr == CSR_ADDR_STVEC,
+		addr == CSR_ADDR_SCOUNTEREN, addr == CSR_ADDR_SSCRATCH, addr == CSR_ADDR_SEPC,
+		addr == CSR_ADDR_SCAUSE, addr == CSR_ADDR_STVAL, addr == CSR_ADDR_SIP,
+		addr == CSR_ADDR_SATP:
+		return true
+	case (CSR_ADDR_MSTATUS <= addr) && (addr <= CSR_ADDR_MCOUNTEREN):
+		return true
+	case addr == CSR_ADDR_MSTATUSH, addr == CSR_ADDR_MCOUNTINHIBIT:
+		return true
+	case (CSR_ADDR_MHPMEVENT3 <= addr) && (addr <= CSR_ADDR_MHPMEVENT31):
+		return true
+	case (CSR_ADDR_MSCRATCH <= addr) && (addr <= CSR_ADDR_MIP):
+		return true
+	case (CSR_ADDR_PMPCFG0 <= addr) && (addr <= CSR_ADDR_PMPCFG3):
+		return true
+	case (CSR_ADDR_PMPADDR0 <= addr) && (addr <= CSR_ADDR_PMPADDR15):
+		return true
+	case (CSR_ADDR_MCYCLE <= addr) && (addr <= CSR_ADDR_MHPMCOUNTER31):
+		return true
+	case (CSR_ADDR_MCYCLEH <= addr) && (addr <= CSR_ADDR_MHPMCOUNTER31H):
+		return true
+	case (CSR_ADDR_CYCLE <= addr) && (addr <= CSR_ADDR_HPMCOUNTER31):
+		return true
+	case (CSR_ADDR_CYCLEH <= addr) && (addr <= CSR_ADDR_HPMCOUNTER31H):
+		return true
+	case (CSR_ADDR_MVENDORID <= addr) && (addr <= CSR_ADDR_MHARTID):
+		return true
+	}
+	return false
+}
+
+// CSRAllowed reports whether the current privilege level may access addr.
+// An access that is not allowed raises an illegal instruction exception.
+func (p *CPU) CSRAllowed(addr uint32, write bool) bool {
+	if !csrExists(addr) {
+		return false
+	}
+	if p.Priv < (addr>>8)&0x3 {
+		return false
+	}
+	if write && (addr>>10)&0x3 == 0x3 {
+		return false
+	}
+	if (addr == CSR_ADDR_SATP) && (p.Priv == PRIV_S) && (p.CSRs[CSR_ADDR_MSTATUS]&MSTATUS_TVM != 0) {
+		return false
+	}
+
+	// User counters are gated by mcounteren and scounteren.
+	var counter uint32 = 0xffffffff
+	if (CSR_ADDR_CYCLE <= addr) && (addr <= CSR_ADDR_HPMCOUNTER31) {
+		counter = addr - CSR_ADDR_CYCLE
+	} else if (CSR_ADDR_CYCLEH <= addr) && (addr <= CSR_ADDR_HPMCOUNTER31H) {
+		counter = addr - CSR_ADDR_CYCLEH
+	}
+	if counter != 0xffffffff {
+		if (p.Priv < PRIV_M) && (p.CSRs[CSR_ADDR_MCOUNTEREN]&(1<<counter) == 0) {
+			return false
+		}
+		if (p.Priv < PRIV_S) && (p.CSRs[CSR_ADDR_SCOUNTEREN]&(1<<counter) == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *CPU) CSRLoad(addr uint32) uint32 {
+	switch {
+	case addr == CSR_ADDR_SSTATUS:
+		return p.CSRs[CSR_ADDR_MSTATUS] & sstatusMask
+	case addr == CSR_ADDR_SIE:
+		return p.CSRs[CSR_ADDR_MIE] & p.CSRs[CSR_ADDR_MIDELEG]
+	case addr == CSR_ADDR_SIP:
+		return p.CSRs[CSR_ADDR_MIP] & p.CSRs[CSR_ADDR_MIDELEG]
+	case addr == CSR_ADDR_MCYCLE, addr == CSR_ADDR_CYCLE:
+		return uint32(p.Cycle)
+	case addr == CSR_ADDR_MCYCLEH, addr == CSR_ADDR_CYCLEH:
+		return uint32(p.Cycle >> 32)
+	case addr == CSR_ADDR_MINSTRET, addr == CSR_ADDR_INSTRET:
+		return uint32(p.Instret)
+	case addr == CSR_ADDR_MINSTRETH, addr == CSR_ADDR_INSTRETH:
+		return uint32(p.Instret >> 32)
+	case addr == CSR_ADDR_TIME:
+		return uint32(p.bus.Time())
+	case addr == CSR_ADDR_TIMEH:
+		return uint32(p.bus.Time() >> 32)
+	case (CSR_ADDR_MHPMEVENT3 <= addr) && (addr <= CSR_ADDR_MHPMEVENT31),
+		(CSR_ADDR_MCYCLE <= addr) && (addr <= CSR_ADDR_MHPMCOUNTER31H),
+		(CSR_ADDR_CYCLE <= addr) && (addr <= CSR_ADDR_HPMCOUNTER31H):
+		// no hardware performance monitor
+		return 0
+	default:
+		return p.CSRs[addr]
+	}
+}
+
+func (p *CPU) CSRStore(addr uint32, data uint32) {
+	switch addr {
+	case CSR_ADDR_SSTATUS:
+		p.CSRs[CSR_ADDR_MSTATUS] = (p.CSRs[CSR_ADDR_MSTATUS] &^ sstatusMask) | (data & sstatusMask)
+	case CSR_ADDR_SIE:
+		mask := p.CSRs[CSR_ADDR_MIDELEG]
+		p.CSRs[CSR_ADDR_MIE] = (p.CSRs[CSR_ADDR_MIE] &^ mask) | (data & mask)
+	case CSR_ADDR_SIP:
+		mask := p.CSRs[CSR_ADDR_MIDELEG] & MIP_SSIP
+		p.CSRs[CSR_ADDR_MIP] = (p.CSRs[CSR_ADDR_MIP] &^ mask) | (data & mask)
+	case CSR_ADDR_STVEC, CSR_ADDR_MTVEC:
+		if data&0x3 >= 2 {
+			data = data &^ 0x3
+		}
+		p.CSRs[addr] = data
+	case CSR_ADDR_SEPC, CSR_ADDR_MEPC:
+		p.CSRs[addr] = data &^ 0x3
+	case CSR_ADDR_SATP:
+		p.CSRs[addr] = data & satpMask
+		p.FlushTLB()
+	case CSR_ADDR_MSTATUS:
+		if (data&MSTATUS_MPP)>>11 == 2 {
+			data = data &^ MSTATUS_MPP
+		}
+		p.CSRs[addr] = (p.CSRs[addr] &^ mstatusMask) | (data & mstatusMask)
+	case CSR_ADDR_MISA, CSR_ADDR_MSTATUSH:
+	case CSR_ADDR_MCOUNTINHIBIT:
+		// The counters always count; the simulator's timeline is
+		// mcycle, so mcountinhibit is read-only zero.
+	case CSR_ADDR_MEDELEG:
+		p.CSRs[addr] = data & medelegMask
+	case CSR_ADDR_MIDELEG:
+		p.CSRs[addr] = data & midelegMask
+	case CSR_ADDR_MIE:
+		p.CSRs[addr] = data & mieMask
+	case CSR_ADDR_MIP:
+		p.CSRs[addr] = (p.CSRs[addr] &^ mipMask) | (data & mipMask)
+		p.seip = data&MIP_SEIP != 0
+	case CSR_ADDR_MCYCLE:
+		p.Cycle = (p.Cycle & 0xffffffff00000000) | uint64(data)
+	case CSR_ADDR_MCYCLEH:
+		p.Cycle = (p.Cycle & 0x00000000ffffffff) | (uint64(data) << 32)
+	case CSR_ADDR_MINSTRET:
+		p.Instret = (p.Instret & 0xffffffff00000000) | uint64(data)
+		p.instretW = true
+	case CSR_ADDR_MINSTRETH:
+		p.Instret = (p.Instret & 0x00000000ffffffff) | (uint64(data) << 32)
+		p.instretW = true
+	default:
+		if (CSR_ADDR_MHPMEVENT3 <= addr) && (addr <= CSR_ADDR_MHPMEVENT31) {
+			return
+		}
+		if (CSR_ADDR_MCYCLE <= addr) && (addr <= CSR_ADDR_MHPMCOUNTER31H) {
+			return
+		}
+		p.CSRs[addr] = data
+	}
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// With -debug the machine does not run on its own. Commands read from
+// standard input step it forwards and backwards, stop it at breakpoints
+// and watchpoints, and find the store that last wrote to an address.
+//
+// Going backwards works by running again: every so many steps the
+// debugger keeps a snapshot of the machine, and to reach an earlier step
+// it restores the last snapshot before it and runs forward from there. A
+// snapshot only copies the memory pages written since the one before and
+// shares the others with it.
+// Inputs from the host are logged as with -record and replayed on the
+// way, and console output that has been shown already is not repeated, so
+// the machine goes through exactly the same states again. Files written
+// through semihosting are written again.
+//
+// A step is one step of one hart. With more than one hart they take turns
+// quantum by quantum as in a normal run. Addresses are physical.
+const (
+	checkpointInterval = 100000
+	checkpointMax      = 64
+)
+
+type checkpoint struct {
+	pos   uint64
+	state []byte              // the snapshot without the memory pages
+	pages []map[uint32][]byte // the pages of each memory of the snapshot
+	rec   recState
+}
+
+type watchpoint struct {
+	addr uint32
+	size uint32
+}
+
+func (w watchpoint) covers(addr uint32, size uint32) bool {
+	return (uint64(addr) < uint64(w.addr)+uint64(w.size)) && (uint64(w.addr) < uint64(addr)+uint64(size))
+}
+
+// A store found by who. hart is -1 for a device.
+type storeInfo struct {
+	pos  uint64
+	hart int
+	pc   uint32
+}
+
+// muteWriter drops the output written to it while *mute is set. The
+// writers of all UARTs share one flag.
+type muteWriter struct {
+	w    io.Writer
+	mute *bool
+}
+
+func (p *muteWriter) Write(b []byte) (int, error) {
+	if *p.mute {
+		return len(b), nil
+	}
+	return p.w.Write(b)
+}
+
+type Debugger struct {
+	harts   []*CPU
+	bus     *Bus
+	rec     *Recorder
+	mute    *bool
+	w       io.Writer
+	quantum uint64
+
+	pos         uint64 // steps run since the start
+	frontier    uint64 // the furthest pos reached
+	checkpoints []checkpoint
+	interval    uint64
+	// base holds the pages of the checkpoint taken or restored last. The
+	// pages that are not in bus.dirty still hold the same.
+	base []map[uint32][]byte
+
+	breaks  map[uint32]bool
+	watches []watchpoint
+	hit     *watchpoint // the watchpoint the last step stored to
+	who     watchpoint
+	wrote   bool // the last step stored to who
+	store   storeInfo
+
+	interrupted int32
+}
+
+// NewDebugger takes control of the machine on bus, whose inputs go
+// through rec and whose UART output is dropped while *mute is set.
+func NewDebugger(bus *Bus, rec *Recorder, mute *bool) *Debugger {
+	d := &Debugger{
+		harts:    bus.harts,
+		bus:      bus,
+		rec:      rec,
+		mute:     mute,
+		w:        os.Stdout,
+		quantum:  uint64(bus.machine.Quantum),
+		interval: checkpointInterval,
+		breaks:   map[uint32]bool{},
+	}
+	bus.watch = d.watch
+	bus.dirty = map[uint32]bool{}
+	d.checkpoint()
+	return d
+}
+
+func (d *Debugger) watch(h *CPU, vaddr uint32, paddr uint32, size uint32, data uint32) {
+	for i := range d.watches {
+		if d.watches[i].covers(paddr, size) {
+			d.hit = &d.watches[i]
+		}
+	}
+	if (d.who.size != 0) && d.who.covers(paddr, size) {
+		d.wrote = true
+		d.store = storeInfo{d.pos, -1, 0}
+		if h != nil {
+			d.store = storeInfo{d.pos, h.hart, h.PC}
+		}
+	}
+}
+
+// current returns the hart that runs the next step.
+func (d *Debugger) current() *CPU {
+	return d.harts[(d.pos/d.quantum)%uint64(len(d.harts))]
+}
+
+func (d *Debugger) halted() *CPU {
+	for _, h := range d.harts {
+		if h.Halted {
+			return h
+		}
+	}
+	return nil
+}
+
+// step runs the next step. It returns false if a hart has halted.
+func (d *Debugger) step() bool {
+	if d.halted() != nil {
+		return false
+	}
+	if d.pos == d.frontier {
+		d.rec.resume()
+		*d.mute = false
+	}
+	d.hit = nil
+	d.wrote = false
+	h := d.current()
+	if h.Tick() {
+		if ops, ok := h.Next(); ok {
+			h.Execute(ops)
+		}
+	}
+	if h.Halted {
+		h.bus.flushSerial()
+	}
+	d.pos++
+	if d.pos > d.frontier {
+		d.frontier = d.pos
+	}
+	if d.pos >= d.checkpoints[len(d.checkpoints)-1].pos+d.interval {
+		d.checkpoint()
+	}
+	return true
+}
+
+// checkpoint keeps a snapshot of the machine at the current step. When
+// there are too many, every other one is dropped and they are taken half
+// as often.
+func (d *Debugger) checkpoint() {
+	s := d.bus.Save()
+	pages := make([]map[uint32][]byte, len(s.Mems))
+	for i := range s.Mems {
+		m := &s.Mems[i]
+		pages[i] = make(map[uint32][]byte, len(m.Pages))
+		for pn, pg := range m.Pages {
+			old, ok := []byte(nil), false
+			if i < len(d.base) {
+				old, ok = d.base[i][pn]
+			}
+			if ok && !d.bus.dirty[m.Base+pn<<pageShift] {
+				pages[i][pn] = old
+			} else {
+				pages[i][pn] = append([]byte(nil), pg...)
+			}
+		}
+		m.Pages = nil
+	}
+	d.base = pages
+	d.bus.dirty = map[uint32]bool{}
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(s); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	d.checkpoints = append(d.checkpoints, checkpoint{d.pos, b.Bytes(), pages, d.rec.state()})
+	if len(d.checkpoints) > checkpointMax {
+		t := d.checkpoints[:0]
+		for i := 0; i < len(d.checkpoints); i += 2 {
+			t = append(t, d.checkpoints[i])
+		}
+		d.checkpoints = t
+		d.interval *= 2
+	}
+}
+
+func (d *Debugger) restore(ck *checkpoint) {
+	s := &Snapshot{}
+	if err := gob.NewDecoder(bytes.NewReader(ck.state)).Decode(s); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	// The machine gets copies, the pages are shared with later
+	// checkpoints.
+	for i := range s.Mems {
+		s.Mems[i].Pages = make(map[uint32][]byte, len(ck.pages[i]))
+		for pn, pg := range ck.pages[i] {
+			s.Mems[i].Pages[pn] = append([]byte(nil), pg...)
+		}
+	}
+	if err := d.bus.Restore(s); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	d.base = ck.pages
+	d.bus.dirty = map[uint32]bool{}
+	d.rec.rewind(ck.rec)
+	d.pos = ck.pos
+	d.hit = nil
+	d.wrote = false
+	*d.mute = d.pos < d.frontier
+}
+
+// seek brings the machine to step t, which must not be past the
+// frontier.
+func (d *Debugger) seek(t uint64) {
+	if t < d.pos {
+		i := len(d.checkpoints) - 1
+		for d.checkpoints[i].pos > t {
+			i--
+		}
+		d.restore(&d.checkpoints[i])
+	}
+	for (d.pos < t) && d.step() {
+	}
+}
+
+// findBack runs the steps up to last again, a checkpoint at a time
+// starting with the last one, and returns the last step up to last where
+// stop reports true. stop is called before each step and after the last,
+// when d.hit and d.wrote describe the step that ended there. The machine
+// is left anywhere up to last.
+func (d *Debugger) findBack(last uint64, stop func() bool) (uint64, bool) {
+	end := last
+	for i := len(d.checkpoints) - 1; i >= 0; i-- {
+		ck := &d.checkpoints[i]
+		if ck.pos >= end {
+			continue
+		}
+		d.restore(ck)
+		var at uint64
+		found := false
+		for {
+			if (d.pos <= last) && stop() {
+				at, found = d.pos, true
+			}
+			if (d.pos >= end) || !d.step() {
+				break
+			}
+		}
+		if found {
+			return at, true
+		}
+		end = ck.pos
+	}
+	return 0, false
+}
+
+func (d *Debugger) atBreak() bool {
+	return d.breaks[d.current().PC]
+}
+
+// stepi runs n steps, stopping early at a breakpoint or watchpoint.
+func (d *Debugger) stepi(n uint64) {
+	for i := uint64(0); i < n; i++ {
+		if !d.step() || (d.hit != nil) || d.atBreak() {
+			break
+		}
+	}
+	d.where()
+}
+
+// cont runs until a breakpoint, a watchpoint, a hart halting or SIGINT.
+func (d *Debugger) cont() {
+	atomic.StoreInt32(&d.interrupted, 0)
+	for i := 0; ; i++ {
+		if !d.step() || (d.hit != nil) || d.atBreak() {
+			break
+		}
+		if (i&0xfff == 0) && (atomic.LoadInt32(&d.interrupted) != 0) {
+			fmt.Fprintf(d.w, "interrupted\n")
+			break
+		}
+	}
+	d.where()
+}
+
+func (d *Debugger) reverseStepi(n uint64) {
+	if n > d.pos {
+		n = d.pos
+	}
+	d.seek(d.pos - n)
+	d.where()
+}
+
+// reverseContinue goes back to the last point where cont would have
+// stopped, or to the start.
+func (d *Debugger) reverseContinue() {
+	var at uint64
+	ok := false
+	if d.pos > 0 {
+		at, ok = d.findBack(d.pos-1, func() bool { return (d.hit != nil) || d.atBreak() })
+	}
+	if !ok {
+		fmt.Fprintf(d.w, "reached the start\n")
+	}
+	d.seek(at)
+	d.where()
+}
+
+// whoWrote finds the last store to w up to the current step, including
+// the step that has just run.
+func (d *Debugger) whoWrote(w watchpoint) {
+	cur := d.pos
+	d.who = w
+	var s storeInfo
+	_, ok := d.findBack(cur, func() bool {
+		if d.wrote {
+			s = d.store
+		}
+		return d.wrote
+	})
+	d.who = watchpoint{}
+	d.seek(cur)
+	if !ok {
+		fmt.Fprintf(d.w, "no hart stored to %08x since the start\n", w.addr)
+		return
+	}
+	if s.hart < 0 {
+		fmt.Fprintf(d.w, "step %v: a device\n", s.pos)
+		return
+	}
+	fmt.Fprintf(d.w, "step %v, hart %v: %v\n", s.pos, s.hart, d.disasm(d.harts[s.hart], s.pc))
+}
+
+// peek reads the word at addr if it is memory, without side effects.
+func (d *Debugger) peek(addr uint32) (uint32, bool) {
+	dev, off := d.bus.lookup(addr)
+	if m, ok := dev.(*Mem); ok {
+		return m.ReadWord(off &^ 3), true
+	}
+	return 0, false
+}
+
+// disasm returns the instruction at pc of hart h. It is only shown when
+// pc is translated by the TLB or not at all, a page table walk would
+// change the machine.
+func (d *Debugger) disasm(h *CPU, pc uint32) string {
+	s := fmt.Sprintf("pc %08x", pc)
+	paddr := pc
+	if (h.Priv != PRIV_M) && (h.CSRs[CSR_ADDR_SATP]&0x80000000 != 0) {
+		e, ok := h.tlb[pc>>12]
+		if !ok || (e.ppn > 0xfffff) {
+			return s
+		}
+		paddr = uint32(e.ppn<<12) | (pc & 0xfff)
+	}
+	inst, ok := d.peek(paddr)
+	if !ok {
+		return s
+	}
+	ops := h.Decode(inst)
+	return fmt.Sprintf("%v: %08x  %v", s, inst, disasms[ops.Name](&ops, pc))
+}
+
+func (d *Debugger) where() {
+	if h := d.halted(); h != nil {
+		fmt.Fprintf(d.w, "hart %v exited with status %v\n", h.hart, h.Exit)
+	}
+	h := d.current()
+	if d.hit != nil {
+		fmt.Fprintf(d.w, "watchpoint at %08x\n", d.hit.addr)
+	} else if d.atBreak() {
+		fmt.Fprintf(d.w, "breakpoint at %08x\n", h.PC)
+	}
+	fmt.Fprintf(d.w, "step %v, hart %v: %v\n", d.pos, h.hart, d.disasm(h, h.PC))
+}
+
+func (d *Debugger) memory(addr uint32, n uint64) {
+	addr &^= 3
+	for i := uint64(0); i < n; i++ {
+		a := addr + uint32(4*i)
+		if i%4 == 0 {
+			if i > 0 {
+				fmt.Fprintf(d.w, "\n")
+			}
+			fmt.Fprintf(d.w, "%08x:", a)
+		}
+		if t, ok := d.peek(a); ok {
+			fmt.Fprintf(d.w, " %08x", t)
+		} else {
+			fmt.Fprintf(d.w, " --------")
+		}
+	}
+	fmt.Fprintf(d.w, "\n")
+}
+
+const debugHelp = `stepi [N], si [N]           run N steps (1)
+continue, c                 run until a breakpoint, a watchpoint or an exit
+reverse-stepi [N], rsi [N]  go back N steps (1)
+reverse-continue, rc        go back to the last breakpoint or watchpoint hit
+goto STEP                   go to STEP, at most the furthest step run so far
+break ADDR, b ADDR          stop before the instruction at ADDR
+watch ADDR [SIZE]           stop after a store to SIZE bytes at ADDR (4)
+delete                      remove all breakpoints and watchpoints
+who ADDR [SIZE]             find the last store to SIZE bytes at ADDR (1)
+x ADDR [N]                  print N words of memory at ADDR (1)
+regs                        print the registers of every hart
+where                       print the current step
+quit, q                     stop the simulator
+`
+
+// Run reads commands from r until quit or the end of r. It returns the
+// hart that halted, or hart 0.
+func (d *Debugger) Run(r io.Reader) *CPU {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	defer signal.Stop(c)
+	go func() {
+		for range c {
+			atomic.StoreInt32(&d.interrupted, 1)
+		}
+	}()
+
+	d.where()
+	in := bufio.NewScanner(r)
+	var last string
+	for {
+		fmt.Fprintf(d.w, "(rv32) ")
+		if !in.Scan() {
+			fmt.Fprintf(d.w, "\n")
+			break
+		}
+		l := strings.TrimSpace(in.Text())
+		if l == "" {
+			// An empty line repeats the last command.
+			l = last
+		}
+		last = l
+		if (l == "quit") || (l == "q") {
+			break
+		}
+		if err := d.command(strings.Fields(l)); err != nil {
+			fmt.Fprintf(d.w, "%v\n", err)
+		}
+	}
+	if h := d.halted(); h != nil {
+		return h
+	}
+	return d.harts[0]
+}
+
+func (d *Debugger) command(a []string) error {
+	if len(a) == 0 {
+		return nil
+	}
+	arg := func(i int, def uint64) (uint64, error) {
+		if i >= len(a) {
+			return def, nil
+		}
+		n, err := parseSize(a[i])
+		if err != nil {
+			return 0, fmt.Errorf("bad number %v", a[i])
+		}
+		return n, nil
+	}
+	need := func(n int) error {
+		if len(a) < n+1 {
+			return fmt.Errorf("%v needs %v arguments", a[0], n)
+		}
+		return nil
+	}
+	switch a[0] {
+	case "stepi", "si":
+		n, err := arg(1, 1)
+		if err != nil {
+			return err
+		}
+		d.stepi(n)
+	case "continue", "c":
+		d.cont()
+	case "reverse-stepi", "rsi":
+		n, err := arg(1, 1)
+		if err != nil {
+			return err
+		}
+		d.reverseStepi(n)
+	case "reverse-continue", "rc":
+		d.reverseContinue()
+	case "goto":
+		if err := need(1); err != nil {
+			return err
+		}
+		n, err := strconv.ParseUint(a[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad step %v", a[1])
+		}
+		if n > d.frontier {
+			return fmt.Errorf("step %v has not been run yet, the furthest is %v", n, d.frontier)
+		}
+		d.seek(n)
+		d.where()
+	case "break", "b":
+		if err := need(1); err != nil {
+			return err
+		}
+		addr, err := arg(1, 0)
+		if err != nil {
+			return err
+		}
+		d.breaks[uint32(addr)] = true
+	case "watch":
+		if err := need(1); err != nil {
+			return err
+		}
+		addr, err := arg(1, 0)
+		if err != nil {
+			return err
+		}
+		size, err := arg(2, 4)
+		if (err != nil) || (size == 0) {
+			return fmt.Errorf("bad size")
+		}
+		d.watches = append(d.watches, watchpoint{uint32(addr), uint32(size)})
+	case "delete":
+		d.breaks = map[uint32]bool{}
+		d.watches = nil
+		d.hit = nil
+	case "who":
+		if err := need(1); err != nil {
+			return err
+		}
+		addr, err := arg(1, 0)
+		if err != nil {
+			return err
+		}
+		size, err := arg(2, 1)
+		if (err != nil) || (size == 0) {
+			return fmt.Errorf("bad size")
+		}
+		d.whoWrote(watchpoint{uint32(addr), uint32(size)})
+	case "x":
+		if err := need(1); err != nil {
+			return err
+		}
+		addr, err := arg(1, 0)
+		if err != nil {
+			return err
+		}
+		n, err := arg(2, 1)
+		if err != nil {
+			return err
+		}
+		d.memory(uint32(addr), n)
+	case "regs":
+		for _, h := range d.harts {
+			h.Dump(d.w)
+		}
+	case "where":
+		d.where()
+	case "help":
+		fmt.Fprintf(d.w, "%v", debugHelp)
+	default:
+		return fmt.Errorf("unknown command %v, try help", a[0])
+	}
+	return nil
+}
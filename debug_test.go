@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// debugProg stores a counter to 0x80001000 every four steps.
+var debugProg = []uint32{
+	encU(0x37, 5, 0x80001000), // lui t0, 0x80001
+	encI(0x13, 0, 6, 0, 5),    // li t1, 5
+	encS(2, 5, 6, 0),          // 1: sw t1, 0(t0)
+	encI(0x13, 0, 6, 6, 1),    // addi t1, t1, 1
+	encI(0x13, 0, 7, 6, 0),    // mv t2, t1
+	encJ(0, -12),              // j 1b
+}
+
+// newTestDebugger returns a debugger of a machine running debugProg. It
+// keeps a checkpoint every 8 steps so that going back crosses them.
+func newTestDebugger(t *testing.T) (*Debugger, *bytes.Buffer) {
+	p := newTestCPU(t)
+	loadProgram([]*CPU{p}, debugProg)
+	rec, err := Record("", p.bus, "interp", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.bus.rec = rec
+	var out bytes.Buffer
+	rec.Attach(&out, nil)
+	d := NewDebugger(p.bus, rec, new(bool))
+	d.interval = 8
+	d.w = &out
+	return d, &out
+}
+
+// debugRun runs the commands in cmds and returns the output of the last.
+func debugRun(t *testing.T, d *Debugger, out *bytes.Buffer, cmds ...string) string {
+	for _, c := range cmds {
+		out.Reset()
+		if err := d.command(strings.Fields(c)); err != nil {
+			t.Fatalf("%v: %v", c, err)
+		}
+	}
+	return out.String()
+}
+
+// Going back to a step gives the machine it had there.
+func TestDebugReverseStepi(t *testing.T) {
+	d, out := newTestDebugger(t)
+	debugRun(t, d, out, "si 13")
+	want := snapState(d.harts)
+	// The snapshot holds the live pages.
+	for _, m := range want.Mems {
+		for pn, pg := range m.Pages {
+			m.Pages[pn] = append([]byte(nil), pg...)
+		}
+	}
+	debugRun(t, d, out, "si 20")
+	got := debugRun(t, d, out, "rsi 20")
+	if !strings.HasPrefix(got, "step 13, hart 0: pc 80000014") {
+		t.Errorf("rsi 20 printed %q", got)
+	}
+	if !reflect.DeepEqual(snapState(d.harts), want) {
+		t.Errorf("machine at step 13 differs from the first time")
+	}
+	if got := debugRun(t, d, out, "rsi 100"); !strings.HasPrefix(got, "step 0,") {
+		t.Errorf("rsi past the start printed %q", got)
+	}
+}
+
+// reverse-continue goes back to the last watchpoint or breakpoint hit,
+// and to the start if there is none.
+func TestDebugReverseContinue(t *testing.T) {
+	d, out := newTestDebugger(t)
+	if got := debugRun(t, d, out, "si 30", "rc"); !strings.HasPrefix(got, "reached the start\nstep 0,") {
+		t.Errorf("rc without breakpoints printed %q", got)
+	}
+
+	debugRun(t, d, out, "si 30", "watch 0x80001000")
+	got := debugRun(t, d, out, "rc")
+	if !strings.HasPrefix(got, "watchpoint at 80001000\nstep 27,") {
+		t.Errorf("rc to a watchpoint printed %q", got)
+	}
+	if n := d.bus.ReadWord(0x80001000); n != 11 {
+		t.Errorf("counter %v at the watchpoint, want 11", n)
+	}
+	got = debugRun(t, d, out, "delete", "break 0x8000000c", "rc")
+	if !strings.HasPrefix(got, "breakpoint at 8000000c\nstep 23,") {
+		t.Errorf("rc to a breakpoint printed %q", got)
+	}
+}
+
+// who finds the last store to an address, including one made by the
+// step that has just run.
+func TestDebugWho(t *testing.T) {
+	d, out := newTestDebugger(t)
+	if got := debugRun(t, d, out, "si 2", "who 0x80001000 4"); got != "no hart stored to 80001000 since the start\n" {
+		t.Errorf("who before the store printed %q", got)
+	}
+	for _, n := range []int{3, 6, 7, 30} {
+		d.seek(uint64(n))
+		last := (n-3)/4*4 + 2
+		want := fmt.Sprintf("step %v, hart 0: pc 80000008: 0062a023  sw\tt1,0(t0)\n", last)
+		if got := debugRun(t, d, out, "who 0x80001000 4"); got != want {
+			t.Errorf("who at step %v printed %q, want %q", n, got, want)
+		}
+		if d.pos != uint64(n) {
+			t.Errorf("who moved from step %v to %v", n, d.pos)
+		}
+	}
+	if got := debugRun(t, d, out, "who 0x80001004 4"); !strings.HasPrefix(got, "no hart") {
+		t.Errorf("who of an address never written printed %q", got)
+	}
+}
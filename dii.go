@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// With -rvfi-dii the simulator is driven by a verification harness such as
+// TestRIG over a tcp or unix socket, using the RVFI-DII protocol. The
+// harness sends 8-byte instruction packets and receives an RVFI execution
+// packet for each: instructions are executed at PC as if fetched from
+// there, memory only holds data. A packet with command 0 ends the trace;
+// it is answered with a packet that has the halt flag set and the machine
+// goes back to its state at the start. The simulator exits when the
+// harness closes the connection.
+const (
+	diiEnd  = 0
+	diiInsn = 1
+)
+
+// diiPacket is an instruction packet, little-endian.
+type diiPacket struct {
+	Insn uint32
+	Time uint16
+	Cmd  uint8
+	Pad  uint8
+}
+
+// ServeDII serves the harness connecting to spec, tcp:HOST:PORT or
+// unix:PATH, with the single hart on bus.
+func ServeDII(bus *Bus, spec string) error {
+	if len(bus.harts) != 1 {
+		return fmt.Errorf("-rvfi-dii needs a single hart")
+	}
+	i := strings.Index(spec, ":")
+	if (i < 0) || ((spec[:i] != "tcp") && (spec[:i] != "unix")) {
+		return fmt.Errorf("bad RVFI-DII socket %v (tcp:HOST:PORT or unix:PATH)", spec)
+	}
+	var start bytes.Buffer
+	if err := gob.NewEncoder(&start).Encode(bus.Save()); err != nil {
+		return err
+	}
+	conn, err := acceptOne(spec[:i], spec[i+1:])
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	h := bus.harts[0]
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	traces, n := 0, 0
+	for {
+		var in diiPacket
+		if err := binary.Read(r, binary.LittleEndian, &in); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		var out RVFI
+		switch in.Cmd {
+		case diiInsn:
+			out = h.ExecRVFI(in.Insn)
+			n++
+		case diiEnd:
+			out.Halt = 1
+			s := &Snapshot{}
+			if err := gob.NewDecoder(bytes.NewReader(start.Bytes())).Decode(s); err != nil {
+				return err
+			}
+			if err := bus.Restore(s); err != nil {
+				return err
+			}
+			traces++
+		default:
+			return fmt.Errorf("unknown RVFI-DII command %v", in.Cmd)
+		}
+		if err := WriteRVFI(w, &out); err != nil {
+			return err
+		}
+		if r.Buffered() == 0 {
+			// The harness waits for the answers to what it has sent.
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Fprintf(os.Stderr, "rvfi-dii: %v instructions in %v traces\n", n, traces)
+	return w.Flush()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A harness injects a short sequence, ends the trace and runs on from the
+// start state.
+func TestServeDII(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dii")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	null, err := os.Create(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	stderr := os.Stderr
+	os.Stderr = null
+	defer func() { os.Stderr = stderr }()
+
+	p := newTestCPU(t)
+	pc := uint64(p.PC)
+	sock := filepath.Join(dir, "sock")
+	done := make(chan error)
+	go func() { done <- ServeDII(p.bus, "unix:"+sock) }()
+	var conn net.Conn
+	for i := 0; ; i++ {
+		if conn, err = net.Dial("unix", sock); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	insn := func(inst uint32) diiPacket { return diiPacket{Insn: inst, Cmd: diiInsn} }
+	in := []diiPacket{
+		insn(encU(0x37, 5, 0x80001000)), // lui t0, 0x80001
+		insn(encI(0x13, 0, 6, 0, 7)),    // li t1, 7
+		insn(encS(2, 5, 6, 0)),          // sw t1, 0(t0)
+		insn(encI(0x03, 2, 7, 5, 0)),    // lw t2, 0(t0)
+		{Cmd: diiEnd},
+		insn(encU(0x37, 5, 0x80001000)), // lui t0, 0x80001
+		insn(encI(0x03, 2, 7, 5, 0)),    // lw t2, 0(t0)
+	}
+	want := []struct {
+		pc   uint64
+		rd   uint8
+		data uint64
+		halt uint8
+	}{
+		{pc, 5, 0x80001000, 0},
+		{pc + 4, 6, 7, 0},
+		{pc + 8, 0, 0, 0},
+		{pc + 12, 7, 7, 0},
+		{0, 0, 0, 1},
+		// The store is undone with the rest of the machine.
+		{pc, 5, 0x80001000, 0},
+		{pc + 4, 7, 0, 0},
+	}
+	if err := binary.Write(conn, binary.LittleEndian, in); err != nil {
+		t.Fatal(err)
+	}
+	for i, w := range want {
+		r, err := ReadRVFI(conn)
+		if err != nil {
+			t.Fatalf("packet %v: %v", i, err)
+		}
+		if (r.PCRData != w.pc) || (r.RDAddr != w.rd) || (r.RDWData != w.data) || (r.Halt != w.halt) {
+			t.Errorf("packet %v: %v halt %v, want pc %x x%v %x halt %v", i, r.String(), r.Halt, w.pc, w.rd, w.data, w.halt)
+		}
+	}
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
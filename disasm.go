@@ -40,6 +40,16 @@ var regName = [...]string{
 }
 
 var csrName = map[int]string{
+	0x100: "sstatus",
+	0x104: "sie",
+	0x105: "stvec",
+	0x106: "scounteren",
+	0x140: "sscratch",
+	0x141: "sepc",
+	0x142: "scause",
+	0x143: "stval",
+	0x144: "sip",
+	0x180: "satp",
 	0xf11: "mvenorid",
 	0xf12: "marchid",
 	0xf13: "mimpid",
@@ -51,10 +61,25 @@ var csrName = map[int]string{
 	0x304: "mie",
 	0x305: "mtvec",
 	0x306: "mcounteren",
+	0x310: "mstatush",
+	0x320: "mcountinhibit",
+	0x340: "mscratch",
 	0x341: "mepc",
 	0x342: "mcause",
 	0x343: "mtval",
 	0x344: "mip",
+	0x3a0: "pmpcfg0",
+	0x3b0: "pmpaddr0",
+	0xb00: "mcycle",
+	0xb02: "minstret",
+	0xb80: "mcycleh",
+	0xb82: "minstreth",
+	0xc00: "cycle",
+	0xc01: "time",
+	0xc02: "instret",
+	0xc80: "cycleh",
+	0xc81: "timeh",
+	0xc82: "instreth",
 }
 
 var disasms = map[string]func(ops *Ops, pc uint32) string{
@@ -72,7 +97,7 @@ var disasms = map[string]func(ops *Ops, pc uint32) string{
 		}
 	},
 	"jalr": func(ops *Ops, pc uint32) string {
-		if ops.Rs1 == 0 && ops.Imm == 0 {
+		if ops.Rd == 0 && ops.Imm == 0 {
 			return fmt.Sprintf("jr\t%v", regName[ops.Rs1])
 		} else {
 			return fmt.Sprintf("%v\t%v,%d(%v)", ops.Name, regName[ops.Rd], int32(ops.Imm), regName[ops.Rs1])
@@ -130,10 +155,10 @@ var disasms = map[string]func(ops *Ops, pc uint32) string{
 		return fmt.Sprintf("%v\t%v,%d(%v)", ops.Name, regName[ops.Rd], int32(ops.Imm), regName[ops.Rs1])
 	},
 	"sb": func(ops *Ops, pc uint32) string {
-		return fmt.Sprintf("%v\t%v,%d(%v)", ops.Name, regName[ops.Rd], int32(ops.Imm), regName[ops.Rs1])
+		return fmt.Sprintf("%v\t%v,%d(%v)", ops.Name, regName[ops.Rs2], int32(ops.Imm), regName[ops.Rs1])
 	},
 	"sh": func(ops *Ops, pc uint32) string {
-		return fmt.Sprintf("%v\t%v,%d(%v)", ops.Name, regName[ops.Rd], int32(ops.Imm), regName[ops.Rs1])
+		return fmt.Sprintf("%v\t%v,%d(%v)", ops.Name, regName[ops.Rs2], int32(ops.Imm), regName[ops.Rs1])
 	},
 	"sw": func(ops *Ops, pc uint32) string {
 		return fmt.Sprintf("%v\t%v,%d(%v)", ops.Name, regName[ops.Rs2], int32(ops.Imm), regName[ops.Rs1])
@@ -207,11 +232,68 @@ var disasms = map[string]func(ops *Ops, pc uint32) string{
 	"and": func(ops *Ops, pc uint32) string {
 		return fmt.Sprintf("%v\t%v,%v,%v", ops.Name, regName[ops.Rd], regName[ops.Rs1], regName[ops.Rs2])
 	},
+	"mul": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("%v\t%v,%v,%v", ops.Name, regName[ops.Rd], regName[ops.Rs1], regName[ops.Rs2])
+	},
+	"mulh": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("%v\t%v,%v,%v", ops.Name, regName[ops.Rd], regName[ops.Rs1], regName[ops.Rs2])
+	},
+	"mulhsu": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("%v\t%v,%v,%v", ops.Name, regName[ops.Rd], regName[ops.Rs1], regName[ops.Rs2])
+	},
+	"mulhu": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("%v\t%v,%v,%v", ops.Name, regName[ops.Rd], regName[ops.Rs1], regName[ops.Rs2])
+	},
+	"div": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("%v\t%v,%v,%v", ops.Name, regName[ops.Rd], regName[ops.Rs1], regName[ops.Rs2])
+	},
+	"divu": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("%v\t%v,%v,%v", ops.Name, regName[ops.Rd], regName[ops.Rs1], regName[ops.Rs2])
+	},
+	"rem": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("%v\t%v,%v,%v", ops.Name, regName[ops.Rd], regName[ops.Rs1], regName[ops.Rs2])
+	},
+	"remu": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("%v\t%v,%v,%v", ops.Name, regName[ops.Rd], regName[ops.Rs1], regName[ops.Rs2])
+	},
+	"lr_w": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("lr.w\t%v,(%v)", regName[ops.Rd], regName[ops.Rs1])
+	},
+	"sc_w": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("sc.w\t%v,%v,(%v)", regName[ops.Rd], regName[ops.Rs2], regName[ops.Rs1])
+	},
+	"amoswap_w": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("amoswap.w\t%v,%v,(%v)", regName[ops.Rd], regName[ops.Rs2], regName[ops.Rs1])
+	},
+	"amoadd_w": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("amoadd.w\t%v,%v,(%v)", regName[ops.Rd], regName[ops.Rs2], regName[ops.Rs1])
+	},
+	"amoxor_w": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("amoxor.w\t%v,%v,(%v)", regName[ops.Rd], regName[ops.Rs2], regName[ops.Rs1])
+	},
+	"amoand_w": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("amoand.w\t%v,%v,(%v)", regName[ops.Rd], regName[ops.Rs2], regName[ops.Rs1])
+	},
+	"amoor_w": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("amoor.w\t%v,%v,(%v)", regName[ops.Rd], regName[ops.Rs2], regName[ops.Rs1])
+	},
+	"amomin_w": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("amomin.w\t%v,%v,(%v)", regName[ops.Rd], regName[ops.Rs2], regName[ops.Rs1])
+	},
+	"amomax_w": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("amomax.w\t%v,%v,(%v)", regName[ops.Rd], regName[ops.Rs2], regName[ops.Rs1])
+	},
+	"amominu_w": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("amominu.w\t%v,%v,(%v)", regName[ops.Rd], regName[ops.Rs2], regName[ops.Rs1])
+	},
+	"amomaxu_w": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("amomaxu.w\t%v,%v,(%v)", regName[ops.Rd], regName[ops.Rs2], regName[ops.Rs1])
+	},
 	"fence": func(ops *Ops, pc uint32) string {
 		return fmt.Sprintf("%v", ops.Name)
 	},
 	"fence_i": func(ops *Ops, pc uint32) string {
-		return fmt.Sprintf("%v", ops.Name)
+		return "fence.i"
 	},
 	"ecall": func(ops *Ops, pc uint32) string {
 		return fmt.Sprintf("%v", ops.Name)
@@ -222,6 +304,15 @@ var disasms = map[string]func(ops *Ops, pc uint32) string{
 	"mret": func(ops *Ops, pc uint32) string {
 		return fmt.Sprintf("%v", ops.Name)
 	},
+	"sret": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("%v", ops.Name)
+	},
+	"wfi": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("%v", ops.Name)
+	},
+	"sfence_vma": func(ops *Ops, pc uint32) string {
+		return fmt.Sprintf("sfence.vma\t%v,%v", regName[ops.Rs1], regName[ops.Rs2])
+	},
 	"csrrw": func(ops *Ops, pc uint32) string {
 		if ops.Rd == 0 {
 			return fmt.Sprintf("csrw\t%v,%v", toCsrName(ops.Csr), regName[ops.Rs1])
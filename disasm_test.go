@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// disasmInsts are disassembled at 0x80000100 and compared with
+// testdata/disasm.golden.
+var disasmInsts = []uint32{
+	encU(0x37, 10, 0x12345000),
+	encU(0x17, 5, 0xfffff000),
+	encJ(0, -16),
+	encJ(1, 0x100),
+	encI(0x67, 0, 0, 1, 0),
+	encI(0x67, 0, 1, 6, -4),
+	encB(0, 10, 0, 8),
+	encB(0, 10, 11, -8),
+	encB(1, 5, 0, 16),
+	encB(1, 5, 6, 16),
+	encB(4, 12, 0, 4),
+	encB(4, 12, 13, 4),
+	encB(5, 0, 14, 4),
+	encB(5, 14, 0, 4),
+	encB(5, 14, 15, 4),
+	encB(6, 16, 17, -0x1000),
+	encB(7, 16, 17, 0xffe),
+	encI(0x03, 0, 10, 2, -1),
+	encI(0x03, 1, 11, 8, 2),
+	encI(0x03, 2, 12, 2, 0x7ff),
+	encI(0x03, 4, 13, 2, -0x800),
+	encI(0x03, 5, 14, 2, 6),
+	encS(0, 2, 10, -1),
+	encS(1, 8, 11, 2),
+	encS(2, 2, 1, 12),
+	encI(0x13, 0, 0, 0, 0),
+	encI(0x13, 0, 10, 0, -5),
+	encI(0x13, 0, 2, 2, -32),
+	encI(0x13, 2, 5, 6, -1),
+	encI(0x13, 3, 5, 6, 1),
+	encI(0x13, 4, 5, 6, -1),
+	encI(0x13, 6, 5, 6, 0xff),
+	encI(0x13, 7, 5, 6, 0x7f),
+	encR(0x13, 1, 0, 5, 6, 31),
+	encR(0x13, 5, 0, 5, 6, 1),
+	encR(0x13, 5, 0x20, 5, 6, 16),
+	encR(0x33, 0, 0, 10, 11, 12),
+	encR(0x33, 0, 0x20, 10, 11, 12),
+	encR(0x33, 1, 0, 10, 11, 12),
+	encR(0x33, 2, 0, 10, 11, 0),
+	encR(0x33, 2, 0, 10, 11, 12),
+	encR(0x33, 3, 0, 10, 11, 12),
+	encR(0x33, 4, 0, 10, 11, 12),
+	encR(0x33, 5, 0, 10, 11, 12),
+	encR(0x33, 5, 0x20, 10, 11, 12),
+	encR(0x33, 6, 0, 10, 11, 12),
+	encR(0x33, 7, 0, 10, 11, 12),
+	encR(0x33, 0, 1, 28, 29, 30),
+	encR(0x33, 1, 1, 28, 29, 30),
+	encR(0x33, 2, 1, 28, 29, 30),
+	encR(0x33, 3, 1, 28, 29, 30),
+	encR(0x33, 4, 1, 28, 29, 30),
+	encR(0x33, 5, 1, 28, 29, 30),
+	encR(0x33, 6, 1, 28, 29, 30),
+	encR(0x33, 7, 1, 28, 29, 30),
+	encR(0x2f, 2, 0x02<<2, 10, 11, 0),
+	encR(0x2f, 2, 0x03<<2, 10, 11, 12),
+	encR(0x2f, 2, 0x01<<2|3, 10, 11, 12),
+	encR(0x2f, 2, 0x00<<2, 10, 11, 12),
+	encR(0x2f, 2, 0x04<<2, 10, 11, 12),
+	encR(0x2f, 2, 0x0c<<2, 10, 11, 12),
+	encR(0x2f, 2, 0x08<<2, 10, 11, 12),
+	encR(0x2f, 2, 0x10<<2, 10, 11, 12),
+	encR(0x2f, 2, 0x14<<2, 10, 11, 12),
+	encR(0x2f, 2, 0x18<<2, 10, 11, 12),
+	encR(0x2f, 2, 0x1c<<2, 10, 11, 12),
+	0x0ff0000f,
+	0x0000100f,
+	0x00000073,
+	0x00100073,
+	0x30200073,
+	0x10200073,
+	0x10500073,
+	0x12000073,
+	0x12b50073,
+	encI(0x73, 1, 0, 5, 0x305),
+	encI(0x73, 1, 10, 5, 0x340),
+	encI(0x73, 2, 10, 0, 0xf14),
+	encI(0x73, 2, 0, 5, 0x300),
+	encI(0x73, 2, 10, 5, 0x344),
+	encI(0x73, 3, 0, 5, 0x300),
+	encI(0x73, 3, 10, 5, 0x7c0),
+	encI(0x73, 5, 0, 8, 0x300),
+	encI(0x73, 5, 10, 8, 0x300),
+	encI(0x73, 6, 0, 8, 0x300),
+	encI(0x73, 6, 10, 8, 0x304),
+	encI(0x73, 7, 0, 8, 0x300),
+	encI(0x73, 7, 10, 8, 0x304),
+	0x00000000,
+	0xffffffff,
+}
+
+func TestDisasmGolden(t *testing.T) {
+	p := newTestCPU(t)
+	var b bytes.Buffer
+	for _, inst := range disasmInsts {
+		ops := p.Decode(inst)
+		fmt.Fprintf(&b, "%08x  %v\n", inst, disasms[ops.Name](&ops, 0x80000100))
+	}
+	golden := filepath.Join("testdata", "disasm.golden")
+	if *update {
+		if err := ioutil.WriteFile(golden, b.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(b.Bytes(), want) {
+		return
+	}
+	got := bytes.Split(b.Bytes(), []byte("\n"))
+	lines := bytes.Split(want, []byte("\n"))
+	for i := 0; (i < len(got)) || (i < len(lines)); i++ {
+		var g, w []byte
+		if i < len(got) {
+			g = got[i]
+		}
+		if i < len(lines) {
+			w = lines[i]
+		}
+		if !bytes.Equal(g, w) {
+			t.Errorf("line %v: got %q, want %q", i+1, g, w)
+		}
+	}
+}
+
+// TestDisasmNames checks that every instruction the decoder knows can be
+// disassembled.
+func TestDisasmNames(t *testing.T) {
+	for name := range instructions {
+		if disasms[name] == nil {
+			t.Errorf("%v has no disassembler", name)
+		}
+	}
+}
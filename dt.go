@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	phandlePLIC    = 2
+	phandleClock   = 3
+	phandleCPUIntc = 0x100 // + hart ID
+)
+
+const (
+	uartClockFreq = 3686400
+)
+
+// ISA returns the ISA string for the extensions set in misa.
+func (p *CPU) ISA() string {
+	misa := p.CSRs[CSR_ADDR_MISA]
+	isa := "rv32"
+	for _, c := range "iemafdqlcbjtpvh" {
+		if misa&(1<<uint32(c-'a')) != 0 {
+			isa += string(c)
+		}
+	}
+	return isa
+}
+
+// DeviceTree describes the machine as configured: memory, the harts and
+// every device mapped on the bus.
+func (p *CPU) DeviceTree(bootargs string) *FDTNode {
+	bus := p.bus
+	m := bus.machine
+	root := NewFDTNode("")
+	root.Cells("#address-cells", 1)
+	root.Cells("#size-cells", 1)
+	root.String("compatible", "gopher-rv32sim")
+	root.String("model", "gopher-rv32sim")
+
+	chosen := root.AddNode("chosen")
+	if bootargs != "" {
+		chosen.String("bootargs", bootargs)
+	}
+
+	cpus := root.AddNode("cpus")
+	cpus.Cells("#address-cells", 1)
+	cpus.Cells("#size-cells", 0)
+	cpus.Cells("timebase-frequency", timebaseFreq)
+	var clintIrqs, plicIrqs []uint32
+	for h := range bus.harts {
+		cpu := cpus.AddNode(fmt.Sprintf("cpu@%v", h))
+		cpu.String("device_type", "cpu")
+		cpu.Cells("reg", uint32(h))
+		cpu.String("status", "okay")
+		cpu.String("compatible", "riscv")
+		cpu.String("riscv,isa", p.ISA())
+		cpu.String("mmu-type", "riscv,sv32")
+		intc := cpu.AddNode("interrupt-controller")
+		intc.Cells("#interrupt-cells", 1)
+		intc.Empty("interrupt-controller")
+		intc.String("compatible", "riscv,cpu-intc")
+		intc.Cells("phandle", phandleCPUIntc+uint32(h))
+		clintIrqs = append(clintIrqs, phandleCPUIntc+uint32(h), 3, phandleCPUIntc+uint32(h), 7)
+		plicIrqs = append(plicIrqs, phandleCPUIntc+uint32(h), 11, phandleCPUIntc+uint32(h), 9)
+	}
+
+	memory := root.AddNode(nodeName("memory", p.bus.ramBase))
+	memory.String("device_type", "memory")
+	memory.Cells("reg", p.bus.ramBase, p.bus.ramTop-p.bus.ramBase+1)
+
+	clk := root.AddNode("uartclk")
+	clk.String("compatible", "fixed-clock")
+	clk.Cells("#clock-cells", 0)
+	clk.Cells("clock-frequency", uartClockFreq)
+	clk.Cells("phandle", phandleClock)
+
+	soc := root.AddNode("soc")
+	soc.Cells("#address-cells", 1)
+	soc.Cells("#size-cells", 1)
+	soc.String("compatible", "simple-bus")
+	soc.Empty("ranges")
+
+	clint := soc.AddNode(nodeName("clint", m.CLINT.Base))
+	clint.String("compatible", "sifive,clint0", "riscv,clint0")
+	clint.Cells("reg", m.CLINT.Base, m.CLINT.Size)
+	clint.Cells("interrupts-extended", clintIrqs...)
+
+	plic := soc.AddNode(nodeName("plic", m.PLIC.Base))
+	plic.String("compatible", "sifive,plic-1.0.0", "riscv,plic0")
+	plic.Cells("reg", m.PLIC.Base, m.PLIC.Size)
+	plic.Cells("#interrupt-cells", 1)
+	plic.Cells("#address-cells", 0)
+	plic.Empty("interrupt-controller")
+	plic.Cells("riscv,ndev", plicSources-1)
+	plic.Cells("interrupts-extended", plicIrqs...)
+	plic.Cells("phandle", phandlePLIC)
+
+	for i, d := range append([]DevConfig{m.UART}, m.Serials...) {
+		uart := soc.AddNode(nodeName("serial", d.Base))
+		uart.Cells("reg", d.Base, d.Size)
+		switch bus.uarts[i].(type) {
+		case *NS16550:
+			uart.String("compatible", "ns16550a")
+			uart.Cells("clock-frequency", uartClockFreq)
+		default:
+			uart.String("compatible", "sifive,uart0")
+			uart.Cells("clocks", phandleClock)
+		}
+		uart.Cells("interrupt-parent", phandlePLIC)
+		uart.Cells("interrupts", d.IRQ)
+		if i == 0 {
+			chosen.String("stdout-path", "/soc/"+uart.Name)
+		}
+	}
+
+	for _, d := range m.Drives {
+		blk := soc.AddNode(nodeName("virtio_mmio", d.Base))
+		blk.String("compatible", "virtio,mmio")
+		blk.Cells("reg", d.Base, d.Size)
+		blk.Cells("interrupt-parent", phandlePLIC)
+		blk.Cells("interrupts", d.IRQ)
+	}
+
+	return root
+}
+
+// LoadDeviceTree places dtb at the top of RAM and passes it to the
+// program following the boot convention: on every hart a0 holds the hart
+// ID and a1 the address of the device tree. The space below it is kept
+// for the boot information. It fails if an image is already there.
+func (p *CPU) LoadDeviceTree(dtb []byte) (uint32, error) {
+	addr := (p.bus.ramTop + 1 - uint32(len(dtb))) &^ 0xfff
+	if err := p.place("device tree", addr-bootInfoSize, bootInfoSize+uint32(len(dtb))); err != nil {
+		return 0, err
+	}
+	for i, b := range dtb {
+		p.bus.WriteByte(addr+uint32(i), b)
+	}
+	for _, h := range p.bus.harts {
+		h.RegWrite(10, h.CSRs[CSR_ADDR_MHARTID])
+		h.RegWrite(11, addr)
+	}
+	return addr, nil
+}
+
+func nodeName(name string, addr uint32) string {
+	return fmt.Sprintf("%v@%x", name, addr)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	FDT_MAGIC      = 0xd00dfeed
+	FDT_BEGIN_NODE = 0x00000001
+	FDT_END_NODE   = 0x00000002
+	FDT_PROP       = 0x00000003
+	FDT_END        = 0x00000009
+)
+
+const (
+	propEmpty = iota
+	propString
+	propCells
+)
+
+type FDTProp struct {
+	Name    string
+	Kind    int
+	Strings []string
+	Cells   []uint32
+}
+
+type FDTNode struct {
+	Name     string
+	Props    []FDTProp
+	Children []*FDTNode
+}
+
+func NewFDTNode(name string) *FDTNode {
+	return &FDTNode{Name: name}
+}
+
+func (p *FDTNode) AddNode(name string) *FDTNode {
+	t := NewFDTNode(name)
+	p.Children = append(p.Children, t)
+	return t
+}
+
+// Node returns the child called name, or nil.
+func (p *FDTNode) Node(name string) *FDTNode {
+	for _, c := range p.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (p *FDTNode) Empty(name string) {
+	p.Props = append(p.Props, FDTProp{Name: name, Kind: propEmpty})
+}
+
+func (p *FDTNode) String(name string, s ...string) {
+	p.Props = append(p.Props, FDTProp{Name: name, Kind: propString, Strings: s})
+}
+
+func (p *FDTNode) Cells(name string, c ...uint32) {
+	p.Props = append(p.Props, FDTProp{Name: name, Kind: propCells, Cells: c})
+}
+
+func (p *FDTProp) value() []byte {
+	var buf bytes.Buffer
+	switch p.Kind {
+	case propString:
+		for _, s := range p.Strings {
+			buf.WriteString(s)
+			buf.WriteByte(0)
+		}
+	case propCells:
+		binary.Write(&buf, binary.BigEndian, p.Cells)
+	}
+	return buf.Bytes()
+}
+
+func align4(buf *bytes.Buffer) {
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+}
+
+// DTB flattens the tree rooted at p into a version 17 device tree blob.
+func (p *FDTNode) DTB() []byte {
+	var st, strs bytes.Buffer
+	offs := make(map[string]uint32)
+
+	var walk func(n *FDTNode)
+	walk = func(n *FDTNode) {
+		binary.Write(&st, binary.BigEndian, uint32(FDT_BEGIN_NODE))
+		st.WriteString(n.Name)
+		st.WriteByte(0)
+		align4(&st)
+		for _, prop := range n.Props {
+			off, ok := offs[prop.Name]
+			if !ok {
+				off = uint32(strs.Len())
+				offs[prop.Name] = off
+				strs.WriteString(prop.Name)
+				strs.WriteByte(0)
+			}
+			v := prop.value()
+			binary.Write(&st, binary.BigEndian, []uint32{FDT_PROP, uint32(len(v)), off})
+			st.Write(v)
+			align4(&st)
+		}
+		for _, c := range n.Children {
+			walk(c)
+		}
+		binary.Write(&st, binary.BigEndian, uint32(FDT_END_NODE))
+	}
+	walk(p)
+	binary.Write(&st, binary.BigEndian, uint32(FDT_END))
+
+	const hdrSize = 40
+	const rsvSize = 16
+	offStruct := uint32(hdrSize + rsvSize)
+	offStrings := offStruct + uint32(st.Len())
+	total := offStrings + uint32(strs.Len())
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.BigEndian, []uint32{
+		FDT_MAGIC,
+		total,
+		offStruct,
+		offStrings,
+		hdrSize, // off_mem_rsvmap
+		17,      // version
+		16,      // last_comp_version
+		0,       // boot_cpuid_phys
+		uint32(strs.Len()),
+		uint32(st.Len()),
+	})
+	out.Write(make([]byte, rsvSize))
+	out.Write(st.Bytes())
+	out.Write(strs.Bytes())
+	return out.Bytes()
+}
+
+// DTS writes the tree rooted at p in device tree source format.
+func (p *FDTNode) DTS(w io.Writer) {
+	fmt.Fprintf(w, "/dts-v1/;\n\n")
+	p.dts(w, 0)
+}
+
+func (p *FDTNode) dts(w io.Writer, depth int) {
+	indent := strings.Repeat("\t", depth)
+	name := p.Name
+	if name == "" {
+		name = "/"
+	}
+	fmt.Fprintf(w, "%v%v {\n", indent, name)
+	for _, prop := range p.Props {
+		switch prop.Kind {
+		case propEmpty:
+			fmt.Fprintf(w, "%v\t%v;\n", indent, prop.Name)
+		case propString:
+			fmt.Fprintf(w, "%v\t%v = \"%v\";\n", indent, prop.Name, strings.Join(prop.Strings, "\", \""))
+		case propCells:
+			cells := make([]string, len(prop.Cells))
+			for i, c := range prop.Cells {
+				cells[i] = fmt.Sprintf("0x%x", c)
+			}
+			fmt.Fprintf(w, "%v\t%v = <%v>;\n", indent, prop.Name, strings.Join(cells, " "))
+		}
+	}
+	for _, c := range p.Children {
+		fmt.Fprintln(w)
+		c.dts(w, depth+1)
+	}
+	fmt.Fprintf(w, "%v};\n", indent)
+}
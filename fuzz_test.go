@@ -0,0 +1,53 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import "testing"
+
+// Run the fuzz targets with, for example,
+//
+//	go test -fuzz FuzzDecode -fuzztime 1m
+//
+// Inputs that fail are written to testdata/fuzz and rerun by go test.
+
+func FuzzDecode(f *testing.F) {
+	for _, inst := range refSeeds() {
+		f.Add(inst)
+	}
+	p := newTestCPU(f)
+	f.Fuzz(func(t *testing.T, inst uint32) {
+		ops := p.Decode(inst)
+		if want := refDecode(inst); ops.Name != want {
+			t.Fatalf("%08x: decoded as %q, want %q", inst, ops.Name, want)
+		}
+		if (ops.Rd > 31) || (ops.Rs1 > 31) || (ops.Rs2 > 31) {
+			t.Fatalf("%08x %v: register out of range: rd %v rs1 %v rs2 %v", inst, ops.Name, ops.Rd, ops.Rs1, ops.Rs2)
+		}
+		if _, ok := instructions[ops.Name]; !ok {
+			t.Fatalf("%08x: no instruction %q", inst, ops.Name)
+		}
+		d, ok := disasms[ops.Name]
+		if !ok {
+			t.Fatalf("%08x: no disassembler for %q", inst, ops.Name)
+		}
+		if d(&ops, 0x80000000) == "" {
+			t.Fatalf("%08x %v: empty disassembly", inst, ops.Name)
+		}
+	})
+}
+
+func FuzzExecute(f *testing.F) {
+	for _, inst := range refSeeds() {
+		f.Add(inst, uint32(0x12345678), uint32(0x9abcdef0))
+	}
+	var p *CPU
+	f.Fuzz(func(t *testing.T, inst uint32, a uint32, b uint32) {
+		if p == nil {
+			p = newTestCPU(t)
+		}
+		if !checkRef(t, p, inst, a, b) {
+			p = nil
+		}
+	})
+}
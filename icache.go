@@ -0,0 +1,97 @@
+package main
+
+// Decoded instructions are cached per 4KiB physical page so that a step
+// only has to fetch and decode an instruction the first time it runs.
+// Every write through the bus drops the entry of the word it touches, and
+// fence.i drops them all.
+const (
+	icachePageShift = 12
+	icachePageWords = 1 << (icachePageShift - 2)
+)
+
+type icachePage struct {
+	ops   [icachePageWords]Ops
+	valid [icachePageWords]bool
+	count int // valid entries
+}
+
+type ICache struct {
+	pages  map[uint32]*icachePage
+	last   *icachePage
+	lastPN uint32
+	Hits   uint64
+	Misses uint64
+}
+
+func NewICache() *ICache {
+	return &ICache{pages: make(map[uint32]*icachePage), lastPN: 0xffffffff}
+}
+
+func (p *ICache) page(paddr uint32) *icachePage {
+	pn := paddr >> icachePageShift
+	if pn == p.lastPN {
+		return p.last
+	}
+	t, ok := p.pages[pn]
+	if !ok {
+		return nil
+	}
+	p.last = t
+	p.lastPN = pn
+	return t
+}
+
+// Lookup returns the decoded instruction at paddr, or nil.
+func (p *ICache) Lookup(paddr uint32) *Ops {
+	t := p.page(paddr)
+	idx := (paddr >> 2) & (icachePageWords - 1)
+	if (t == nil) || !t.valid[idx] {
+		p.Misses++
+		return nil
+	}
+	p.Hits++
+	return &t.ops[idx]
+}
+
+// Insert stores the decoded instruction at paddr and returns the cached
+// copy.
+func (p *ICache) Insert(paddr uint32, ops Ops) *Ops {
+	t := p.page(paddr)
+	if t == nil {
+		t = &icachePage{}
+		p.pages[paddr>>icachePageShift] = t
+	}
+	idx := (paddr >> 2) & (icachePageWords - 1)
+	t.ops[idx] = ops
+	if !t.valid[idx] {
+		t.valid[idx] = true
+		t.count++
+	}
+	return &t.ops[idx]
+}
+
+// Invalidate drops the instruction in the word containing paddr.
+func (p *ICache) Invalidate(paddr uint32) {
+	if t := p.page(paddr); t != nil {
+		idx := (paddr >> 2) & (icachePageWords - 1)
+		if t.valid[idx] {
+			t.valid[idx] = false
+			t.count--
+		}
+	}
+}
+
+// Holds reports whether any instruction of the page of paddr is cached.
+func (p *ICache) Holds(paddr uint32) bool {
+	t := p.page(paddr)
+	return (t != nil) && (t.count > 0)
+}
+
+// Flush drops every cached instruction. Pages stay allocated so that
+// they can be refilled without going through the map.
+func (p *ICache) Flush() {
+	for _, t := range p.pages {
+		t.valid = [icachePageWords]bool{}
+		t.count = 0
+	}
+}
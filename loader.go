@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Image formats recognised by LoadFile.
+const (
+	formatRaw = iota
+	formatElf
+	formatIHex
+	formatSRec
+)
+
+type segment struct {
+	addr uint32
+	data []byte
+}
+
+// image is the contents of a HEX or S-record file: the data records and
+// the start address if the file has one.
+type image struct {
+	segs     []segment
+	entry    uint32
+	hasEntry bool
+}
+
+func (p *image) add(addr uint32, data []byte) {
+	if n := len(p.segs); n > 0 {
+		last := &p.segs[n-1]
+		if last.addr+uint32(len(last.data)) == addr {
+			last.data = append(last.data, data...)
+			return
+		}
+	}
+	p.segs = append(p.segs, segment{addr, append([]byte(nil), data...)})
+}
+
+// elfSymbol returns the value of the symbol name in the ELF file filename.
+func elfSymbol(filename string, name string) (uint32, bool) {
+	f, err := elf.Open(filename)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	syms, err := f.Symbols()
+	if err != nil {
+		return 0, false
+	}
+	for _, s := range syms {
+		if s.Name == name {
+			return uint32(s.Value), true
+		}
+	}
+	return 0, false
+}
+
+// detectFormat guesses the format of an image from its contents.
+func detectFormat(b []byte) int {
+	if bytes.HasPrefix(b, []byte("\x7fELF")) {
+		return formatElf
+	}
+	line := b
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		line = b[:i]
+	}
+	line = bytes.TrimSpace(line)
+	if (len(line) >= 11) && (line[0] == ':') && isHex(line[1:]) {
+		return formatIHex
+	}
+	if (len(line) >= 4) && (line[0] == 'S') && ('0' <= line[1]) && (line[1] <= '9') && isHex(line[2:]) {
+		return formatSRec
+	}
+	return formatRaw
+}
+
+func isHex(b []byte) bool {
+	for _, c := range b {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadFile loads the image in filename, detecting its format from the
+// contents. ELF, Intel HEX and S-record files carry their own addresses;
+// a raw binary is loaded at addr. If the image has an entry point PC is
+// set to it.
+func (p *CPU) LoadFile(filename string, addr uint32) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var img *image
+	switch detectFormat(b) {
+	case formatElf:
+		return p.LoadElf(filename)
+	case formatIHex:
+		img, err = parseIHex(b)
+	case formatSRec:
+		img, err = parseSRec(b)
+	default:
+		img = &image{segs: []segment{{addr, b}}}
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %v", filename, err)
+	}
+
+	for _, s := range img.segs {
+		if err := p.checkLoad(filename, s.addr, uint32(len(s.data))); err != nil {
+			return err
+		}
+		p.LoadBytes(s.data, s.addr)
+		p.loaded(filename, s.addr, uint32(len(s.data)))
+	}
+	if img.hasEntry {
+		p.PC = img.entry
+	}
+	return nil
+}
+
+// checkLoad fails unless the size bytes at addr that filename loads are
+// all memory.
+func (p *CPU) checkLoad(filename string, addr uint32, size uint32) error {
+	if !p.bus.InMemory(addr, size) {
+		return fmt.Errorf("%v: 0x%08x-0x%08x is outside of memory", filename, addr, uint64(addr)+uint64(size)-1)
+	}
+	return nil
+}
+
+// record decodes the hex digits of one line of a HEX or S-record file.
+func record(line string, n int) ([]byte, error) {
+	if len(line)%2 != 0 {
+		return nil, fmt.Errorf("line %v: odd number of hex digits", n)
+	}
+	b, err := hex.DecodeString(line)
+	if err != nil {
+		return nil, fmt.Errorf("line %v: %v", n, err)
+	}
+	return b, nil
+}
+
+// parseIHex reads an Intel HEX file. Extended segment and extended linear
+// address records are supported, as are both start address records.
+func parseIHex(b []byte) (*image, error) {
+	img := &image{}
+	var base uint32 = 0
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if line[0] != ':' {
+			return nil, fmt.Errorf("line %v: missing ':'", n)
+		}
+		rec, err := record(line[1:], n)
+		if err != nil {
+			return nil, err
+		}
+		if (len(rec) < 5) || (len(rec) != int(rec[0])+5) {
+			return nil, fmt.Errorf("line %v: bad record length", n)
+		}
+		var sum uint8 = 0
+		for _, c := range rec {
+			sum += c
+		}
+		if sum != 0 {
+			return nil, fmt.Errorf("line %v: checksum mismatch", n)
+		}
+
+		offset := uint32(rec[1])<<8 | uint32(rec[2])
+		data := rec[4 : len(rec)-1]
+		switch rec[3] {
+		case 0x00: // data
+			img.add(base+offset, data)
+		case 0x01: // end of file
+			return img, nil
+		case 0x02: // extended segment address
+			if len(data) != 2 {
+				return nil, fmt.Errorf("line %v: bad segment address record", n)
+			}
+			base = (uint32(data[0])<<8 | uint32(data[1])) << 4
+		case 0x03: // start segment address, CS:IP
+			if len(data) != 4 {
+				return nil, fmt.Errorf("line %v: bad start address record", n)
+			}
+			cs := uint32(data[0])<<8 | uint32(data[1])
+			ip := uint32(data[2])<<8 | uint32(data[3])
+			img.entry = cs<<4 + ip
+			img.hasEntry = true
+		case 0x04: // extended linear address
+			if len(data) != 2 {
+				return nil, fmt.Errorf("line %v: bad linear address record", n)
+			}
+			base = (uint32(data[0])<<8 | uint32(data[1])) << 16
+		case 0x05: // start linear address
+			if len(data) != 4 {
+				return nil, fmt.Errorf("line %v: bad start address record", n)
+			}
+			img.entry = uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+			img.hasEntry = true
+		default:
+			return nil, fmt.Errorf("line %v: unknown record type %02x", n, rec[3])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("missing end of file record")
+}
+
+// parseSRec reads a Motorola S-record file. S1/S2/S3 data records and
+// S7/S8/S9 termination records with 16, 24 and 32 bit addresses are
+// supported; header and count records are checked and ignored.
+func parseSRec(b []byte) (*image, error) {
+	img := &image{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if (len(line) < 4) || (line[0] != 'S') {
+			return nil, fmt.Errorf("line %v: missing 'S'", n)
+		}
+		typ := line[1]
+		rec, err := record(line[2:], n)
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) != int(rec[0])+1 {
+			return nil, fmt.Errorf("line %v: bad record length", n)
+		}
+		var sum uint8 = 0
+		for _, c := range rec {
+			sum += c
+		}
+		if sum != 0xff {
+			return nil, fmt.Errorf("line %v: checksum mismatch", n)
+		}
+
+		var alen int
+		switch typ {
+		case '0', '1', '5', '9':
+			alen = 2
+		case '2', '6', '8':
+			alen = 3
+		case '3', '7':
+			alen = 4
+		default:
+			return nil, fmt.Errorf("line %v: unknown record type S%c", n, typ)
+		}
+		if len(rec) < alen+2 {
+			return nil, fmt.Errorf("line %v: bad record length", n)
+		}
+		var addr uint32 = 0
+		for _, c := range rec[1 : 1+alen] {
+			addr = addr<<8 | uint32(c)
+		}
+		data := rec[1+alen : len(rec)-1]
+
+		switch typ {
+		case '1', '2', '3':
+			img.add(addr, data)
+		case '7', '8', '9':
+			// Tools write a zero start address when there is none.
+			img.entry = addr
+			img.hasEntry = addr != 0
+			return img, nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
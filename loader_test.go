@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ihex returns an Intel HEX record with a correct checksum.
+func ihex(typ byte, offset uint16, data ...byte) string {
+	rec := append([]byte{byte(len(data)), byte(offset >> 8), byte(offset), typ}, data...)
+	var sum byte
+	for _, c := range rec {
+		sum += c
+	}
+	return fmt.Sprintf(":%X%02X\n", rec, -sum)
+}
+
+// srec returns an S-record of type typ with an address of alen bytes
+// and a correct checksum.
+func srec(typ byte, alen int, addr uint32, data ...byte) string {
+	rec := []byte{byte(alen + len(data) + 1)}
+	for i := alen - 1; i >= 0; i-- {
+		rec = append(rec, byte(addr>>(8*uint(i))))
+	}
+	rec = append(rec, data...)
+	var sum byte
+	for _, c := range rec {
+		sum += c
+	}
+	return fmt.Sprintf("S%c%X%02X\n", typ, rec, ^sum)
+}
+
+func TestDetectFormat(t *testing.T) {
+	for _, tt := range []struct {
+		data string
+		want int
+	}{
+		{"\x7fELF\x01\x01\x01", formatElf},
+		{ihex(0x00, 0, 1, 2, 3), formatIHex},
+		{"  " + ihex(0x01, 0), formatIHex},
+		{srec('0', 2, 0, 'h', 'i'), formatSRec},
+		{srec('3', 4, 0x80000000, 1), formatSRec},
+		{":0000", formatRaw},
+		{":00000001FG\n", formatRaw},
+		{"S", formatRaw},
+		{"SX0000\n", formatRaw},
+		{"\x13\x00\x00\x00", formatRaw},
+		{"", formatRaw},
+	} {
+		if got := detectFormat([]byte(tt.data)); got != tt.want {
+			t.Errorf("%q detected as %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestParseIHex(t *testing.T) {
+	eof := ihex(0x01, 0)
+	tests := []struct {
+		name  string
+		file  string
+		segs  []segment
+		entry uint32
+		err   string
+	}{
+		{"data", ihex(0x00, 0x10, 1, 2) + ihex(0x00, 0x12, 3) + eof,
+			[]segment{{0x10, []byte{1, 2, 3}}}, 0, ""},
+		{"extended segment", ihex(0x02, 0, 0x12, 0x34) + ihex(0x00, 0x10, 1) + eof,
+			[]segment{{0x12350, []byte{1}}}, 0, ""},
+		{"extended linear", ihex(0x04, 0, 0x80, 0x00) + ihex(0x00, 0x10, 1) + ihex(0x00, 0x20, 2) + eof,
+			[]segment{{0x80000010, []byte{1}}, {0x80000020, []byte{2}}}, 0, ""},
+		{"start segment", ihex(0x03, 0, 0x12, 0x34, 0x00, 0x10) + eof, nil, 0x12350, ""},
+		{"start linear", ihex(0x05, 0, 0x80, 0x00, 0x01, 0x00) + eof, nil, 0x80000100, ""},
+		{"after eof", eof + "garbage\n", nil, 0, ""},
+		{"checksum", ":0100000001FF\n" + eof, nil, 0, "line 1: checksum mismatch"},
+		{"length", ":0200000001FD\n" + eof, nil, 0, "line 1: bad record length"},
+		{"odd", ":0100000001F\n", nil, 0, "line 1: odd number of hex digits"},
+		{"colon", eof[1:], nil, 0, "line 1: missing ':'"},
+		{"type", ihex(0x06, 0) + eof, nil, 0, "line 1: unknown record type 06"},
+		{"bad segment", ihex(0x02, 0, 1) + eof, nil, 0, "line 1: bad segment address record"},
+		{"bad linear", ihex(0x04, 0, 1, 2, 3) + eof, nil, 0, "line 1: bad linear address record"},
+		{"bad start", ihex(0x05, 0, 1) + eof, nil, 0, "line 1: bad start address record"},
+		{"no eof", ihex(0x00, 0, 1), nil, 0, "missing end of file record"},
+	}
+	for _, tt := range tests {
+		img, err := parseIHex([]byte(tt.file))
+		if tt.err != "" {
+			if (err == nil) || (err.Error() != tt.err) {
+				t.Errorf("%v: error %v, want %v", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(img.segs, tt.segs) || (img.entry != tt.entry) || (img.hasEntry != (tt.entry != 0)) {
+			t.Errorf("%v: got %+v, want %+v entry %#x", tt.name, img, tt.segs, tt.entry)
+		}
+	}
+}
+
+func TestParseSRec(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		segs  []segment
+		entry uint32
+		err   string
+	}{
+		{"S1", srec('0', 2, 0, 'h', 'i') + srec('1', 2, 0x1000, 1, 2) + srec('1', 2, 0x1002, 3) + srec('9', 2, 0),
+			[]segment{{0x1000, []byte{1, 2, 3}}}, 0, ""},
+		{"S2", srec('2', 3, 0x123456, 1) + srec('5', 2, 1) + srec('8', 3, 0x123456),
+			[]segment{{0x123456, []byte{1}}}, 0x123456, ""},
+		{"S3", srec('3', 4, 0x80000000, 1) + srec('3', 4, 0x80000100, 2) + srec('7', 4, 0x80000000),
+			[]segment{{0x80000000, []byte{1}}, {0x80000100, []byte{2}}}, 0x80000000, ""},
+		{"no termination", srec('3', 4, 0x80000000, 1),
+			[]segment{{0x80000000, []byte{1}}}, 0, ""},
+		{"checksum", "S1041000010A\n", nil, 0, "line 1: checksum mismatch"},
+		{"length", "S10610000100E8\n", nil, 0, "line 1: bad record length"},
+		{"short", "S1011000\n", nil, 0, "line 1: bad record length"},
+		{"type", srec('4', 2, 0), nil, 0, "line 1: unknown record type S4"},
+		{"S", "T1030000FC\n", nil, 0, "line 1: missing 'S'"},
+		{"hex", "S103000XFC\n", nil, 0, "line 1: encoding/hex: invalid byte: U+0058 'X'"},
+	}
+	for _, tt := range tests {
+		img, err := parseSRec([]byte(tt.file))
+		if tt.err != "" {
+			if (err == nil) || (err.Error() != tt.err) {
+				t.Errorf("%v: error %v, want %v", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(img.segs, tt.segs) || (img.entry != tt.entry) || (img.hasEntry != (tt.entry != 0)) {
+			t.Errorf("%v: got %+v, want %+v entry %#x", tt.name, img, tt.segs, tt.entry)
+		}
+	}
+}
+
+// testElf returns an RV32 ELF executable with one PT_LOAD segment holding
+// data at addr and entry point addr.
+func testElf(addr uint32, data []byte) []byte {
+	var b bytes.Buffer
+	h := FileHeader{Type: 2, Machine: 243, Version: 1, Entry: addr, Phoff: 52,
+		Ehsize: 52, Phentsize: 32, Phnum: 1}
+	copy(h.Ident[:], "\x7fELF\x01\x01\x01")
+	binary.Write(&b, binary.LittleEndian, &h)
+	ph := ProgramHeader{Type: PT_LOAD, Off: 84, Vaddr: addr, Paddr: addr,
+		Filesz: uint32(len(data)), Memsz: uint32(len(data)), Flags: 5, Align: 4}
+	binary.Write(&b, binary.LittleEndian, &ph)
+	b.Write(data)
+	return b.Bytes()
+}
+
+// Every format loads into memory, RAM and regions alike, and fails for
+// an image that reaches anything else, without loading part of it.
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const rom, sram = 0x1000, 0x4000
+	data := []byte{0x13, 0x05, 0x10, 0x00, 0x73, 0x00, 0x10, 0x00}
+	// From the end of the ROM over the hole to the SRAM.
+	span := make([]byte, sram+8-(rom+0xff8))
+	tests := []struct {
+		name string
+		file []byte
+		addr uint32
+		ok   bool
+	}{
+		{"ram.bin", data, 0x80000000, true},
+		{"rom.bin", data, rom, true},
+		{"hole.bin", data, 0x3000, false},
+		{"uart.bin", data, uartBase, false},
+		{"end.bin", data, 0x87fffffc, false},
+		{"span.bin", span, rom + 0xff8, false},
+		{"wrap.bin", data, 0xfffffffc, false},
+		{"ram.hex", []byte(ihex(0x04, 0, 0x80, 0x00) + ihex(0x00, 0x10, data...) + ihex(0x01, 0)), 0x80000010, true},
+		{"hole.hex", []byte(ihex(0x00, 0x1ffc, data...) + ihex(0x01, 0)), 0x1ffc, false},
+		{"ram.srec", []byte(srec('3', 4, 0x80000020, data...)), 0x80000020, true},
+		{"uart.srec", []byte(srec('3', 4, uartBase, data...)), uartBase, false},
+		{"ram.elf", testElf(0x80000030, data), 0x80000030, true},
+		{"rom.elf", testElf(rom+8, data), rom + 8, true},
+		{"hole.elf", testElf(0x3000, data), 0x3000, false},
+		{"end.elf", testElf(0x87fffffc, data), 0x87fffffc, false},
+		{"span.elf", testElf(rom+0xff8, span), rom + 0xff8, false},
+	}
+	for _, tt := range tests {
+		m := DefaultMachine()
+		m.Regions = append(m.Regions, MemConfig{Name: "rom", Base: rom, Size: 0x1000, Attr: memRO},
+			MemConfig{Name: "sram", Base: sram, Size: 0x1000, Attr: memRWX})
+		bus, err := NewBus(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := NewCPU(bus)
+		p.Reset()
+		name := filepath.Join(dir, tt.name)
+		if err := ioutil.WriteFile(name, tt.file, 0644); err != nil {
+			t.Fatal(err)
+		}
+		err = p.LoadFile(name, tt.addr)
+		if !tt.ok {
+			if (err == nil) || !strings.Contains(err.Error(), "is outside of memory") {
+				t.Errorf("%v: error %v, want outside of memory", tt.name, err)
+			}
+			if bus.InMemory(tt.addr, 4) && (bus.ReadWord(tt.addr) != 0) {
+				t.Errorf("%v: loaded the part in memory", tt.name)
+			}
+			bus.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+		} else if got, want := bus.ReadWord(tt.addr+4), binary.LittleEndian.Uint32(data[4:]); got != want {
+			t.Errorf("%v: read %08x at %08x, want %08x", tt.name, got, tt.addr+4, want)
+		}
+		bus.Close()
+	}
+}
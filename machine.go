@@ -0,0 +1,479 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MemConfig places RAM or an additional memory region.
+type MemConfig struct {
+	Name string
+	Base uint32
+	Size uint32
+	Attr uint8
+	File string // image loaded at Base at startup
+	line int
+}
+
+// DevConfig places a device on the bus.
+type DevConfig struct {
+	Model string
+	Base  uint32
+	Size  uint32
+	IRQ   uint32
+	line  int
+}
+
+// DriveConfig is a virtio block device.
+type DriveConfig struct {
+	DevConfig
+	Path     string
+	ReadOnly bool
+	Cow      bool
+}
+
+// Machine describes the simulated machine. It starts out as the default
+// machine, is updated from a machine description file given with
+// -machine and then from the command line flags that are set.
+type Machine struct {
+	file     string
+	Harts    uint32
+	Quantum  uint32 // steps a hart runs before the next one
+	ISA      string
+	Reset    uint32
+	HasReset bool
+	RAM      MemConfig
+	Regions  []MemConfig
+	CLINT    DevConfig
+	PLIC     DevConfig
+	UART     DevConfig   // the console UART
+	Serials  []DevConfig // further UARTs
+	Drives   []DriveConfig
+	Bios     string
+	Kernel   string
+	Initrd   string
+	Bootargs string
+	Program  string
+	Loads    []string
+	lines    map[string]int
+}
+
+const (
+	hartMax        = 32
+	quantumDefault = 100
+)
+
+func DefaultMachine() *Machine {
+	uart, _ := uartConfig("sifive")
+	return &Machine{
+		Harts:   1,
+		Quantum: quantumDefault,
+		ISA:     "rv32ima",
+		RAM:     MemConfig{Name: "RAM", Base: ramBaseDefault, Size: 128 << 20, Attr: memRWX},
+		CLINT:   DevConfig{Model: "clint", Base: clintBase, Size: clintTop - clintBase + 1},
+		PLIC:    DevConfig{Model: "plic", Base: plicBase, Size: plicTop - plicBase + 1},
+		UART:    uart,
+		lines:   map[string]int{},
+	}
+}
+
+// uartConfig returns the default placement of a console UART model.
+func uartConfig(model string) (DevConfig, bool) {
+	switch model {
+	case "sifive":
+		return DevConfig{Model: model, Base: uartBase, Size: uartTop - uartBase + 1, IRQ: uartIrq}, true
+	case "ns16550":
+		return DevConfig{Model: model, Base: ns16550Base, Size: ns16550Top - ns16550Base + 1, IRQ: uartIrq}, true
+	}
+	return DevConfig{}, false
+}
+
+// errorf formats an error, pointing at line of the machine description
+// if the setting came from there.
+func (p *Machine) errorf(line int, format string, a ...interface{}) error {
+	if line == 0 {
+		return fmt.Errorf(format, a...)
+	}
+	return fmt.Errorf("%v:%v: %v", p.file, line, fmt.Sprintf(format, a...))
+}
+
+// AddRegion adds a region given as NAME,BASE,SIZE[,ro|,xo].
+func (p *Machine) AddRegion(spec string) error {
+	opts := strings.Split(spec, ",")
+	if len(opts) < 3 {
+		return fmt.Errorf("bad region %q, want NAME,BASE,SIZE[,ro|,xo]", spec)
+	}
+	base, err := strconv.ParseUint(opts[1], 0, 32)
+	if err != nil {
+		return fmt.Errorf("bad base address in region %q", spec)
+	}
+	size, err := parseSize(opts[2])
+	if err != nil || (size > 0xffffffff) {
+		return fmt.Errorf("bad size in region %q", spec)
+	}
+	r := MemConfig{Name: opts[0], Base: uint32(base), Size: uint32(size), Attr: memRWX}
+	for _, o := range opts[3:] {
+		if r.Attr, err = parseAttr(o); err != nil {
+			return err
+		}
+	}
+	p.Regions = append(p.Regions, r)
+	return nil
+}
+
+func parseAttr(s string) (uint8, error) {
+	switch s {
+	case "rw", "rwx":
+		return memRWX, nil
+	case "ro":
+		return memRO, nil
+	case "xo":
+		return memXO, nil
+	}
+	return 0, fmt.Errorf("unknown region option %q", s)
+}
+
+// parseSize reads a byte count with an optional K, M or G suffix.
+func parseSize(s string) (uint64, error) {
+	var unit uint64 = 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, err
+	}
+	return n * unit, nil
+}
+
+// AddDrive adds a drive given as PATH[,ro][,cow] in the next virtio-mmio
+// slot.
+func (p *Machine) AddDrive(spec string) error {
+	opts := strings.Split(spec, ",")
+	d := p.newDrive(opts[0])
+	for _, o := range opts[1:] {
+		switch o {
+		case "ro":
+			d.ReadOnly = true
+		case "cow":
+			d.Cow = true
+		default:
+			return fmt.Errorf("unknown drive option %q", o)
+		}
+	}
+	p.Drives = append(p.Drives, d)
+	return nil
+}
+
+// newDrive returns a drive in the next virtio-mmio slot: slot n is at
+// virtioBase + n*virtioSize and uses interrupt source virtioIrq + n.
+func (p *Machine) newDrive(path string) DriveConfig {
+	n := uint32(len(p.Drives))
+	return DriveConfig{
+		DevConfig: DevConfig{Model: "virtio-blk", Base: virtioBase + virtioSize*n, Size: virtioSize, IRQ: virtioIrq + n},
+		Path:      path,
+	}
+}
+
+// Misa returns the misa value for the ISA string.
+func (p *Machine) Misa() uint32 {
+	misa, _ := parseISA(p.ISA)
+	return misa
+}
+
+// parseISA accepts rv32i followed by any of m and a, and multi-letter
+// extensions after an underscore, which are ignored. S and U modes are
+// always present.
+func parseISA(s string) (uint32, error) {
+	s = strings.ToLower(s)
+	if !strings.HasPrefix(s, "rv32i") {
+		return 0, fmt.Errorf("ISA %q must start with rv32i", s)
+	}
+	var misa uint32 = MISA_MXL_32 | MISA_I | MISA_S | MISA_U
+	base := strings.SplitN(s[len("rv32i"):], "_", 2)[0]
+	for _, c := range base {
+		switch c {
+		case 'm':
+			misa |= MISA_M
+		case 'a':
+			misa |= MISA_A
+		default:
+			return 0, fmt.Errorf("ISA extension %q is not supported", c)
+		}
+	}
+	return misa, nil
+}
+
+// Load updates the machine from the description in filename.
+func (p *Machine) Load(filename string) error {
+	f, err := readConfig(filename)
+	if err != nil {
+		return err
+	}
+	p.file = filename
+	root := f.root
+	known := map[string]bool{"ram": true, "region": true, "clint": true, "plic": true,
+		"uart": true, "serial": true, "drive": true, "boot": true}
+
+	if _, err := f.u32(root, "harts", &p.Harts); err != nil {
+		return err
+	}
+	p.lines["harts"] = root.lineOf("harts")
+	if _, err := f.u32(root, "quantum", &p.Quantum); err != nil {
+		return err
+	}
+	p.lines["quantum"] = root.lineOf("quantum")
+	if _, err := f.str(root, "isa", &p.ISA); err != nil {
+		return err
+	}
+	p.lines["isa"] = root.lineOf("isa")
+	if p.HasReset, err = f.u32(root, "reset", &p.Reset); err != nil {
+		return err
+	}
+
+	if t, ok := f.tables["ram"]; ok {
+		if err := p.loadMem(f, t, &p.RAM); err != nil {
+			return err
+		}
+	}
+	for _, t := range f.arrays["region"] {
+		r := MemConfig{Attr: memRWX}
+		if err := p.loadMem(f, t, &r); err != nil {
+			return err
+		}
+		if r.Name == "" {
+			return f.errorf(t.line, "region needs a name")
+		}
+		p.Regions = append(p.Regions, r)
+	}
+
+	if t, ok := f.tables["clint"]; ok {
+		if err := p.loadDev(f, t, &p.CLINT, false); err != nil {
+			return err
+		}
+	}
+	if t, ok := f.tables["plic"]; ok {
+		if err := p.loadDev(f, t, &p.PLIC, false); err != nil {
+			return err
+		}
+	}
+	if t, ok := f.tables["uart"]; ok {
+		var model string
+		if set, err := f.str(t, "model", &model); err != nil {
+			return err
+		} else if set {
+			uart, ok := uartConfig(model)
+			if !ok {
+				return f.errorf(t.lineOf("model"), "unknown UART model %q", model)
+			}
+			p.UART = uart
+		}
+		if err := p.loadDev(f, t, &p.UART, true); err != nil {
+			return err
+		}
+	}
+	for _, t := range f.arrays["serial"] {
+		var model string
+		if set, err := f.str(t, "model", &model); err != nil {
+			return err
+		} else if !set {
+			return f.errorf(t.line, "serial needs a model")
+		}
+		uart, ok := uartConfig(model)
+		if !ok {
+			return f.errorf(t.lineOf("model"), "unknown UART model %q", model)
+		}
+		_, base := t.keys["base"]
+		_, irq := t.keys["irq"]
+		if !base || !irq {
+			return f.errorf(t.line, "serial needs a base and an irq")
+		}
+		if err := p.loadDev(f, t, &uart, true); err != nil {
+			return err
+		}
+		p.Serials = append(p.Serials, uart)
+	}
+	for _, t := range f.arrays["drive"] {
+		var path string
+		if set, err := f.path(t, "path", &path); err != nil {
+			return err
+		} else if !set {
+			return f.errorf(t.line, "drive needs a path")
+		}
+		d := p.newDrive(path)
+		if _, err := f.boolean(t, "readonly", &d.ReadOnly); err != nil {
+			return err
+		}
+		if _, err := f.boolean(t, "cow", &d.Cow); err != nil {
+			return err
+		}
+		if err := p.loadDev(f, t, &d.DevConfig, true); err != nil {
+			return err
+		}
+		p.Drives = append(p.Drives, d)
+	}
+
+	if t, ok := f.tables["boot"]; ok {
+		for key, dst := range map[string]*string{"bios": &p.Bios, "kernel": &p.Kernel,
+			"initrd": &p.Initrd, "program": &p.Program} {
+			if _, err := f.path(t, key, dst); err != nil {
+				return err
+			}
+		}
+		if _, err := f.str(t, "bootargs", &p.Bootargs); err != nil {
+			return err
+		}
+		if _, err := f.strs(t, "load", &p.Loads); err != nil {
+			return err
+		}
+		for i, l := range p.Loads {
+			p.Loads[i] = f.join(l)
+		}
+	}
+	return f.unused(known)
+}
+
+func (p *Machine) loadMem(f *configFile, t *configTable, m *MemConfig) error {
+	if _, err := f.str(t, "name", &m.Name); err != nil {
+		return err
+	}
+	if _, err := f.u32(t, "base", &m.Base); err != nil {
+		return err
+	}
+	if _, err := f.u32(t, "size", &m.Size); err != nil {
+		return err
+	}
+	var access string
+	if set, err := f.str(t, "access", &access); err != nil {
+		return err
+	} else if set {
+		attr, err := parseAttr(access)
+		if err != nil {
+			return f.errorf(t.lineOf("access"), "%v", err)
+		}
+		m.Attr = attr
+	}
+	if _, err := f.path(t, "file", &m.File); err != nil {
+		return err
+	}
+	m.line = t.lineOf("base")
+	return nil
+}
+
+func (p *Machine) loadDev(f *configFile, t *configTable, d *DevConfig, irq bool) error {
+	if _, err := f.u32(t, "base", &d.Base); err != nil {
+		return err
+	}
+	if _, err := f.u32(t, "size", &d.Size); err != nil {
+		return err
+	}
+	if irq {
+		if _, err := f.u32(t, "irq", &d.IRQ); err != nil {
+			return err
+		}
+	}
+	d.line = t.lineOf("base")
+	return nil
+}
+
+// minSize is the size of the register block of each device model.
+var minSize = map[string]uint32{
+	"clint":      clintTop - clintBase + 1,
+	"plic":       0x00400000,
+	"sifive":     0x1c,
+	"ns16550":    0x08,
+	"virtio-blk": 0x200,
+}
+
+// Validate checks the machine for settings that cannot work and for
+// overlapping address ranges.
+func (p *Machine) Validate() error {
+	if (p.Harts == 0) || (p.Harts > hartMax) {
+		return p.errorf(p.lines["harts"], "number of harts must be 1-%v", hartMax)
+	}
+	if p.Quantum == 0 {
+		return p.errorf(p.lines["quantum"], "quantum must be at least 1")
+	}
+	if _, err := parseISA(p.ISA); err != nil {
+		return p.errorf(p.lines["isa"], "%v", err)
+	}
+	if len(p.Drives) > virtioMax {
+		return p.errorf(p.Drives[virtioMax].line, "more than %v drives", virtioMax)
+	}
+
+	type span struct {
+		name      string
+		base, top uint64
+		line      int
+	}
+	var spans []span
+	add := func(name string, base uint32, size uint32, line int) error {
+		if size == 0 {
+			return p.errorf(line, "%v has no size", name)
+		}
+		s := span{name, uint64(base), uint64(base) + uint64(size) - 1, line}
+		if s.top > 0xffffffff {
+			return p.errorf(line, "%v does not fit in the address space", name)
+		}
+		for _, t := range spans {
+			if (s.base <= t.top) && (t.base <= s.top) {
+				// Point at whichever of the two the file moved.
+				if line == 0 {
+					line = t.line
+				}
+				return p.errorf(line, "%v at 0x%08x-0x%08x overlaps %v at 0x%08x-0x%08x",
+					name, s.base, s.top, t.name, t.base, t.top)
+			}
+		}
+		spans = append(spans, s)
+		return nil
+	}
+
+	if p.RAM.Base&pageMask != 0 {
+		return p.errorf(p.RAM.line, "RAM must start on a 4KiB boundary")
+	}
+	if err := add("RAM", p.RAM.Base, p.RAM.Size, p.RAM.line); err != nil {
+		return err
+	}
+	for _, r := range p.Regions {
+		if err := add(r.Name, r.Base, r.Size, r.line); err != nil {
+			return err
+		}
+	}
+	irqs := map[uint32]string{}
+	devs := append([]DevConfig{p.CLINT, p.PLIC, p.UART}, p.Serials...)
+	for _, d := range p.Drives {
+		devs = append(devs, d.DevConfig)
+	}
+	for _, d := range devs {
+		if d.Size < minSize[d.Model] {
+			return p.errorf(d.line, "%v needs at least 0x%x bytes", d.Model, minSize[d.Model])
+		}
+		if d.Base&3 != 0 {
+			return p.errorf(d.line, "%v must be word aligned", d.Model)
+		}
+		if err := add(d.Model, d.Base, d.Size, d.line); err != nil {
+			return err
+		}
+		if (d.Model == "clint") || (d.Model == "plic") {
+			continue
+		}
+		if (d.IRQ == 0) || (d.IRQ >= plicSources) {
+			return p.errorf(d.line, "%v interrupt %v is not in 1-%v", d.Model, d.IRQ, plicSources-1)
+		}
+		if other, ok := irqs[d.IRQ]; ok {
+			return p.errorf(d.line, "%v interrupt %v is already used by %v", d.Model, d.IRQ, other)
+		}
+		irqs[d.IRQ] = d.Model
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loadMachine reads the machine description text from a temporary file.
+func loadMachine(t *testing.T, text string) (*Machine, error) {
+	dir, err := ioutil.TempDir("", "machine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "m.toml")
+	if err := ioutil.WriteFile(filename, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := DefaultMachine()
+	if err := m.Load(filename); err != nil {
+		return nil, err
+	}
+	return m, m.Validate()
+}
+
+func TestMachineSerials(t *testing.T) {
+	m, err := loadMachine(t, `
+[[serial]]
+model = "ns16550"
+base = 0x10000100
+irq = 11
+
+[[serial]]
+model = "sifive"
+base = 0x20001000
+irq = 12
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus, err := NewBus(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bus.uarts) != 3 {
+		t.Fatalf("%v UARTs, want 3", len(bus.uarts))
+	}
+	var outs [3]bytes.Buffer
+	for i, u := range bus.uarts {
+		u.Attach(&outs[i], nil)
+	}
+	bus.WriteWord(uartBase+uartTxctrl, uartTxen)
+	bus.WriteWord(uartBase+uartTxdata, '0')
+	bus.WriteByte(0x10000100+ns16550Rbr, '1')
+	bus.WriteWord(0x20001000+uartTxctrl, uartTxen)
+	bus.WriteWord(0x20001000+uartTxdata, '2')
+	bus.Tick()
+	for i := range outs {
+		if want := string(rune('0' + i)); outs[i].String() != want {
+			t.Errorf("UART %v sent %q, want %q", i, outs[i].String(), want)
+		}
+	}
+
+	var dts bytes.Buffer
+	NewCPU(bus).DeviceTree("").DTS(&dts)
+	for _, node := range []string{"serial@20000000", "serial@10000100", "serial@20001000"} {
+		if !strings.Contains(dts.String(), node) {
+			t.Errorf("device tree has no %v", node)
+		}
+	}
+}
+
+func TestMachineSerialErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"[[serial]]\nbase = 0x10000100\nirq = 11\n", "m.toml:1: serial needs a model"},
+		{"[[serial]]\nmodel = \"pl011\"\nbase = 0x10000100\nirq = 11\n", "m.toml:2: unknown UART model"},
+		{"[[serial]]\nmodel = \"ns16550\"\nirq = 11\n", "m.toml:1: serial needs a base and an irq"},
+		{"[[serial]]\nmodel = \"sifive\"\nbase = 0x20000010\nirq = 11\n", "m.toml:3: sifive at 0x20000010-0x2000100f overlaps sifive"},
+		{"[[serial]]\nmodel = \"ns16550\"\nbase = 0x10000100\nirq = 10\n", "m.toml:3: ns16550 interrupt 10 is already used by sifive"},
+	}
+	for _, tt := range tests {
+		_, err := loadMachine(t, tt.text)
+		if (err == nil) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: error %v, want %v", tt.text, err, tt.want)
+		}
+	}
+}
+
+// The sample description spells out the default machine.
+func TestMachineSample(t *testing.T) {
+	m := DefaultMachine()
+	if err := m.Load("sample/machine.toml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	def := DefaultMachine()
+	m.file, m.lines, def.lines = "", nil, nil
+	m.RAM.line, m.CLINT.line, m.PLIC.line, m.UART.line = 0, 0, 0, 0
+	if !reflect.DeepEqual(m, def) {
+		t.Errorf("sample machine\n%+v\ndiffers from the default\n%+v", m, def)
+	}
+}
+
+func TestMachineLoad(t *testing.T) {
+	m, err := loadMachine(t, `
+harts = 4
+quantum = 10
+isa = "rv32im_zicsr"
+reset = 0x1000
+
+[ram]
+base = 0x40000000
+size = "64M"
+
+[[region]]
+name = "rom"
+base = 0x1000
+size = "4K"
+access = "ro"
+file = "rom.bin"
+
+[uart]
+model = "ns16550"
+irq = 3
+
+[[drive]]
+path = "/disk.img"
+readonly = true
+
+[[drive]]
+path = "b.img"
+cow = true
+
+[boot]
+bootargs = "console=ttyS0"
+load = ["a.hex", "/b.bin@0x40100000"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (m.Harts != 4) || (m.Quantum != 10) || !m.HasReset || (m.Reset != 0x1000) {
+		t.Errorf("harts %v quantum %v reset %v %x", m.Harts, m.Quantum, m.HasReset, m.Reset)
+	}
+	if m.Misa()&(MISA_M|MISA_A) != MISA_M {
+		t.Errorf("misa %08x", m.Misa())
+	}
+	if (m.RAM.Base != 0x40000000) || (m.RAM.Size != 64<<20) {
+		t.Errorf("RAM %+v", m.RAM)
+	}
+	dir := filepath.Dir(m.file)
+	if r := m.Regions; (len(r) != 1) || (r[0].Name != "rom") || (r[0].Size != 0x1000) ||
+		(r[0].Attr != memRO) || (r[0].File != filepath.Join(dir, "rom.bin")) {
+		t.Errorf("regions %+v", r)
+	}
+	// The model brings its own default base; irq is overridden.
+	if (m.UART.Model != "ns16550") || (m.UART.Base != ns16550Base) || (m.UART.IRQ != 3) {
+		t.Errorf("UART %+v", m.UART)
+	}
+	d := m.Drives
+	if (len(d) != 2) || (d[0].Path != "/disk.img") || !d[0].ReadOnly || d[0].Cow ||
+		(d[1].Path != filepath.Join(dir, "b.img")) || !d[1].Cow || (d[1].Base != virtioBase+virtioSize) ||
+		(d[1].IRQ != virtioIrq+1) {
+		t.Errorf("drives %+v", d)
+	}
+	if (m.Bootargs != "console=ttyS0") ||
+		!reflect.DeepEqual(m.Loads, []string{filepath.Join(dir, "a.hex"), "/b.bin@0x40100000"}) {
+		t.Errorf("boot %q %v", m.Bootargs, m.Loads)
+	}
+}
+
+func TestMachineErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"hart = 2\n", "m.toml:1: unknown key hart"},
+		{"[cpu]\n", "m.toml:1: unknown table cpu"},
+		{"[ram]\nsize = 1\nbogus = 2\n", "m.toml:3: unknown key bogus"},
+		{"harts = true\n", "m.toml:1: harts must be an integer"},
+		{"\nharts = 0\n", "m.toml:2: number of harts must be 1-32"},
+		{"harts = 33\n", "m.toml:1: number of harts must be 1-32"},
+		{"quantum = 0\n", "m.toml:1: quantum must be at least 1"},
+		{"isa = \"rv32imc\"\n", "m.toml:1: ISA extension 'c' is not supported"},
+		{"isa = \"rv64i\"\n", "m.toml:1: ISA \"rv64i\" must start with rv32i"},
+		{"[ram]\nsize = \"12Q\"\n", "m.toml:2: size: bad size \"12Q\""},
+		{"[ram]\nbase = 0x80000800\n", "m.toml:2: RAM must start on a 4KiB boundary"},
+		{"[ram]\nbase = 0xfff00000\nsize = \"2M\"\n", "m.toml:2: RAM does not fit in the address space"},
+		{"[[region]]\nbase = 0x1000\nsize = 4096\n", "m.toml:1: region needs a name"},
+		{"[[region]]\nname = \"r\"\nbase = 0x1000\nsize = 4096\naccess = \"wx\"\n", "m.toml:5: unknown region option \"wx\""},
+		{"[[region]]\nname = \"r\"\nbase = 0x1000\n", "m.toml:3: r has no size"},
+		{"[[region]]\nname = \"r\"\nbase = 0x87fff000\nsize = \"8K\"\n", "m.toml:3: r at 0x87fff000-0x88000fff overlaps RAM"},
+		{"[uart]\nmodel = \"8250\"\n", "m.toml:2: unknown UART model \"8250\""},
+		{"[uart]\nbase = 0x20000002\n", "m.toml:2: sifive must be word aligned"},
+		{"[uart]\nsize = 4\n", "sifive needs at least 0x1c bytes"},
+		{"[uart]\nirq = 64\n", "sifive interrupt 64 is not in 1-"},
+		{"[clint]\nbase = 0x0c000000\n", "m.toml:2: plic at 0x0c000000-0x0fffffff overlaps clint"},
+		{"[[drive]]\nreadonly = true\n", "m.toml:1: drive needs a path"},
+		{"[[drive]]\npath = \"d\"\nirq = 10\n", "m.toml:1: virtio-blk interrupt 10 is already used by sifive"},
+		{"[boot]\nload = \"a.hex\"\n", "m.toml:2: load must be an array of strings"},
+	}
+	for _, tt := range tests {
+		_, err := loadMachine(t, tt.text)
+		if (err == nil) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: error %v, want %v", tt.text, err, tt.want)
+		}
+	}
+}
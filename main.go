@@ -4,39 +4,693 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 	// "reflect"
 )
 
 var _ = fmt.Println
 
 var verbose = flag.Bool("v", false, "")
+var steps = flag.Int("n", 5000, "number of steps to run (0: unlimited)")
+var uartType = flag.String("uart", "sifive", "console UART model (sifive, ns16550)")
+var serialTs = flag.Bool("serial-ts", false, "time stamp each console output line")
+var bootargs = flag.String("bootargs", "", "kernel command line passed in /chosen")
+var dumpDts = flag.String("dump-dts", "", "write the generated device tree source to file (- for stdout)")
+var ramSize = flag.Uint("m", 128, "RAM size in MiB")
+var ramBase = flag.Uint("ram-base", ramBaseDefault, "RAM base address")
+var bios = flag.String("bios", "", "firmware loaded at the start of RAM (ELF or raw binary)")
+var kernel = flag.String("kernel", "", "kernel image loaded 4MiB into RAM and started by the firmware")
+var initrd = flag.String("initrd", "", "initial ramdisk placed below the device tree")
+var user = flag.Bool("user", false, "run a static Linux/newlib program in U-mode with emulated system calls")
+var userABI = flag.String("user-abi", "linux", "system call convention of a -user program (linux, newlib)")
+var semihosting = flag.Bool("semihosting", false, "service RISC-V semihosting calls")
+var sandbox = flag.String("sandbox", ".", "host directory the program sees as / in -user and -semihosting mode")
+var icache = flag.Bool("icache", true, "cache decoded instructions")
+var engine = flag.String("engine", "interp", "execution engine (interp, block)")
+var stats = flag.Bool("stats", false, "print execution statistics on exit")
+var smp = flag.Uint("smp", 1, "number of harts")
+var parallel = flag.Bool("parallel", false, "run each hart on its own goroutine (not deterministic)")
+var quantum = flag.Uint("quantum", quantumDefault, "steps each hart runs before switching to the next")
+var saveFile = flag.String("save", "", "save a snapshot of the machine to file when the run stops")
+var restoreFile = flag.String("restore", "", "resume the machine saved in a snapshot file")
+var recordFile = flag.String("record", "", "log the inputs from the host to file")
+var replayFile = flag.String("replay", "", "feed the inputs logged by -record back to the machine")
+var debug = flag.Bool("debug", false, "step the machine forwards and backwards with commands read from stdin")
+var cosim = flag.String("cosim", "", "compare every instruction with a reference trace read from FILE, tcp:HOST:PORT or unix:PATH")
+var cosimFormat = flag.String("cosim-format", "spike", "format of the -cosim trace (spike, rvfi)")
+var rvfiDII = flag.String("rvfi-dii", "", "execute the instructions sent by an RVFI-DII harness on tcp:HOST:PORT or unix:PATH")
+var machineFile = flag.String("machine", "", "machine description file; flags that are set override it")
+var serials stringList
+var serialIns stringList
+var serialPrefixes stringList
+var regions stringList
+var drives stringList
+var loads stringList
+var envs stringList
+
+func init() {
+	flag.Var(&serials, "serial", "UART sink (stdio, stdout, file:PATH, pty, tcp:HOST:PORT, unix:PATH, none); repeat for each UART, the console first (default stdio)")
+	flag.Var(&serialIns, "serial-in", "read UART input from file; repeat for each UART like -serial")
+	flag.Var(&serialPrefixes, "serial-prefix", "prefix for each UART output line; repeat for each UART like -serial")
+	flag.Var(&regions, "region", "extra memory region NAME,BASE,SIZE[,ro|,xo], SIZE may end in K, M or G (repeatable)")
+	flag.Var(&drives, "drive", "virtio block device image PATH[,ro][,cow] (repeatable)")
+	flag.Var(&loads, "load", "load image FILE[@ADDR] (ELF, Intel HEX, S-record or raw binary; repeatable)")
+	flag.Var(&envs, "env", "environment variable NAME=VALUE for -user mode (repeatable)")
+}
+
+type stringList []string
+
+func (p *stringList) String() string {
+	return fmt.Sprint(*p)
+}
+
+func (p *stringList) Set(s string) error {
+	*p = append(*p, s)
+	return nil
+}
 
 func main() {
+	if (len(os.Args) > 1) && (os.Args[1] == "test") {
+		os.Exit(runTests(os.Args[2:]))
+	}
 	flag.Parse()
-	
-	if flag.NArg() != 1 {
+	if (*engine != "interp") && (*engine != "block") {
+		log.Fatalf("ERROR: unknown engine %v", *engine)
+	}
+	if *parallel && (*engine == "block") {
+		log.Fatalf("ERROR: -parallel runs the interpreter only")
+	}
+	if (*recordFile != "") && (*replayFile != "") {
+		log.Fatalf("ERROR: -record and -replay cannot be combined")
+	}
+	if *parallel && ((*recordFile != "") || (*replayFile != "")) {
+		log.Fatalf("ERROR: -parallel runs are not deterministic and cannot be recorded")
+	}
+	if *user && ((*recordFile != "") || (*replayFile != "") || *debug) {
+		log.Fatalf("ERROR: -record, -replay and -debug do not support -user")
+	}
+	if *parallel && *debug {
+		log.Fatalf("ERROR: -debug cannot be combined with -parallel")
+	}
+	if (*cosim != "") && (*parallel || *debug || *user) {
+		log.Fatalf("ERROR: -cosim cannot be combined with -parallel, -debug or -user")
+	}
+	if (*rvfiDII != "") && (*parallel || *debug || *user || (*cosim != "")) {
+		log.Fatalf("ERROR: -rvfi-dii cannot be combined with -parallel, -debug, -user or -cosim")
+	}
+	if *restoreFile != "" {
+		snap, err := restored()
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		os.Exit(run(snap.Machine, snap))
+	}
+	m, err := machine()
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+
+	if *user {
+		if (*userABI != "linux") && (*userABI != "newlib") {
+			log.Fatalf("ERROR: unknown -user-abi %v", *userABI)
+		}
+		if flag.NArg() < 1 {
+			log.Fatalf("ERROR: %v", errors.New("Argument Error"))
+		}
+		os.Exit(runUser(m, flag.Args()))
+	}
+
+	switch {
+	case flag.NArg() == 1, (flag.NArg() > 1) && *semihosting:
+		m.Program = flag.Args()[0]
+	case (flag.NArg() == 0) && ((m.Program != "") || (m.Bios != "") || (len(m.Loads) > 0)):
+	case (flag.NArg() == 0) && (*rvfiDII != ""):
+		// The harness sends the instructions.
+	default:
 		log.Fatalf("ERROR: %v", errors.New("Argument Error"))
 	}
-	
-	filename := flag.Args()[0]
-	sim := NewCPU()
+
+	os.Exit(run(m, nil))
+}
+
+// machine builds the machine description from -machine and the flags
+// set on the command line.
+func machine() (*Machine, error) {
+	m := DefaultMachine()
+	if *machineFile != "" {
+		if err := m.Load(*machineFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		switch f.Name {
+		case "m":
+			if (*ramSize == 0) || (*ramSize >= 4096) {
+				err = fmt.Errorf("RAM size must be 1-4095 MiB")
+			}
+			m.RAM.Size = uint32(*ramSize) << 20
+			m.RAM.line = 0
+		case "ram-base":
+			if *ramBase > 0xffffffff {
+				err = fmt.Errorf("RAM base must be below 4GiB")
+			}
+			m.RAM.Base = uint32(*ramBase)
+			m.RAM.line = 0
+		case "smp":
+			if *smp > hartMax {
+				err = fmt.Errorf("number of harts must be 1-%v", hartMax)
+			}
+			m.Harts = uint32(*smp)
+			m.lines["harts"] = 0
+		case "quantum":
+			if *quantum > 0xffffffff {
+				err = fmt.Errorf("quantum is out of range")
+			}
+			m.Quantum = uint32(*quantum)
+			m.lines["quantum"] = 0
+		case "uart":
+			uart, ok := uartConfig(*uartType)
+			if !ok {
+				err = fmt.Errorf("unknown UART model %v", *uartType)
+			}
+			m.UART = uart
+		case "bios":
+			m.Bios = *bios
+		case "kernel":
+			m.Kernel = *kernel
+		case "initrd":
+			m.Initrd = *initrd
+		case "bootargs":
+			m.Bootargs = *bootargs
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range regions {
+		if err := m.AddRegion(r); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range drives {
+		if err := m.AddDrive(d); err != nil {
+			return nil, err
+		}
+	}
+	m.Loads = append(m.Loads, loads...)
+	return m, m.Validate()
+}
+
+func run(m *Machine, snap *Snapshot) int {
+	bus, err := NewBus(m)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if !*icache {
+		bus.icache = nil
+	}
+	if *engine != "block" {
+		bus.blocks = nil
+	}
+	sim := NewCPU(bus)
+	defer sim.bus.Close()
+	for i := uint32(1); i < m.Harts; i++ {
+		NewCPU(bus)
+	}
+	if snap != nil {
+		restore(sim, snap)
+	} else {
+		boot(sim, m)
+	}
+
+	consoles, err := openConsoles(len(bus.uarts))
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	defer func() {
+		for _, c := range consoles {
+			c.Close()
+		}
+	}()
+	console := consoles[0]
+	var mute *bool
+	if *debug {
+		mute = new(bool)
+	}
+	output := func(c *Console) io.Writer {
+		if mute != nil {
+			return &muteWriter{c, mute}
+		}
+		return c
+	}
+	for i, u := range bus.uarts[1:] {
+		c := consoles[i+1]
+		if (c.Input() != nil) && (*debug || (*recordFile != "") || (*replayFile != "")) {
+			log.Fatalf("ERROR: -record, -replay and -debug only log the input of the console UART")
+		}
+		u.Attach(output(c), Feed(c.Input()))
+	}
+	out := output(console)
+	rec := recorder(bus, console.Input() != nil)
+	switch {
+	case *semihosting:
+		// Console input goes to the program's semihosting reads.
+		in := console.Input()
+		if rec != nil {
+			in = rec.Input(in)
+		}
+		sh := NewSemihost(*sandbox, strings.Join(flag.Args(), " "), out, in)
+		defer sh.Close()
+		sim.semihost = sh
+		sim.bus.uart.Attach(out, nil)
+	case rec != nil:
+		rec.Attach(out, console.Input())
+	default:
+		sim.bus.uart.Attach(out, Feed(console.Input()))
+	}
+
+	status := -1
+	switch {
+	case *debug:
+		sim = NewDebugger(bus, rec, mute).Run(os.Stdin)
+	case *cosim != "":
+		if len(bus.harts) != 1 {
+			log.Fatalf("ERROR: -cosim needs a single hart")
+		}
+		src, f, err := OpenCosim(*cosim, *cosimFormat)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		status = Cosim(sim, src, *cosimFormat, *steps)
+		f.Close()
+	case *rvfiDII != "":
+		if err := ServeDII(bus, *rvfiDII); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		status = 0
+	default:
+		sim = simulate(bus.harts, m.Quantum)
+	}
+	bus.flushSerial()
+	if *saveFile != "" {
+		if err := WriteSnapshot(*saveFile, bus); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+	}
+	if rec != nil {
+		if err := rec.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+		}
+	}
+
+	// Result
+	if status >= 0 {
+		return status
+	}
+	return result(sim)
+}
+
+// openConsoles opens the sinks of n UARTs. The i-th -serial, -serial-in
+// and -serial-prefix belong to UART i; the console UART defaults to stdio
+// and the others to none.
+func openConsoles(n int) (cs []*Console, err error) {
+	if (len(serials) > n) || (len(serialIns) > n) || (len(serialPrefixes) > n) {
+		return nil, fmt.Errorf("-serial, -serial-in and -serial-prefix can be given once per UART, %v times", n)
+	}
+	defer func() {
+		if err != nil {
+			for _, c := range cs {
+				c.Close()
+			}
+		}
+	}()
+	stdio := false
+	for i := 0; i < n; i++ {
+		spec := "none"
+		if i == 0 {
+			spec = "stdio"
+		}
+		if i < len(serials) {
+			spec = serials[i]
+		}
+		if *debug && (spec == "stdio") {
+			// Standard input is for debugger commands.
+			spec = "stdout"
+		}
+		if spec == "stdio" {
+			if stdio {
+				return cs, fmt.Errorf("only one UART can use stdio")
+			}
+			stdio = true
+		}
+		var in io.Reader
+		var f *os.File
+		if (i < len(serialIns)) && (serialIns[i] != "") {
+			if f, err = os.Open(serialIns[i]); err != nil {
+				return cs, err
+			}
+			in = f
+		}
+		c, err := OpenConsole(spec, in)
+		if err != nil {
+			if f != nil {
+				f.Close()
+			}
+			return cs, err
+		}
+		if f != nil {
+			c.closers = append(c.closers, func() { f.Close() })
+		}
+		if i < len(serialPrefixes) {
+			c.SetPrefix(serialPrefixes[i])
+		}
+		c.SetTimestamp(*serialTs)
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+// recorder starts -record or -replay on bus. input tells whether the
+// console has input. The debugger always records, in memory if not to a
+// file.
+func recorder(bus *Bus, input bool) *Recorder {
+	var rec *Recorder
+	var err error
+	eng := *engine
+	if *verbose || *debug || (*cosim != "") {
+		// See simulate; the debugger and -cosim step the interpreter.
+		eng = "interp"
+	}
+	switch {
+	case *recordFile != "":
+		rec, err = Record(*recordFile, bus, eng, input)
+	case *replayFile != "":
+		rec, err = Replay(*replayFile, bus, eng)
+	case *debug:
+		rec, err = Record("", bus, eng, input)
+	default:
+		return nil
+	}
+	if *debug {
+		rec.keep = true
+	}
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	bus.rec = rec
+	return rec
+}
+
+// boot loads the images of m and the device tree into the machine at
+// reset.
+func boot(sim *CPU, m *Machine) {
+	bus := sim.bus
 	sim.Reset()
-	sim.LoadElf(filename)
-	for i := 0; i < 5000; i++ {
-		inst := sim.Fetch()
-		ops := sim.Decode(inst)
+	for _, r := range m.Regions {
+		if r.File == "" {
+			continue
+		}
+		if err := sim.LoadFile(r.File, r.Base); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+	}
+	if m.Bios != "" {
+		if err := sim.LoadFile(m.Bios, bus.ramBase); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+	}
+	for _, l := range m.Loads {
+		name, addr, err := parseLoad(l, bus.ramBase)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		if err := sim.LoadFile(name, addr); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+	}
+	if m.Program != "" {
+		if err := sim.LoadFile(m.Program, bus.ramBase); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+	}
+	if m.Kernel != "" {
+		if err := sim.LoadFile(m.Kernel, bus.ramBase+kernelOffset); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+	}
+	if m.HasReset {
+		sim.PC = m.Reset
+	}
+	// Images are loaded through hart 0; every hart starts where it does.
+	for _, h := range bus.harts[1:] {
+		h.PC = sim.PC
+	}
+
+	dt := sim.DeviceTree(m.Bootargs)
+	if m.Initrd != "" {
+		start, end, err := sim.LoadInitrd(m.Initrd)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		chosen := dt.Node("chosen")
+		chosen.Cells("linux,initrd-start", start)
+		chosen.Cells("linux,initrd-end", end)
+	}
+	dtb, err := sim.LoadDeviceTree(dt.DTB())
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if m.Bios != "" {
+		sim.LoadBootInfo(dtb, bus.ramBase+kernelOffset)
+	}
+	if *dumpDts != "" {
+		if err := writeDts(dt, *dumpDts); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+	}
+}
+
+// restore puts the machine into the state saved in snap and writes the
+// -load images on top, without changing PC.
+func restore(sim *CPU, snap *Snapshot) {
+	if err := sim.bus.Restore(snap); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	pc := sim.PC
+	for _, l := range loads {
+		name, addr, err := parseLoad(l, sim.bus.ramBase)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		if err := sim.LoadFile(name, addr); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+	}
+	sim.PC = pc
+}
+
+// restored reads the machine from the -restore snapshot. Flags that
+// describe the machine or its boot images cannot be combined with it.
+func restored() (*Snapshot, error) {
+	snap, err := ReadSnapshot(*restoreFile)
+	if err != nil {
+		return nil, err
+	}
+	m := snap.Machine
+	flag.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		switch f.Name {
+		case "machine", "m", "ram-base", "smp", "uart", "region", "drive",
+			"bios", "kernel", "initrd", "bootargs", "dump-dts", "user":
+			err = fmt.Errorf("-%v cannot be used with -restore", f.Name)
+		case "quantum":
+			m.Quantum = uint32(*quantum)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if (flag.NArg() > 0) && !*semihosting {
+		return nil, fmt.Errorf("a program cannot be used with -restore")
+	}
+	return snap, m.Validate()
+}
+
+// simulate runs the harts round-robin, each for quantum steps at a time,
+// until one of them halts or every hart has run -n steps. It returns the
+// hart that halted, or hart 0.
+func simulate(harts []*CPU, quantum uint32) *CPU {
+	start := time.Now()
+	// Tracing needs to see every instruction, so -v always interprets.
+	blocks := (*engine == "block") && !*verbose
+	q := int(quantum)
+	if len(harts) == 1 {
+		q = math.MaxInt32
+	}
+	sim := harts[0]
+	threads := *parallel && (len(harts) > 1)
+	if threads {
+		g := NewHartGroup(harts, quantum)
+		g.DumpOn(dumpSignals...)
+		sim = g.Run(*steps)
+	}
+	for i := 0; !threads && !sim.Halted && ((*steps == 0) || (i < *steps)); {
+		n := q
+		if (*steps != 0) && (*steps-i < n) {
+			n = *steps - i
+		}
+		for _, h := range harts {
+			runHart(h, n, blocks)
+			if h.Halted {
+				sim = h
+				break
+			}
+		}
+		i += n
+	}
+
+	if *stats {
+		d := time.Since(start)
+		var instret uint64
+		for _, h := range harts {
+			instret += h.Instret
+		}
+		fmt.Fprintf(os.Stderr, "%v instructions in %v (%.2f MIPS)\n",
+			instret, d, float64(instret)/d.Seconds()/1e6)
+		// With -parallel every hart has a cache of its own.
+		var hits, misses uint64
+		caches := map[*ICache]bool{}
+		for _, h := range harts {
+			if c := h.icache; (c != nil) && !caches[c] {
+				caches[c] = true
+				hits += c.Hits
+				misses += c.Misses
+			}
+		}
+		if len(caches) > 0 {
+			fmt.Fprintf(os.Stderr, "icache: %v hits, %v misses\n", hits, misses)
+		}
+		if c := sim.bus.blocks; blocks && (c != nil) {
+			fmt.Fprintf(os.Stderr, "blocks: %v translated, %v chained\n", c.Translated, c.Chained)
+		}
+	}
+	return sim
+}
+
+// runHart runs sim for n steps or until it halts.
+func runHart(sim *CPU, n int, blocks bool) {
+	for i := 0; !sim.Halted && (i < n); {
+		if blocks {
+			m := blockMax
+			if n-i < m {
+				m = n - i
+			}
+			i += sim.StepBlock(m)
+			continue
+		}
+		i++
+		if !sim.Tick() {
+			continue
+		}
+		ops, ok := sim.Next()
+		if !ok {
+			continue
+		}
 		if *verbose {
-			disasm(sim.PC, inst, &ops)
+			disasm(sim.PC, ops.Inst, ops)
 		}
-		sim.Execute(&ops)
+		sim.Execute(ops)
 	}
+}
 
-	// Result
+// runUser runs the program in args[0] with the arguments args under
+// system call emulation and returns its exit status.
+func runUser(m *Machine, args []string) int {
+	size := m.RAM.Size
+	if size > ramBaseDefault {
+		log.Fatalf("ERROR: RAM size must be 1-%v MiB", ramBaseDefault>>20)
+	}
+	// The program gets its own memory at address 0 in front of the
+	// devices; RAM proper is not used.
+	m.RAM.Base = ramBaseDefault
+	m.RAM.Size = pageSize
+	bus, err := NewBus(m)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if !*icache {
+		bus.icache = nil
+	}
+	if *engine != "block" {
+		bus.blocks = nil
+	}
+	if m.Harts != 1 {
+		log.Fatalf("ERROR: -user runs a single hart")
+	}
+	sim := NewCPU(bus)
+	sim.Reset()
+	proxy, err := NewProxy(sim, *sandbox, size, args[0], args, envs)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	defer proxy.Close()
+	proxy.newlib = *userABI == "newlib"
+
+	simulate(bus.harts, m.Quantum)
+	if !sim.Halted {
+		log.Printf("ERROR: program did not exit within %v steps", *steps)
+		return 1
+	}
+	return sim.Exit
+}
+
+// parseLoad splits a -load argument FILE[@ADDR]. Raw binaries without an
+// address are loaded at def.
+func parseLoad(s string, def uint32) (string, uint32, error) {
+	i := strings.LastIndex(s, "@")
+	if i < 0 {
+		return s, def, nil
+	}
+	addr, err := strconv.ParseUint(s[i+1:], 0, 32)
+	if err != nil {
+		return "", 0, fmt.Errorf("bad load address in %v", s)
+	}
+	return s[:i], uint32(addr), nil
+}
+
+func writeDts(dt *FDTNode, filename string) error {
+	if filename == "-" {
+		dt.DTS(os.Stdout)
+		return nil
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dt.DTS(f)
+	return nil
+}
+
+func result(sim *CPU) int {
+	if sim.Halted {
+		return sim.Exit
+	}
 	if sim.Regs[3] == 1 {
-		os.Exit(0)
-	} else {
-		os.Exit(1)
+		return 0
 	}
+	return 1
 }
@@ -1,54 +1,75 @@
 package main
 
+import "encoding/binary"
+
+// Access rights of a memory region, one bit per kind of access.
+const (
+	memX   = 1 << accessFetch
+	memR   = 1 << accessLoad
+	memW   = 1 << accessStore
+	memRWX = memR | memW | memX
+	memRO  = memR | memX
+	memXO  = memX
+)
+
+// Mem is a RAM or ROM region. Its pages are allocated on the first write,
+// so a large region only costs host memory for the parts that are used;
+// unwritten pages read as zero.
 type Mem struct {
-	mem []uint8
+	size  uint32
+	attr  uint8
+	pages [][]byte
+}
+
+func NewMem(size uint32, attr uint8) *Mem {
+	n := (uint64(size) + pageMask) >> pageShift
+	return &Mem{size: size, attr: attr, pages: make([][]byte, n)}
+}
+
+// Allows reports whether the hart may access the region with access.
+func (p *Mem) Allows(access int) bool {
+	return p.attr&(1<<uint(access)) != 0
 }
 
-func NewMem() *Mem {
-	mem := make([]uint8, 1024*1024)
-	return &Mem{mem}
+// Page returns the page at offset addr, allocating it if alloc is set.
+// It returns nil for a page that has never been written.
+func (p *Mem) Page(addr uint32, alloc bool) []byte {
+	pn := addr >> pageShift
+	if (p.pages[pn] == nil) && alloc {
+		p.pages[pn] = make([]byte, pageSize)
+	}
+	return p.pages[pn]
 }
 
 func (p *Mem) ReadByte(addr uint32) uint8 {
-	return p.mem[addr]
+	if pg := p.pages[addr>>pageShift]; pg != nil {
+		return pg[addr&pageMask]
+	}
+	return 0
 }
 
 func (p *Mem) ReadHalf(addr uint32) uint16 {
-	maskAddr := addr & 0xfffffffe
-	b0 := uint16(p.mem[maskAddr+0] & 0xff)
-	b1 := uint16(p.mem[maskAddr+1] & 0xff)
-	return (b1 << 8) | (b0)
+	if pg := p.pages[addr>>pageShift]; pg != nil {
+		return binary.LittleEndian.Uint16(pg[addr&(pageMask&^1):])
+	}
+	return 0
 }
 
 func (p *Mem) ReadWord(addr uint32) uint32 {
-	maskAddr := addr & 0xfffffffc
-	b0 := uint32(p.mem[maskAddr+0] & 0xff)
-	b1 := uint32(p.mem[maskAddr+1] & 0xff)
-	b2 := uint32(p.mem[maskAddr+2] & 0xff)
-	b3 := uint32(p.mem[maskAddr+3] & 0xff)
-	return (b3 << 24) | (b2 << 16) | (b1 << 8) | (b0)
+	if pg := p.pages[addr>>pageShift]; pg != nil {
+		return binary.LittleEndian.Uint32(pg[addr&(pageMask&^3):])
+	}
+	return 0
 }
 
 func (p *Mem) WriteByte(addr uint32, data uint8) {
-	p.mem[addr] = data
+	p.Page(addr, true)[addr&pageMask] = data
 }
 
 func (p *Mem) WriteHalf(addr uint32, data uint16) {
-	maskAddr := addr & 0xfffffffe
-	b0 := uint8((data >> 0) & 0xff)
-	b1 := uint8((data >> 8) & 0xff)
-	p.mem[maskAddr+0] = b0
-	p.mem[maskAddr+1] = b1
+	binary.LittleEndian.PutUint16(p.Page(addr, true)[addr&(pageMask&^1):], data)
 }
 
 func (p *Mem) WriteWord(addr uint32, data uint32) {
-	maskAddr := addr & 0xfffffffc
-	b0 := uint8((data >> 0) & 0xff)
-	b1 := uint8((data >> 8) & 0xff)
-	b2 := uint8((data >> 16) & 0xff)
-	b3 := uint8((data >> 24) & 0xff)
-	p.mem[maskAddr+0] = b0
-	p.mem[maskAddr+1] = b1
-	p.mem[maskAddr+2] = b2
-	p.mem[maskAddr+3] = b3
+	binary.LittleEndian.PutUint32(p.Page(addr, true)[addr&(pageMask&^3):], data)
 }
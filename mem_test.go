@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestMemAccess(t *testing.T) {
+	m := NewMem(2*pageSize, memRWX)
+	if (m.ReadWord(0) != 0) || (m.Page(0, false) != nil) {
+		t.Fatalf("unwritten memory is not zero or has a page")
+	}
+	m.WriteWord(0x100, 0x44332211)
+	for i, want := range []uint8{0x11, 0x22, 0x33, 0x44} {
+		if got := m.ReadByte(0x100 + uint32(i)); got != want {
+			t.Errorf("byte %v = %02x, want %02x", i, got, want)
+		}
+	}
+	if got := m.ReadHalf(0x102); got != 0x4433 {
+		t.Errorf("half = %04x, want 4433", got)
+	}
+	m.WriteByte(0x101, 0xaa)
+	m.WriteHalf(0x102, 0xccbb)
+	if got := m.ReadWord(0x100); got != 0xccbbaa11 {
+		t.Errorf("word = %08x, want ccbbaa11", got)
+	}
+	m.WriteWord(pageSize+pageSize-4, 0x12345678)
+	if got := m.ReadWord(pageSize + pageSize - 4); got != 0x12345678 {
+		t.Errorf("last word = %08x", got)
+	}
+	if m.ReadWord(pageSize) != 0 {
+		t.Errorf("write leaked into the rest of the page")
+	}
+}
+
+func TestMemAllows(t *testing.T) {
+	tests := []struct {
+		attr               uint8
+		fetch, load, store bool
+	}{
+		{memRWX, true, true, true},
+		{memRO, true, true, false},
+		{memXO, true, false, false},
+	}
+	for _, tt := range tests {
+		m := NewMem(pageSize, tt.attr)
+		if (m.Allows(accessFetch) != tt.fetch) || (m.Allows(accessLoad) != tt.load) || (m.Allows(accessStore) != tt.store) {
+			t.Errorf("attr %v: got %v %v %v", tt.attr, m.Allows(accessFetch), m.Allows(accessLoad), m.Allows(accessStore))
+		}
+	}
+}
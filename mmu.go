@@ -0,0 +1,311 @@
+package main
+
+import "encoding/binary"
+
+const (
+	accessFetch = iota
+	accessLoad
+	accessStore
+)
+
+const (
+	PTE_V = 0x001
+	PTE_R = 0x002
+	PTE_W = 0x004
+	PTE_X = 0x008
+	PTE_U = 0x010
+	PTE_G = 0x020
+	PTE_A = 0x040
+	PTE_D = 0x080
+)
+
+type tlbEntry struct {
+	pte     uint32
+	pteAddr uint32
+	ppn     uint64 // physical page of the 4KiB page
+}
+
+var pageFault = [...]uint32{
+	accessFetch: EXCEPT_CODE_INST_PAGE_FAULT,
+	accessLoad:  EXCEPT_CODE_LOAD_PAGE_FAULT,
+	accessStore: EXCEPT_CODE_STORE_PAGE_FAULT,
+}
+
+var accessFault = [...]uint32{
+	accessFetch: EXCEPT_CODE_INST_ACCESS_FAULT,
+	accessLoad:  EXCEPT_CODE_LOAD_ACCESS_FAULT,
+	accessStore: EXCEPT_CODE_STORE_ACCESS_FAULT,
+}
+
+func (p *CPU) FlushTLB() {
+	p.tlb = make(map[uint32]tlbEntry)
+	p.tlbGen++
+}
+
+// permitted checks the leaf pte against the access type and the
+// effective privilege level.
+func (p *CPU) permitted(pte uint32, access int, priv uint32) bool {
+	mstatus := p.CSRs[CSR_ADDR_MSTATUS]
+	if pte&PTE_U != 0 {
+		if priv == PRIV_S && (access == accessFetch || mstatus&MSTATUS_SUM == 0) {
+			return false
+		}
+	} else if priv == PRIV_U {
+		return false
+	}
+
+	switch access {
+	case accessFetch:
+		return pte&PTE_X != 0
+	case accessLoad:
+		return (pte&PTE_R != 0) || ((pte&PTE_X != 0) && (mstatus&MSTATUS_MXR != 0))
+	default:
+		return pte&PTE_W != 0
+	}
+}
+
+// Translate maps a virtual address to a physical address using Sv32. On
+// failure it returns the exception code to raise.
+func (p *CPU) Translate(vaddr uint32, access int) (uint32, uint32, bool) {
+	priv := p.Priv
+	mstatus := p.CSRs[CSR_ADDR_MSTATUS]
+	if (access != accessFetch) && (mstatus&MSTATUS_MPRV != 0) {
+		priv = (mstatus & MSTATUS_MPP) >> 11
+	}
+	satp := p.CSRs[CSR_ADDR_SATP]
+	if (priv == PRIV_M) || (satp&0x80000000 == 0) {
+		return vaddr, 0, true
+	}
+
+	vpn := vaddr >> 12
+	if e, ok := p.tlb[vpn]; ok {
+		if p.permitted(e.pte, access, priv) && !((access == accessStore) && (e.pte&PTE_D == 0)) {
+			if e.ppn > 0xfffff {
+				return 0, accessFault[access], false
+			}
+			return uint32(e.ppn<<12) | (vaddr & 0xfff), 0, true
+		}
+	}
+
+	a := uint64(satp&0x003fffff) << 12
+	for level := 1; level >= 0; level-- {
+		idx := (vaddr >> (12 + 10*uint32(level))) & 0x3ff
+		pteAddr := a + uint64(idx)*4
+		if pteAddr > 0xffffffff || !p.bus.Mapped(uint32(pteAddr)) {
+			return 0, accessFault[access], false
+		}
+		pte := p.bus.ReadWord(uint32(pteAddr))
+
+		if (pte&PTE_V == 0) || ((pte&PTE_R == 0) && (pte&PTE_W != 0)) {
+			return 0, pageFault[access], false
+		}
+		ppn := uint64(pte >> 10)
+		if pte&(PTE_R|PTE_X) == 0 {
+			// pointer to the next level
+			a = ppn << 12
+			continue
+		}
+
+		if !p.permitted(pte, access, priv) {
+			return 0, pageFault[access], false
+		}
+		if (level == 1) && (ppn&0x3ff != 0) {
+			// misaligned superpage
+			return 0, pageFault[access], false
+		}
+
+		// Accessed and dirty bits are updated by hardware.
+		t := pte | PTE_A
+		if access == accessStore {
+			t |= PTE_D
+		}
+		if t != pte {
+			p.bus.WriteWord(uint32(pteAddr), t)
+			pte = t
+		}
+
+		if level == 1 {
+			ppn = ppn | uint64((vaddr>>12)&0x3ff)
+		}
+		p.tlb[vpn] = tlbEntry{pte, uint32(pteAddr), ppn}
+		if ppn > 0xfffff {
+			return 0, accessFault[access], false
+		}
+		return uint32(ppn<<12) | (vaddr & 0xfff), 0, true
+	}
+	return 0, pageFault[access], false
+}
+
+// Load reads size bytes from the virtual address vaddr. Misaligned
+// accesses are carried out byte by byte. If the access faults the trap is
+// taken and false is returned.
+func (p *CPU) Load(vaddr uint32, size uint32) (uint32, bool) {
+	if vaddr&(size-1) != 0 {
+		var ret uint32 = 0
+		for i := uint32(0); i < size; i++ {
+			t, ok := p.Load(vaddr+i, 1)
+			if !ok {
+				return 0, false
+			}
+			ret |= t << (8 * i)
+		}
+		return ret, true
+	}
+
+	paddr, cause, ok := p.Translate(vaddr, accessLoad)
+	if !ok {
+		p.Trap(cause, vaddr)
+		return 0, false
+	}
+	if pg := p.bus.access(paddr, accessLoad); pg != nil {
+		off := paddr & pageMask
+		if p.bus.parallel {
+			return loadShared(pg, off, size), true
+		}
+		switch size {
+		case 1:
+			return uint32(pg[off]), true
+		case 2:
+			return uint32(binary.LittleEndian.Uint16(pg[off:])), true
+		default:
+			return binary.LittleEndian.Uint32(pg[off:]), true
+		}
+	}
+	if !p.bus.Allowed(paddr, accessLoad) {
+		p.Trap(EXCEPT_CODE_LOAD_ACCESS_FAULT, vaddr)
+		return 0, false
+	}
+	switch size {
+	case 1:
+		return uint32(p.bus.ReadByte(paddr)), true
+	case 2:
+		return uint32(p.bus.ReadHalf(paddr)), true
+	default:
+		return p.bus.ReadWord(paddr), true
+	}
+}
+
+// Store writes the low size bytes of data to the virtual address vaddr.
+func (p *CPU) Store(vaddr uint32, size uint32, data uint32) bool {
+	if vaddr&(size-1) != 0 {
+		// Translate every byte first so that a fault leaves memory
+		// untouched.
+		for i := uint32(0); i < size; i++ {
+			if _, cause, ok := p.Translate(vaddr+i, accessStore); !ok {
+				p.Trap(cause, vaddr+i)
+				return false
+			}
+		}
+		for i := uint32(0); i < size; i++ {
+			if !p.Store(vaddr+i, 1, data>>(8*i)) {
+				return false
+			}
+		}
+		return true
+	}
+
+	paddr, cause, ok := p.Translate(vaddr, accessStore)
+	if !ok {
+		p.Trap(cause, vaddr)
+		return false
+	}
+	if len(p.bus.harts) > 1 {
+		p.bus.snoop(paddr, p)
+	}
+	if pg := p.bus.access(paddr, accessStore); pg != nil {
+		if p.bus.watch != nil {
+			p.bus.watch(p, vaddr, paddr, size, data)
+		}
+		p.bus.invalidate(paddr)
+		off := paddr & pageMask
+		if p.bus.parallel {
+			p.bus.writeShared(pg, paddr, size, data)
+			return true
+		}
+		switch size {
+		case 1:
+			pg[off] = uint8(data)
+		case 2:
+			binary.LittleEndian.PutUint16(pg[off:], uint16(data))
+		default:
+			binary.LittleEndian.PutUint32(pg[off:], data)
+		}
+		return true
+	}
+	if !p.bus.Allowed(paddr, accessStore) {
+		p.Trap(EXCEPT_CODE_STORE_ACCESS_FAULT, vaddr)
+		return false
+	}
+	if p.bus.watch != nil {
+		p.bus.watch(p, vaddr, paddr, size, data)
+	}
+	switch size {
+	case 1:
+		p.bus.WriteByte(paddr, uint8(data&0xff))
+	case 2:
+		p.bus.WriteHalf(paddr, uint16(data&0xffff))
+	default:
+		p.bus.WriteWord(paddr, data)
+	}
+	return true
+}
+
+// Atomic performs a read-modify-write of the word at vaddr for the A
+// extension. op computes the value to store from the loaded one.
+func (p *CPU) Atomic(vaddr uint32, op func(t uint32) uint32) (uint32, bool) {
+	if vaddr&0x3 != 0 {
+		p.Trap(EXCEPT_CODE_STORE_MISALIGNED, vaddr)
+		return 0, false
+	}
+	paddr, cause, ok := p.Translate(vaddr, accessStore)
+	if !ok {
+		p.Trap(cause, vaddr)
+		return 0, false
+	}
+	if p.bus.parallel {
+		if t, ok := p.amoShared(paddr, op); ok {
+			return t, true
+		}
+	}
+	if !p.bus.Allowed(paddr, accessLoad) || !p.bus.Allowed(paddr, accessStore) {
+		p.Trap(EXCEPT_CODE_STORE_ACCESS_FAULT, vaddr)
+		return 0, false
+	}
+	p.bus.snoop(paddr, p)
+	t := p.bus.ReadWord(paddr)
+	v := op(t)
+	if p.bus.watch != nil {
+		p.bus.watch(p, vaddr, paddr, 4, v)
+	}
+	p.bus.WriteWord(paddr, v)
+	return t, true
+}
+
+// ReadVirt copies n bytes from the virtual address vaddr as a load would
+// see them, without taking a trap. It fails if any byte is not mapped.
+func (p *CPU) ReadVirt(vaddr uint32, n uint32) ([]byte, bool) {
+	b := make([]byte, n)
+	for i := range b {
+		paddr, _, ok := p.Translate(vaddr+uint32(i), accessLoad)
+		if !ok || !p.bus.Allowed(paddr, accessLoad) {
+			return nil, false
+		}
+		b[i] = p.bus.ReadByte(paddr)
+	}
+	return b, true
+}
+
+// WriteVirt copies b to the virtual address vaddr without taking a trap.
+func (p *CPU) WriteVirt(vaddr uint32, b []byte) bool {
+	for i, c := range b {
+		paddr, _, ok := p.Translate(vaddr+uint32(i), accessStore)
+		if !ok || !p.bus.Allowed(paddr, accessStore) {
+			return false
+		}
+		if p.bus.watch != nil {
+			p.bus.watch(p, vaddr+uint32(i), paddr, 1, uint32(c))
+		}
+		p.bus.WriteByte(paddr, c)
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+package main
+
+import "testing"
+
+const (
+	testRoot  = 0x80100000 // first level page table
+	testLeaf  = 0x80101000 // second level page table for 0x40800000
+	testFlags = PTE_V | PTE_A | PTE_D
+)
+
+// newTestMMU returns a hart with Sv32 enabled and these mappings:
+//
+//	0x40000000 4MiB superpage at 0x80000000, RWX
+//	0x40400000 misaligned superpage
+//	0x40800000 user page at 0x80200000, RW
+//	0x40801000 user page at 0x80201000, execute only
+//	0x40802000 invalid
+//	0x40803000 write only, which is reserved
+//	0x40804000 page at 0x80204000, RW, not accessed or dirty
+//	0x40c00000 second level table outside of memory
+//	0x41000000 superpage above 4GiB
+func newTestMMU(t *testing.T) *CPU {
+	p := newTestCPU(t)
+	l1 := func(va uint32, pte uint32) { p.bus.WriteWord(testRoot+4*(va>>22), pte) }
+	l0 := func(va uint32, pte uint32) { p.bus.WriteWord(testLeaf+4*((va>>12)&0x3ff), pte) }
+	l1(0x40000000, 0x80000<<10|PTE_R|PTE_W|PTE_X|testFlags)
+	l1(0x40400000, 0x80001<<10|PTE_R|PTE_W|PTE_X|testFlags)
+	l1(0x40800000, testLeaf>>12<<10|PTE_V)
+	l1(0x40c00000, 0x00001<<10|PTE_V)
+	l1(0x41000000, 0x100000<<10|PTE_R|testFlags)
+	l0(0x40800000, 0x80200<<10|PTE_U|PTE_R|PTE_W|testFlags)
+	l0(0x40801000, 0x80201<<10|PTE_U|PTE_X|testFlags)
+	l0(0x40803000, 0x80203<<10|PTE_W|testFlags)
+	l0(0x40804000, 0x80204<<10|PTE_R|PTE_W|PTE_V)
+	p.CSRs[CSR_ADDR_SATP] = 0x80000000 | testRoot>>12
+	return p
+}
+
+func TestTranslate(t *testing.T) {
+	const (
+		load  = accessLoad
+		store = accessStore
+		fetch = accessFetch
+		sum   = MSTATUS_SUM
+		mxr   = MSTATUS_MXR
+		mprvS = MSTATUS_MPRV | PRIV_S<<11
+	)
+	tests := []struct {
+		priv    uint32
+		mstatus uint32
+		vaddr   uint32
+		access  int
+		paddr   uint32
+		cause   uint32 // 0 if the translation succeeds
+	}{
+		// Superpages map the low bits of the virtual page.
+		{PRIV_S, 0, 0x40000123, load, 0x80000123, 0},
+		{PRIV_S, 0, 0x403ff004, fetch, 0x803ff004, 0},
+		{PRIV_S, 0, 0x40400000, load, 0, EXCEPT_CODE_LOAD_PAGE_FAULT},
+		{PRIV_S, 0, 0x41000000, load, 0, EXCEPT_CODE_LOAD_ACCESS_FAULT},
+
+		// U pages are for U-mode, and for S-mode loads and stores
+		// with SUM.
+		{PRIV_U, 0, 0x40000000, load, 0, EXCEPT_CODE_LOAD_PAGE_FAULT},
+		{PRIV_U, 0, 0x40800010, store, 0x80200010, 0},
+		{PRIV_S, 0, 0x40800010, load, 0, EXCEPT_CODE_LOAD_PAGE_FAULT},
+		{PRIV_S, 0, 0x40800010, store, 0, EXCEPT_CODE_STORE_PAGE_FAULT},
+		{PRIV_S, sum, 0x40800010, load, 0x80200010, 0},
+		{PRIV_S, sum, 0x40800010, store, 0x80200010, 0},
+		{PRIV_S, sum, 0x40801008, fetch, 0, EXCEPT_CODE_INST_PAGE_FAULT},
+
+		// MXR makes executable pages readable.
+		{PRIV_U, 0, 0x40801008, fetch, 0x80201008, 0},
+		{PRIV_U, 0, 0x40801008, load, 0, EXCEPT_CODE_LOAD_PAGE_FAULT},
+		{PRIV_U, mxr, 0x40801008, load, 0x80201008, 0},
+		{PRIV_U, mxr, 0x40801008, store, 0, EXCEPT_CODE_STORE_PAGE_FAULT},
+
+		// Invalid and reserved entries.
+		{PRIV_S, 0, 0x40802000, fetch, 0, EXCEPT_CODE_INST_PAGE_FAULT},
+		{PRIV_S, 0, 0x40802000, load, 0, EXCEPT_CODE_LOAD_PAGE_FAULT},
+		{PRIV_S, 0, 0x40802000, store, 0, EXCEPT_CODE_STORE_PAGE_FAULT},
+		{PRIV_S, 0, 0x40803000, store, 0, EXCEPT_CODE_STORE_PAGE_FAULT},
+		{PRIV_S, 0, 0x40c00000, load, 0, EXCEPT_CODE_LOAD_ACCESS_FAULT},
+		{PRIV_S, 0, 0x40c00000, fetch, 0, EXCEPT_CODE_INST_ACCESS_FAULT},
+
+		// M-mode is not translated, unless MPRV applies to a load or
+		// store.
+		{PRIV_M, 0, 0x40000123, load, 0x40000123, 0},
+		{PRIV_M, mprvS, 0x40000123, load, 0x80000123, 0},
+		{PRIV_M, mprvS, 0x40000123, fetch, 0x40000123, 0},
+		{PRIV_M, mprvS, 0x40800010, load, 0, EXCEPT_CODE_LOAD_PAGE_FAULT},
+	}
+	for _, tt := range tests {
+		p := newTestMMU(t)
+		p.Priv = tt.priv
+		p.CSRs[CSR_ADDR_MSTATUS] = tt.mstatus
+		paddr, cause, ok := p.Translate(tt.vaddr, tt.access)
+		if (ok != (tt.cause == 0)) || (cause != tt.cause) || (ok && (paddr != tt.paddr)) {
+			t.Errorf("priv %v, mstatus %08x, access %v of %08x: %08x, cause %v, want %08x, cause %v",
+				tt.priv, tt.mstatus, tt.access, tt.vaddr, paddr, cause, tt.paddr, tt.cause)
+		}
+	}
+
+	// Without satp.MODE nothing is translated.
+	p := newTestMMU(t)
+	p.Priv = PRIV_S
+	p.CSRs[CSR_ADDR_SATP] &^= 0x80000000
+	if paddr, _, ok := p.Translate(0x40000123, accessLoad); !ok || (paddr != 0x40000123) {
+		t.Errorf("bare: %08x, %v", paddr, ok)
+	}
+}
+
+// The walk sets A on any access and D on a store, also for a page that is
+// already in the TLB.
+func TestTranslateAccessedDirty(t *testing.T) {
+	p := newTestMMU(t)
+	p.Priv = PRIV_S
+	pteAddr := uint32(testLeaf + 4*4)
+	steps := []struct {
+		access int
+		pte    uint32
+	}{
+		{accessLoad, PTE_A},
+		{accessLoad, PTE_A},
+		{accessStore, PTE_A | PTE_D},
+	}
+	for i, s := range steps {
+		if paddr, cause, ok := p.Translate(0x40804008, s.access); !ok || (paddr != 0x80204008) {
+			t.Fatalf("%v: %08x, cause %v", i, paddr, cause)
+		}
+		if got := p.bus.ReadWord(pteAddr) & (PTE_A | PTE_D); got != s.pte {
+			t.Errorf("%v: A/D bits %02x, want %02x", i, got, s.pte)
+		}
+	}
+
+	// A store that faults leaves the entry alone.
+	p = newTestMMU(t)
+	p.Priv = PRIV_U
+	p.Translate(0x40804008, accessStore)
+	if got := p.bus.ReadWord(pteAddr) & (PTE_A | PTE_D); got != 0 {
+		t.Errorf("fault: A/D bits %02x, want 0", got)
+	}
+}
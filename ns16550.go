@@ -0,0 +1,309 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// Memory Map (reg-shift 0, byte wide registers):
+// 0x0: rbr receive buffer    (read,  DLAB=0)
+//      thr transmit holding  (write, DLAB=0)
+//      dll divisor latch LSB (DLAB=1)
+// 0x1: ier interrupt enable  (DLAB=0)
+//      dlm divisor latch MSB (DLAB=1)
+// 0x2: iir interrupt identification (read)
+//      fcr FIFO control      (write)
+// 0x3: lcr line control
+// 0x4: mcr modem control
+// 0x5: lsr line status
+// 0x6: msr modem status
+// 0x7: scr scratch
+
+const (
+	ns16550Rbr = 0x0
+	ns16550Ier = 0x1
+	ns16550Iir = 0x2
+	ns16550Lcr = 0x3
+	ns16550Mcr = 0x4
+	ns16550Lsr = 0x5
+	ns16550Msr = 0x6
+	ns16550Scr = 0x7
+)
+
+const (
+	ns16550FifoDepth = 16
+	ns16550Timeout   = 1024
+
+	ns16550IerRdi  = 0x01
+	ns16550IerThri = 0x02
+	ns16550IerRlsi = 0x04
+	ns16550IerMsi  = 0x08
+
+	ns16550IirNoInt = 0x01
+	ns16550IirMsi   = 0x00
+	ns16550IirThri  = 0x02
+	ns16550IirRdi   = 0x04
+	ns16550IirRlsi  = 0x06
+	ns16550IirCti   = 0x0c
+	ns16550IirFifo  = 0xc0
+
+	ns16550FcrEnable = 0x01
+	ns16550FcrClrRx  = 0x02
+	ns16550FcrClrTx  = 0x04
+
+	ns16550LcrDlab = 0x80
+
+	ns16550McrLoop = 0x10
+
+	ns16550LsrDr   = 0x01
+	ns16550LsrOe   = 0x02
+	ns16550LsrThre = 0x20
+	ns16550LsrTemt = 0x40
+)
+
+var ns16550Trigger = [4]int{1, 4, 8, 14}
+
+type NS16550 struct {
+	txfifo []uint8
+	rxfifo []uint8
+	ier    uint8
+	fcr    uint8
+	lcr    uint8
+	mcr    uint8
+	lsr    uint8
+	scr    uint8
+	dll    uint8
+	dlm    uint8
+	thri   bool
+	shift  bool // the transmitter shift register holds a character
+	rxIdle int
+	input  <-chan uint8
+	out    io.Writer
+}
+
+func NewNS16550() *NS16550 {
+	txfifo := make([]uint8, 0, ns16550FifoDepth)
+	rxfifo := make([]uint8, 0, ns16550FifoDepth)
+	return &NS16550{txfifo: txfifo, rxfifo: rxfifo, lsr: ns16550LsrThre | ns16550LsrTemt, out: os.Stdout}
+}
+
+// Attach connects the UART to out and feeds the bytes arriving on in, if
+// it is not nil, into the receive path until in is closed.
+func (p *NS16550) Attach(out io.Writer, in <-chan uint8) {
+	p.out = out
+	p.input = in
+}
+
+func (p *NS16550) depth() int {
+	if p.fcr&ns16550FcrEnable != 0 {
+		return ns16550FifoDepth
+	}
+	return 1
+}
+
+func (p *NS16550) receive(c uint8) {
+	if len(p.rxfifo) >= p.depth() {
+		p.lsr |= ns16550LsrOe
+		return
+	}
+	p.rxfifo = append(p.rxfifo, c)
+	p.rxIdle = 0
+}
+
+// Tick moves one character from the transmit FIFO through the shift
+// register and receives one character.
+func (p *NS16550) Tick() {
+	p.shift = false
+	if len(p.txfifo) > 0 {
+		c := p.txfifo[0]
+		p.txfifo = p.txfifo[1:]
+		if p.mcr&ns16550McrLoop != 0 {
+			p.receive(c)
+		} else {
+			p.out.Write([]byte{c})
+		}
+		p.shift = true
+		if len(p.txfifo) == 0 {
+			p.thri = true
+		}
+	}
+
+	if (p.mcr&ns16550McrLoop == 0) && (p.input != nil) && (len(p.rxfifo) < p.depth()) {
+		select {
+		case c, ok := <-p.input:
+			if ok {
+				p.receive(c)
+			} else {
+				p.input = nil
+			}
+		default:
+		}
+	}
+
+	if len(p.rxfifo) > 0 && p.rxIdle < ns16550Timeout {
+		p.rxIdle++
+	}
+}
+
+// Flush sends the characters still in the transmit FIFO, so that output
+// queued when the simulation stops is not lost.
+func (p *NS16550) Flush() {
+	if (len(p.txfifo) > 0) && (p.mcr&ns16550McrLoop == 0) {
+		p.out.Write(p.txfifo)
+		p.txfifo = p.txfifo[:0]
+		p.thri = true
+	}
+	p.shift = false
+}
+
+// iir returns the highest priority pending interrupt.
+func (p *NS16550) iir() uint8 {
+	var fifo uint8 = 0
+	if p.fcr&ns16550FcrEnable != 0 {
+		fifo = ns16550IirFifo
+	}
+
+	trigger := 1
+	if p.fcr&ns16550FcrEnable != 0 {
+		trigger = ns16550Trigger[p.fcr>>6]
+	}
+
+	switch {
+	case (p.ier&ns16550IerRlsi != 0) && (p.lsr&ns16550LsrOe != 0):
+		return fifo | ns16550IirRlsi
+	case (p.ier&ns16550IerRdi != 0) && (len(p.rxfifo) >= trigger):
+		return fifo | ns16550IirRdi
+	case (p.ier&ns16550IerRdi != 0) && (len(p.rxfifo) > 0) && (p.rxIdle >= ns16550Timeout):
+		return fifo | ns16550IirCti
+	case (p.ier&ns16550IerThri != 0) && p.thri:
+		return fifo | ns16550IirThri
+	default:
+		return fifo | ns16550IirNoInt
+	}
+}
+
+func (p *NS16550) Pending() bool {
+	return p.iir()&ns16550IirNoInt == 0
+}
+
+// Interactive reports whether input may still arrive from the host.
+func (p *NS16550) Interactive() bool {
+	return p.input != nil
+}
+
+func (p *NS16550) ReadByte(addr uint32) uint8 {
+	dlab := p.lcr&ns16550LcrDlab != 0
+	switch addr & 0x7 {
+	case ns16550Rbr:
+		if dlab {
+			return p.dll
+		}
+		if len(p.rxfifo) == 0 {
+			return 0
+		}
+		c := p.rxfifo[0]
+		p.rxfifo = p.rxfifo[1:]
+		p.rxIdle = 0
+		return c
+	case ns16550Ier:
+		if dlab {
+			return p.dlm
+		}
+		return p.ier
+	case ns16550Iir:
+		t := p.iir()
+		if t&0x0f == ns16550IirThri {
+			p.thri = false
+		}
+		return t
+	case ns16550Lcr:
+		return p.lcr
+	case ns16550Mcr:
+		return p.mcr
+	case ns16550Lsr:
+		t := p.lsr
+		if len(p.rxfifo) > 0 {
+			t |= ns16550LsrDr
+		}
+		// THRE: the FIFO (or holding register) is empty. TEMT: so is
+		// the shift register.
+		t &^= ns16550LsrThre | ns16550LsrTemt
+		if len(p.txfifo) == 0 {
+			t |= ns16550LsrThre
+			if !p.shift {
+				t |= ns16550LsrTemt
+			}
+		}
+		p.lsr &^= ns16550LsrOe
+		return t
+	case ns16550Msr:
+		if p.mcr&ns16550McrLoop != 0 {
+			// DTR->DSR, RTS->CTS, OUT1->RI, OUT2->DCD
+			m := p.mcr
+			return ((m & 0x01) << 5) | ((m & 0x02) << 3) | ((m & 0x04) << 4) | ((m & 0x08) << 4)
+		}
+		return 0xb0 // DCD, DSR, CTS
+	default:
+		return p.scr
+	}
+}
+
+func (p *NS16550) WriteByte(addr uint32, data uint8) {
+	dlab := p.lcr&ns16550LcrDlab != 0
+	switch addr & 0x7 {
+	case ns16550Rbr:
+		if dlab {
+			p.dll = data
+			return
+		}
+		if len(p.txfifo) < p.depth() {
+			p.txfifo = append(p.txfifo, data)
+		}
+		p.thri = false
+	case ns16550Ier:
+		if dlab {
+			p.dlm = data
+			return
+		}
+		// Enabling THRI while the holding register is empty raises
+		// the interrupt right away, as on real parts.
+		if (data&ns16550IerThri != 0) && (p.ier&ns16550IerThri == 0) && (len(p.txfifo) == 0) {
+			p.thri = true
+		}
+		p.ier = data & 0x0f
+	case ns16550Iir:
+		if data&ns16550FcrClrRx != 0 {
+			p.rxfifo = p.rxfifo[:0]
+		}
+		if data&ns16550FcrClrTx != 0 {
+			p.txfifo = p.txfifo[:0]
+		}
+		p.fcr = data & 0xc1
+	case ns16550Lcr:
+		p.lcr = data
+	case ns16550Mcr:
+		p.mcr = data & 0x1f
+	case ns16550Lsr, ns16550Msr:
+	default:
+		p.scr = data
+	}
+}
+
+// Half and word accesses are treated as accesses to the byte register at
+// the given address, matching reg-io-width = 1.
+
+func (p *NS16550) ReadHalf(addr uint32) uint16 {
+	return uint16(p.ReadByte(addr))
+}
+
+func (p *NS16550) ReadWord(addr uint32) uint32 {
+	return uint32(p.ReadByte(addr))
+}
+
+func (p *NS16550) WriteHalf(addr uint32, data uint16) {
+	p.WriteByte(addr, uint8(data&0xff))
+}
+
+func (p *NS16550) WriteWord(addr uint32, data uint32) {
+	p.WriteByte(addr, uint8(data&0xff))
+}
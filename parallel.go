@@ -0,0 +1,384 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// With -parallel every hart runs on its own goroutine instead of being
+// interleaved with the others:
+//   - Every load and store to memory is a single atomic operation on the
+//     aligned word containing it. Go's atomics are sequentially
+//     consistent, which is stronger than RVWMO, so fence needs no work of
+//     its own. A memory page is allocated and mapped the first time a
+//     hart touches it, under a lock, and its page table entry is
+//     published with an atomic store.
+//   - Stores, AMOs and sc.w take the lock of the word's slot in a table of
+//     reservations and bump its version. lr.w notes the version, and sc.w
+//     only stores if it has not changed since, so a store by another hart
+//     in between makes it fail even if the word holds the old value again.
+//   - Devices are accessed under a lock. A hart samples its interrupt
+//     lines every quantum steps, and hart 0 advances mtime and the other
+//     devices by the steps it ran since the last time.
+//   - Each hart has its own decoded instruction cache. Like on hardware,
+//     a hart only sees code written by itself or another hart after a
+//     fence.i.
+
+var hostBigEndian = func() bool {
+	t := uint32(1)
+	return *(*byte)(unsafe.Pointer(&t)) == 0
+}()
+
+// le converts between a little-endian word in guest memory and the same
+// word as seen by an atomic operation of the host.
+func le(t uint32) uint32 {
+	if hostBigEndian {
+		return bits.ReverseBytes32(t)
+	}
+	return t
+}
+
+func sharedWord(pg []byte, off uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&pg[off&^3]))
+}
+
+// loadShared reads size bytes at off of a memory page that other harts
+// may be writing. The access must be naturally aligned.
+func loadShared(pg []byte, off uint32, size uint32) uint32 {
+	t := le(atomic.LoadUint32(sharedWord(pg, off)))
+	switch size {
+	case 1:
+		return (t >> (8 * (off & 3))) & 0xff
+	case 2:
+		return (t >> (8 * (off & 2))) & 0xffff
+	}
+	return t
+}
+
+// storeShared writes size bytes at off of a memory page that other harts
+// may be accessing. Bytes and halfwords replace their part of the word
+// with a compare-and-swap so that stores to the rest of it are not lost.
+func storeShared(pg []byte, off uint32, size uint32, data uint32) {
+	w := sharedWord(pg, off)
+	if size == 4 {
+		atomic.StoreUint32(w, le(data))
+		return
+	}
+	shift := 8 * (off & 3)
+	mask := uint32(0xff)
+	if size == 2 {
+		mask = 0xffff
+	}
+	mask <<= shift
+	for {
+		old := atomic.LoadUint32(w)
+		t := le((le(old) &^ mask) | ((data << shift) & mask))
+		if atomic.CompareAndSwapUint32(w, old, t) {
+			return
+		}
+	}
+}
+
+// resSlots is the number of slots in a resTable. Words share a slot if
+// their addresses are a multiple of 4*resSlots apart, which can only make
+// sc.w fail more often.
+const resSlots = 1024
+
+type resSlot struct {
+	sync.Mutex
+	version uint32
+}
+
+// resTable orders the writes of -parallel harts to each word of memory so
+// that sc.w can tell whether the word was written since lr.w.
+type resTable [resSlots]resSlot
+
+func (p *Bus) slot(paddr uint32) *resSlot {
+	return &p.resv[(paddr>>2)%resSlots]
+}
+
+// writeShared is storeShared for a write to paddr, which is in pg. It
+// breaks the reservations of the word.
+func (p *Bus) writeShared(pg []byte, paddr uint32, size uint32, data uint32) {
+	s := p.slot(paddr)
+	s.Lock()
+	s.version++
+	storeShared(pg, paddr&pageMask, size, data)
+	s.Unlock()
+}
+
+// populate allocates and maps the memory page of addr the first time a
+// -parallel hart touches it. It returns nil if the page is not entirely
+// covered by a Mem.
+func (p *Bus) populate(addr uint32) []byte {
+	dev, t := p.lookup(addr)
+	mem, ok := dev.(*Mem)
+	if !ok {
+		return nil
+	}
+	p.grow.Lock()
+	defer p.grow.Unlock()
+	e := p.entry(addr)
+	if pg := e.bytes(); pg != nil {
+		return pg
+	}
+	base := addr - t
+	if (addr&^pageMask < base) || (uint64(addr|pageMask) > uint64(base)+uint64(mem.size)-1) {
+		return nil
+	}
+	mem.Page((addr&^pageMask)-base, true)
+	p.mapPage(addr)
+	return e.bytes()
+}
+
+// lock and unlock guard device accesses in -parallel mode.
+func (p *Bus) lock() {
+	if p.parallel {
+		p.io.Lock()
+	}
+}
+
+func (p *Bus) unlock() {
+	if p.parallel {
+		p.io.Unlock()
+	}
+}
+
+// Time returns mtime.
+func (p *Bus) Time() uint64 {
+	p.lock()
+	defer p.unlock()
+	return p.clint.mtime
+}
+
+// amoShared is Atomic for memory in -parallel mode. It returns false if
+// paddr is not memory the hart may read and write.
+func (p *CPU) amoShared(paddr uint32, op func(t uint32) uint32) (uint32, bool) {
+	if p.bus.access(paddr, accessLoad) == nil {
+		return 0, false
+	}
+	pg := p.bus.access(paddr, accessStore)
+	if pg == nil {
+		return 0, false
+	}
+	off := paddr & pageMask
+	s := p.bus.slot(paddr)
+	s.Lock()
+	s.version++
+	t := loadShared(pg, off, 4)
+	storeShared(pg, off, 4, op(t))
+	s.Unlock()
+	return t, true
+}
+
+// loadReserved loads the word at vaddr, which is paddr, for lr.w. With
+// -parallel it notes the version of the word's reservation slot.
+func (p *CPU) loadReserved(vaddr uint32, paddr uint32) (uint32, bool) {
+	if p.bus.parallel {
+		if pg := p.bus.access(paddr, accessLoad); pg != nil {
+			s := p.bus.slot(paddr)
+			s.Lock()
+			p.resVer = s.version
+			t := loadShared(pg, paddr&pageMask, 4)
+			s.Unlock()
+			return t, true
+		}
+	}
+	return p.Load(vaddr, 4)
+}
+
+// storeConditional stores data at vaddr for sc.w, whose reservation at
+// paddr is valid, and reports whether the store took place. ok is false
+// if it trapped.
+func (p *CPU) storeConditional(vaddr uint32, paddr uint32, data uint32) (stored bool, ok bool) {
+	if p.bus.parallel {
+		if pg := p.bus.access(paddr, accessStore); pg != nil {
+			s := p.bus.slot(paddr)
+			s.Lock()
+			if s.version == p.resVer {
+				s.version++
+				storeShared(pg, paddr&pageMask, 4, data)
+				stored = true
+			}
+			s.Unlock()
+			return stored, true
+		}
+	}
+	if !p.Store(vaddr, 4, data) {
+		return false, false
+	}
+	return true, true
+}
+
+// HartGroup runs the harts of a machine on one goroutine each. The harts
+// can be paused at a safe point, between two quanta, to look at them.
+type HartGroup struct {
+	harts   []*CPU
+	quantum int
+	stop    int32 // set when the harts should return
+	paused  int32 // set while a pause is requested
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pause   bool
+	parked  int
+	running int
+	halted  *CPU
+	wg      sync.WaitGroup
+}
+
+func NewHartGroup(harts []*CPU, quantum uint32) *HartGroup {
+	g := &HartGroup{harts: harts, quantum: int(quantum), running: len(harts)}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// Run runs the harts until one halts or each has run n steps (0 for no
+// limit) and returns the hart that halted, or hart 0.
+func (g *HartGroup) Run(n int) *CPU {
+	bus := g.harts[0].bus
+	bus.parallel = true
+	defer func() { bus.parallel = false }()
+	for _, h := range g.harts {
+		if h.icache != nil {
+			h.icache = NewICache()
+		}
+	}
+	bus.icache = nil
+	bus.blocks = nil
+	bus.clearCode()
+
+	for _, h := range g.harts {
+		g.wg.Add(1)
+		go g.hart(h, n)
+	}
+	g.wg.Wait()
+	if g.halted != nil {
+		return g.halted
+	}
+	return g.harts[0]
+}
+
+func (g *HartGroup) hart(h *CPU, n int) {
+	defer g.wg.Done()
+	defer g.exit()
+	bus := h.bus
+	last := h.Cycle
+	for i := 0; (n == 0) || (i < n); {
+		if atomic.LoadInt32(&g.paused) != 0 {
+			g.park()
+		}
+		if atomic.LoadInt32(&g.stop) != 0 {
+			return
+		}
+		bus.io.Lock()
+		if h.hart == 0 {
+			for ; last != h.Cycle; last++ {
+				bus.Tick()
+			}
+		}
+		h.sample()
+		bus.io.Unlock()
+
+		q := g.quantum
+		if (n != 0) && (n-i < q) {
+			q = n - i
+		}
+		runHart(h, q, false)
+		i += q
+		if h.Halted {
+			g.mu.Lock()
+			if g.halted == nil {
+				g.halted = h
+			}
+			g.mu.Unlock()
+			g.Stop()
+			return
+		}
+	}
+}
+
+// exit takes a hart that has returned out of the count of running harts.
+func (g *HartGroup) exit() {
+	g.mu.Lock()
+	g.running--
+	g.cond.Broadcast()
+	g.mu.Unlock()
+}
+
+func (g *HartGroup) park() {
+	g.mu.Lock()
+	g.parked++
+	g.cond.Broadcast()
+	for g.pause && (atomic.LoadInt32(&g.stop) == 0) {
+		g.cond.Wait()
+	}
+	g.parked--
+	g.mu.Unlock()
+}
+
+// Pause waits until every hart that is still running has stopped between
+// two quanta. The harts stay there until Resume.
+func (g *HartGroup) Pause() {
+	g.mu.Lock()
+	g.pause = true
+	atomic.StoreInt32(&g.paused, 1)
+	for g.parked < g.running {
+		g.cond.Wait()
+	}
+	g.mu.Unlock()
+}
+
+func (g *HartGroup) Resume() {
+	g.mu.Lock()
+	g.pause = false
+	atomic.StoreInt32(&g.paused, 0)
+	g.cond.Broadcast()
+	g.mu.Unlock()
+}
+
+// Stop makes every hart return at the end of its current quantum, paused
+// or not.
+func (g *HartGroup) Stop() {
+	g.mu.Lock()
+	atomic.StoreInt32(&g.stop, 1)
+	g.cond.Broadcast()
+	g.mu.Unlock()
+}
+
+// DumpOn pauses the harts and prints their state to stderr each time one
+// of the signals arrives.
+func (g *HartGroup) DumpOn(sig ...os.Signal) {
+	if len(sig) == 0 {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sig...)
+	go func() {
+		for range c {
+			g.Pause()
+			for _, h := range g.harts {
+				h.Dump(os.Stderr)
+			}
+			g.Resume()
+		}
+	}()
+}
+
+// Dump prints the hart's PC, privilege level and registers.
+func (p *CPU) Dump(w io.Writer) {
+	wfi := ""
+	if p.Wfi {
+		wfi = " (wfi)"
+	}
+	fmt.Fprintf(w, "hart %v: pc %08x priv %v instret %v%v\n", p.hart, p.PC, p.Priv, p.Instret, wfi)
+	for i := 0; i < 32; i += 4 {
+		fmt.Fprintf(w, "  x%-2v %08x  x%-2v %08x  x%-2v %08x  x%-2v %08x\n",
+			i, p.Regs[i], i+1, p.Regs[i+1], i+2, p.Regs[i+2], i+3, p.Regs[i+3])
+	}
+}
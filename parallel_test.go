@@ -0,0 +1,166 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// loadProgram writes prog at the reset PC of the harts.
+func loadProgram(h []*CPU, prog []uint32) {
+	for i, inst := range prog {
+		h[0].bus.WriteWord(h[0].PC+uint32(4*i), inst)
+	}
+}
+
+// Each hart increments a counter with lr.w/sc.w on its own goroutine.
+func TestParallelLrSc(t *testing.T) {
+	const n = 2000
+	prog := []uint32{
+		encU(0x37, 11, 0x80001000),       // lui a1, 0x80001
+		encI(0x13, 0, 9, 0, n),           // li s1, n
+		encR(0x2f, 2, 0x02<<2, 5, 11, 0), // 1: lr.w t0, (a1)
+		encI(0x13, 0, 5, 5, 1),           // addi t0, t0, 1
+		encR(0x2f, 2, 0x03<<2, 6, 11, 5), // sc.w t1, t0, (a1)
+		encB(1, 6, 0, -12),               // bnez t1, 1b
+		encI(0x13, 0, 9, 9, -1),          // addi s1, s1, -1
+		encB(1, 9, 0, -20),               // bnez s1, 1b
+		encI(0x73, 2, 10, 0, 0xf14),      // csrr a0, mhartid
+		encI(0x13, 1, 10, 10, 2),         // slli a0, a0, 2
+		encR(0x33, 0, 0, 10, 10, 11),     // add a0, a0, a1
+		encI(0x13, 0, 12, 0, 1),          // li a2, 1
+		encS(2, 10, 12, 4),               // sw a2, 4(a0)
+		encJ(0, 0),                       // j .
+	}
+	h := newTestHarts(t, 2)
+	loadProgram(h, prog)
+	NewHartGroup(h, 7).Run(20 * n * len(prog))
+	bus := h[0].bus
+	for i := range h {
+		if bus.ReadWord(0x80001004+uint32(4*i)) != 1 {
+			t.Fatalf("hart %v did not finish", i)
+		}
+	}
+	if c := bus.ReadWord(0x80001000); c != 2*n {
+		t.Errorf("counter %v, want %v", c, 2*n)
+	}
+	if bus.mem.Page(0x01000000, false) != nil {
+		t.Errorf("page never touched was allocated")
+	}
+}
+
+// With -parallel, sc.w fails after a store by another hart even if the
+// store leaves the word as lr.w loaded it.
+func TestParallelReservation(t *testing.T) {
+	lr := encR(0x2f, 2, 0x02<<2, 3, 1, 0)
+	sc := encR(0x2f, 2, 0x03<<2, 4, 1, 2)
+	for _, tt := range []struct {
+		name  string
+		store uint32
+		addr  uint32
+		want  uint32
+	}{
+		{"same value", encS(2, 1, 0, 0), 0x80001000, 1},
+		{"amo", encR(0x2f, 2, 0, 0, 1, 0), 0x80001000, 1},
+		{"other word", encS(2, 1, 0, 0), 0x80001004, 0},
+		{"none", 0, 0, 0},
+	} {
+		h := newTestHarts(t, 2)
+		h[0].bus.parallel = true
+		h[0].Regs[1], h[0].Regs[2] = 0x80001000, 7
+		exec(h[0], lr)
+		if tt.store != 0 {
+			h[1].Regs[1] = tt.addr
+			exec(h[1], tt.store)
+		}
+		exec(h[0], sc)
+		if h[0].Regs[4] != tt.want {
+			t.Errorf("%v: sc.w returned %v, want %v", tt.name, h[0].Regs[4], tt.want)
+		}
+	}
+}
+
+// spin makes every hart loop forever.
+var spin = []uint32{
+	encI(0x13, 0, 5, 5, 1), // 1: addi t0, t0, 1
+	encJ(0, -4),            // j 1b
+}
+
+func TestHartGroupPause(t *testing.T) {
+	h := newTestHarts(t, 2)
+	loadProgram(h, spin)
+	g := NewHartGroup(h, 100)
+	done := make(chan *CPU)
+	go func() { done <- g.Run(0) }()
+
+	time.Sleep(10 * time.Millisecond)
+	g.Pause()
+	var before [2]uint64
+	for i, p := range h {
+		before[i] = p.Instret
+		if p.Instret%100 != 0 {
+			t.Errorf("hart %v paused after %v steps, not between quanta", i, p.Instret)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i, p := range h {
+		if p.Instret != before[i] {
+			t.Errorf("hart %v ran while paused", i)
+		}
+	}
+	g.Resume()
+	for i, p := range h {
+		for tries := 0; ; tries++ {
+			g.Pause()
+			n := p.Instret
+			g.Resume()
+			if n != before[i] {
+				break
+			}
+			if tries == 500 {
+				t.Fatalf("hart %v did not resume", i)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	g.Stop()
+	select {
+	case p := <-done:
+		if p != h[0] {
+			t.Errorf("Run returned hart %v, want 0", p.hart)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+	if h[0].bus.parallel {
+		t.Errorf("bus still parallel after Run")
+	}
+}
+
+// Stop also releases paused harts.
+func TestHartGroupStopPaused(t *testing.T) {
+	h := newTestHarts(t, 2)
+	loadProgram(h, spin)
+	g := NewHartGroup(h, 100)
+	done := make(chan *CPU)
+	go func() { done <- g.Run(0) }()
+	g.Pause()
+	g.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+}
+
+// Run returns once each hart has run its steps.
+func TestHartGroupSteps(t *testing.T) {
+	h := newTestHarts(t, 3)
+	loadProgram(h, spin)
+	NewHartGroup(h, 64).Run(1000)
+	for i, p := range h {
+		if p.Instret != 1000 {
+			t.Errorf("hart %v ran %v steps, want 1000", i, p.Instret)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+// Memory Map:
+// 0x000000: priority     source priority, one word per source
+// 0x001000: pending      pending bits
+// 0x002000: enable       enable bits, 0x80 bytes per context
+// 0x200000: threshold    priority threshold, 0x1000 bytes per context
+// 0x200004: claim        claim/complete, 0x1000 bytes per context
+//
+// Context 2*h is hart h M-mode, context 2*h+1 is hart h S-mode.
+
+const (
+	plicSources = 32
+
+	plicPriority  = 0x000000
+	plicPending   = 0x001000
+	plicEnable    = 0x002000
+	plicThreshold = 0x200000
+	plicClaim     = 0x200004
+)
+
+type PLIC struct {
+	priority  []uint32
+	level     uint32
+	pending   uint32
+	claimed   uint32
+	enable    []uint32
+	threshold []uint32
+}
+
+func NewPLIC(harts int) *PLIC {
+	priority := make([]uint32, plicSources)
+	enable := make([]uint32, 2*harts)
+	threshold := make([]uint32, 2*harts)
+	return &PLIC{priority, 0, 0, 0, enable, threshold}
+}
+
+// SetLevel drives interrupt source irq. Sources are level triggered; a
+// source that has been claimed is not pending again until it completes.
+func (p *PLIC) SetLevel(irq uint32, level bool) {
+	bit := uint32(1) << irq
+	if level {
+		p.level |= bit
+		if p.claimed&bit == 0 {
+			p.pending |= bit
+		}
+	} else {
+		p.level &^= bit
+		p.pending &^= bit
+	}
+}
+
+// best returns the highest priority source that may interrupt ctx.
+func (p *PLIC) best(ctx int) uint32 {
+	var id, prio uint32 = 0, 0
+	t := p.pending & p.enable[ctx]
+	if t == 0 {
+		return 0
+	}
+	for i := uint32(1); i < plicSources; i++ {
+		if (t&(1<<i) != 0) && (p.priority[i] > p.threshold[ctx]) && (p.priority[i] > prio) {
+			id = i
+			prio = p.priority[i]
+		}
+	}
+	return id
+}
+
+// Pending reports whether the interrupt line of ctx is asserted.
+func (p *PLIC) Pending(ctx int) bool {
+	return p.best(ctx) != 0
+}
+
+func (p *PLIC) ReadByte(addr uint32) uint8 {
+	sel := addr & 0x00000003
+	t := p.ReadWord(addr & 0xfffffffc)
+	return uint8((t >> (sel * 8)) & 0xff)
+}
+
+func (p *PLIC) ReadHalf(addr uint32) uint16 {
+	sel := addr & 0x00000002
+	t := p.ReadWord(addr & 0xfffffffc)
+	return uint16((t >> (sel * 8)) & 0xffff)
+}
+
+func (p *PLIC) ReadWord(addr uint32) uint32 {
+	return p.read(addr, true)
+}
+
+// read returns the register at addr. Reading the claim register claims
+// the interrupt only if claim is set; otherwise it reads as 0.
+func (p *PLIC) read(addr uint32, claim bool) uint32 {
+	addr = addr & 0xfffffffc
+	switch {
+	case addr < plicPending:
+		if i := addr / 4; i < plicSources {
+			return p.priority[i]
+		}
+	case addr == plicPending:
+		return p.pending
+	case (plicEnable <= addr) && (addr < plicThreshold):
+		if ctx := int((addr - plicEnable) / 0x80); (ctx < len(p.enable)) && (addr&0x7f == 0) {
+			return p.enable[ctx]
+		}
+	case plicThreshold <= addr:
+		ctx := int((addr - plicThreshold) / 0x1000)
+		if ctx >= len(p.threshold) {
+			return 0
+		}
+		switch addr & 0xfff {
+		case 0:
+			return p.threshold[ctx]
+		case 4:
+			if !claim {
+				return 0
+			}
+			id := p.best(ctx)
+			if id != 0 {
+				p.pending &^= 1 << id
+				p.claimed |= 1 << id
+			}
+			return id
+		}
+	}
+	return 0
+}
+
+// Byte and half writes update their part of the register and keep the
+// rest.
+
+func (p *PLIC) WriteByte(addr uint32, data uint8) {
+	sel := addr & 0x00000003
+	maskAddr := addr & 0xfffffffc
+	t := p.read(maskAddr, false)
+	t = (t &^ (0xff << (sel * 8))) | (uint32(data) << (sel * 8))
+	p.WriteWord(maskAddr, t)
+}
+
+func (p *PLIC) WriteHalf(addr uint32, data uint16) {
+	sel := addr & 0x00000002
+	maskAddr := addr & 0xfffffffc
+	t := p.read(maskAddr, false)
+	t = (t &^ (0xffff << (sel * 8))) | (uint32(data) << (sel * 8))
+	p.WriteWord(maskAddr, t)
+}
+
+func (p *PLIC) WriteWord(addr uint32, data uint32) {
+	addr = addr & 0xfffffffc
+	switch {
+	case addr < plicPending:
+		if i := addr / 4; (i > 0) && (i < plicSources) {
+			p.priority[i] = data & 0x7
+		}
+	case (plicEnable <= addr) && (addr < plicThreshold):
+		if ctx := int((addr - plicEnable) / 0x80); (ctx < len(p.enable)) && (addr&0x7f == 0) {
+			p.enable[ctx] = data &^ 1
+		}
+	case plicThreshold <= addr:
+		ctx := int((addr - plicThreshold) / 0x1000)
+		if ctx >= len(p.threshold) {
+			return
+		}
+		switch addr & 0xfff {
+		case 0:
+			p.threshold[ctx] = data & 0x7
+		case 4:
+			if data < plicSources {
+				p.claimed &^= 1 << data
+				if p.level&(1<<data) != 0 {
+					p.pending |= 1 << data
+				}
+			}
+		}
+	}
+}
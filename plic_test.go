@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestPLICPartialWrites(t *testing.T) {
+	p := NewPLIC(1)
+	p.WriteWord(plicEnable, 0x00000600)
+	p.WriteByte(plicEnable+2, 0x01)
+	if got := p.ReadWord(plicEnable); got != 0x00010600 {
+		t.Errorf("enable after a byte write = %08x, want 00010600", got)
+	}
+	p.WriteHalf(plicEnable+2, 0x8000)
+	if got := p.ReadWord(plicEnable); got != 0x80000600 {
+		t.Errorf("enable after a half write = %08x, want 80000600", got)
+	}
+	p.WriteByte(4*10, 5)
+	if got := p.ReadWord(4 * 10); got != 5 {
+		t.Errorf("priority 10 = %v, want 5", got)
+	}
+}
+
+func TestPLICClaim(t *testing.T) {
+	p := NewPLIC(1)
+	p.WriteWord(4*10, 1)
+	p.WriteWord(plicEnable, 1<<10)
+	p.SetLevel(10, true)
+	if !p.Pending(0) {
+		t.Fatalf("interrupt 10 not pending")
+	}
+	// A partial write to the claim register must not claim.
+	p.WriteByte(plicThreshold+5, 0)
+	if !p.Pending(0) {
+		t.Fatalf("byte write claimed the interrupt")
+	}
+	if id := p.ReadWord(plicThreshold + 4); id != 10 {
+		t.Fatalf("claimed %v, want 10", id)
+	}
+	p.SetLevel(10, false)
+	p.SetLevel(10, true)
+	if p.Pending(0) {
+		t.Errorf("claimed interrupt pending again before completion")
+	}
+	p.WriteByte(plicThreshold+4, 10)
+	if !p.Pending(0) {
+		t.Errorf("interrupt 10 not pending after completion")
+	}
+}
@@ -0,0 +1,657 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Linux system call numbers (asm-generic, as used by rv32 Linux and
+// newlib).
+const (
+	SYS_ioctl           = 29
+	SYS_openat          = 56
+	SYS_close           = 57
+	SYS_lseek           = 62 // llseek in rv32 Linux, lseek in newlib
+	SYS_read            = 63
+	SYS_write           = 64
+	SYS_writev          = 66
+	SYS_fstat           = 80
+	SYS_exit            = 93
+	SYS_exit_group      = 94
+	SYS_set_tid_address = 96
+	SYS_set_robust_list = 99
+	SYS_clock_gettime   = 113
+	SYS_uname           = 160
+	SYS_gettimeofday    = 169
+	SYS_getpid          = 172
+	SYS_getuid          = 174
+	SYS_geteuid         = 175
+	SYS_getgid          = 176
+	SYS_getegid         = 177
+	SYS_gettid          = 178
+	SYS_brk             = 214
+	SYS_munmap          = 215
+	SYS_mmap            = 222
+	SYS_clock_gettime64 = 403
+)
+
+// Guest open flags and other ABI constants.
+const (
+	O_ACCMODE   = 0x00003
+	O_WRONLY    = 0x00001
+	O_RDWR      = 0x00002
+	O_CREAT     = 0x00040
+	O_EXCL      = 0x00080
+	O_TRUNC     = 0x00200
+	O_APPEND    = 0x00400
+	O_DIRECTORY = 0x10000
+	AT_FDCWD    = 0xffffff9c // -100
+	MAP_FIXED   = 0x10
+	MAP_ANON    = 0x20
+)
+
+// Auxiliary vector entries.
+const (
+	AT_NULL   = 0
+	AT_PHDR   = 3
+	AT_PHENT  = 4
+	AT_PHNUM  = 5
+	AT_PAGESZ = 6
+	AT_ENTRY  = 9
+	AT_UID    = 11
+	AT_EUID   = 12
+	AT_GID    = 13
+	AT_EGID   = 14
+	AT_RANDOM = 25
+)
+
+const userStackSize = 0x00800000
+
+// proxyChunk bounds the host buffer used for a read or write, whatever
+// count the program passes.
+const proxyChunk = 0x10000
+
+// Proxy services the system calls of a program running in U-mode on the
+// host, in the manner of the RISC-V proxy kernel. Paths are resolved
+// inside the sandbox directory root; the program cannot name files
+// outside of it.
+type Proxy struct {
+	root     string
+	newlib   bool // the program uses newlib's system calls, not Linux's
+	files    map[uint32]*os.File
+	names    map[uint32]string
+	brk      uint32
+	brkBase  uint32
+	mmapTop  uint32
+	mmapBase uint32
+	start    time.Time
+}
+
+// NewProxy maps size bytes of user memory at address 0, loads the static
+// ELF program in filename there and lays out argv, envp and auxv on the
+// initial stack. The hart is left in U-mode at the entry point.
+func NewProxy(cpu *CPU, root string, size uint32, filename string, argv []string, envp []string) (*Proxy, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{
+		root:  root,
+		files: map[uint32]*os.File{0: os.Stdin, 1: os.Stdout, 2: os.Stderr},
+		names: map[uint32]string{},
+		start: time.Now(),
+	}
+
+	// User memory is placed in front of the devices, which a user program
+	// has no business touching.
+	cpu.bus.Overlay(0, size-1, NewMem(size, memRWX))
+	if err := cpu.LoadElf(filename); err != nil {
+		return nil, err
+	}
+	phdr, phnum, end, err := elfLayout(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	stackTop := size
+	p.mmapTop = (stackTop - userStackSize) &^ (pageSize - 1)
+	p.mmapBase = p.mmapTop
+	p.brkBase = (end + pageSize - 1) &^ (pageSize - 1)
+	p.brk = p.brkBase
+	if p.brkBase >= p.mmapTop {
+		return nil, fmt.Errorf("%v: does not fit in %v bytes of user memory", filename, size)
+	}
+
+	// Strings and the random bytes go to the top of the stack, the
+	// pointer arrays below them.
+	sp := stackTop
+	push := func(s string) uint32 {
+		sp -= uint32(len(s) + 1)
+		p.writeBytes(cpu, sp, append([]byte(s), 0))
+		return sp
+	}
+	var argvAddr, envpAddr []uint32
+	for _, s := range argv {
+		argvAddr = append(argvAddr, push(s))
+	}
+	for _, s := range envp {
+		envpAddr = append(envpAddr, push(s))
+	}
+	sp -= 16
+	random := sp
+	for i := uint32(0); i < 16; i++ {
+		cpu.bus.WriteByte(random+i, uint8(i*0x9e+0x37))
+	}
+
+	auxv := []uint32{
+		AT_PHDR, phdr,
+		AT_PHENT, 32,
+		AT_PHNUM, phnum,
+		AT_PAGESZ, pageSize,
+		AT_ENTRY, cpu.PC,
+		AT_UID, 0,
+		AT_EUID, 0,
+		AT_GID, 0,
+		AT_EGID, 0,
+		AT_RANDOM, random,
+		AT_NULL, 0,
+	}
+	words := []uint32{uint32(len(argv))}
+	words = append(words, argvAddr...)
+	words = append(words, 0)
+	words = append(words, envpAddr...)
+	words = append(words, 0)
+	words = append(words, auxv...)
+	sp = (sp - uint32(4*len(words))) &^ 0xf
+	for i, w := range words {
+		cpu.bus.WriteWord(sp+uint32(4*i), w)
+	}
+
+	cpu.RegWrite(2, sp)
+	cpu.Priv = PRIV_U
+	cpu.CSRs[CSR_ADDR_MCOUNTEREN] = 0x7
+	cpu.CSRs[CSR_ADDR_SCOUNTEREN] = 0x7
+	cpu.proxy = p
+	return p, nil
+}
+
+// elfLayout returns the address and number of the program headers as
+// seen by the loaded program, and the end of its highest segment.
+func elfLayout(filename string) (uint32, uint32, uint32, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer file.Close()
+
+	fileHdr := new(FileHeader)
+	if err := binary.Read(file, binary.LittleEndian, fileHdr); err != nil {
+		return 0, 0, 0, err
+	}
+	var phdr, end uint32
+	progHdr := new(ProgramHeader)
+	for i := 0; i < int(fileHdr.Phnum); i++ {
+		file.Seek(int64(fileHdr.Phoff)+int64(32*i), io.SeekStart)
+		if err := binary.Read(file, binary.LittleEndian, progHdr); err != nil {
+			return 0, 0, 0, err
+		}
+		if progHdr.Type != PT_LOAD {
+			continue
+		}
+		if (progHdr.Off <= fileHdr.Phoff) && (fileHdr.Phoff < progHdr.Off+progHdr.Filesz) {
+			phdr = progHdr.Vaddr + fileHdr.Phoff - progHdr.Off
+		}
+		if t := progHdr.Vaddr + progHdr.Memsz; t > end {
+			end = t
+		}
+	}
+	return phdr, uint32(fileHdr.Phnum), end, nil
+}
+
+// Close closes the files left open by the program.
+func (p *Proxy) Close() {
+	for fd, f := range p.files {
+		if fd > 2 {
+			f.Close()
+		}
+	}
+}
+
+// read reads up to n bytes from f into guest memory at addr, through a
+// buffer of at most proxyChunk bytes. It stops at a short read, which is
+// all a terminal or pipe has to offer for now.
+func (p *Proxy) read(cpu *CPU, f *os.File, addr uint32, n uint32) (uint32, error) {
+	size := n
+	if size > proxyChunk {
+		size = proxyChunk
+	}
+	b := make([]byte, size)
+	var done uint32
+	for done < n {
+		if n-done < size {
+			b = b[:n-done]
+		}
+		t, err := f.Read(b)
+		p.writeBytes(cpu, addr+done, b[:t])
+		done += uint32(t)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if done == 0 {
+				return 0, err
+			}
+			break
+		}
+		if t < len(b) {
+			break
+		}
+	}
+	return done, nil
+}
+
+// write writes n bytes of guest memory at addr to f, at most proxyChunk
+// bytes at a time. It returns the number written before any error.
+func (p *Proxy) write(cpu *CPU, f *os.File, addr uint32, n uint32) (uint32, error) {
+	var done uint32
+	for done < n {
+		size := n - done
+		if size > proxyChunk {
+			size = proxyChunk
+		}
+		t, err := f.Write(p.readBytes(cpu, addr+done, size))
+		done += uint32(t)
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+func (p *Proxy) readBytes(cpu *CPU, addr uint32, n uint32) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = cpu.bus.ReadByte(addr + uint32(i))
+	}
+	return b
+}
+
+func (p *Proxy) writeBytes(cpu *CPU, addr uint32, b []byte) {
+	for i, c := range b {
+		cpu.bus.WriteByte(addr+uint32(i), c)
+	}
+}
+
+func (p *Proxy) readString(cpu *CPU, addr uint32) string {
+	var b []byte
+	for c := cpu.bus.ReadByte(addr); c != 0; c = cpu.bus.ReadByte(addr) {
+		b = append(b, c)
+		addr++
+	}
+	return string(b)
+}
+
+// hostPath maps a guest path, relative to dirfd unless it is absolute,
+// to the host.
+func (p *Proxy) hostPath(dirfd uint32, name string, follow bool) (string, error) {
+	if !path.IsAbs(name) && (dirfd != AT_FDCWD) {
+		dir, ok := p.names[dirfd]
+		if !ok {
+			return "", syscall.EBADF
+		}
+		name = path.Join(dir, name)
+	}
+	return sandboxPath(p.root, name, follow)
+}
+
+// sandboxPath maps the guest path name to a host path under root. The
+// path is cleaned as if it were absolute first so that ".." cannot climb
+// out of the sandbox, and symbolic links are resolved before checking
+// that the result is still inside root. If follow is false a link in the
+// last element is not followed, as for remove and rename. A path that
+// leads out of the sandbox fails with EACCES.
+func sandboxPath(root string, name string, follow bool) (string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return "", err
+	}
+	host := filepath.Join(root, filepath.FromSlash(path.Clean("/"+name)))
+	if host == root {
+		return host, nil
+	}
+
+	resolved, err := filepath.EvalSymlinks(host)
+	if !follow || os.IsNotExist(err) {
+		if _, err := os.Lstat(host); follow && (err == nil) {
+			// A dangling link: the target does not exist.
+			return "", syscall.ENOENT
+		}
+		// The file itself may not exist yet; its directory must.
+		dir, err := filepath.EvalSymlinks(filepath.Dir(host))
+		if err != nil {
+			return "", err
+		}
+		resolved = filepath.Join(dir, filepath.Base(host))
+	} else if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if (err != nil) || (rel == "..") || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", syscall.EACCES
+	}
+	return resolved, nil
+}
+
+// errno converts a host error to a negated Linux errno.
+func errno(err error) uint32 {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	}
+	if e, ok := err.(syscall.Errno); ok {
+		return uint32(-int32(e))
+	}
+	return errno(syscall.EIO)
+}
+
+func (p *Proxy) newFd(f *os.File, name string) uint32 {
+	fd := uint32(3)
+	for ; p.files[fd] != nil; fd++ {
+	}
+	p.files[fd] = f
+	p.names[fd] = name
+	return fd
+}
+
+// Syscall carries out the system call requested by an ecall from U-mode:
+// a7 holds the number, a0-a5 the arguments and the result goes to a0.
+func (p *Proxy) Syscall(cpu *CPU) {
+	a := cpu.Regs[10:16]
+	var ret uint32
+	switch cpu.Regs[17] {
+	case SYS_read:
+		f, ok := p.files[a[0]]
+		if !ok {
+			ret = errno(syscall.EBADF)
+			break
+		}
+		n, err := p.read(cpu, f, a[1], a[2])
+		if err != nil {
+			ret = errno(err)
+			break
+		}
+		ret = n
+	case SYS_write:
+		f, ok := p.files[a[0]]
+		if !ok {
+			ret = errno(syscall.EBADF)
+			break
+		}
+		n, err := p.write(cpu, f, a[1], a[2])
+		if (err != nil) && (n == 0) {
+			ret = errno(err)
+			break
+		}
+		ret = n
+	case SYS_writev:
+		f, ok := p.files[a[0]]
+		if !ok {
+			ret = errno(syscall.EBADF)
+			break
+		}
+		for i := uint32(0); i < a[2]; i++ {
+			base := cpu.bus.ReadWord(a[1] + 8*i)
+			size := cpu.bus.ReadWord(a[1] + 8*i + 4)
+			n, err := p.write(cpu, f, base, size)
+			ret += n
+			if err != nil {
+				if ret == 0 {
+					ret = errno(err)
+				}
+				break
+			}
+		}
+	case SYS_openat:
+		ret = p.openat(cpu, a[0], p.readString(cpu, a[1]), a[2], a[3])
+	case SYS_close:
+		f, ok := p.files[a[0]]
+		if !ok {
+			ret = errno(syscall.EBADF)
+			break
+		}
+		// The host's standard streams stay open.
+		if a[0] > 2 {
+			f.Close()
+		}
+		delete(p.files, a[0])
+		delete(p.names, a[0])
+	case SYS_lseek:
+		// The two ABIs give number 62 different arguments.
+		if p.newlib {
+			ret = p.lseek(a)
+		} else {
+			ret = p.llseek(cpu, a)
+		}
+	case SYS_fstat:
+		ret = p.fstat(cpu, a[0], a[1])
+	case SYS_ioctl:
+		ret = errno(syscall.ENOTTY)
+	case SYS_brk:
+		if (p.brkBase <= a[0]) && (a[0] < p.mmapBase) {
+			for t := p.brk; t < a[0]; t++ {
+				cpu.bus.WriteByte(t, 0)
+			}
+			p.brk = a[0]
+		}
+		ret = p.brk
+	case SYS_mmap:
+		// Only anonymous mappings are supported. They are carved out
+		// downwards below the stack and never given back.
+		size := (a[1] + pageSize - 1) &^ (pageSize - 1)
+		if (a[3]&MAP_ANON == 0) || (a[3]&MAP_FIXED != 0) || (size == 0) || (p.mmapBase-p.brk < size) {
+			ret = errno(syscall.ENOMEM)
+			break
+		}
+		p.mmapBase -= size
+		p.writeBytes(cpu, p.mmapBase, make([]byte, size))
+		ret = p.mmapBase
+	case SYS_munmap:
+		ret = 0
+	case SYS_clock_gettime:
+		sec, nsec := p.now(a[0])
+		cpu.bus.WriteWord(a[1], uint32(sec))
+		cpu.bus.WriteWord(a[1]+4, uint32(nsec))
+	case SYS_clock_gettime64:
+		sec, nsec := p.now(a[0])
+		cpu.bus.WriteWord(a[1], uint32(sec))
+		cpu.bus.WriteWord(a[1]+4, uint32(sec>>32))
+		cpu.bus.WriteWord(a[1]+8, uint32(nsec))
+		cpu.bus.WriteWord(a[1]+12, 0)
+	case SYS_gettimeofday:
+		if a[0] != 0 {
+			sec, nsec := p.now(0)
+			cpu.bus.WriteWord(a[0], uint32(sec))
+			cpu.bus.WriteWord(a[0]+4, uint32(nsec/1000))
+		}
+	case SYS_uname:
+		for i, s := range []string{"Linux", "gopher-rv32sim", "5.0.0", "#1", "riscv32", ""} {
+			b := make([]byte, 65)
+			copy(b[:64], s)
+			p.writeBytes(cpu, a[0]+uint32(65*i), b)
+		}
+	case SYS_set_tid_address, SYS_getpid, SYS_gettid:
+		ret = 1
+	case SYS_set_robust_list, SYS_getuid, SYS_geteuid, SYS_getgid, SYS_getegid:
+		ret = 0
+	case SYS_exit, SYS_exit_group:
+		cpu.Halt(int(int32(a[0])))
+		return
+	default:
+		ret = errno(syscall.ENOSYS)
+	}
+	cpu.RegWrite(10, ret)
+}
+
+func (p *Proxy) openat(cpu *CPU, dirfd uint32, name string, flags uint32, mode uint32) uint32 {
+	host, err := p.hostPath(dirfd, name, true)
+	if err != nil {
+		return errno(err)
+	}
+	var t int
+	switch flags & O_ACCMODE {
+	case O_WRONLY:
+		t = os.O_WRONLY
+	case O_RDWR:
+		t = os.O_RDWR
+	default:
+		t = os.O_RDONLY
+	}
+	if flags&O_CREAT != 0 {
+		t |= os.O_CREATE
+	}
+	if flags&O_EXCL != 0 {
+		t |= os.O_EXCL
+	}
+	if flags&O_TRUNC != 0 {
+		t |= os.O_TRUNC
+	}
+	if flags&O_APPEND != 0 {
+		t |= os.O_APPEND
+	}
+	f, err := os.OpenFile(host, t, os.FileMode(mode&0777))
+	if err != nil {
+		return errno(err)
+	}
+	if flags&O_DIRECTORY != 0 {
+		if st, err := f.Stat(); (err != nil) || !st.IsDir() {
+			f.Close()
+			return errno(syscall.ENOTDIR)
+		}
+	}
+	guest, _ := filepath.Rel(p.root, host)
+	return p.newFd(f, "/"+filepath.ToSlash(guest))
+}
+
+// lseek is newlib's lseek(fd, offset, whence).
+func (p *Proxy) lseek(a []uint32) uint32 {
+	f, ok := p.files[a[0]]
+	if !ok {
+		return errno(syscall.EBADF)
+	}
+	off, err := f.Seek(int64(int32(a[1])), int(a[2]))
+	if err != nil {
+		return errno(err)
+	}
+	return uint32(off)
+}
+
+// llseek is the rv32 Linux llseek(fd, offset_high, offset_low, result,
+// whence).
+func (p *Proxy) llseek(cpu *CPU, a []uint32) uint32 {
+	f, ok := p.files[a[0]]
+	if !ok {
+		return errno(syscall.EBADF)
+	}
+	off, err := f.Seek(int64(uint64(a[1])<<32|uint64(a[2])), int(a[4]))
+	if err != nil {
+		return errno(err)
+	}
+	cpu.bus.WriteWord(a[3], uint32(off))
+	cpu.bus.WriteWord(a[3]+4, uint32(off>>32))
+	return 0
+}
+
+// fstat fills in the struct kernel_stat used by rv32 newlib.
+func (p *Proxy) fstat(cpu *CPU, fd uint32, addr uint32) uint32 {
+	f, ok := p.files[fd]
+	if !ok {
+		return errno(syscall.EBADF)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return errno(err)
+	}
+	st := hostStat(fi)
+	b := make([]byte, 128)
+	le := binary.LittleEndian
+	le.PutUint64(b[0:], st.dev)
+	le.PutUint64(b[8:], st.ino)
+	le.PutUint32(b[16:], st.mode)
+	le.PutUint32(b[20:], st.nlink)
+	le.PutUint32(b[24:], st.uid)
+	le.PutUint32(b[28:], st.gid)
+	le.PutUint64(b[32:], st.rdev)
+	le.PutUint64(b[48:], st.size)
+	le.PutUint32(b[56:], st.blksize)
+	le.PutUint64(b[64:], st.blocks)
+	mtime := fi.ModTime()
+	for _, off := range []int{72, 88, 104} {
+		le.PutUint64(b[off:], uint64(mtime.Unix()))
+		le.PutUint32(b[off+8:], uint32(mtime.Nanosecond()))
+	}
+	p.writeBytes(cpu, addr, b)
+	return 0
+}
+
+// kernelStat holds the fields of struct kernel_stat that fstat fills in
+// from the host.
+type kernelStat struct {
+	dev, ino, rdev, size, blocks   uint64
+	mode, nlink, uid, gid, blksize uint32
+}
+
+// fileStat returns what os.FileInfo tells of a file, for hosts whose
+// file status is not like Linux's.
+func fileStat(fi os.FileInfo) kernelStat {
+	m := fi.Mode()
+	st := kernelStat{
+		size:    uint64(fi.Size()),
+		blocks:  (uint64(fi.Size()) + 511) / 512,
+		mode:    uint32(m.Perm()),
+		nlink:   1,
+		blksize: 4096,
+	}
+	switch {
+	case m&os.ModeDir != 0:
+		st.mode |= 0040000
+	case m&os.ModeSymlink != 0:
+		st.mode |= 0120000
+	case m&os.ModeNamedPipe != 0:
+		st.mode |= 0010000
+	case m&os.ModeSocket != 0:
+		st.mode |= 0140000
+	case m&os.ModeCharDevice != 0:
+		st.mode |= 0020000
+	case m&os.ModeDevice != 0:
+		st.mode |= 0060000
+	default:
+		st.mode |= 0100000
+	}
+	return st
+}
+
+// now returns the time of the given clock as seconds and nanoseconds.
+// Clocks other than CLOCK_REALTIME (0) count from the start of the run.
+func (p *Proxy) now(clock uint32) (int64, int64) {
+	if clock == 0 {
+		t := time.Now()
+		return t.Unix(), int64(t.Nanosecond())
+	}
+	d := time.Since(p.start)
+	return int64(d / time.Second), int64(d % time.Second)
+}
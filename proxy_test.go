@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSandboxPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(root, "sub"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"up":    outside,
+		"rel":   "../outside",
+		"inner": "sub",
+		"gone":  filepath.Join(outside, "missing"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		follow bool
+		host   string
+		err    error
+	}{
+		{"/", true, root, nil},
+		{"../../etc/passwd", true, filepath.Join(root, "etc/passwd"), syscall.ENOENT},
+		{"sub/new", true, filepath.Join(root, "sub/new"), nil},
+		{"inner/new", true, filepath.Join(root, "sub/new"), nil},
+		{"up", true, "", syscall.EACCES},
+		{"up/new", true, "", syscall.EACCES},
+		{"rel/new", true, "", syscall.EACCES},
+		{"gone", true, "", syscall.ENOENT},
+		// Without follow a link is named itself, as remove expects.
+		{"up", false, filepath.Join(root, "up"), nil},
+		{"inner", false, filepath.Join(root, "inner"), nil},
+	}
+	for _, tt := range tests {
+		host, err := sandboxPath(root, tt.name, tt.follow)
+		if ((err == nil) != (tt.err == nil)) || ((err != nil) && (errno(err) != errno(tt.err))) {
+			t.Errorf("%v: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if (tt.err == nil) && (host != tt.host) {
+			t.Errorf("%v: host path %v, want %v", tt.name, host, tt.host)
+		}
+	}
+}
+
+// The status made from os.FileInfo agrees with the host's where it can.
+func TestFileStat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "f")
+	if err := ioutil.WriteFile(name, make([]byte, 1000), 0640); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		mode uint32
+		size uint64
+	}{
+		{name, 0100640, 1000},
+		{dir, 0040700, 0},
+	} {
+		fi, err := os.Stat(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := fileStat(fi)
+		if (st.mode != tt.mode) || ((tt.size != 0) && (st.size != tt.size)) {
+			t.Errorf("%v: mode %o, size %v, want %o, %v", tt.name, st.mode, st.size, tt.mode, tt.size)
+		}
+		if h := hostStat(fi); h.mode != st.mode {
+			t.Errorf("%v: host mode %o, from FileInfo %o", tt.name, h.mode, st.mode)
+		}
+	}
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// The reference model below is written from the ISA manual independently
+// of Decode and the instruction table, so that comparing the two finds
+// mistakes in either. It executes RV32IMA and the Zicsr instructions on
+// mscratch; refDecode also knows which encodings of the other CSRs and the
+// privileged instructions are legal. Decoding shamt and funct7 with too
+// few bits, which prompted it, is also covered by TestDecodeFields.
+
+// refOpcodes lists every legal encoding as a mask and a match, in the
+// style of riscv-opcodes.
+var refOpcodes = []struct {
+	name  string
+	mask  uint32
+	match uint32
+}{
+	{"lui", 0x0000007f, 0x00000037},
+	{"auipc", 0x0000007f, 0x00000017},
+	{"jal", 0x0000007f, 0x0000006f},
+	{"jalr", 0x0000707f, 0x00000067},
+	{"beq", 0x0000707f, 0x00000063},
+	{"bne", 0x0000707f, 0x00001063},
+	{"blt", 0x0000707f, 0x00004063},
+	{"bge", 0x0000707f, 0x00005063},
+	{"bltu", 0x0000707f, 0x00006063},
+	{"bgeu", 0x0000707f, 0x00007063},
+	{"lb", 0x0000707f, 0x00000003},
+	{"lh", 0x0000707f, 0x00001003},
+	{"lw", 0x0000707f, 0x00002003},
+	{"lbu", 0x0000707f, 0x00004003},
+	{"lhu", 0x0000707f, 0x00005003},
+	{"sb", 0x0000707f, 0x00000023},
+	{"sh", 0x0000707f, 0x00001023},
+	{"sw", 0x0000707f, 0x00002023},
+	{"addi", 0x0000707f, 0x00000013},
+	{"slti", 0x0000707f, 0x00002013},
+	{"sltiu", 0x0000707f, 0x00003013},
+	{"xori", 0x0000707f, 0x00004013},
+	{"ori", 0x0000707f, 0x00006013},
+	{"andi", 0x0000707f, 0x00007013},
+	{"slli", 0xfe00707f, 0x00001013},
+	{"srli", 0xfe00707f, 0x00005013},
+	{"srai", 0xfe00707f, 0x40005013},
+	{"add", 0xfe00707f, 0x00000033},
+	{"sub", 0xfe00707f, 0x40000033},
+	{"sll", 0xfe00707f, 0x00001033},
+	{"slt", 0xfe00707f, 0x00002033},
+	{"sltu", 0xfe00707f, 0x00003033},
+	{"xor", 0xfe00707f, 0x00004033},
+	{"srl", 0xfe00707f, 0x00005033},
+	{"sra", 0xfe00707f, 0x40005033},
+	{"or", 0xfe00707f, 0x00006033},
+	{"and", 0xfe00707f, 0x00007033},
+	{"fence", 0x0000707f, 0x0000000f},
+	{"fence_i", 0x0000707f, 0x0000100f},
+	{"mul", 0xfe00707f, 0x02000033},
+	{"mulh", 0xfe00707f, 0x02001033},
+	{"mulhsu", 0xfe00707f, 0x02002033},
+	{"mulhu", 0xfe00707f, 0x02003033},
+	{"div", 0xfe00707f, 0x02004033},
+	{"divu", 0xfe00707f, 0x02005033},
+	{"rem", 0xfe00707f, 0x02006033},
+	{"remu", 0xfe00707f, 0x02007033},
+	{"lr_w", 0xf9f0707f, 0x1000202f},
+	{"sc_w", 0xf800707f, 0x1800202f},
+	{"amoswap_w", 0xf800707f, 0x0800202f},
+	{"amoadd_w", 0xf800707f, 0x0000202f},
+	{"amoxor_w", 0xf800707f, 0x2000202f},
+	{"amoand_w", 0xf800707f, 0x6000202f},
+	{"amoor_w", 0xf800707f, 0x4000202f},
+	{"amomin_w", 0xf800707f, 0x8000202f},
+	{"amomax_w", 0xf800707f, 0xa000202f},
+	{"amominu_w", 0xf800707f, 0xc000202f},
+	{"amomaxu_w", 0xf800707f, 0xe000202f},
+	{"ecall", 0xffffffff, 0x00000073},
+	{"ebreak", 0xffffffff, 0x00100073},
+	{"sret", 0xffffffff, 0x10200073},
+	{"mret", 0xffffffff, 0x30200073},
+	{"wfi", 0xffffffff, 0x10500073},
+	{"sfence_vma", 0xfe007fff, 0x12000073},
+	{"csrrw", 0x0000707f, 0x00001073},
+	{"csrrs", 0x0000707f, 0x00002073},
+	{"csrrc", 0x0000707f, 0x00003073},
+	{"csrrwi", 0x0000707f, 0x00005073},
+	{"csrrsi", 0x0000707f, 0x00006073},
+	{"csrrci", 0x0000707f, 0x00007073},
+}
+
+// refDecode returns the name of the instruction inst encodes, or
+// illegal_instruction.
+func refDecode(inst uint32) string {
+	for _, o := range refOpcodes {
+		if inst&o.mask == o.match {
+			return o.name
+		}
+	}
+	return "illegal_instruction"
+}
+
+// refMemBase is where the reference model's memory window starts; the
+// window is a little over a page so that an access near its end fits.
+const refMemBase = 0x80001000
+
+// refState is the architectural state the reference model works on.
+type refState struct {
+	pc       uint32
+	x        [32]uint32
+	mem      [0x1004]byte
+	mscratch uint32
+}
+
+// refEffect is what executing one instruction did.
+type refEffect struct {
+	known bool // the model implements the instruction
+	trap  bool
+	cause uint32
+	tval  uint32
+}
+
+func field(inst uint32, hi uint, lo uint) uint32 {
+	return (inst >> lo) & (1<<(hi-lo+1) - 1)
+}
+
+// signed sign extends the low n bits of v.
+func signed(v uint32, n uint) uint32 {
+	return uint32(int32(v<<(32-n)) >> (32 - n))
+}
+
+func immI(inst uint32) uint32 {
+	return signed(field(inst, 31, 20), 12)
+}
+
+func immS(inst uint32) uint32 {
+	return signed(field(inst, 31, 25)<<5|field(inst, 11, 7), 12)
+}
+
+func immB(inst uint32) uint32 {
+	return signed(field(inst, 31, 31)<<12|field(inst, 7, 7)<<11|field(inst, 30, 25)<<5|field(inst, 11, 8)<<1, 13)
+}
+
+func immJ(inst uint32) uint32 {
+	return signed(field(inst, 31, 31)<<20|field(inst, 19, 12)<<12|field(inst, 20, 20)<<11|field(inst, 30, 21)<<1, 21)
+}
+
+// inWindow reports whether an access of size bytes at addr lies in the
+// memory window.
+func (s *refState) inWindow(addr uint32, size uint32) bool {
+	return (addr >= refMemBase) && (addr-refMemBase+size <= uint32(len(s.mem)))
+}
+
+func (s *refState) load(addr uint32, size uint32) uint32 {
+	var v uint32
+	for i := size; i > 0; i-- {
+		v = v<<8 | uint32(s.mem[addr-refMemBase+i-1])
+	}
+	return v
+}
+
+func (s *refState) storeMem(addr uint32, size uint32, v uint32) {
+	for i := uint32(0); i < size; i++ {
+		s.mem[addr-refMemBase+i] = byte(v >> (8 * i))
+	}
+}
+
+// refStep executes inst in M-mode at s.pc with no LR reservation. Loads,
+// stores and AMOs must fall in the memory window; an instruction the model
+// does not implement, such as one on a CSR other than mscratch, or an
+// access outside the window leaves s alone and returns an effect that is
+// not known.
+func refStep(s *refState, inst uint32) (e refEffect) {
+	name := refDecode(inst)
+	rd, rs1, rs2 := field(inst, 11, 7), field(inst, 19, 15), field(inst, 24, 20)
+	a, b := s.x[rs1], s.x[rs2]
+	next := s.pc + 4
+	var v uint32
+	wb := true
+
+	e.known = true
+	fail := func(cause uint32, tval uint32) refEffect {
+		return refEffect{known: true, trap: true, cause: cause, tval: tval}
+	}
+	target := func(t uint32) bool {
+		if t%4 != 0 {
+			return false
+		}
+		next = t
+		return true
+	}
+	cond := map[string]bool{
+		"beq":  a == b,
+		"bne":  a != b,
+		"blt":  int32(a) < int32(b),
+		"bge":  int32(a) >= int32(b),
+		"bltu": a < b,
+		"bgeu": a >= b,
+	}
+	width := map[string]uint32{"lb": 1, "lh": 2, "lw": 4, "lbu": 1, "lhu": 2, "sb": 1, "sh": 2, "sw": 4}
+	amo := map[string]func(t uint32) uint32{
+		"amoswap_w": func(t uint32) uint32 { return b },
+		"amoadd_w":  func(t uint32) uint32 { return t + b },
+		"amoxor_w":  func(t uint32) uint32 { return t ^ b },
+		"amoand_w":  func(t uint32) uint32 { return t & b },
+		"amoor_w":   func(t uint32) uint32 { return t | b },
+		"amomin_w": func(t uint32) uint32 {
+			if int32(t) < int32(b) {
+				return t
+			}
+			return b
+		},
+		"amomax_w": func(t uint32) uint32 {
+			if int32(t) > int32(b) {
+				return t
+			}
+			return b
+		},
+		"amominu_w": func(t uint32) uint32 {
+			if t < b {
+				return t
+			}
+			return b
+		},
+		"amomaxu_w": func(t uint32) uint32 {
+			if t > b {
+				return t
+			}
+			return b
+		},
+	}
+
+	switch name {
+	case "illegal_instruction":
+		return fail(EXCEPT_CODE_ILLEGAL_INST, inst)
+	case "lui":
+		v = inst & 0xfffff000
+	case "auipc":
+		v = s.pc + inst&0xfffff000
+	case "jal":
+		v = s.pc + 4
+		if !target(s.pc + immJ(inst)) {
+			return fail(EXCEPT_CODE_INST_MISALIGNED, s.pc+immJ(inst))
+		}
+	case "jalr":
+		v = s.pc + 4
+		t := (a + immI(inst)) &^ 1
+		if !target(t) {
+			return fail(EXCEPT_CODE_INST_MISALIGNED, t)
+		}
+	case "beq", "bne", "blt", "bge", "bltu", "bgeu":
+		wb = false
+		if cond[name] && !target(s.pc+immB(inst)) {
+			return fail(EXCEPT_CODE_INST_MISALIGNED, s.pc+immB(inst))
+		}
+	case "lb", "lh", "lw", "lbu", "lhu":
+		addr := a + immI(inst)
+		if !s.inWindow(addr, width[name]) {
+			return refEffect{}
+		}
+		v = s.load(addr, width[name])
+		if (name == "lb") || (name == "lh") {
+			v = signed(v, uint(8*width[name]))
+		}
+	case "sb", "sh", "sw":
+		wb = false
+		addr := a + immS(inst)
+		if !s.inWindow(addr, width[name]) {
+			return refEffect{}
+		}
+		s.storeMem(addr, width[name], b)
+	case "addi":
+		v = a + immI(inst)
+	case "slti":
+		v = 0
+		if int32(a) < int32(immI(inst)) {
+			v = 1
+		}
+	case "sltiu":
+		v = 0
+		if a < immI(inst) {
+			v = 1
+		}
+	case "xori":
+		v = a ^ immI(inst)
+	case "ori":
+		v = a | immI(inst)
+	case "andi":
+		v = a & immI(inst)
+	case "slli":
+		v = a << rs2
+	case "srli":
+		v = a >> rs2
+	case "srai":
+		v = uint32(int32(a) >> rs2)
+	case "add":
+		v = a + b
+	case "sub":
+		v = a - b
+	case "sll":
+		v = a << (b % 32)
+	case "slt":
+		v = 0
+		if int32(a) < int32(b) {
+			v = 1
+		}
+	case "sltu":
+		v = 0
+		if a < b {
+			v = 1
+		}
+	case "xor":
+		v = a ^ b
+	case "srl":
+		v = a >> (b % 32)
+	case "sra":
+		v = uint32(int32(a) >> (b % 32))
+	case "or":
+		v = a | b
+	case "and":
+		v = a & b
+	case "mul":
+		v = a * b
+	case "mulh":
+		v = uint32(uint64(int64(int32(a))*int64(int32(b))) >> 32)
+	case "mulhsu":
+		v = uint32(uint64(int64(int32(a))*int64(b)) >> 32)
+	case "mulhu":
+		v = uint32(uint64(a) * uint64(b) >> 32)
+	case "div":
+		switch {
+		case b == 0:
+			v = 0xffffffff
+		case (a == 0x80000000) && (b == 0xffffffff):
+			v = a
+		default:
+			v = uint32(int32(a) / int32(b))
+		}
+	case "divu":
+		v = 0xffffffff
+		if b != 0 {
+			v = a / b
+		}
+	case "rem":
+		switch {
+		case b == 0:
+			v = a
+		case (a == 0x80000000) && (b == 0xffffffff):
+			v = 0
+		default:
+			v = uint32(int32(a) % int32(b))
+		}
+	case "remu":
+		v = a
+		if b != 0 {
+			v = a % b
+		}
+	case "lr_w":
+		if a%4 != 0 {
+			return fail(EXCEPT_CODE_LOAD_MISALIGNED, a)
+		}
+		if !s.inWindow(a, 4) {
+			return refEffect{}
+		}
+		v = s.load(a, 4)
+	case "sc_w":
+		// Without a reservation it fails and stores nothing.
+		if a%4 != 0 {
+			return fail(EXCEPT_CODE_STORE_MISALIGNED, a)
+		}
+		if !s.inWindow(a, 4) {
+			return refEffect{}
+		}
+		v = 1
+	case "amoswap_w", "amoadd_w", "amoxor_w", "amoand_w", "amoor_w",
+		"amomin_w", "amomax_w", "amominu_w", "amomaxu_w":
+		if a%4 != 0 {
+			return fail(EXCEPT_CODE_STORE_MISALIGNED, a)
+		}
+		if !s.inWindow(a, 4) {
+			return refEffect{}
+		}
+		v = s.load(a, 4)
+		s.storeMem(a, 4, amo[name](v))
+	case "csrrw", "csrrs", "csrrc", "csrrwi", "csrrsi", "csrrci":
+		if field(inst, 31, 20) != CSR_ADDR_MSCRATCH {
+			return refEffect{}
+		}
+		src := a
+		if name[len(name)-1] == 'i' {
+			src = rs1
+		}
+		v = s.mscratch
+		switch name {
+		case "csrrw", "csrrwi":
+			s.mscratch = src
+		case "csrrs", "csrrsi":
+			s.mscratch |= src
+		default:
+			s.mscratch &^= src
+		}
+	case "fence":
+		wb = false
+	case "ecall":
+		return fail(EXCEPT_CODE_ECALL_FROM_M, 0)
+	case "ebreak":
+		return fail(EXCEPT_CODE_BREAKPOINT, s.pc)
+	default:
+		return refEffect{}
+	}
+	if wb && (rd != 0) {
+		s.x[rd] = v
+	}
+	s.pc = next
+	return e
+}
+
+// checkRef executes inst on p and on the reference model, both starting
+// at the reset PC with registers, mscratch and memory derived from a and
+// b, and reports any difference. Loads, stores and AMOs are pointed into
+// the memory window. It returns false if inst is outside the model, when p
+// may have been left in any state and should not be used again.
+func checkRef(t *testing.T, p *CPU, inst uint32, a uint32, b uint32) bool {
+	var s refState
+	for i := 1; i < 32; i++ {
+		s.x[i] = a*uint32(2*i+1) ^ b>>uint(i%8)
+	}
+	switch inst & 0x7f {
+	case 0x03, 0x23:
+		rs1 := field(inst, 19, 15)
+		if rs1 == 0 {
+			return true
+		}
+		imm := immI(inst)
+		if inst&0x7f == 0x23 {
+			imm = immS(inst)
+		}
+		s.x[rs1] = refMemBase + a%0x1000 - imm
+	case 0x2f:
+		rs1 := field(inst, 19, 15)
+		if rs1 == 0 {
+			return true
+		}
+		// Mostly aligned, as AMOs have to be.
+		s.x[rs1] = refMemBase + a%0x1000
+		if b%8 != 0 {
+			s.x[rs1] &^= 3
+		}
+	}
+	s.mscratch = a ^ b
+	x := b
+	for i := range s.mem {
+		x = x*1664525 + 1013904223
+		s.mem[i] = byte(x >> 24)
+	}
+	return compareRef(t, p, inst, &s)
+}
+
+// compareRef executes inst on p and on the reference model, both starting
+// at the reset PC in state s, and reports any difference like checkRef.
+func compareRef(t *testing.T, p *CPU, inst uint32, s *refState) bool {
+	p.Reset()
+	p.CSRs[CSR_ADDR_MTVEC] = 0x80000100
+	copy(p.Regs, s.x[:])
+	p.CSRs[CSR_ADDR_MSCRATCH] = s.mscratch
+	p.resOk = false
+	for i := range s.mem {
+		p.bus.WriteByte(refMemBase+uint32(i), s.mem[i])
+	}
+	s.pc = p.PC
+	pc := p.PC
+	e := refStep(s, inst)
+	exec(p, inst)
+	if !e.known {
+		return false
+	}
+
+	if e.trap {
+		if (p.PC != 0x80000100) || (p.CSRs[CSR_ADDR_MEPC] != pc) ||
+			(p.CSRs[CSR_ADDR_MCAUSE] != e.cause) || (p.CSRs[CSR_ADDR_MTVAL] != e.tval) {
+			t.Errorf("%08x %v: pc %08x mepc %08x mcause %v mtval %08x, want trap %v tval %08x",
+				inst, refDecode(inst), p.PC, p.CSRs[CSR_ADDR_MEPC], p.CSRs[CSR_ADDR_MCAUSE],
+				p.CSRs[CSR_ADDR_MTVAL], e.cause, e.tval)
+		}
+	} else if p.PC != s.pc {
+		t.Errorf("%08x %v: pc = %08x, want %08x", inst, refDecode(inst), p.PC, s.pc)
+	}
+	for i := range s.x {
+		if p.Regs[i] != s.x[i] {
+			t.Errorf("%08x %v: x%v = %08x, want %08x", inst, refDecode(inst), i, p.Regs[i], s.x[i])
+		}
+	}
+	if p.CSRs[CSR_ADDR_MSCRATCH] != s.mscratch {
+		t.Errorf("%08x %v: mscratch = %08x, want %08x", inst, refDecode(inst), p.CSRs[CSR_ADDR_MSCRATCH], s.mscratch)
+	}
+	for i := range s.mem {
+		if m := p.bus.ReadByte(refMemBase + uint32(i)); m != s.mem[i] {
+			t.Errorf("%08x %v: byte at %08x = %02x, want %02x", inst, refDecode(inst), refMemBase+uint32(i), m, s.mem[i])
+			break
+		}
+	}
+	return true
+}
+
+// refSeeds are encodings every run of the differential tests covers.
+func refSeeds() []uint32 {
+	seeds := append([]uint32{}, disasmInsts...)
+	for _, tt := range executeTests {
+		seeds = append(seeds, tt.inst)
+	}
+	return seeds
+}
+
+func TestRefDecode(t *testing.T) {
+	p := newTestCPU(t)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200000; i++ {
+		inst := r.Uint32()
+		if i%2 == 0 {
+			// Most random words have an unused major opcode.
+			inst = inst&^0x7f | []uint32{0x03, 0x0f, 0x13, 0x17, 0x23, 0x2f, 0x33, 0x37, 0x63, 0x67, 0x6f, 0x73}[i/2%12]
+		}
+		ops := p.Decode(inst)
+		if want := refDecode(inst); ops.Name != want {
+			t.Errorf("%08x: decoded as %q, want %q", inst, ops.Name, want)
+		}
+	}
+}
+
+func TestRefExecute(t *testing.T) {
+	p := newTestCPU(t)
+	for _, inst := range refSeeds() {
+		if !checkRef(t, p, inst, 0x12345678, 0x9abcdef0) {
+			p = newTestCPU(t)
+		}
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000 && !t.Failed(); i++ {
+		inst := r.Uint32()&^0x7f | []uint32{0x03, 0x13, 0x17, 0x23, 0x2f, 0x33, 0x37, 0x63, 0x67, 0x6f, 0x73}[i%11]
+		// Make most of them valid M, A and mscratch instructions.
+		switch {
+		case i%2 == 1:
+		case inst&0x7f == 0x33:
+			inst = inst&0x01ffffff | 0x01<<25
+		case inst&0x7f == 0x2f:
+			inst = inst&0x07ff8fff | 2<<12 | []uint32{0x00, 0x01, 0x02, 0x03, 0x04, 0x08, 0x0c, 0x10, 0x14, 0x18, 0x1c}[i/2%11]<<27
+			if inst>>27 == 0x02 {
+				inst &^= 0x1f << 20 // lr.w
+			}
+		case inst&0x7f == 0x73:
+			inst = inst&0xfffff | CSR_ADDR_MSCRATCH<<20
+		}
+		if !checkRef(t, p, inst, r.Uint32(), r.Uint32()) {
+			p = newTestCPU(t)
+		}
+	}
+}
+
+// Corner cases the random registers of TestRefExecute rarely reach.
+func TestRefCorners(t *testing.T) {
+	p := newTestCPU(t)
+	for _, tt := range []struct {
+		inst uint32
+		a, b uint32
+	}{
+		{encR(0x33, 4, 1, 3, 1, 2), 7, 0},                         // div
+		{encR(0x33, 4, 1, 3, 1, 2), 0x80000000, 0xffffffff},       // div
+		{encR(0x33, 5, 1, 3, 1, 2), 7, 0},                         // divu
+		{encR(0x33, 6, 1, 3, 1, 2), 7, 0},                         // rem
+		{encR(0x33, 6, 1, 3, 1, 2), 0x80000000, 0xffffffff},       // rem
+		{encR(0x33, 7, 1, 3, 1, 2), 7, 0},                         // remu
+		{encR(0x33, 1, 1, 3, 1, 2), 0x80000000, 0x80000000},       // mulh
+		{encR(0x33, 2, 1, 3, 1, 2), 0xffffffff, 0xffffffff},       // mulhsu
+		{encR(0x33, 3, 1, 3, 1, 2), 0xffffffff, 0xffffffff},       // mulhu
+		{encR(0x2f, 2, 0x02<<2, 3, 1, 0), refMemBase + 2, 0},      // lr.w
+		{encR(0x2f, 2, 0x03<<2, 3, 1, 2), refMemBase + 1, 5},      // sc.w
+		{encR(0x2f, 2, 0x03<<2, 3, 1, 2), refMemBase + 8, 5},      // sc.w
+		{encR(0x2f, 2, 0x00<<2, 3, 1, 2), refMemBase + 6, 5},      // amoadd.w
+		{encR(0x2f, 2, 0x10<<2, 3, 1, 2), refMemBase, 0xfffffff0}, // amomin.w
+		{encR(0x2f, 2, 0x18<<2, 3, 1, 2), refMemBase, 0xfffffff0}, // amominu.w
+		{encR(0x2f, 2, 0x00<<2, 1, 1, 1), refMemBase + 4, 0},      // amoadd.w x1, x1, (x1)
+		{encI(0x73, 1, 3, 1, CSR_ADDR_MSCRATCH), 0x1234, 0},       // csrrw
+		{encI(0x73, 2, 3, 0, CSR_ADDR_MSCRATCH), 0x1234, 0},       // csrr
+		{encI(0x73, 7, 0, 5, CSR_ADDR_MSCRATCH), 0, 0},            // csrci
+	} {
+		var s refState
+		s.x[1], s.x[2] = tt.a, tt.b
+		s.mscratch = 0xa5a5a5a5
+		for i := range s.mem {
+			s.mem[i] = byte(i * 7)
+		}
+		if !compareRef(t, p, tt.inst, &s) {
+			t.Errorf("%08x %v: not in the reference model", tt.inst, refDecode(tt.inst))
+			p = newTestCPU(t)
+		}
+	}
+}
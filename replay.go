@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// With -record every input the guest takes from the host is written to an
+// event log together with the step count of the hart that took it, and
+// -replay feeds the logged inputs back at the same steps instead of asking
+// the host. Everything else the simulator does is a function of the
+// machine state, so a replayed run goes through exactly the same states
+// as the recorded one.
+//
+// The inputs are the bytes the console UART receives and the end of its
+// input, reads of the console and of the host clock through semihosting.
+// Files opened through semihosting and drive images are not logged and
+// must not change between recording and replaying.
+//
+// The log is text. A header names the engine and the scheduling it was
+// recorded with, and each event is a line
+//
+//	CYCLE HART KIND [ARG...]
+//
+// where CYCLE is the hart's step count. Kinds are
+//
+//	rx BYTE           the UART took BYTE (hex) from its input
+//	eof               the UART found its input closed
+//	clock T           a read of the host clock returned T
+//	read HEX [eof]    a console read returned the bytes HEX (- for none),
+//	                  then EOF
+const recordVersion = 1
+
+type event struct {
+	cycle uint64
+	hart  int
+	kind  string
+	value int64
+	data  []byte
+	eof   bool
+}
+
+func (e *event) String() string {
+	s := fmt.Sprintf("%v %v %v", e.cycle, e.hart, e.kind)
+	switch e.kind {
+	case "rx":
+		s += fmt.Sprintf(" %02x", e.value)
+	case "clock":
+		s += fmt.Sprintf(" %v", e.value)
+	case "read":
+		if len(e.data) == 0 {
+			s += " -"
+		} else {
+			s += " " + hex.EncodeToString(e.data)
+		}
+		if e.eof {
+			s += " eof"
+		}
+	}
+	return s
+}
+
+// Recorder writes or replays the event log of a machine.
+type Recorder struct {
+	name   string
+	bus    *Bus
+	replay bool
+	input  bool // the console has input
+	out    io.Writer
+
+	// Recording. err is the first error writing the log, which ends at
+	// errAt.
+	f       *os.File
+	err     error
+	errAt   string
+	host    <-chan uint8
+	pending bool  // c is waiting in dev
+	c       uint8 // the last byte passed to the UART
+
+	// Replaying. A recording that keeps its events can go back to an
+	// earlier point and replay from there, it is live until it reaches
+	// the point where it left off.
+	events     []event
+	next       int
+	keep       bool
+	live       bool
+	closedLive bool
+
+	// dev is the UART's input. closed is set from closing it until the
+	// UART has seen that.
+	dev    chan uint8
+	closed bool
+}
+
+// recordHeader returns the header of a log recorded on bus.
+func recordHeader(bus *Bus, engine string, input bool) []string {
+	return []string{
+		fmt.Sprintf("version %v", recordVersion),
+		fmt.Sprintf("engine %v", engine),
+		fmt.Sprintf("harts %v", len(bus.harts)),
+		fmt.Sprintf("quantum %v", bus.machine.Quantum),
+		fmt.Sprintf("input %v", input),
+	}
+}
+
+// Record starts logging the inputs of the machine on bus, which runs with
+// engine, to filename, or only in memory if filename is empty. input
+// tells whether the console has input.
+func Record(filename string, bus *Bus, engine string, input bool) (*Recorder, error) {
+	r := &Recorder{name: filename, bus: bus, input: input}
+	if filename == "" {
+		r.name = "event log"
+		r.keep = true
+		return r, nil
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	header := "# gopher-rv32sim event log\n"
+	for _, l := range recordHeader(bus, engine, input) {
+		header += l + "\n"
+	}
+	if _, err := f.WriteString(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.f = f
+	return r, nil
+}
+
+// Replay reads the log in filename to feed its inputs to the machine on
+// bus, which must be the machine it was recorded on and run with the same
+// engine.
+func Replay(filename string, bus *Bus, engine string) (*Recorder, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &Recorder{name: filename, bus: bus, replay: true}
+	want := recordHeader(bus, engine, false)
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<24)
+	for line := 1; s.Scan(); line++ {
+		l := strings.TrimSpace(s.Text())
+		if (l == "") || strings.HasPrefix(l, "#") {
+			continue
+		}
+		a := strings.Fields(l)
+		if _, err := strconv.ParseUint(a[0], 10, 64); err != nil {
+			// A header line.
+			if (len(a) != 2) || (len(r.events) > 0) {
+				return nil, fmt.Errorf("%v:%v: bad header line", filename, line)
+			}
+			if a[0] == "input" {
+				r.input = a[1] == "true"
+				continue
+			}
+			found := false
+			for _, w := range want {
+				if strings.HasPrefix(w, a[0]+" ") {
+					if l != w {
+						return nil, fmt.Errorf("%v:%v: recorded with %v, this run has %v", filename, line, l, w)
+					}
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("%v:%v: unknown header %v", filename, line, a[0])
+			}
+			continue
+		}
+		e, err := parseEvent(a)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", filename, line, err)
+		}
+		if e.hart >= len(bus.harts) {
+			return nil, fmt.Errorf("%v:%v: no hart %v", filename, line, e.hart)
+		}
+		r.events = append(r.events, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	return r, nil
+}
+
+func parseEvent(a []string) (event, error) {
+	var e event
+	if len(a) < 3 {
+		return e, fmt.Errorf("bad event")
+	}
+	var err error
+	if e.cycle, err = strconv.ParseUint(a[0], 10, 64); err != nil {
+		return e, fmt.Errorf("bad cycle %v", a[0])
+	}
+	if e.hart, err = strconv.Atoi(a[1]); (err != nil) || (e.hart < 0) {
+		return e, fmt.Errorf("bad hart %v", a[1])
+	}
+	e.kind = a[2]
+	args := a[3:]
+	n := 0
+	switch e.kind {
+	case "rx":
+		n = 1
+		if len(args) == n {
+			e.value, err = strconv.ParseInt(args[0], 16, 64)
+			if (err == nil) && (e.value > 0xff) {
+				err = fmt.Errorf("bad byte %v", args[0])
+			}
+		}
+	case "eof":
+	case "clock":
+		n = 1
+		if len(args) == n {
+			e.value, err = strconv.ParseInt(args[0], 10, 64)
+		}
+	case "read":
+		n = 1
+		if (len(args) == 2) && (args[1] == "eof") {
+			e.eof = true
+			args = args[:1]
+		}
+		if (len(args) == n) && (args[0] != "-") {
+			e.data, err = hex.DecodeString(args[0])
+		}
+	default:
+		return e, fmt.Errorf("unknown event %v", e.kind)
+	}
+	if len(args) != n {
+		return e, fmt.Errorf("bad %v event", e.kind)
+	}
+	if err != nil {
+		return e, fmt.Errorf("bad %v event: %v", e.kind, err)
+	}
+	return e, nil
+}
+
+// Input returns the console reader for semihosting, in, or in replay
+// mode a reader that returns the logged reads. Semihosting calls are made
+// by hart 0.
+func (r *Recorder) Input(in io.Reader) io.Reader {
+	if (r.replay && !r.input) || (!r.replay && (in == nil)) {
+		return nil
+	}
+	return &recordedInput{r, in}
+}
+
+type recordedInput struct {
+	r  *Recorder
+	in io.Reader
+}
+
+func (p *recordedInput) Read(b []byte) (int, error) {
+	r := p.r
+	h := r.bus.harts[0]
+	if r.replay {
+		e := r.take(h, "read")
+		if len(e.data) > len(b) {
+			r.diverged(h, fmt.Sprintf("a read of %v bytes", len(b)))
+		}
+		n := copy(b, e.data)
+		if e.eof {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	n, err := p.in.Read(b)
+	r.log(event{cycle: h.Cycle, hart: h.hart, kind: "read", data: append([]byte(nil), b[:n]...), eof: err != nil})
+	return n, err
+}
+
+// Attach connects the console UART to out and to the input of the log. In
+// record mode the bytes come from in, in replay mode in is not read.
+func (r *Recorder) Attach(out io.Writer, in io.Reader) {
+	r.out = out
+	if (r.replay && r.input) || (!r.replay && (in != nil)) {
+		if !r.replay {
+			r.host = Feed(in)
+		}
+		r.dev = make(chan uint8, 1)
+	}
+	r.reattach()
+}
+
+// Clock returns t, the host clock as read by hart h, or the logged reading
+// in replay mode.
+func (r *Recorder) Clock(h *CPU, t int64) int64 {
+	if r.replay {
+		return r.take(h, "clock").value
+	}
+	r.log(event{cycle: h.Cycle, hart: h.hart, kind: "clock", value: t})
+	return t
+}
+
+// before passes the next byte of input to the UART, and after sees if the
+// UART took it. The UART only looks at its input while it has room for a
+// byte, so a byte is logged when it arrives in the FIFO, not when it
+// arrives from the host.
+func (r *Recorder) before() {
+	if r.dev == nil {
+		return
+	}
+	h := r.bus.harts[0]
+	if !r.replay {
+		if r.pending || r.closed {
+			return
+		}
+		select {
+		case c, ok := <-r.host:
+			if !ok {
+				r.host = nil
+				r.closed = true
+				close(r.dev)
+				return
+			}
+			r.c = c
+			r.pending = true
+			r.dev <- c
+		default:
+		}
+		return
+	}
+	for r.next < len(r.events) {
+		e := &r.events[r.next]
+		if (e.kind != "rx") && (e.kind != "eof") {
+			return
+		}
+		if e.cycle > h.Cycle {
+			return
+		}
+		if (e.cycle < h.Cycle) || (len(r.dev) > 0) {
+			r.diverged(h, "missed the UART input")
+		}
+		r.next++
+		if e.kind == "eof" {
+			close(r.dev)
+			r.dev = nil
+			r.closed = true
+			return
+		}
+		r.dev <- uint8(e.value)
+	}
+}
+
+func (r *Recorder) after() {
+	h := r.bus.harts[0]
+	if r.replay {
+		if ((r.dev != nil) && (len(r.dev) > 0)) || (r.closed && r.bus.uart.Interactive()) {
+			r.diverged(h, "the UART not taking its input")
+		}
+		r.closed = false
+		return
+	}
+	switch {
+	case r.pending && (len(r.dev) == 0):
+		r.pending = false
+		r.log(event{cycle: h.Cycle, hart: h.hart, kind: "rx", value: int64(r.c)})
+	case r.closed && !r.bus.uart.Interactive():
+		r.closed = false
+		r.dev = nil
+		r.log(event{cycle: h.Cycle, hart: h.hart, kind: "eof"})
+	}
+}
+
+// take returns the next event, which must be of kind and come from hart h
+// at its current step.
+func (r *Recorder) take(h *CPU, kind string) *event {
+	if r.next >= len(r.events) {
+		r.diverged(h, "a "+kind+" event")
+	}
+	e := &r.events[r.next]
+	if (e.kind != kind) || (e.hart != h.hart) || (e.cycle != h.Cycle) {
+		r.diverged(h, "a "+kind+" event")
+	}
+	r.next++
+	return e
+}
+
+// diverged stops the simulator when the run no longer matches the log.
+func (r *Recorder) diverged(h *CPU, what string) {
+	logged := "ended"
+	if r.next < len(r.events) {
+		logged = fmt.Sprintf("has %q", r.events[r.next].String())
+	}
+	log.Fatalf("ERROR: %v: replay diverged at step %v of hart %v (pc %08x): the run has %v, the log %v",
+		r.name, h.Cycle, h.hart, h.PC, what, logged)
+}
+
+func (r *Recorder) log(e event) {
+	if r.keep {
+		r.events = append(r.events, e)
+	}
+	if (r.f != nil) && (r.err == nil) {
+		if _, err := fmt.Fprintf(r.f, "%v\n", e.String()); err != nil {
+			r.err = err
+			r.errAt = fmt.Sprintf("step %v of hart %v", e.cycle, e.hart)
+		}
+	}
+}
+
+// recState is where a Recorder is in the log at some point of the run.
+type recState struct {
+	next        int
+	interactive bool
+}
+
+// state returns the position of the machine in the log between two
+// steps.
+func (r *Recorder) state() recState {
+	next := r.next
+	if !r.replay {
+		next = len(r.events)
+	}
+	return recState{next, r.bus.uart.Interactive()}
+}
+
+// rewind goes back to st, after the machine has been restored to the
+// point where state returned it. The events from there on are replayed.
+func (r *Recorder) rewind(st recState) {
+	if !r.replay {
+		r.replay = true
+		r.live = true
+		r.closedLive = r.closed
+	}
+	r.next = st.next
+	r.closed = false
+	r.dev = nil
+	if st.interactive {
+		r.dev = make(chan uint8, 1)
+	}
+	r.reattach()
+}
+
+// resume goes back to recording when a rewound run has caught up with the
+// point where rewind was first called.
+func (r *Recorder) resume() {
+	if !r.live {
+		return
+	}
+	r.replay = false
+	r.live = false
+	r.closed = r.closedLive
+	r.dev = nil
+	if r.bus.uart.Interactive() {
+		r.dev = make(chan uint8, 1)
+		if r.pending {
+			r.dev <- r.c
+		}
+		if r.closed {
+			close(r.dev)
+		}
+	}
+	r.reattach()
+}
+
+// reattach gives the UART its new input, if the UART takes its input from
+// the log.
+func (r *Recorder) reattach() {
+	if r.out != nil {
+		r.bus.uart.Attach(r.out, r.dev)
+	}
+}
+
+// Close finishes the log. In replay mode it reports logged events that
+// the run did not reach, in record mode events that could not be written.
+func (r *Recorder) Close() error {
+	if r.replay && !r.live {
+		if left := len(r.events) - r.next; left > 0 {
+			return fmt.Errorf("%v: the run stopped before %v logged events", r.name, left)
+		}
+		return nil
+	}
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	if r.err != nil {
+		return fmt.Errorf("the event log stops before %v: %v", r.errAt, r.err)
+	}
+	return err
+}
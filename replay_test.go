@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEventString(t *testing.T) {
+	for _, e := range []event{
+		{cycle: 7, hart: 0, kind: "rx", value: 0x41},
+		{cycle: 8, hart: 0, kind: "eof"},
+		{cycle: 9, hart: 1, kind: "clock", value: 1234567},
+		{cycle: 10, hart: 0, kind: "read", data: []byte("ab")},
+		{cycle: 11, hart: 0, kind: "read", data: []byte("c"), eof: true},
+		{cycle: 12, hart: 0, kind: "read", eof: true},
+		{cycle: 13, hart: 0, kind: "read"},
+	} {
+		got, err := parseEvent(strings.Fields(e.String()))
+		if err != nil {
+			t.Errorf("%q: %v", e.String(), err)
+			continue
+		}
+		if !reflect.DeepEqual(got, e) {
+			t.Errorf("%q parses as %+v, want %+v", e.String(), got, e)
+		}
+	}
+}
+
+// echoProg copies the bytes the UART receives to 0x80001000 on, counting
+// them at 0x80000ffc.
+var echoProg = []uint32{
+	encU(0x37, 10, uartBase),         // lui a0, uart
+	encI(0x13, 0, 5, 0, uartRxen),    // li t0, rxen
+	encS(2, 10, 5, uartRxctrl),       // sw t0, rxctrl(a0)
+	encU(0x37, 11, 0x80001000),       // lui a1, 0x80001
+	encI(0x03, 2, 5, 10, uartRxdata), // 1: lw t0, rxdata(a0)
+	encB(4, 5, 0, -4),                // bltz t0, 1b
+	encR(0x33, 0, 0, 6, 11, 12),      // add t1, a1, a2
+	encS(0, 6, 5, 0),                 // sb t0, 0(t1)
+	encI(0x13, 0, 12, 12, 1),         // addi a2, a2, 1
+	encS(2, 11, 12, -4),              // sw a2, -4(a1)
+	encJ(0, -24),                     // j 1b
+}
+
+// runRecorded runs echoProg with rec as the machine's event log until n
+// bytes have arrived and for at least steps steps, and reads the console
+// through semihosting's input once it is done.
+func runRecorded(t *testing.T, rec func(*Bus) (*Recorder, error), in io.Reader, n uint32, steps uint64) (*CPU, []byte) {
+	p := newTestCPU(t)
+	loadProgram([]*CPU{p}, echoProg)
+	r, err := rec(p.bus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.bus.rec = r
+	r.Attach(ioutil.Discard, in)
+	for (p.bus.ReadWord(0x80000ffc) < n) || (p.Cycle < steps) {
+		runHart(p, 10, false)
+		if p.Cycle > 10000000 {
+			t.Fatalf("received %v bytes, want %v", p.bus.ReadWord(0x80000ffc), n)
+		}
+	}
+	// Reads of the console through semihosting, up to its end.
+	var read []byte
+	con := r.Input(strings.NewReader("xyz"))
+	b := make([]byte, 2)
+	for {
+		k, err := con.Read(b)
+		read = append(read, b[:k]...)
+		if err != nil {
+			break
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Error(err)
+	}
+	return p, read
+}
+
+// A replayed run receives the same bytes at the same steps as the
+// recorded one.
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "run.log")
+
+	const input = "hello, world"
+	p, read := runRecorded(t, func(bus *Bus) (*Recorder, error) {
+		return Record(file, bus, "interp", true)
+	}, strings.NewReader(input), uint32(len(input)), 0)
+	q, replayed := runRecorded(t, func(bus *Bus) (*Recorder, error) {
+		return Replay(file, bus, "interp")
+	}, nil, 0, p.Cycle)
+
+	if string(read) != "xyz" {
+		t.Errorf("recorded run read %q, want %q", read, "xyz")
+	}
+	if string(replayed) != string(read) {
+		t.Errorf("replayed run read %q, want %q", replayed, read)
+	}
+	if q.Cycle != p.Cycle {
+		t.Errorf("replay ran %v steps, the recording %v", q.Cycle, p.Cycle)
+	}
+	if got, want := snapState([]*CPU{q}), snapState([]*CPU{p}); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed machine differs from the recorded one")
+	}
+	got, _ := q.ReadVirt(0x80001000, uint32(len(input)))
+	if string(got) != input {
+		t.Errorf("replay received %q, want %q", got, input)
+	}
+}
+
+// Events that cannot be written to the log are reported by Close.
+func TestRecordWriteError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "run.log")
+
+	p := newTestCPU(t)
+	r, err := Record(file, p.bus, "interp", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.f.Close()
+	if r.f, err = os.Open(file); err != nil {
+		t.Fatal(err)
+	}
+	r.Clock(p, 42)
+	if err := r.Close(); (err == nil) || !strings.Contains(err.Error(), "step 0 of hart 0") {
+		t.Errorf("Close returned %v, want the failed write", err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// RVFI describes one retired instruction in the layout of the RISC-V
+// Formal Interface execution packets exchanged by RVFI-DII, 88 bytes
+// little-endian. Memory addresses are byte addresses and data is not
+// shifted, the masks have one bit for each byte accessed.
+type RVFI struct {
+	Order    uint64
+	PCRData  uint64
+	PCWData  uint64
+	Insn     uint64
+	RS1Data  uint64
+	RS2Data  uint64
+	RDWData  uint64
+	MemAddr  uint64
+	MemRData uint64
+	MemWData uint64
+	MemRMask uint8
+	MemWMask uint8
+	RS1Addr  uint8
+	RS2Addr  uint8
+	RDAddr   uint8
+	Trap     uint8
+	Halt     uint8
+	Intr     uint8
+}
+
+const rvfiSize = 88
+
+// ReadRVFI reads the next packet from r.
+func ReadRVFI(r io.Reader) (RVFI, error) {
+	var p RVFI
+	err := binary.Read(r, binary.LittleEndian, &p)
+	return p, err
+}
+
+// WriteRVFI writes p to w.
+func WriteRVFI(w io.Writer, p *RVFI) error {
+	return binary.Write(w, binary.LittleEndian, p)
+}
+
+// String formats p like a line of a Spike commit log.
+func (p *RVFI) String() string {
+	s := fmt.Sprintf("0x%08x (0x%08x)", p.PCRData, p.Insn)
+	if p.Intr != 0 {
+		s = "interrupt, " + s
+	}
+	if p.Trap != 0 {
+		return s + " trap"
+	}
+	if p.RDAddr != 0 {
+		s += fmt.Sprintf(" x%-2v 0x%08x", p.RDAddr, p.RDWData)
+	}
+	if p.MemWMask != 0 {
+		s += fmt.Sprintf(" mem 0x%08x 0x%0*x", p.MemAddr, 2*maskBytes(p.MemWMask), p.MemWData)
+	} else if p.MemRMask != 0 {
+		s += fmt.Sprintf(" mem 0x%08x", p.MemAddr)
+	}
+	return s
+}
+
+func maskBytes(mask uint8) int {
+	n := 0
+	for ; mask != 0; mask >>= 1 {
+		n++
+	}
+	return n
+}
+
+// writesRd reports whether inst, if it does not trap, writes its rd
+// field. Only stores and branches have none.
+func writesRd(inst uint32) bool {
+	switch inst & 0x7f {
+	case 0x23, 0x63:
+		return false
+	}
+	return (inst>>7)&0x1f != 0
+}
+
+// readsRs reports whether inst reads its rs1 and rs2 fields.
+func readsRs(inst uint32) (rs1 bool, rs2 bool) {
+	switch inst & 0x7f {
+	case 0x03, 0x13, 0x67:
+		return true, false
+	case 0x23, 0x2f, 0x33, 0x63:
+		return true, true
+	case 0x73:
+		// The CSR instructions without an immediate.
+		f := (inst >> 12) & 7
+		return (f >= 1) && (f <= 3), false
+	}
+	return false, false
+}
+
+// StepRVFI runs one step of the hart and describes the instruction it
+// retired or that trapped. ok is false if the hart is waiting in wfi.
+// Loads are described by their register write only.
+func (p *CPU) StepRVFI() (r RVFI, ok bool) {
+	traps := p.traps
+	if !p.Tick() {
+		return r, false
+	}
+	if p.traps != traps {
+		r.Intr = 1
+	}
+	p.retire(&r, p.Next)
+	return r, true
+}
+
+// ExecRVFI runs inst as if it had been fetched from PC, without reading
+// memory or taking interrupts, and describes it like StepRVFI.
+func (p *CPU) ExecRVFI(inst uint32) RVFI {
+	var r RVFI
+	p.Cycle++
+	p.retire(&r, func() (*Ops, bool) {
+		// The fetch still faults for PC.
+		if _, ok := p.fetchAddr(); !ok {
+			return nil, false
+		}
+		ops := p.Decode(inst)
+		return &ops, true
+	})
+	r.Insn = uint64(inst)
+	return r
+}
+
+// retire executes the instruction returned by next and fills in r.
+func (p *CPU) retire(r *RVFI, next func() (*Ops, bool)) {
+	r.Order = p.Instret
+	r.PCRData = uint64(p.PC)
+	traps := p.traps
+
+	watch := p.bus.watch
+	p.bus.watch = func(h *CPU, vaddr uint32, paddr uint32, size uint32, data uint32) {
+		if watch != nil {
+			watch(h, vaddr, paddr, size, data)
+		}
+		if h != p {
+			return
+		}
+		// A misaligned store arrives a byte at a time.
+		if r.MemWMask == 0 {
+			r.MemAddr = uint64(vaddr)
+		}
+		off := uint64(vaddr) - r.MemAddr
+		mask := uint64(1)<<(8*size) - 1
+		r.MemWData |= (uint64(data) & mask) << (8 * off)
+		r.MemWMask |= uint8((1<<size)-1) << off
+	}
+	defer func() { p.bus.watch = watch }()
+
+	var inst, load uint32
+	if ops, ok := next(); ok {
+		inst = ops.Inst
+		rs1, rs2 := readsRs(inst)
+		if rs1 {
+			r.RS1Addr = uint8(ops.Rs1)
+			r.RS1Data = uint64(p.Regs[ops.Rs1])
+		}
+		if rs2 {
+			r.RS2Addr = uint8(ops.Rs2)
+			r.RS2Data = uint64(p.Regs[ops.Rs2])
+		}
+		load = p.Regs[ops.Rs1] + ops.Imm
+		p.Execute(ops)
+	}
+	r.Insn = uint64(inst)
+	r.PCWData = uint64(p.PC)
+	if p.traps != traps {
+		r.Trap = 1
+		r.MemAddr, r.MemWData, r.MemWMask = 0, 0, 0
+		return
+	}
+	if writesRd(inst) {
+		r.RDAddr = uint8((inst >> 7) & 0x1f)
+		r.RDWData = uint64(p.Regs[r.RDAddr])
+	}
+	if inst&0x7f == 0x03 {
+		// The size is in the low bits of funct3.
+		size := uint32(1) << ((inst >> 12) & 3)
+		r.MemAddr = uint64(load)
+		r.MemRMask = uint8(1<<size) - 1
+		r.MemRData = r.RDWData & (uint64(1)<<(8*size) - 1)
+	}
+	if p.Halted {
+		r.Halt = 1
+	}
+}
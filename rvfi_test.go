@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Packets are laid out as RVFI-DII has them: the 64-bit fields in order,
+// then the 8-bit ones.
+func TestRVFIRoundTrip(t *testing.T) {
+	p := RVFI{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18}
+	var b bytes.Buffer
+	if err := WriteRVFI(&b, &p); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != rvfiSize {
+		t.Fatalf("packet of %v bytes, want %v", b.Len(), rvfiSize)
+	}
+	for i := 0; i < 10; i++ {
+		if got := binary.LittleEndian.Uint64(b.Bytes()[8*i:]); got != uint64(i+1) {
+			t.Errorf("64-bit field %v is %v, want %v", i, got, i+1)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		if got := b.Bytes()[80+i]; got != uint8(11+i) {
+			t.Errorf("8-bit field %v is %v, want %v", i, got, 11+i)
+		}
+	}
+	q, err := ReadRVFI(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q != p {
+		t.Errorf("read back %+v, want %+v", q, p)
+	}
+
+	var d bytes.Buffer
+	in := diiPacket{Insn: 0x800012b7, Time: 3, Cmd: diiInsn}
+	if err := binary.Write(&d, binary.LittleEndian, &in); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0xb7, 0x12, 0x00, 0x80, 3, 0, diiInsn, 0}; !bytes.Equal(d.Bytes(), want) {
+		t.Errorf("instruction packet % x, want % x", d.Bytes(), want)
+	}
+}
+
+func TestExecRVFI(t *testing.T) {
+	p := newTestCPU(t)
+	pc := uint64(p.PC)
+	prog := []uint32{
+		encU(0x37, 5, 0x80001000), // lui t0, 0x80001
+		encI(0x13, 0, 6, 0, -2),   // li t1, -2
+		encS(1, 5, 6, 2),          // sh t1, 2(t0)
+		encI(0x03, 5, 7, 5, 2),    // lhu t2, 2(t0)
+		0,                         // illegal
+	}
+	want := []RVFI{
+		{Order: 0, PCRData: pc, PCWData: pc + 4, Insn: uint64(prog[0]), RDAddr: 5, RDWData: 0x80001000},
+		{Order: 1, PCRData: pc + 4, PCWData: pc + 8, Insn: uint64(prog[1]), RS1Addr: 0, RDAddr: 6, RDWData: 0xfffffffe},
+		{Order: 2, PCRData: pc + 8, PCWData: pc + 12, Insn: uint64(prog[2]), RS1Addr: 5, RS1Data: 0x80001000,
+			RS2Addr: 6, RS2Data: 0xfffffffe, MemAddr: 0x80001002, MemWData: 0xfffe, MemWMask: 3},
+		{Order: 3, PCRData: pc + 12, PCWData: pc + 16, Insn: uint64(prog[3]), RS1Addr: 5, RS1Data: 0x80001000,
+			RDAddr: 7, RDWData: 0xfffe, MemAddr: 0x80001002, MemRData: 0xfffe, MemRMask: 3},
+		{Order: 4, PCRData: pc + 16, PCWData: uint64(p.CSRs[CSR_ADDR_MTVEC] &^ 3), Insn: 0, Trap: 1},
+	}
+	for i, inst := range prog {
+		if r := p.ExecRVFI(inst); r != want[i] {
+			t.Errorf("%v: %+v, want %+v", i, r, want[i])
+		}
+	}
+}
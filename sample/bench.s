@@ -0,0 +1,35 @@
+# Throughput benchmark: a mix of ALU, load/store and branch instructions.
+# Run with `make bench`, which needs -semihosting to stop.
+
+    .section .text
+    .globl _start
+_start:
+    li      s0, 0x80010000      # scratch buffer
+    li      s1, 1000000         # iterations
+    li      a0, 0
+    li      a1, 1
+loop:
+    add     a2, a0, a1
+    mv      a0, a1
+    mv      a1, a2
+    andi    t0, s1, 0xfc
+    add     t0, t0, s0
+    sw      a2, 0(t0)
+    lw      t1, 0(t0)
+    xor     a3, a3, t1
+    slli    t2, a3, 3
+    srli    t3, a3, 5
+    or      a3, t2, t3
+    addi    s1, s1, -1
+    bnez    s1, loop
+    li      gp, 1
+    li      a0, 0x18            # semihosting SYS_EXIT
+    li      a1, 0x20026         # ADP_Stopped_ApplicationExit
+    .option push
+    .option norvc
+    slli    x0, x0, 0x1f
+    ebreak
+    srai    x0, x0, 7
+    .option pop
+done:
+    j       done
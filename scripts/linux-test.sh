@@ -0,0 +1,56 @@
+#!/bin/sh
+# Boot Linux to a shell prompt and fail if it does not get there in time.
+#
+# The images are not part of the repository. Put them in images/ (or point
+# IMAGES at another directory):
+#   fw_dynamic.elf  OpenSBI generic platform, FW_TEXT_START=0x80000000
+#   Image           rv32ima kernel
+#   rootfs.cpio     initramfs, e.g. a buildroot rootfs.cpio
+# When they are missing the test is skipped with exit status 77, so that
+# it never counts as a pass; set ALLOW_SKIP=1 to exit 0 instead.
+
+IMAGES=${IMAGES:-images}
+TIMEOUT=${TIMEOUT:-600}
+PROMPT=${PROMPT:-'# '}
+SIM=${SIM:-./gopher-rv32sim}
+
+for f in fw_dynamic.elf Image rootfs.cpio; do
+	if [ ! -f "$IMAGES/$f" ]; then
+		echo "SKIP: $IMAGES/$f not found"
+		if [ -n "$ALLOW_SKIP" ]; then
+			exit 0
+		fi
+		exit 77
+	fi
+done
+
+log=$(mktemp)
+trap 'rm -f "$log"' EXIT
+
+"$SIM" -n 0 -uart ns16550 -serial "file:$log" \
+	-bios "$IMAGES/fw_dynamic.elf" \
+	-kernel "$IMAGES/Image" \
+	-initrd "$IMAGES/rootfs.cpio" \
+	-bootargs "console=ttyS0 earlycon=sbi" &
+pid=$!
+
+i=0
+while [ $i -lt "$TIMEOUT" ]; do
+	if grep -q -F -- "$PROMPT" "$log"; then
+		kill $pid
+		wait $pid 2>/dev/null
+		echo "PASS: shell prompt after ${i}s"
+		exit 0
+	fi
+	if ! kill -0 $pid 2>/dev/null; then
+		break
+	fi
+	sleep 1
+	i=$((i + 1))
+done
+
+kill $pid 2>/dev/null
+wait $pid 2>/dev/null
+tail -n 20 "$log"
+echo "FAIL: no shell prompt"
+exit 1
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Semihosting operation numbers, passed in a0.
+const (
+	SYS_OPEN          = 0x01
+	SYS_CLOSE         = 0x02
+	SYS_WRITEC        = 0x03
+	SYS_WRITE0        = 0x04
+	SYS_WRITE         = 0x05
+	SYS_READ          = 0x06
+	SYS_READC         = 0x07
+	SYS_ISERROR       = 0x08
+	SYS_ISTTY         = 0x09
+	SYS_SEEK          = 0x0a
+	SYS_FLEN          = 0x0c
+	SYS_TMPNAM        = 0x0d
+	SYS_REMOVE        = 0x0e
+	SYS_RENAME        = 0x0f
+	SYS_CLOCK         = 0x10
+	SYS_TIME          = 0x11
+	SYS_SYSTEM        = 0x12
+	SYS_ERRNO         = 0x13
+	SYS_GET_CMDLINE   = 0x15
+	SYS_HEAPINFO      = 0x16
+	SYS_EXIT          = 0x18
+	SYS_EXIT_EXTENDED = 0x20
+	SYS_ELAPSED       = 0x30
+	SYS_TICKFREQ      = 0x31
+)
+
+const (
+	ADP_Stopped_ApplicationExit = 0x20026
+
+	// The instructions around the ebreak that make it a semihosting call.
+	semihostEntry = 0x01f01013 // slli x0, x0, 0x1f
+	semihostExit  = 0x40705013 // srai x0, x0, 7
+)
+
+// semihostChunk bounds the host buffer used for a SYS_READ or SYS_WRITE,
+// whatever count the program passes.
+const semihostChunk = 0x10000
+
+// semihostPathMax bounds the length of a file name, like PATH_MAX, and of
+// the string printed by SYS_WRITE0.
+const semihostPathMax = 4096
+
+// semihostFeatures is the content of the ":semihosting-features" file:
+// SYS_EXIT_EXTENDED and stdout/stderr through ":tt" are supported.
+var semihostFeatures = []byte{'S', 'H', 'F', 'B', 0x03}
+
+// fopen modes in the order of the SYS_OPEN mode argument.
+var semihostModes = []int{
+	os.O_RDONLY,
+	os.O_RDONLY,
+	os.O_RDWR,
+	os.O_RDWR,
+	os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+	os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+	os.O_RDWR | os.O_CREATE | os.O_TRUNC,
+	os.O_RDWR | os.O_CREATE | os.O_TRUNC,
+	os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+	os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+	os.O_RDWR | os.O_CREATE | os.O_APPEND,
+	os.O_RDWR | os.O_CREATE | os.O_APPEND,
+}
+
+// semihostFile is an open semihosting handle. Console handles have no
+// host file and cannot seek.
+type semihostFile struct {
+	f    *os.File
+	in   io.Reader
+	out  io.Writer
+	seek io.Seeker
+	tty  bool
+	buf  []byte
+}
+
+// Semihost services RISC-V semihosting calls, the ebreak sandwiched
+// between slli x0, x0, 0x1f and srai x0, x0, 7. The console goes to the
+// simulator console; files are opened inside the sandbox directory root.
+type Semihost struct {
+	root    string
+	cmdline string
+	out     io.Writer
+	in      io.Reader
+	files   map[uint32]*semihostFile
+	errno   uint32
+	start   time.Time
+}
+
+func NewSemihost(root string, cmdline string, out io.Writer, in io.Reader) *Semihost {
+	return &Semihost{
+		root:    root,
+		cmdline: cmdline,
+		out:     out,
+		in:      in,
+		files:   make(map[uint32]*semihostFile),
+		start:   time.Now(),
+	}
+}
+
+// Close closes the files left open by the program.
+func (p *Semihost) Close() {
+	for _, h := range p.files {
+		if h.f != nil {
+			h.f.Close()
+		}
+	}
+}
+
+// Detect reports whether the ebreak at PC is a semihosting call.
+func (p *Semihost) Detect(cpu *CPU) bool {
+	before, ok := cpu.ReadVirt(cpu.PC-4, 4)
+	if !ok {
+		return false
+	}
+	after, ok := cpu.ReadVirt(cpu.PC+4, 4)
+	if !ok {
+		return false
+	}
+	return (binary.LittleEndian.Uint32(before) == semihostEntry) &&
+		(binary.LittleEndian.Uint32(after) == semihostExit)
+}
+
+// args reads n words of the parameter block at addr.
+func (p *Semihost) args(cpu *CPU, addr uint32, n int) ([]uint32, bool) {
+	b, ok := cpu.ReadVirt(addr, uint32(4*n))
+	if !ok {
+		return nil, false
+	}
+	a := make([]uint32, n)
+	for i := range a {
+		a[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	return a, true
+}
+
+// name reads the file name of n bytes at addr.
+func (p *Semihost) name(cpu *CPU, addr uint32, n uint32) (string, bool) {
+	if n > semihostPathMax {
+		p.errno = uint32(syscall.ENAMETOOLONG)
+		return "", false
+	}
+	b, ok := cpu.ReadVirt(addr, n)
+	if !ok {
+		p.errno = uint32(syscall.EINVAL)
+		return "", false
+	}
+	return string(b), true
+}
+
+func (p *Semihost) fail(err error) uint32 {
+	p.errno = uint32(syscall.EIO)
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	}
+	if e, ok := err.(syscall.Errno); ok {
+		p.errno = uint32(e)
+	}
+	return 0xffffffff
+}
+
+func (p *Semihost) newHandle(h *semihostFile) uint32 {
+	fd := uint32(1)
+	for ; p.files[fd] != nil; fd++ {
+	}
+	p.files[fd] = h
+	return fd
+}
+
+// Call carries out the operation in a0 with the parameter block in a1
+// and returns its result in a0.
+func (p *Semihost) Call(cpu *CPU) {
+	op := cpu.Regs[10]
+	arg := cpu.Regs[11]
+	ret := uint32(0xffffffff)
+	ebadf := func() { p.errno = uint32(syscall.EBADF) }
+
+	switch op {
+	case SYS_OPEN:
+		a, ok := p.args(cpu, arg, 3)
+		if !ok {
+			break
+		}
+		if a[1] >= uint32(len(semihostModes)) {
+			p.errno = uint32(syscall.EINVAL)
+			break
+		}
+		if name, ok := p.name(cpu, a[0], a[2]); ok {
+			ret = p.open(name, a[1])
+		}
+	case SYS_CLOSE:
+		a, ok := p.args(cpu, arg, 1)
+		if !ok {
+			break
+		}
+		h, ok := p.files[a[0]]
+		if !ok {
+			ebadf()
+			break
+		}
+		if h.f != nil {
+			h.f.Close()
+		}
+		delete(p.files, a[0])
+		ret = 0
+	case SYS_WRITEC:
+		if b, ok := cpu.ReadVirt(arg, 1); ok {
+			p.out.Write(b)
+		}
+	case SYS_WRITE0:
+		var b []byte
+		for addr := arg; len(b) < semihostPathMax; addr++ {
+			c, ok := cpu.ReadVirt(addr, 1)
+			if !ok || (c[0] == 0) {
+				break
+			}
+			b = append(b, c[0])
+		}
+		p.out.Write(b)
+	case SYS_WRITE:
+		a, ok := p.args(cpu, arg, 3)
+		if !ok {
+			break
+		}
+		h, ok := p.files[a[0]]
+		if !ok || (h.out == nil) {
+			ebadf()
+			ret = a[2]
+			break
+		}
+		ret = a[2] - p.write(cpu, h, a[1], a[2])
+	case SYS_READ:
+		a, ok := p.args(cpu, arg, 3)
+		if !ok {
+			break
+		}
+		h, ok := p.files[a[0]]
+		if !ok || (h.in == nil) {
+			ebadf()
+			ret = a[2]
+			break
+		}
+		ret = a[2] - p.read(cpu, h, a[1], a[2])
+	case SYS_READC:
+		if p.in == nil {
+			break
+		}
+		b := make([]byte, 1)
+		if n, _ := p.in.Read(b); n == 1 {
+			ret = uint32(b[0])
+		}
+	case SYS_ISERROR:
+		a, ok := p.args(cpu, arg, 1)
+		if !ok {
+			break
+		}
+		ret = 0
+		if int32(a[0]) < 0 {
+			ret = 1
+		}
+	case SYS_ISTTY:
+		a, ok := p.args(cpu, arg, 1)
+		if !ok {
+			break
+		}
+		h, ok := p.files[a[0]]
+		if !ok {
+			ebadf()
+			ret = 0
+			break
+		}
+		ret = 0
+		if h.tty {
+			ret = 1
+		}
+	case SYS_SEEK:
+		a, ok := p.args(cpu, arg, 2)
+		if !ok {
+			break
+		}
+		h, ok := p.files[a[0]]
+		if !ok || (h.seek == nil) {
+			ebadf()
+			break
+		}
+		if _, err := h.seek.Seek(int64(a[1]), io.SeekStart); err != nil {
+			p.fail(err)
+			break
+		}
+		ret = 0
+	case SYS_FLEN:
+		a, ok := p.args(cpu, arg, 1)
+		if !ok {
+			break
+		}
+		h, ok := p.files[a[0]]
+		if !ok {
+			ebadf()
+			break
+		}
+		if h.f == nil {
+			ret = uint32(len(h.buf))
+			break
+		}
+		fi, err := h.f.Stat()
+		if err != nil {
+			p.fail(err)
+			break
+		}
+		ret = uint32(fi.Size())
+	case SYS_REMOVE:
+		a, ok := p.args(cpu, arg, 2)
+		if !ok {
+			break
+		}
+		name, ok := p.name(cpu, a[0], a[1])
+		if !ok {
+			break
+		}
+		host, err := sandboxPath(p.root, name, false)
+		if err == nil {
+			err = os.Remove(host)
+		}
+		if err != nil {
+			ret = p.fail(err)
+			break
+		}
+		ret = 0
+	case SYS_RENAME:
+		a, ok := p.args(cpu, arg, 4)
+		if !ok {
+			break
+		}
+		from, ok := p.name(cpu, a[0], a[1])
+		if !ok {
+			break
+		}
+		to, ok := p.name(cpu, a[2], a[3])
+		if !ok {
+			break
+		}
+		src, err := sandboxPath(p.root, from, false)
+		if err == nil {
+			var dst string
+			if dst, err = sandboxPath(p.root, to, false); err == nil {
+				err = os.Rename(src, dst)
+			}
+		}
+		if err != nil {
+			ret = p.fail(err)
+			break
+		}
+		ret = 0
+	case SYS_CLOCK:
+		ret = uint32(p.clock(cpu, int64(time.Since(p.start))) / int64(10*time.Millisecond))
+	case SYS_TIME:
+		ret = uint32(p.clock(cpu, time.Now().Unix()))
+	case SYS_ERRNO:
+		ret = p.errno
+	case SYS_GET_CMDLINE:
+		a, ok := p.args(cpu, arg, 2)
+		if !ok {
+			break
+		}
+		if uint32(len(p.cmdline)) >= a[1] {
+			break
+		}
+		cpu.WriteVirt(a[0], append([]byte(p.cmdline), 0))
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, uint32(len(p.cmdline)))
+		cpu.WriteVirt(arg+4, b)
+		ret = 0
+	case SYS_HEAPINFO:
+		// Zeros tell the C library to use its own defaults, except for
+		// the stack which starts below the device tree.
+		a, ok := p.args(cpu, arg, 1)
+		if !ok {
+			break
+		}
+		b := make([]byte, 16)
+		binary.LittleEndian.PutUint32(b[8:], cpu.bus.ramTop+1-bootReserve)
+		cpu.WriteVirt(a[0], b)
+		ret = 0
+	case SYS_EXIT:
+		// On RV32 the argument is the reason code itself.
+		if arg == ADP_Stopped_ApplicationExit {
+			cpu.Halt(0)
+		} else {
+			cpu.Halt(1)
+		}
+		return
+	case SYS_EXIT_EXTENDED:
+		a, ok := p.args(cpu, arg, 2)
+		if !ok {
+			cpu.Halt(1)
+			return
+		}
+		if a[0] == ADP_Stopped_ApplicationExit {
+			cpu.Halt(int(int32(a[1])))
+		} else {
+			cpu.Halt(1)
+		}
+		return
+	case SYS_ELAPSED:
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, cpu.bus.Time())
+		if cpu.WriteVirt(arg, b) {
+			ret = 0
+		}
+	case SYS_TICKFREQ:
+		ret = timebaseFreq
+	default:
+		// SYS_TMPNAM and SYS_SYSTEM are deliberately not provided.
+		p.errno = uint32(syscall.ENOSYS)
+	}
+	cpu.RegWrite(10, ret)
+}
+
+// read reads up to n bytes from h into memory at addr, a chunk at a
+// time, and returns the number read. It stops at a short read, which is
+// all the console has to offer for now.
+func (p *Semihost) read(cpu *CPU, h *semihostFile, addr uint32, n uint32) uint32 {
+	size := n
+	if size > semihostChunk {
+		size = semihostChunk
+	}
+	b := make([]byte, size)
+	var done uint32
+	for done < n {
+		if n-done < size {
+			b = b[:n-done]
+		}
+		t, err := h.in.Read(b)
+		if !cpu.WriteVirt(addr+done, b[:t]) {
+			break
+		}
+		done += uint32(t)
+		if (err != nil) && (err != io.EOF) {
+			p.fail(err)
+		}
+		if (err != nil) || (t < len(b)) {
+			break
+		}
+	}
+	return done
+}
+
+// write writes n bytes of memory at addr to h, a chunk at a time, and
+// returns the number written.
+func (p *Semihost) write(cpu *CPU, h *semihostFile, addr uint32, n uint32) uint32 {
+	var done uint32
+	for done < n {
+		size := n - done
+		if size > semihostChunk {
+			size = semihostChunk
+		}
+		b, ok := cpu.ReadVirt(addr+done, size)
+		if !ok {
+			break
+		}
+		t, err := h.out.Write(b)
+		done += uint32(t)
+		if err != nil {
+			p.fail(err)
+			break
+		}
+	}
+	return done
+}
+
+// clock returns t, read from the host clock, through the -record or
+// -replay log.
+func (p *Semihost) clock(cpu *CPU, t int64) int64 {
+	if rec := cpu.bus.rec; rec != nil {
+		return rec.Clock(cpu, t)
+	}
+	return t
+}
+
+func (p *Semihost) open(name string, mode uint32) uint32 {
+	flags := semihostModes[mode]
+	switch name {
+	case ":tt":
+		// r is stdin, w is stdout and a is stderr.
+		switch {
+		case mode < 4:
+			return p.newHandle(&semihostFile{in: p.in, tty: true})
+		case mode < 8:
+			return p.newHandle(&semihostFile{out: p.out, tty: true})
+		default:
+			return p.newHandle(&semihostFile{out: os.Stderr, tty: true})
+		}
+	case ":semihosting-features":
+		if flags != os.O_RDONLY {
+			p.errno = uint32(syscall.EACCES)
+			return 0xffffffff
+		}
+		buf := append([]byte(nil), semihostFeatures...)
+		r := bytes.NewReader(buf)
+		return p.newHandle(&semihostFile{in: r, seek: r, buf: buf})
+	}
+
+	host, err := sandboxPath(p.root, name, true)
+	if err != nil {
+		return p.fail(err)
+	}
+	f, err := os.OpenFile(host, flags, 0644)
+	if err != nil {
+		return p.fail(err)
+	}
+	h := &semihostFile{f: f, seek: f}
+	if flags&(os.O_WRONLY|os.O_RDWR) != os.O_WRONLY {
+		h.in = f
+	}
+	if flags&(os.O_WRONLY|os.O_RDWR) != 0 {
+		h.out = f
+	}
+	return p.newHandle(h)
+}
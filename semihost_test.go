@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// semihostCall makes the semihosting call op with the parameter block
+// args and returns a0.
+func semihostCall(p *CPU, sh *Semihost, op uint32, args ...uint32) uint32 {
+	const block = 0x80000100
+	for i, a := range args {
+		p.bus.WriteWord(block+uint32(4*i), a)
+	}
+	p.Regs[10] = op
+	p.Regs[11] = block
+	sh.Call(p)
+	return p.Regs[10]
+}
+
+func TestSemihostFeatures(t *testing.T) {
+	p := newTestCPU(t)
+	sh := NewSemihost(".", "", ioutil.Discard, nil)
+	const name, buf = 0x80000200, 0x80001000
+	p.WriteVirt(name, []byte(":semihosting-features\x00"))
+
+	fd := semihostCall(p, sh, SYS_OPEN, name, 0, 21)
+	if int32(fd) < 0 {
+		t.Fatalf("open failed, errno %v", sh.errno)
+	}
+	if n := semihostCall(p, sh, SYS_FLEN, fd); n != uint32(len(semihostFeatures)) {
+		t.Errorf("flen %v", n)
+	}
+	if ret := semihostCall(p, sh, SYS_SEEK, fd, 4); ret != 0 {
+		t.Fatalf("seek returned %#x, errno %v", ret, sh.errno)
+	}
+	if left := semihostCall(p, sh, SYS_READ, fd, buf, 1); (left != 0) || (p.bus.ReadByte(buf) != semihostFeatures[4]) {
+		t.Errorf("read after seek: %v left, byte %#x", left, p.bus.ReadByte(buf))
+	}
+
+	// A count far beyond the file, and beyond any sensible buffer,
+	// reads what there is.
+	semihostCall(p, sh, SYS_SEEK, fd, 0)
+	const huge = 0x40000000
+	if left := semihostCall(p, sh, SYS_READ, fd, buf, huge); left != huge-uint32(len(semihostFeatures)) {
+		t.Errorf("read left %#x", left)
+	}
+	got, _ := p.ReadVirt(buf, uint32(len(semihostFeatures)))
+	if string(got) != string(semihostFeatures) {
+		t.Errorf("read %q", got)
+	}
+	if ret := semihostCall(p, sh, SYS_CLOSE, fd); ret != 0 {
+		t.Errorf("close returned %#x", ret)
+	}
+}
+
+// Names longer than semihostPathMax are refused before anything is read
+// for them, and SYS_WRITE0 stops at the same length.
+func TestSemihostLongNames(t *testing.T) {
+	p := newTestCPU(t)
+	var out bytes.Buffer
+	sh := NewSemihost(".", "", &out, nil)
+	const name = 0x80000200
+	for _, tt := range []struct {
+		op   uint32
+		args []uint32
+	}{
+		{SYS_OPEN, []uint32{name, 0, 0xffffffff}},
+		{SYS_REMOVE, []uint32{name, semihostPathMax + 1}},
+		{SYS_RENAME, []uint32{name, 1, name, 0x80000000}},
+	} {
+		sh.errno = 0
+		if ret := semihostCall(p, sh, tt.op, tt.args...); ret != 0xffffffff {
+			t.Errorf("op %#x returned %#x", tt.op, ret)
+		}
+		if sh.errno != uint32(syscall.ENAMETOOLONG) {
+			t.Errorf("op %#x: errno %v", tt.op, sh.errno)
+		}
+	}
+
+	p.WriteVirt(0x80001000, []byte(strings.Repeat("x", 2*semihostPathMax)))
+	p.Regs[10], p.Regs[11] = SYS_WRITE0, 0x80001000
+	sh.Call(p)
+	if out.Len() != semihostPathMax {
+		t.Errorf("SYS_WRITE0 of an unterminated string wrote %v bytes", out.Len())
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A snapshot holds the complete state of a machine: its description, the
+// harts, the contents of RAM and the other memories, and the registers
+// of every device. It is written as a header with the format version
+// followed by the gob encoding of Snapshot, compressed with gzip.
+//
+// Decoded instruction and translated block caches are not saved since
+// they are rebuilt on demand. Host-side state is not part of the machine
+// either: console input that has not reached the UART, files opened
+// through semihosting, and the contents of drive images other than the
+// copy-on-write overlay, so drives must not change between saving and
+// restoring.
+const (
+	snapshotMagic   = "RV32SNAP"
+	snapshotVersion = 2
+)
+
+type Snapshot struct {
+	Machine *Machine
+	Harts   []HartState
+	Mems    []MemState
+	CLINT   CLINTState
+	PLIC    PLICState
+	Serials []SerialState // the console UART first
+	Drives  []VirtioState
+}
+
+type HartState struct {
+	PC      uint32
+	Regs    []uint32
+	CSRs    []uint32
+	Priv    uint32
+	Wfi     bool
+	Halted  bool
+	Exit    int
+	Cycle   uint64
+	Instret uint64
+	Seip    bool
+	ResAddr uint32
+	ResOk   bool
+	TLB     []TLBState
+}
+
+type TLBState struct {
+	VPN     uint32
+	PTE     uint32
+	PTEAddr uint32
+	PPN     uint64
+}
+
+// MemState holds the pages of a memory that have been written.
+type MemState struct {
+	Base  uint32
+	Size  uint32
+	Pages map[uint32][]byte
+}
+
+type CLINTState struct {
+	Msip     []uint32
+	Mtimecmp []uint64
+	Mtime    uint64
+}
+
+type PLICState struct {
+	Priority  []uint32
+	Level     uint32
+	Pending   uint32
+	Claimed   uint32
+	Enable    []uint32
+	Threshold []uint32
+}
+
+type UARTState struct {
+	TxFIFO []uint8
+	RxFIFO []uint8
+	TxCtrl uint32
+	RxCtrl uint32
+	IE     uint32
+	Div    uint32
+}
+
+// SerialState holds the registers of a UART of either model.
+type SerialState struct {
+	UART    *UARTState
+	NS16550 *NS16550State
+}
+
+type NS16550State struct {
+	TxFIFO []uint8
+	RxFIFO []uint8
+	IER    uint8
+	FCR    uint8
+	LCR    uint8
+	MCR    uint8
+	LSR    uint8
+	SCR    uint8
+	DLL    uint8
+	DLM    uint8
+	THRI   bool
+	Shift  bool
+	RxIdle int
+}
+
+type VirtioState struct {
+	Overlay           map[uint64][]byte
+	QueueSel          uint32
+	DeviceFeaturesSel uint32
+	DriverFeatures    uint64
+	DriverFeaturesSel uint32
+	QueueNum          uint32
+	QueueReady        uint32
+	QueueDesc         uint64
+	QueueDriver       uint64
+	QueueDevice       uint64
+	LastAvail         uint16
+	InterruptStatus   uint32
+	Status            uint32
+}
+
+// Save captures the state of the machine on bus.
+func (p *Bus) Save() *Snapshot {
+	s := &Snapshot{Machine: p.machine}
+	for _, h := range p.harts {
+		t := HartState{
+			PC: h.PC, Regs: h.Regs, CSRs: h.CSRs, Priv: h.Priv,
+			Wfi: h.Wfi, Halted: h.Halted, Exit: h.Exit,
+			Cycle: h.Cycle, Instret: h.Instret, Seip: h.seip,
+			ResAddr: h.resAddr, ResOk: h.resOk,
+		}
+		for vpn, e := range h.tlb {
+			t.TLB = append(t.TLB, TLBState{vpn, e.pte, e.pteAddr, e.ppn})
+		}
+		s.Harts = append(s.Harts, t)
+	}
+	for _, m := range p.devs {
+		mem, ok := m.dev.(*Mem)
+		if !ok {
+			continue
+		}
+		t := MemState{Base: m.base, Size: mem.size, Pages: map[uint32][]byte{}}
+		for i, pg := range mem.pages {
+			if pg != nil {
+				t.Pages[uint32(i)] = pg
+			}
+		}
+		s.Mems = append(s.Mems, t)
+	}
+
+	c := p.clint
+	s.CLINT = CLINTState{c.msip, c.mtimecmp, c.mtime}
+	q := p.plic
+	s.PLIC = PLICState{q.priority, q.level, q.pending, q.claimed, q.enable, q.threshold}
+	for _, u := range p.uarts {
+		s.Serials = append(s.Serials, saveSerial(u))
+	}
+	for _, d := range p.drives {
+		s.Drives = append(s.Drives, VirtioState{
+			d.overlay, d.queueSel, d.deviceFeaturesSel, d.driverFeatures,
+			d.driverFeaturesSel, d.queueNum, d.queueReady, d.queueDesc,
+			d.queueDriver, d.queueDevice, d.lastAvail, d.interruptStatus, d.status,
+		})
+	}
+	return s
+}
+
+// Restore puts the machine on bus, which must have been built from
+// s.Machine with all of its harts, into the saved state. The machine may
+// have run since it was built.
+func (p *Bus) Restore(s *Snapshot) error {
+	if len(s.Harts) != len(p.harts) {
+		return fmt.Errorf("snapshot has %v harts, machine has %v", len(s.Harts), len(p.harts))
+	}
+	for i, t := range s.Harts {
+		h := p.harts[i]
+		h.PC, h.Priv = t.PC, t.Priv
+		copy(h.Regs, t.Regs)
+		copy(h.CSRs, t.CSRs)
+		h.Wfi, h.Halted, h.Exit = t.Wfi, t.Halted, t.Exit
+		h.Cycle, h.Instret, h.seip = t.Cycle, t.Instret, t.Seip
+		h.resAddr, h.resOk = t.ResAddr, t.ResOk
+		h.FlushTLB()
+		for _, e := range t.TLB {
+			h.tlb[e.VPN] = tlbEntry{e.PTE, e.PTEAddr, e.PPN}
+		}
+		h.lastBlock = nil
+		if h.icache != nil {
+			h.icache.Flush()
+		}
+	}
+	if p.blocks != nil {
+		p.blocks.Flush()
+	}
+	p.clearCode()
+
+	i := 0
+	for _, m := range p.devs {
+		mem, ok := m.dev.(*Mem)
+		if !ok {
+			continue
+		}
+		if (i >= len(s.Mems)) || (s.Mems[i].Base != m.base) || (s.Mems[i].Size != mem.size) {
+			return fmt.Errorf("memory at 0x%08x does not match the snapshot", m.base)
+		}
+		for pn, pg := range s.Mems[i].Pages {
+			if (int(pn) >= len(mem.pages)) || (len(pg) != pageSize) {
+				return fmt.Errorf("bad page %v of memory at 0x%08x", pn, m.base)
+			}
+		}
+		// Pages written since the snapshot was taken go back to zero.
+		for pn := range mem.pages {
+			mem.pages[pn] = s.Mems[i].Pages[uint32(pn)]
+		}
+		p.remap(m.base, m.top)
+		i++
+	}
+
+	c := p.clint
+	if (len(s.CLINT.Msip) != len(c.msip)) || (len(s.CLINT.Mtimecmp) != len(c.mtimecmp)) {
+		return fmt.Errorf("bad CLINT state")
+	}
+	copy(c.msip, s.CLINT.Msip)
+	copy(c.mtimecmp, s.CLINT.Mtimecmp)
+	c.mtime = s.CLINT.Mtime
+	q := p.plic
+	if (len(s.PLIC.Priority) != len(q.priority)) || (len(s.PLIC.Enable) != len(q.enable)) ||
+		(len(s.PLIC.Threshold) != len(q.threshold)) {
+		return fmt.Errorf("bad PLIC state")
+	}
+	copy(q.priority, s.PLIC.Priority)
+	copy(q.enable, s.PLIC.Enable)
+	copy(q.threshold, s.PLIC.Threshold)
+	q.level, q.pending, q.claimed = s.PLIC.Level, s.PLIC.Pending, s.PLIC.Claimed
+
+	if len(s.Serials) != len(p.uarts) {
+		return fmt.Errorf("snapshot has %v UARTs, the machine %v", len(s.Serials), len(p.uarts))
+	}
+	for i, u := range p.uarts {
+		if err := restoreSerial(u, s.Serials[i]); err != nil {
+			return err
+		}
+	}
+
+	if len(s.Drives) != len(p.drives) {
+		return fmt.Errorf("snapshot has %v drives, machine has %v", len(s.Drives), len(p.drives))
+	}
+	for i, t := range s.Drives {
+		d := p.drives[i]
+		if t.Overlay != nil {
+			d.overlay = t.Overlay
+		}
+		d.queueSel, d.deviceFeaturesSel = t.QueueSel, t.DeviceFeaturesSel
+		d.driverFeatures, d.driverFeaturesSel = t.DriverFeatures, t.DriverFeaturesSel
+		d.queueNum, d.queueReady = t.QueueNum, t.QueueReady
+		d.queueDesc, d.queueDriver, d.queueDevice = t.QueueDesc, t.QueueDriver, t.QueueDevice
+		d.lastAvail, d.interruptStatus, d.status = t.LastAvail, t.InterruptStatus, t.Status
+	}
+	for _, l := range p.irqs {
+		p.plic.SetLevel(l.irq, l.dev.Pending())
+	}
+	return nil
+}
+
+func saveSerial(u Serial) SerialState {
+	var s SerialState
+	switch u := u.(type) {
+	case *UART:
+		s.UART = &UARTState{u.txfifo, u.rxfifo, u.txctrl, u.rxctrl, u.ie, u.div}
+	case *NS16550:
+		s.NS16550 = &NS16550State{u.txfifo, u.rxfifo, u.ier, u.fcr, u.lcr, u.mcr,
+			u.lsr, u.scr, u.dll, u.dlm, u.thri, u.shift, u.rxIdle}
+	}
+	return s
+}
+
+func restoreSerial(u Serial, s SerialState) error {
+	switch u := u.(type) {
+	case *UART:
+		t := s.UART
+		if t == nil {
+			return fmt.Errorf("snapshot has no SiFive UART state")
+		}
+		u.txfifo = append(u.txfifo[:0], t.TxFIFO...)
+		u.rxfifo = append(u.rxfifo[:0], t.RxFIFO...)
+		u.txctrl, u.rxctrl, u.ie, u.div = t.TxCtrl, t.RxCtrl, t.IE, t.Div
+	case *NS16550:
+		t := s.NS16550
+		if t == nil {
+			return fmt.Errorf("snapshot has no NS16550 state")
+		}
+		u.txfifo = append(u.txfifo[:0], t.TxFIFO...)
+		u.rxfifo = append(u.rxfifo[:0], t.RxFIFO...)
+		u.ier, u.fcr, u.lcr, u.mcr = t.IER, t.FCR, t.LCR, t.MCR
+		u.lsr, u.scr, u.dll, u.dlm = t.LSR, t.SCR, t.DLL, t.DLM
+		u.thri, u.shift, u.rxIdle = t.THRI, t.Shift, t.RxIdle
+	}
+	return nil
+}
+
+// WriteSnapshot saves the machine on bus to filename.
+func WriteSnapshot(filename string, bus *Bus) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(snapshotMagic)
+	binary.Write(w, binary.LittleEndian, uint32(snapshotVersion))
+	z := gzip.NewWriter(w)
+	if err := gob.NewEncoder(z).Encode(bus.Save()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := z.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshot.
+func ReadSnapshot(filename string) (*Snapshot, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(snapshotMagic))
+	var version uint32
+	if _, err := io.ReadFull(r, magic); (err != nil) || (string(magic) != snapshotMagic) {
+		return nil, fmt.Errorf("%v: not a snapshot", filename)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, fmt.Errorf("%v: not a snapshot", filename)
+	}
+	if version != snapshotVersion {
+		return nil, fmt.Errorf("%v: snapshot version %v is not supported (want %v)", filename, version, snapshotVersion)
+	}
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	s := &Snapshot{}
+	if err := gob.NewDecoder(z).Decode(s); err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	if (s.Machine == nil) || (len(s.Harts) == 0) {
+		return nil, fmt.Errorf("%v: incomplete snapshot", filename)
+	}
+	s.Machine.lines = map[string]int{}
+	return s, nil
+}
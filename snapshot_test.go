@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// snapProg has every hart count in memory with amoadd.w, store the count
+// in a slot of its own and arm its mtimecmp, forever.
+var snapProg = []uint32{
+	encU(0x37, 11, 0x80001000),   // lui a1, 0x80001
+	encU(0x37, 13, 0x02004000),   // lui a3, 0x2004 (mtimecmp)
+	encI(0x73, 2, 10, 0, 0xf14),  // csrr a0, mhartid
+	encI(0x13, 1, 10, 10, 3),     // slli a0, a0, 3
+	encR(0x33, 0, 0, 13, 13, 10), // add a3, a3, a0
+	encR(0x33, 0, 0, 10, 10, 11), // add a0, a0, a1
+	encI(0x13, 0, 12, 0, 1),      // li a2, 1
+	encR(0x2f, 2, 0, 5, 11, 12),  // 1: amoadd.w t0, a2, (a1)
+	encS(2, 10, 5, 8),            // sw t0, 8(a0)
+	encS(2, 13, 5, 0),            // sw t0, 0(a3)
+	encI(0x13, 0, 6, 6, 3),       // addi t1, t1, 3
+	encJ(0, -16),                 // j 1b
+}
+
+func runAll(h []*CPU, rounds int) {
+	for i := 0; i < rounds; i++ {
+		for _, p := range h {
+			runHart(p, 10, false)
+		}
+		h[0].bus.Tick()
+	}
+}
+
+// snapState returns the state of the machine of h without its
+// description, which a restored machine holds its own copy of.
+func snapState(h []*CPU) *Snapshot {
+	s := h[0].bus.Save()
+	s.Machine = nil
+	return s
+}
+
+// A machine restored from a snapshot file is in the same state as the
+// one saved and stays so when both run on.
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "m.snap")
+
+	h := newTestHarts(t, 2)
+	loadProgram(h, snapProg)
+	h[0].bus.plic.WriteWord(4, 5) // priority of source 1
+	runAll(h, 37)
+	if err := WriteSnapshot(file, h[0].bus); err != nil {
+		t.Fatal(err)
+	}
+	s, err := ReadSnapshot(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Machine.Harts, h[0].bus.machine.Harts) {
+		t.Errorf("machine description not saved")
+	}
+
+	r := newTestHarts(t, 2)
+	runAll(r, 5) // state the restore must replace
+	if err := r[0].bus.Restore(s); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := snapState(h), snapState(r); !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored state differs:\n got %+v\nwant %+v", got.Harts, want.Harts)
+	}
+	runAll(h, 50)
+	runAll(r, 50)
+	if want, got := snapState(h), snapState(r); !reflect.DeepEqual(got, want) {
+		t.Fatalf("state differs after running on:\n got %+v\nwant %+v", got.Harts, want.Harts)
+	}
+	// Each hart ran 870 steps: 7 to set up and 173 times into the loop.
+	if n := r[0].bus.ReadWord(0x80001000); n != 2*173 {
+		t.Errorf("counter %v, want %v", n, 2*173)
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "m.snap")
+
+	if err := ioutil.WriteFile(file, []byte("not a snapshot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSnapshot(file); err == nil {
+		t.Errorf("ReadSnapshot accepted a file that is not a snapshot")
+	}
+	b := append([]byte(snapshotMagic), snapshotVersion+1, 0, 0, 0)
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSnapshot(file); err == nil {
+		t.Errorf("ReadSnapshot accepted version %v", snapshotVersion+1)
+	}
+
+	if err := WriteSnapshot(file, newTestHarts(t, 2)[0].bus); err != nil {
+		t.Fatal(err)
+	}
+	s, err := ReadSnapshot(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestCPU(t).bus.Restore(s); err == nil {
+		t.Errorf("Restore accepted a snapshot with 2 harts on a machine with 1")
+	}
+}
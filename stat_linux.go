@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// hostStat returns the status of the file described by fi.
+func hostStat(fi os.FileInfo) kernelStat {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileStat(fi)
+	}
+	return kernelStat{
+		dev:     uint64(st.Dev),
+		ino:     st.Ino,
+		rdev:    uint64(st.Rdev),
+		size:    uint64(st.Size),
+		blocks:  uint64(st.Blocks),
+		mode:    st.Mode,
+		nlink:   uint32(st.Nlink),
+		uid:     st.Uid,
+		gid:     st.Gid,
+		blksize: uint32(st.Blksize),
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+func hostStat(fi os.FileInfo) kernelStat {
+	return fileStat(fi)
+}
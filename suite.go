@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// The test subcommand runs a directory of compiled test programs, such as
+// riscv-tests or the architecture tests, each on a machine of its own:
+//
+//	gopher-rv32sim test [-j N] [-timeout D] [-junit FILE] DIR
+//
+// Every little-endian 32-bit RISC-V ELF file in DIR is a test, other ELF
+// files are skipped. A test with a tohost symbol ends when it stores a
+// nonzero word there; 1 is a pass, anything else reports the failing case
+// in the upper bits as riscv-tests do. Other tests end with a semihosting
+// exit, status 0 being a pass. A test that has not ended after the
+// timeout fails. The timeout is checked every testChunk steps, a few
+// milliseconds.
+const testChunk = 100000
+
+type testResult struct {
+	Name    string
+	Pass    bool
+	Skip    bool
+	Reason  string
+	Output  string
+	Instret uint64
+	Time    time.Duration
+}
+
+func runTests(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	jobs := fs.Int("j", runtime.NumCPU(), "number of tests run at the same time")
+	timeout := fs.Duration("timeout", 10*time.Second, "time each test may run")
+	junit := fs.String("junit", "", "write a JUnit XML report to file")
+	eng := fs.String("engine", "interp", "execution engine (interp, block)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %v test [flags] DIR\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if (fs.NArg() != 1) || (*jobs < 1) || ((*eng != "interp") && (*eng != "block")) {
+		fs.Usage()
+		return 2
+	}
+	dir := fs.Arg(0)
+	files, err := testFiles(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 2
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: no ELF files in %v\n", dir)
+		return 2
+	}
+
+	start := time.Now()
+	results := make([]testResult, len(files))
+	skipped := 0
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for j := 0; j < *jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results[i] = runTest(files[i].path, *timeout, *eng == "block")
+			}
+		}()
+	}
+	for i, f := range files {
+		if f.skip != "" {
+			results[i] = testResult{Name: filepath.Base(f.path), Skip: true, Reason: f.skip}
+			skipped++
+			continue
+		}
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.Pass:
+			fmt.Printf("PASS  %-40v %10v instructions %8.3fs\n", r.Name, r.Instret, r.Time.Seconds())
+		case r.Skip:
+			fmt.Printf("SKIP  %-40v %v\n", r.Name, r.Reason)
+		default:
+			failed++
+			fmt.Printf("FAIL  %-40v %v\n", r.Name, r.Reason)
+		}
+	}
+	fmt.Printf("%v passed, %v failed", len(results)-failed-skipped, failed)
+	if skipped > 0 {
+		fmt.Printf(", %v skipped", skipped)
+	}
+	fmt.Printf(" in %.3fs\n", time.Since(start).Seconds())
+	if *junit != "" {
+		if err := writeJUnit(*junit, filepath.Base(filepath.Clean(dir)), results, time.Since(start)); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			return 2
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+type testFile struct {
+	path string
+	skip string // why the file is not run as a test, or ""
+}
+
+// testFiles returns the ELF files in dir, sorted by name.
+func testFiles(dir string) ([]testFile, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []testFile
+	for _, fi := range infos {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		name := filepath.Join(dir, fi.Name())
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		hdr := make([]byte, 20)
+		n, _ := io.ReadFull(f, hdr)
+		f.Close()
+		if detectFormat(hdr[:n]) == formatElf {
+			files = append(files, testFile{name, testTarget(hdr[:n])})
+		}
+	}
+	return files, nil
+}
+
+// testTarget returns why the ELF file starting with hdr is not a program
+// for the simulator, or "".
+func testTarget(hdr []byte) string {
+	if len(hdr) < 20 {
+		return "truncated ELF header"
+	}
+	if c := elf.Class(hdr[elf.EI_CLASS]); c != elf.ELFCLASS32 {
+		return fmt.Sprintf("%v, not ELFCLASS32", c)
+	}
+	if d := elf.Data(hdr[elf.EI_DATA]); d != elf.ELFDATA2LSB {
+		return fmt.Sprintf("%v, not ELFDATA2LSB", d)
+	}
+	if m := elf.Machine(binary.LittleEndian.Uint16(hdr[18:])); m != elf.EM_RISCV {
+		return fmt.Sprintf("%v, not EM_RISCV", m)
+	}
+	return ""
+}
+
+// runTest runs the test in filename on a default machine.
+func runTest(filename string, timeout time.Duration, blocks bool) (r testResult) {
+	r.Name = filepath.Base(filename)
+	start := time.Now()
+	defer func() { r.Time = time.Since(start) }()
+
+	bus, err := NewBus(DefaultMachine())
+	if err != nil {
+		r.Reason = err.Error()
+		return r
+	}
+	defer bus.Close()
+	if !blocks {
+		bus.blocks = nil
+	}
+	var out bytes.Buffer
+	bus.uart.Attach(&out, nil)
+	sim := NewCPU(bus)
+	sim.Reset()
+	if err := sim.LoadFile(filename, bus.ramBase); err != nil {
+		r.Reason = err.Error()
+		return r
+	}
+	sh := NewSemihost(filepath.Dir(filename), r.Name, &out, nil)
+	defer sh.Close()
+	sim.semihost = sh
+	tohost, hasTohost := elfSymbol(filename, "tohost")
+	if hasTohost {
+		bus.watch = func(h *CPU, vaddr uint32, paddr uint32, size uint32, data uint32) {
+			if (h != nil) && (paddr == tohost) && (data != 0) {
+				h.Halt(int(data))
+			}
+		}
+	}
+
+	for !sim.Halted && (time.Since(start) < timeout) {
+		runHart(sim, testChunk, blocks)
+	}
+	bus.flushSerial()
+	r.Instret = sim.Instret
+	r.Output = out.String()
+	switch {
+	case !sim.Halted:
+		r.Reason = fmt.Sprintf("timed out after %v instructions", sim.Instret)
+	case hasTohost && (sim.Exit != 1):
+		r.Reason = fmt.Sprintf("failed test %v", sim.Exit>>1)
+	case !hasTohost && (sim.Exit != 0):
+		r.Reason = fmt.Sprintf("exit status %v", sim.Exit)
+	default:
+		r.Pass = true
+	}
+	return r
+}
+
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// writeJUnit writes results as a JUnit XML test suite to filename.
+func writeJUnit(filename string, suite string, results []testResult, d time.Duration) error {
+	s := junitSuite{Name: suite, Tests: len(results), Time: fmt.Sprintf("%.3f", d.Seconds())}
+	for _, r := range results {
+		c := junitCase{Name: r.Name, Classname: suite, Time: fmt.Sprintf("%.3f", r.Time.Seconds()), SystemOut: r.Output}
+		switch {
+		case r.Skip:
+			s.Skipped++
+			c.Skipped = &junitSkipped{r.Reason}
+		case !r.Pass:
+			s.Failures++
+			c.Failure = &junitFailure{r.Reason}
+		}
+		s.Cases = append(s.Cases, c)
+	}
+	b, err := xml.MarshalIndent(&s, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append([]byte(xml.Header), b...)
+	return ioutil.WriteFile(filename, append(b, '\n'), 0644)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTestTarget(t *testing.T) {
+	hdr := func(class byte, data byte, machine uint16) []byte {
+		b := make([]byte, 20)
+		copy(b, "\x7fELF")
+		b[4], b[5] = class, data
+		b[18], b[19] = byte(machine), byte(machine>>8)
+		return b
+	}
+	for _, tt := range []struct {
+		hdr  []byte
+		want string
+	}{
+		{hdr(1, 1, 243), ""},
+		{hdr(2, 1, 243), "ELFCLASS64"},
+		{hdr(1, 2, 243), "ELFDATA2MSB"},
+		{hdr(1, 1, 3), "EM_386"},
+		{hdr(1, 1, 243)[:8], "truncated"},
+	} {
+		got := testTarget(tt.hdr)
+		if (got == "") != (tt.want == "") || !strings.Contains(got, tt.want) {
+			t.Errorf("testTarget(% x) = %q, want %q", tt.hdr, got, tt.want)
+		}
+	}
+}
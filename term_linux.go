@@ -0,0 +1,90 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// dumpSignals make a -parallel run print the state of every hart.
+var dumpSignals = []os.Signal{syscall.SIGUSR1}
+
+// MakeRaw puts the terminal on fd into raw mode so that key strokes are
+// delivered to the guest one by one without echo. Signal generation is
+// left enabled so that ^C still stops the simulator. The returned
+// function restores the previous settings.
+func MakeRaw(fd uintptr) (func(), bool) {
+	restore, ok := makeRaw(fd, true)
+	if !ok {
+		return nil, false
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		restore()
+		os.Exit(130)
+	}()
+
+	return restore, true
+}
+
+func makeRaw(fd uintptr, isig bool) (func(), bool) {
+	var old syscall.Termios
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&old))); e != 0 {
+		return nil, false
+	}
+
+	raw := old
+	raw.Iflag &^= syscall.ICRNL | syscall.INLCR | syscall.IGNCR | syscall.IXON | syscall.ISTRIP
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO | syscall.ECHONL | syscall.IEXTEN
+	if !isig {
+		raw.Lflag &^= syscall.ISIG
+		raw.Oflag &^= syscall.OPOST
+	}
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&raw))); e != 0 {
+		return nil, false
+	}
+
+	restore := func() {
+		syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&old)))
+	}
+	return restore, true
+}
+
+// OpenPty creates a pseudo terminal pair with the slave side in raw mode.
+// The slave is kept open so that reads on the master do not fail while
+// no terminal program is attached.
+func OpenPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unlock int32 = 0
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); e != 0 {
+		master.Close()
+		return nil, nil, e
+	}
+	var n uint32
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); e != 0 {
+		master.Close()
+		return nil, nil, e
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	makeRaw(slave.Fd(), false)
+	return master, slave, nil
+}
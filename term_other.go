@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var dumpSignals []os.Signal
+
+func OpenPty() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("pty is not supported on this platform")
+}
+
+func MakeRaw(fd uintptr) (func(), bool) {
+	return nil, false
+}
@@ -1,102 +1,192 @@
 package main
 
 import (
-	"fmt"
+	"io"
+	"os"
 )
 
 // Memory Map:
 // 0x000: txdata transmit data register
+// 0x004: rxdata receive data register
 // 0x008: txctrl transmit control register
+// 0x00c: rxctrl receive control register
+// 0x010: ie     interrupt enable register
+// 0x014: ip     interrupt pending register
+// 0x018: div    baud rate divisor register
+
+const (
+	uartTxdata = 0x000
+	uartRxdata = 0x004
+	uartTxctrl = 0x008
+	uartRxctrl = 0x00c
+	uartIe     = 0x010
+	uartIp     = 0x014
+	uartDiv    = 0x018
+)
+
+const (
+	uartFifoDepth = 8
+	uartFull      = 0x80000000
+	uartEmpty     = 0x80000000
+	uartTxen      = 0x00000001
+	uartRxen      = 0x00000001
+	uartTxwm      = 0x00000001
+	uartRxwm      = 0x00000002
+)
 
 type UART struct {
-	reg []uint32
+	txfifo []uint8
+	rxfifo []uint8
+	txctrl uint32
+	rxctrl uint32
+	ie     uint32
+	div    uint32
+	input  <-chan uint8
+	out    io.Writer
 }
 
 func NewUART() *UART {
-	reg := make([]uint32, 4096)
-	return &UART{reg}
+	txfifo := make([]uint8, 0, uartFifoDepth)
+	rxfifo := make([]uint8, 0, uartFifoDepth)
+	return &UART{txfifo, rxfifo, 0, 0, 0, 0, nil, os.Stdout}
 }
 
-func (p *UART) ReadByte(addr uint32) uint8 {
-	sel := addr & 0x00000003
-	maskAddr := (addr & 0xfffffffc) >> 2
-	switch sel {
-	case 0:
-		return uint8((p.reg[maskAddr] & 0x000000ff) >> 0)
-	case 1:
-		return uint8((p.reg[maskAddr] & 0x0000ff00) >> 8)
-	case 2:
-		return uint8((p.reg[maskAddr] & 0x00ff0000) >> 16)
-	case 3:
-		return uint8((p.reg[maskAddr] & 0xff000000) >> 24)
-	default:
-		return uint8((p.reg[maskAddr] & 0x000000ff) >> 0)
+// Attach connects the UART to out and feeds the bytes arriving on in, if
+// it is not nil, into the receive path until in is closed.
+func (p *UART) Attach(out io.Writer, in <-chan uint8) {
+	p.out = out
+	p.input = in
+}
+
+// Tick shifts one character out of the transmit FIFO and one character
+// into the receive FIFO, if the respective direction is enabled.
+func (p *UART) Tick() {
+	if (p.txctrl&uartTxen != 0) && (len(p.txfifo) > 0) {
+		p.out.Write(p.txfifo[:1])
+		p.txfifo = p.txfifo[1:]
+	}
+	if (p.rxctrl&uartRxen != 0) && (len(p.rxfifo) < uartFifoDepth) && (p.input != nil) {
+		select {
+		case c, ok := <-p.input:
+			if ok {
+				p.rxfifo = append(p.rxfifo, c)
+			} else {
+				p.input = nil
+			}
+		default:
+		}
 	}
 }
 
-func (p *UART) ReadHalf(addr uint32) uint16 {
-	sel := addr & 0x00000002
-	maskAddr := addr & 0xfffffffc
-	var t0, t1 uint16
-	switch sel {
-	case 2:
-		t0 = uint16(p.ReadByte(maskAddr + 2))
-		t1 = uint16(p.ReadByte(maskAddr + 3))
-	default:
-		t0 = uint16(p.ReadByte(maskAddr + 0))
-		t1 = uint16(p.ReadByte(maskAddr + 1))
+// Flush sends the characters still in the transmit FIFO, so that output
+// queued when the simulation stops is not lost.
+func (p *UART) Flush() {
+	if (p.txctrl&uartTxen != 0) && (len(p.txfifo) > 0) {
+		p.out.Write(p.txfifo)
+		p.txfifo = p.txfifo[:0]
 	}
+}
 
-	return (t1 << 8) | t0
+func (p *UART) ip() uint32 {
+	var ip uint32 = 0
+	txcnt := int((p.txctrl >> 16) & 0x7)
+	rxcnt := int((p.rxctrl >> 16) & 0x7)
+	if len(p.txfifo) < txcnt {
+		ip |= uartTxwm
+	}
+	if len(p.rxfifo) > rxcnt {
+		ip |= uartRxwm
+	}
+	return ip
 }
 
-func (p *UART) ReadWord(addr uint32) uint32 {
-	maskAddr := addr & 0xfffffffc
-	t0 := uint32(p.ReadByte(maskAddr + 0))
-	t1 := uint32(p.ReadByte(maskAddr + 1))
-	t2 := uint32(p.ReadByte(maskAddr + 2))
-	t3 := uint32(p.ReadByte(maskAddr + 3))
-	return (t3 << 24) | (t2 << 16) | (t1 << 8) | t0
+// Pending reports whether the UART is asserting its interrupt line.
+func (p *UART) Pending() bool {
+	return p.ip()&p.ie != 0
 }
 
-func (p *UART) WriteByte(addr uint32, data uint8) {
-	sel := addr & 0x00000003
-	maskAddr := (addr & 0xfffffffc) >> 2
-	switch sel {
-	case 0:
-		p.reg[maskAddr] = (p.reg[maskAddr] & 0xffffff00) | (uint32(data) << 0)
-	case 1:
-		p.reg[maskAddr] = (p.reg[maskAddr] & 0xffff00ff) | (uint32(data) << 8)
-	case 2:
-		p.reg[maskAddr] = (p.reg[maskAddr] & 0xff00ffff) | (uint32(data) << 16)
-	case 3:
-		p.reg[maskAddr] = (p.reg[maskAddr] & 0x00ffffff) | (uint32(data) << 24)
+// Interactive reports whether input may still arrive from the host.
+func (p *UART) Interactive() bool {
+	return p.input != nil
+}
+
+func (p *UART) read(addr uint32, pop bool) uint32 {
+	switch addr & 0xfffffffc {
+	case uartTxdata:
+		if len(p.txfifo) >= uartFifoDepth {
+			return uartFull
+		}
+		return 0
+	case uartRxdata:
+		if len(p.rxfifo) == 0 {
+			return uartEmpty
+		}
+		t := uint32(p.rxfifo[0])
+		if pop {
+			p.rxfifo = p.rxfifo[1:]
+		}
+		return t
+	case uartTxctrl:
+		return p.txctrl
+	case uartRxctrl:
+		return p.rxctrl
+	case uartIe:
+		return p.ie
+	case uartIp:
+		return p.ip()
+	case uartDiv:
+		return p.div
 	default:
-		p.reg[maskAddr] = (p.reg[maskAddr] & 0xffffff00) | (uint32(data) << 0)
+		return 0
 	}
+}
 
-	if (p.reg[2]&0x01 != 0) && (addr == 0) {
-		fmt.Printf("%c", data)
+func (p *UART) write(addr uint32, data uint32, mask uint32) {
+	switch addr & 0xfffffffc {
+	case uartTxdata:
+		if (mask&0xff != 0) && (len(p.txfifo) < uartFifoDepth) {
+			p.txfifo = append(p.txfifo, uint8(data&0xff))
+		}
+	case uartTxctrl:
+		p.txctrl = ((p.txctrl &^ mask) | (data & mask)) & 0x00070003
+	case uartRxctrl:
+		p.rxctrl = ((p.rxctrl &^ mask) | (data & mask)) & 0x00070001
+	case uartIe:
+		p.ie = ((p.ie &^ mask) | (data & mask)) & 0x00000003
+	case uartDiv:
+		p.div = ((p.div &^ mask) | (data & mask)) & 0x0000ffff
 	}
 }
 
+// Side effects (popping rxdata, pushing txdata) only happen when the
+// access covers the least significant byte of the register.
+
+func (p *UART) ReadByte(addr uint32) uint8 {
+	sel := addr & 0x00000003
+	t := p.read(addr, sel == 0)
+	return uint8((t >> (sel * 8)) & 0xff)
+}
+
+func (p *UART) ReadHalf(addr uint32) uint16 {
+	sel := addr & 0x00000002
+	t := p.read(addr, sel == 0)
+	return uint16((t >> (sel * 8)) & 0xffff)
+}
+
+func (p *UART) ReadWord(addr uint32) uint32 {
+	return p.read(addr, true)
+}
+
+func (p *UART) WriteByte(addr uint32, data uint8) {
+	sel := addr & 0x00000003
+	p.write(addr, uint32(data)<<(sel*8), 0xff<<(sel*8))
+}
+
 func (p *UART) WriteHalf(addr uint32, data uint16) {
 	sel := addr & 0x00000002
-	maskAddr := addr & 0xfffffffc
-	switch sel {
-	case 2:
-		p.WriteByte(maskAddr+2, uint8((data>>0)&0x000000ff))
-		p.WriteByte(maskAddr+3, uint8((data>>8)&0x000000ff))
-	default:
-		p.WriteByte(maskAddr+0, uint8((data>>0)&0x000000ff))
-		p.WriteByte(maskAddr+1, uint8((data>>8)&0x000000ff))
-	}
+	p.write(addr, uint32(data)<<(sel*8), 0xffff<<(sel*8))
 }
 
 func (p *UART) WriteWord(addr uint32, data uint32) {
-	maskAddr := addr & 0xfffffffc
-	p.WriteByte(maskAddr+0, uint8((data>>0)&0x000000ff))
-	p.WriteByte(maskAddr+1, uint8((data>>8)&0x000000ff))
-	p.WriteByte(maskAddr+2, uint8((data>>16)&0x000000ff))
-	p.WriteByte(maskAddr+3, uint8((data>>24)&0x000000ff))
+	p.write(addr, data, 0xffffffff)
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUARTTransmit(t *testing.T) {
+	u := NewUART()
+	var out bytes.Buffer
+	u.Attach(&out, nil)
+	u.WriteWord(uartTxdata, 'h')
+	u.WriteByte(uartTxdata, 'i')
+	// Only the least significant byte pushes.
+	u.WriteByte(uartTxdata+1, 'x')
+	u.Tick()
+	if out.Len() != 0 {
+		t.Errorf("transmitted %q with txen clear", out.String())
+	}
+	u.WriteWord(uartTxctrl, uartTxen)
+	for i := 0; i < 4; i++ {
+		u.Tick()
+	}
+	if out.String() != "hi" {
+		t.Errorf("transmitted %q, want \"hi\"", out.String())
+	}
+	for i := 0; i < uartFifoDepth; i++ {
+		u.WriteByte(uartTxdata, '.')
+	}
+	if u.ReadWord(uartTxdata) != uartFull {
+		t.Errorf("txdata does not report a full FIFO")
+	}
+}
+
+func TestUARTFlush(t *testing.T) {
+	u := NewUART()
+	var out bytes.Buffer
+	u.Attach(&out, nil)
+	u.WriteWord(uartTxctrl, uartTxen)
+	for _, c := range "bye" {
+		u.WriteByte(uartTxdata, uint8(c))
+	}
+	u.Tick()
+	u.Flush()
+	if out.String() != "bye" {
+		t.Errorf("transmitted %q, want \"bye\"", out.String())
+	}
+	if len(u.txfifo) != 0 {
+		t.Errorf("%v characters left in the transmit FIFO", len(u.txfifo))
+	}
+}
+
+func TestUARTReceive(t *testing.T) {
+	u := NewUART()
+	in := make(chan uint8, 3)
+	in <- 'a'
+	in <- 'b'
+	close(in)
+	u.Attach(&bytes.Buffer{}, in)
+	u.WriteWord(uartRxctrl, uartRxen)
+	for i := 0; i < 4; i++ {
+		u.Tick()
+	}
+	if u.Interactive() {
+		t.Errorf("input still interactive after the channel closed")
+	}
+	// Reads of the upper bytes do not pop.
+	if got := u.ReadByte(uartRxdata + 1); got != 0 {
+		t.Errorf("rxdata byte 1 = %02x", got)
+	}
+	if got := u.ReadHalf(uartRxdata); got != 'a' {
+		t.Errorf("rxdata = %04x, want 'a'", got)
+	}
+	if got := u.ReadByte(uartRxdata); got != 'b' {
+		t.Errorf("rxdata = %02x, want 'b'", got)
+	}
+	if got := u.ReadWord(uartRxdata); got != uartEmpty {
+		t.Errorf("rxdata = %08x, want empty", got)
+	}
+}
+
+func TestUARTRegisters(t *testing.T) {
+	u := NewUART()
+	u.WriteWord(uartTxctrl, 0xffffffff)
+	u.WriteWord(uartRxctrl, 0xffffffff)
+	u.WriteWord(uartIe, 0xffffffff)
+	u.WriteHalf(uartDiv, 0x1234)
+	u.WriteByte(uartDiv+2, 0x56)
+	tests := []struct {
+		addr uint32
+		want uint32
+	}{
+		{uartTxctrl, 0x00070003},
+		{uartRxctrl, 0x00070001},
+		{uartIe, 0x00000003},
+		{uartDiv, 0x00001234},
+		{uartIp, uartTxwm},
+	}
+	for _, tt := range tests {
+		if got := u.ReadWord(tt.addr); got != tt.want {
+			t.Errorf("register %02x = %08x, want %08x", tt.addr, got, tt.want)
+		}
+	}
+	if got := u.ReadHalf(uartTxctrl + 2); got != 0x0007 {
+		t.Errorf("txctrl upper half = %04x, want 0007", got)
+	}
+	if !u.Pending() {
+		t.Errorf("txwm interrupt not pending")
+	}
+}
+
+func TestNS16550LineStatus(t *testing.T) {
+	u := NewNS16550()
+	var out bytes.Buffer
+	u.Attach(&out, nil)
+	u.WriteByte(ns16550Iir, ns16550FcrEnable)
+	lsr := u.ReadByte(ns16550Lsr)
+	if lsr&(ns16550LsrThre|ns16550LsrTemt) != ns16550LsrThre|ns16550LsrTemt {
+		t.Errorf("idle lsr = %02x", lsr)
+	}
+	// A driver may fill the whole FIFO once THRE is set.
+	for i := 0; i < ns16550FifoDepth; i++ {
+		u.WriteByte(ns16550Rbr, 'a'+uint8(i))
+		if u.ReadByte(ns16550Lsr)&(ns16550LsrThre|ns16550LsrTemt) != 0 {
+			t.Fatalf("THRE or TEMT set with %v characters queued", i+1)
+		}
+	}
+	for i := 0; i < ns16550FifoDepth; i++ {
+		u.Tick()
+	}
+	if lsr := u.ReadByte(ns16550Lsr); lsr&(ns16550LsrThre|ns16550LsrTemt) != ns16550LsrThre {
+		t.Errorf("lsr = %02x with the last character shifting out, want THRE only", lsr)
+	}
+	u.Tick()
+	if lsr := u.ReadByte(ns16550Lsr); lsr&ns16550LsrTemt == 0 {
+		t.Errorf("lsr = %02x after transmitting, want TEMT", lsr)
+	}
+	if out.String() != "abcdefghijklmnop" {
+		t.Errorf("transmitted %q", out.String())
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// Memory Map (virtio-mmio version 2):
+// 0x000: MagicValue          0x74726976 ("virt")
+// 0x004: Version             2
+// 0x008: DeviceID            2 (block device)
+// 0x00c: VendorID
+// 0x010: DeviceFeatures      selected by DeviceFeaturesSel
+// 0x014: DeviceFeaturesSel
+// 0x020: DriverFeatures      selected by DriverFeaturesSel
+// 0x024: DriverFeaturesSel
+// 0x030: QueueSel
+// 0x034: QueueNumMax
+// 0x038: QueueNum
+// 0x044: QueueReady
+// 0x050: QueueNotify
+// 0x060: InterruptStatus
+// 0x064: InterruptACK
+// 0x070: Status
+// 0x080: QueueDescLow / 0x084: QueueDescHigh
+// 0x090: QueueDriverLow / 0x094: QueueDriverHigh
+// 0x0a0: QueueDeviceLow / 0x0a4: QueueDeviceHigh
+// 0x0fc: ConfigGeneration
+// 0x100: Config              struct virtio_blk_config
+
+const (
+	virtioMagic             = 0x000
+	virtioVersion           = 0x004
+	virtioDeviceID          = 0x008
+	virtioVendorID          = 0x00c
+	virtioDeviceFeatures    = 0x010
+	virtioDeviceFeaturesSel = 0x014
+	virtioDriverFeatures    = 0x020
+	virtioDriverFeaturesSel = 0x024
+	virtioQueueSel          = 0x030
+	virtioQueueNumMax       = 0x034
+	virtioQueueNum          = 0x038
+	virtioQueueReady        = 0x044
+	virtioQueueNotify       = 0x050
+	virtioInterruptStatus   = 0x060
+	virtioInterruptACK      = 0x064
+	virtioStatus            = 0x070
+	virtioQueueDescLow      = 0x080
+	virtioQueueDescHigh     = 0x084
+	virtioQueueDriverLow    = 0x090
+	virtioQueueDriverHigh   = 0x094
+	virtioQueueDeviceLow    = 0x0a0
+	virtioQueueDeviceHigh   = 0x0a4
+	virtioConfigGeneration  = 0x0fc
+	virtioConfig            = 0x100
+)
+
+const (
+	virtioQueueSize = 64
+	virtioVendor    = 0x47525653 // "SVRG"
+
+	VIRTIO_F_VERSION_1    = 32
+	VIRTIO_BLK_F_RO       = 5
+	VIRTIO_BLK_F_BLK_SIZE = 6
+	VIRTIO_BLK_F_FLUSH    = 9
+
+	VIRTQ_DESC_F_NEXT  = 1
+	VIRTQ_DESC_F_WRITE = 2
+
+	VIRTIO_BLK_T_IN     = 0
+	VIRTIO_BLK_T_OUT    = 1
+	VIRTIO_BLK_T_FLUSH  = 4
+	VIRTIO_BLK_T_GET_ID = 8
+
+	VIRTIO_BLK_S_OK     = 0
+	VIRTIO_BLK_S_IOERR  = 1
+	VIRTIO_BLK_S_UNSUPP = 2
+
+	sectorSize = 512
+)
+
+type VirtioBlk struct {
+	bus      *Bus
+	disk     *os.File
+	readonly bool
+	overlay  map[uint64][]byte
+	capacity uint64
+
+	queueSel          uint32
+	deviceFeaturesSel uint32
+	driverFeatures    uint64
+	driverFeaturesSel uint32
+	queueNum          uint32
+	queueReady        uint32
+	queueDesc         uint64
+	queueDriver       uint64
+	queueDevice       uint64
+	lastAvail         uint16
+	interruptStatus   uint32
+	status            uint32
+}
+
+// NewVirtioBlk opens the disk image of d. A read-only drive fails writes;
+// a copy-on-write drive keeps writes in memory and never modifies the
+// image file.
+func NewVirtioBlk(bus *Bus, d DriveConfig) (*VirtioBlk, error) {
+	p := &VirtioBlk{bus: bus, readonly: d.ReadOnly}
+	cow := d.Cow
+
+	flag := os.O_RDWR
+	if p.readonly || cow {
+		flag = os.O_RDONLY
+	}
+	disk, err := os.OpenFile(d.Path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := disk.Stat()
+	if err != nil {
+		disk.Close()
+		return nil, err
+	}
+	p.disk = disk
+	p.capacity = uint64(fi.Size()) / sectorSize
+	if cow {
+		p.overlay = make(map[uint64][]byte)
+	}
+	return p, nil
+}
+
+func (p *VirtioBlk) Close() {
+	p.disk.Close()
+}
+
+func (p *VirtioBlk) features() uint64 {
+	var f uint64 = (1 << VIRTIO_F_VERSION_1) | (1 << VIRTIO_BLK_F_BLK_SIZE) | (1 << VIRTIO_BLK_F_FLUSH)
+	if p.readonly {
+		f |= 1 << VIRTIO_BLK_F_RO
+	}
+	return f
+}
+
+func (p *VirtioBlk) reset() {
+	p.driverFeatures = 0
+	p.queueSel = 0
+	p.queueNum = 0
+	p.queueReady = 0
+	p.queueDesc = 0
+	p.queueDriver = 0
+	p.queueDevice = 0
+	p.lastAvail = 0
+	p.interruptStatus = 0
+	p.status = 0
+}
+
+// Pending reports whether the device asserts its interrupt line.
+func (p *VirtioBlk) Pending() bool {
+	return p.interruptStatus != 0
+}
+
+func (p *VirtioBlk) readSector(sector uint64, buf []byte) error {
+	if t, ok := p.overlay[sector]; ok {
+		copy(buf, t)
+		return nil
+	}
+	_, err := p.disk.ReadAt(buf, int64(sector*sectorSize))
+	return err
+}
+
+func (p *VirtioBlk) writeSector(sector uint64, buf []byte) error {
+	if p.overlay != nil {
+		t := make([]byte, sectorSize)
+		copy(t, buf)
+		p.overlay[sector] = t
+		return nil
+	}
+	_, err := p.disk.WriteAt(buf, int64(sector*sectorSize))
+	return err
+}
+
+// readMem copies guest memory at addr into buf. A device may only use
+// memory for its queues and buffers: reading a device register on its
+// behalf could have side effects.
+func (p *VirtioBlk) readMem(addr uint32, buf []byte) bool {
+	if !p.bus.InMemory(addr, uint32(len(buf))) {
+		return false
+	}
+	for i := range buf {
+		buf[i] = p.bus.ReadByte(addr + uint32(i))
+	}
+	return true
+}
+
+func (p *VirtioBlk) writeMem(addr uint32, buf []byte) {
+	for i := range buf {
+		p.bus.dmaWrite(addr+uint32(i), 1, uint32(buf[i]))
+	}
+}
+
+type virtqDesc struct {
+	addr  uint32
+	len   uint32
+	flags uint16
+	next  uint16
+}
+
+// desc reads descriptor i, which must lie in memory.
+func (p *VirtioBlk) desc(i uint16) (virtqDesc, bool) {
+	var b [16]byte
+	if !p.readMem(uint32(p.queueDesc)+16*uint32(i), b[:]) {
+		return virtqDesc{}, false
+	}
+	return virtqDesc{
+		binary.LittleEndian.Uint32(b[0:]),
+		binary.LittleEndian.Uint32(b[8:]),
+		binary.LittleEndian.Uint16(b[12:]),
+		binary.LittleEndian.Uint16(b[14:]),
+	}, true
+}
+
+// notify processes all requests made available by the driver.
+func (p *VirtioBlk) notify() {
+	if p.queueReady == 0 || p.queueNum == 0 {
+		return
+	}
+	driver := uint32(p.queueDriver)
+	device := uint32(p.queueDevice)
+	if !p.bus.InMemory(driver, 4+2*p.queueNum) || !p.bus.InMemory(device, 4+8*p.queueNum) {
+		return
+	}
+	for p.lastAvail != p.bus.ReadHalf(driver+2) {
+		head := p.bus.ReadHalf(driver + 4 + 2*uint32(p.lastAvail%uint16(p.queueNum)))
+		written := p.request(head)
+
+		usedIdx := p.bus.ReadHalf(device + 2)
+		elem := device + 4 + 8*uint32(usedIdx%uint16(p.queueNum))
+		p.bus.dmaWrite(elem, 4, uint32(head))
+		p.bus.dmaWrite(elem+4, 4, written)
+		p.bus.dmaWrite(device+2, 2, uint32(usedIdx+1))
+		p.lastAvail++
+	}
+	if p.bus.ReadHalf(driver)&1 == 0 { // VIRTQ_AVAIL_F_NO_INTERRUPT
+		p.interruptStatus |= 1
+	}
+}
+
+// request handles one descriptor chain and returns the number of bytes
+// written into guest memory. A chain that is not in memory is dropped
+// unless its status byte can still be set.
+func (p *VirtioBlk) request(head uint16) uint32 {
+	var chain []virtqDesc
+	for i, n := head, 0; n < int(p.queueNum); n++ {
+		d, ok := p.desc(i)
+		if !ok {
+			return 0
+		}
+		chain = append(chain, d)
+		if d.flags&VIRTQ_DESC_F_NEXT == 0 {
+			break
+		}
+		i = d.next
+	}
+	if len(chain) < 2 {
+		return 0
+	}
+	statusDesc := chain[len(chain)-1]
+	if (statusDesc.len < 1) || !p.bus.InMemory(statusDesc.addr, 1) {
+		return 0
+	}
+
+	hdr := make([]byte, 16)
+	if (chain[0].len < 16) || !p.readMem(chain[0].addr, hdr) {
+		p.bus.dmaWrite(statusDesc.addr, 1, VIRTIO_BLK_S_IOERR)
+		return 1
+	}
+	typ := binary.LittleEndian.Uint32(hdr[0:])
+	sector := binary.LittleEndian.Uint64(hdr[8:])
+	data := chain[1 : len(chain)-1]
+	for _, d := range data {
+		if !p.bus.InMemory(d.addr, d.len) ||
+			(((typ == VIRTIO_BLK_T_IN) || (typ == VIRTIO_BLK_T_OUT)) && (d.len%sectorSize != 0)) {
+			// Transfers are whole sectors; a partial one would have to
+			// write past the buffer or invent the rest of the sector.
+			p.bus.dmaWrite(statusDesc.addr, 1, VIRTIO_BLK_S_IOERR)
+			return 1
+		}
+	}
+
+	var status uint8 = VIRTIO_BLK_S_OK
+	var written uint32 = 0
+	buf := make([]byte, sectorSize)
+
+	switch typ {
+	case VIRTIO_BLK_T_IN:
+	in:
+		for _, d := range data {
+			for off := uint32(0); off < d.len; off += sectorSize {
+				if (sector >= p.capacity) || (p.readSector(sector, buf) != nil) {
+					status = VIRTIO_BLK_S_IOERR
+					break in
+				}
+				p.writeMem(d.addr+off, buf)
+				written += sectorSize
+				sector++
+			}
+		}
+	case VIRTIO_BLK_T_OUT:
+		if p.readonly {
+			status = VIRTIO_BLK_S_IOERR
+			break
+		}
+	out:
+		for _, d := range data {
+			for off := uint32(0); off < d.len; off += sectorSize {
+				p.readMem(d.addr+off, buf)
+				if (sector >= p.capacity) || (p.writeSector(sector, buf) != nil) {
+					status = VIRTIO_BLK_S_IOERR
+					break out
+				}
+				sector++
+			}
+		}
+	case VIRTIO_BLK_T_FLUSH:
+		if p.overlay == nil && !p.readonly {
+			p.disk.Sync()
+		}
+	case VIRTIO_BLK_T_GET_ID:
+		id := make([]byte, 20)
+		copy(id, "gopher-rv32sim")
+		if len(data) > 0 {
+			n := data[0].len
+			if n > 20 {
+				n = 20
+			}
+			p.writeMem(data[0].addr, id[:n])
+			written += n
+		}
+	default:
+		status = VIRTIO_BLK_S_UNSUPP
+	}
+
+	p.bus.dmaWrite(statusDesc.addr, 1, uint32(status))
+	return written + 1
+}
+
+func (p *VirtioBlk) config(addr uint32) uint32 {
+	switch addr {
+	case 0x00: // capacity
+		return uint32(p.capacity)
+	case 0x04:
+		return uint32(p.capacity >> 32)
+	case 0x14: // blk_size
+		return sectorSize
+	default:
+		return 0
+	}
+}
+
+func (p *VirtioBlk) ReadByte(addr uint32) uint8 {
+	sel := addr & 0x00000003
+	t := p.ReadWord(addr & 0xfffffffc)
+	return uint8((t >> (sel * 8)) & 0xff)
+}
+
+func (p *VirtioBlk) ReadHalf(addr uint32) uint16 {
+	sel := addr & 0x00000002
+	t := p.ReadWord(addr & 0xfffffffc)
+	return uint16((t >> (sel * 8)) & 0xffff)
+}
+
+func (p *VirtioBlk) ReadWord(addr uint32) uint32 {
+	addr = addr & 0xfffffffc
+	if addr >= virtioConfig {
+		return p.config(addr - virtioConfig)
+	}
+	switch addr {
+	case virtioMagic:
+		return 0x74726976
+	case virtioVersion:
+		return 2
+	case virtioDeviceID:
+		return 2
+	case virtioVendorID:
+		return virtioVendor
+	case virtioDeviceFeatures:
+		if p.deviceFeaturesSel == 0 {
+			return uint32(p.features())
+		} else if p.deviceFeaturesSel == 1 {
+			return uint32(p.features() >> 32)
+		}
+		return 0
+	case virtioQueueNumMax:
+		if p.queueSel != 0 {
+			return 0
+		}
+		return virtioQueueSize
+	case virtioQueueReady:
+		if p.queueSel != 0 {
+			return 0
+		}
+		return p.queueReady
+	case virtioInterruptStatus:
+		return p.interruptStatus
+	case virtioStatus:
+		return p.status
+	case virtioConfigGeneration:
+		return 0
+	default:
+		return 0
+	}
+}
+
+// Registers are 32 bits wide; narrower writes are not supported by
+// virtio-mmio and are ignored.
+
+func (p *VirtioBlk) WriteByte(addr uint32, data uint8) {
+}
+
+func (p *VirtioBlk) WriteHalf(addr uint32, data uint16) {
+}
+
+func (p *VirtioBlk) WriteWord(addr uint32, data uint32) {
+	addr = addr & 0xfffffffc
+	if (p.queueSel != 0) && (virtioQueueNum <= addr) && (addr <= virtioQueueDeviceHigh) && (addr != virtioQueueNotify) &&
+		(addr != virtioInterruptACK) && (addr != virtioStatus) {
+		// there is only the request queue
+		return
+	}
+	switch addr {
+	case virtioDeviceFeaturesSel:
+		p.deviceFeaturesSel = data
+	case virtioDriverFeatures:
+		if p.driverFeaturesSel == 0 {
+			p.driverFeatures = (p.driverFeatures & 0xffffffff00000000) | uint64(data)
+		} else if p.driverFeaturesSel == 1 {
+			p.driverFeatures = (p.driverFeatures & 0x00000000ffffffff) | (uint64(data) << 32)
+		}
+	case virtioDriverFeaturesSel:
+		p.driverFeaturesSel = data
+	case virtioQueueSel:
+		p.queueSel = data
+	case virtioQueueNum:
+		if data <= virtioQueueSize {
+			p.queueNum = data
+		}
+	case virtioQueueReady:
+		p.queueReady = data & 1
+	case virtioQueueNotify:
+		if data == 0 {
+			p.notify()
+		}
+	case virtioInterruptACK:
+		p.interruptStatus &^= data
+	case virtioStatus:
+		if data == 0 {
+			p.reset()
+		} else {
+			p.status = data
+		}
+	case virtioQueueDescLow:
+		p.queueDesc = (p.queueDesc & 0xffffffff00000000) | uint64(data)
+	case virtioQueueDescHigh:
+		p.queueDesc = (p.queueDesc & 0x00000000ffffffff) | (uint64(data) << 32)
+	case virtioQueueDriverLow:
+		p.queueDriver = (p.queueDriver & 0xffffffff00000000) | uint64(data)
+	case virtioQueueDriverHigh:
+		p.queueDriver = (p.queueDriver & 0x00000000ffffffff) | (uint64(data) << 32)
+	case virtioQueueDeviceLow:
+		p.queueDevice = (p.queueDevice & 0xffffffff00000000) | uint64(data)
+	case virtioQueueDeviceHigh:
+		p.queueDevice = (p.queueDevice & 0x00000000ffffffff) | (uint64(data) << 32)
+	}
+}
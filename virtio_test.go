@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testBuf struct {
+	addr  uint32
+	len   uint32
+	write bool
+}
+
+// virtioSubmit makes a request of typ at sector with its header at hdr and
+// the data buffers bufs available to drive base, notifies it and returns
+// the status byte and the length the device reports written. The queue is
+// set up at ram by the caller.
+func virtioSubmit(bus *Bus, base uint32, ram uint32, hdr uint32, typ uint32, sector uint64, bufs []testBuf) (uint8, uint32) {
+	desc, driver, device, status := ram+0x1000, ram+0x2000, ram+0x3000, ram+0x4100
+	chain := append([]testBuf{{hdr, 16, false}}, bufs...)
+	chain = append(chain, testBuf{status, 1, true})
+	for i, b := range chain {
+		a := desc + 16*uint32(i)
+		var flags uint32
+		if i < len(chain)-1 {
+			flags |= VIRTQ_DESC_F_NEXT
+		}
+		if b.write {
+			flags |= VIRTQ_DESC_F_WRITE
+		}
+		bus.WriteWord(a, b.addr)
+		bus.WriteWord(a+4, 0)
+		bus.WriteWord(a+8, b.len)
+		bus.WriteWord(a+12, flags|uint32(i+1)<<16)
+	}
+	bus.WriteWord(hdr, typ)
+	bus.WriteWord(hdr+4, 0)
+	bus.WriteWord(hdr+8, uint32(sector))
+	bus.WriteWord(hdr+12, uint32(sector>>32))
+	bus.WriteByte(status, 0xff)
+
+	idx := bus.ReadHalf(driver + 2)
+	bus.WriteHalf(driver+4+2*uint32(idx%8), 0)
+	bus.WriteHalf(driver+2, idx+1)
+	bus.WriteWord(base+virtioQueueNotify, 0)
+	return bus.ReadByte(status), bus.ReadWord(device + 4 + 8*uint32(idx%8) + 4)
+}
+
+func TestVirtioBlk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "disk")
+	if err := ioutil.WriteFile(name, bytes.Repeat([]byte{1, 2, 3, 4}, sectorSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sector := func(i int) []byte {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b[i*sectorSize : (i+1)*sectorSize]
+	}
+
+	m := DefaultMachine()
+	m.Drives = append(m.Drives, m.newDrive(name))
+	bus, err := NewBus(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+	bus.uart.Attach(ioutil.Discard, nil)
+	base, ram := m.Drives[0].Base, m.RAM.Base
+	bus.WriteWord(base+virtioQueueNum, 8)
+	bus.WriteWord(base+virtioQueueDescLow, ram+0x1000)
+	bus.WriteWord(base+virtioQueueDriverLow, ram+0x2000)
+	bus.WriteWord(base+virtioQueueDeviceLow, ram+0x3000)
+	bus.WriteWord(base+virtioQueueReady, 1)
+	hdr, buf := ram+0x4000, ram+0x5000
+	mem := func(addr uint32, n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = bus.ReadByte(addr + uint32(i))
+		}
+		return b
+	}
+
+	// Two sectors read into RAM.
+	if st, n := virtioSubmit(bus, base, ram, hdr, VIRTIO_BLK_T_IN, 1, []testBuf{{buf, 2 * sectorSize, true}}); (st != VIRTIO_BLK_S_OK) || (n != 2*sectorSize+1) {
+		t.Errorf("read: status %v, length %v", st, n)
+	}
+	if got, want := mem(buf, 2*sectorSize), bytes.Repeat([]byte{1, 2, 3, 4}, sectorSize/2); !bytes.Equal(got, want) {
+		t.Errorf("read: got % x..., want % x...", got[:8], want[:8])
+	}
+
+	// A sector written from RAM reaches the image.
+	for i := uint32(0); i < sectorSize; i++ {
+		bus.WriteByte(buf+i, 0xaa)
+	}
+	if st, _ := virtioSubmit(bus, base, ram, hdr, VIRTIO_BLK_T_OUT, 3, []testBuf{{buf, sectorSize, false}}); st != VIRTIO_BLK_S_OK {
+		t.Errorf("write: status %v", st)
+	}
+	if got := sector(3); !bytes.Equal(got, bytes.Repeat([]byte{0xaa}, sectorSize)) {
+		t.Errorf("write: sector 3 is % x...", got[:8])
+	}
+
+	// Bad requests fail and leave the image and RAM alone.
+	for i := uint32(0); i < sectorSize; i++ {
+		bus.WriteByte(buf+i, 0x55)
+	}
+	tests := []struct {
+		name   string
+		hdr    uint32
+		typ    uint32
+		sector uint64
+		bufs   []testBuf
+	}{
+		{"partial write", hdr, VIRTIO_BLK_T_OUT, 2, []testBuf{{buf, 100, false}}},
+		{"partial read", hdr, VIRTIO_BLK_T_IN, 2, []testBuf{{buf, 100, true}}},
+		{"write from device", hdr, VIRTIO_BLK_T_OUT, 2, []testBuf{{uartBase, sectorSize, false}}},
+		{"read into device", hdr, VIRTIO_BLK_T_IN, 2, []testBuf{{uartBase, sectorSize, true}}},
+		{"read into hole", hdr, VIRTIO_BLK_T_IN, 2, []testBuf{{0, sectorSize, true}}},
+		{"read past memory", hdr, VIRTIO_BLK_T_IN, 2, []testBuf{{ram + m.RAM.Size - 4, sectorSize, true}}},
+		{"read past end", hdr, VIRTIO_BLK_T_IN, 4, []testBuf{{buf, sectorSize, true}}},
+		{"header in hole", 0x1000, VIRTIO_BLK_T_IN, 2, []testBuf{{buf, sectorSize, true}}},
+	}
+	for _, tt := range tests {
+		if st, _ := virtioSubmit(bus, base, ram, tt.hdr, tt.typ, tt.sector, tt.bufs); st != VIRTIO_BLK_S_IOERR {
+			t.Errorf("%v: status %v, want %v", tt.name, st, VIRTIO_BLK_S_IOERR)
+		}
+		if got := sector(2); !bytes.Equal(got, bytes.Repeat([]byte{1, 2, 3, 4}, sectorSize/4)) {
+			t.Errorf("%v: sector 2 is % x...", tt.name, got[:8])
+		}
+		if got := mem(buf, sectorSize); !bytes.Equal(got, bytes.Repeat([]byte{0x55}, sectorSize)) {
+			t.Errorf("%v: buffer is % x...", tt.name, got[:8])
+		}
+	}
+
+	// Descriptors outside memory are not read at all.
+	bus.WriteWord(base+virtioQueueDescLow, uartBase)
+	if st, n := virtioSubmit(bus, base, ram, hdr, VIRTIO_BLK_T_IN, 2, []testBuf{{buf, sectorSize, true}}); (st != 0xff) || (n != 0) {
+		t.Errorf("descriptors in device: status %v, length %v", st, n)
+	}
+}